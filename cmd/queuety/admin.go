@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tomiok/queuety/server"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// do calls the admin API and decodes the JSON answer into out, nil skips the decoding.
+func (c *config) do(method, path string, query url.Values, out any) error {
+	return c.send(method, path, query, nil, out)
+}
+
+// send is do with a JSON body, in, nil sends none.
+func (c *config) send(method, path string, query url.Values, in, out any) error {
+	u := strings.TrimSuffix(c.web, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.user != "" || c.password != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	answer, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(answer)))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(answer, out)
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func stats(args []string) error {
+	fs, c := newFlagSet("stats")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var raw json.RawMessage
+	if err := c.do(http.MethodGet, "/stats", nil, &raw); err != nil {
+		return err
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, raw, "", "  "); err != nil {
+		return err
+	}
+	indented.WriteByte('\n')
+
+	_, err := indented.WriteTo(os.Stdout)
+	return err
+}
+
+func listTopics(args []string) error {
+	fs, c := newFlagSet("topics list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var s struct {
+		Topics map[string]struct {
+			Mode         string `json:"mode"`
+			Subscribers  int    `json:"subscribers"`
+			Pending      int    `json:"pending"`
+			DeadLettered int    `json:"dead_lettered"`
+			Lag          uint64 `json:"lag"`
+		} `json:"topics"`
+	}
+	if err := c.do(http.MethodGet, "/stats", nil, &s); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(s.Topics))
+	for name := range s.Topics {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tMODE\tSUBSCRIBERS\tPENDING\tDEAD LETTERED\tLAG")
+	for _, name := range names {
+		t := s.Topics[name]
+		if t.Mode == "" {
+			t.Mode = "fanout" // brokers predating the queue topics.
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", name, t.Mode, t.Subscribers, t.Pending, t.DeadLettered, t.Lag)
+	}
+
+	return w.Flush()
+}
+
+func deleteTopic(args []string) error {
+	fs, c := newFlagSet("topics delete")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	var result json.RawMessage
+	if err := c.do(http.MethodDelete, "/topics/"+url.PathEscape(fs.Arg(0)), nil, &result); err != nil {
+		return err
+	}
+
+	return printJSON(result)
+}
+
+func topicSamples(args []string) error {
+	fs, c := newFlagSet("topics samples")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	var samples json.RawMessage
+	if err := c.do(http.MethodGet, "/topics/"+url.PathEscape(fs.Arg(0))+"/samples", nil, &samples); err != nil {
+		return err
+	}
+
+	return printJSON(samples)
+}
+
+func mirror(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	var method, path string
+	switch args[0] {
+	case "status":
+		method, path = http.MethodGet, "/mirror"
+	case "promote":
+		method, path = http.MethodPost, "/mirror/promote"
+	default:
+		return fmt.Errorf("%w: unknown mirror command %q", errUsage, args[0])
+	}
+
+	fs, c := newFlagSet("mirror " + args[0])
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	var st server.MirrorStatus
+	if err := c.do(method, path, nil, &st); err != nil {
+		return err
+	}
+
+	return printJSON(st)
+}
+
+func listDeadLetters(args []string) error {
+	fs, c := newFlagSet("dlq list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errUsage
+	}
+
+	query := url.Values{}
+	if fs.NArg() == 1 {
+		query.Set("topic", fs.Arg(0))
+	}
+
+	var letters []struct {
+		ID        string    `json:"id"`
+		Topic     string    `json:"topic"`
+		Attempts  int       `json:"attempts"`
+		Published time.Time `json:"published"`
+	}
+	if err := c.do(http.MethodGet, "/dlq", query, &letters); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tID\tATTEMPTS\tPUBLISHED")
+	for _, l := range letters {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", l.Topic, l.ID, l.Attempts, l.Published.Format(time.RFC3339))
+	}
+
+	return w.Flush()
+}
+
+func requeue(args []string) error {
+	fs, c := newFlagSet("dlq requeue")
+	topic := fs.String("topic", "", "topic of the dead letters")
+	ids := fs.String("ids", "", "comma separated IDs of the dead letters")
+	all := fs.Bool("all", false, "requeue every dead letter of the topic")
+	before := fs.String("before", "", "with -all, only the messages published before, RFC 3339")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// the topic and the IDs may also come as arguments, as they did before the flags.
+	rest := fs.Args()
+	if *topic == "" && len(rest) > 0 {
+		*topic, rest = rest[0], rest[1:]
+	}
+	if *topic == "" {
+		return fmt.Errorf("%w: missing -topic", errUsage)
+	}
+
+	var selected []string
+	if *ids != "" {
+		selected = strings.Split(*ids, ",")
+	}
+	selected = append(selected, rest...)
+
+	switch {
+	case len(selected) > 0 && *all:
+		return fmt.Errorf("%w: -ids and -all are exclusive", errUsage)
+	case len(selected) == 0 && !*all:
+		return fmt.Errorf("%w: pass -ids or -all", errUsage)
+	case *before != "" && !*all:
+		return fmt.Errorf("%w: -before needs -all", errUsage)
+	}
+
+	query := url.Values{"topic": {*topic}}
+	if len(selected) > 0 {
+		query.Set("ids", strings.Join(selected, ","))
+	}
+	if *before != "" {
+		if _, err := time.Parse(time.RFC3339, *before); err != nil {
+			return fmt.Errorf("%w: -before is not an RFC 3339 time: %s", errUsage, *before)
+		}
+		query.Set("before", *before)
+	}
+
+	var result struct {
+		Requeued int `json:"requeued"`
+	}
+	if err := c.do(http.MethodPost, "/dlq/requeue", query, &result); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "requeued %d messages\n", result.Requeued)
+	return nil
+}
+
+// history pages through the stored messages of the range, printing them as they come.
+func history(args []string) error {
+	fs, c := newFlagSet("history")
+	from := fs.String("from", "", "first publish time, RFC 3339")
+	to := fs.String("to", "", "last publish time, RFC 3339")
+	limit := fs.Int("limit", 0, "messages per page, the broker default when 0")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	query := url.Values{}
+	for name, v := range map[string]string{"from": *from, "to": *to} {
+		if v == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, v); err != nil {
+			return fmt.Errorf("%w: -%s is not an RFC 3339 time: %s", errUsage, name, v)
+		}
+		query.Set(name, v)
+	}
+	if *limit > 0 {
+		query.Set("limit", strconv.Itoa(*limit))
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		var page struct {
+			Messages []json.RawMessage `json:"messages"`
+			Next     uint64            `json:"next"`
+		}
+		if err := c.do(http.MethodGet, "/topics/"+url.PathEscape(fs.Arg(0))+"/history", query, &page); err != nil {
+			return err
+		}
+
+		for _, m := range page.Messages {
+			if err := enc.Encode(m); err != nil {
+				return err
+			}
+		}
+		if page.Next == 0 {
+			return nil
+		}
+		query.Set("after", strconv.FormatUint(page.Next, 10))
+	}
+}
+
+func search(args []string) error {
+	fs, c := newFlagSet("search")
+	header := fs.String("header", "", "indexed header")
+	value := fs.String("value", "", "value of the header")
+	limit := fs.Int("limit", 0, "most messages printed, the broker default when 0")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *header == "" || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	query := url.Values{"header": {*header}, "value": {*value}}
+	if *limit > 0 {
+		query.Set("limit", strconv.Itoa(*limit))
+	}
+
+	var found json.RawMessage
+	if err := c.do(http.MethodGet, "/search", query, &found); err != nil {
+		return err
+	}
+
+	return printJSON(found)
+}
+
+func erase(args []string) error {
+	fs, c := newFlagSet("erase")
+	topic := fs.String("topic", "", "topic of the messages, every topic when empty")
+	ids := fs.String("ids", "", "comma separated message ids")
+	key := fs.String("key", "", "message key")
+	header := fs.String("header", "", "header of the messages")
+	value := fs.String("value", "", "value of the header")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || (*ids == "" && *key == "" && *header == "") {
+		return errUsage
+	}
+
+	e := server.Erasure{Topic: *topic, Key: *key, Header: *header, Value: *value}
+	if *ids != "" {
+		e.IDs = strings.Split(*ids, ",")
+	}
+
+	var result struct {
+		Erased int `json:"erased"`
+	}
+	if err := c.send(http.MethodPost, "/erase", nil, e, &result); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "erased %d messages\n", result.Erased)
+	return nil
+}
+
+func replay(args []string) error {
+	fs, c := newFlagSet("replay")
+	from := fs.String("from", "", "first publish time, RFC 3339")
+	to := fs.String("to", "", "last publish time, RFC 3339")
+	fromSeq := fs.Uint64("from-seq", 0, "first seq")
+	toSeq := fs.Uint64("to-seq", 0, "last seq")
+	target := fs.String("target", "", "topic receiving the messages, the same one by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	query := url.Values{}
+	for name, v := range map[string]string{"from": *from, "to": *to} {
+		if v == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, v); err != nil {
+			return fmt.Errorf("%w: -%s is not an RFC 3339 time: %s", errUsage, name, v)
+		}
+		query.Set(name, v)
+	}
+	if *fromSeq > 0 {
+		query.Set("from_seq", strconv.FormatUint(*fromSeq, 10))
+	}
+	if *toSeq > 0 {
+		query.Set("to_seq", strconv.FormatUint(*toSeq, 10))
+	}
+	if *target != "" {
+		query.Set("target", *target)
+	}
+
+	var result struct {
+		Republished int    `json:"republished"`
+		Target      string `json:"target"`
+	}
+	if err := c.do(http.MethodPost, "/topics/"+url.PathEscape(fs.Arg(0))+"/republish", query, &result); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "republished %d messages to %s\n", result.Republished, result.Target)
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tomiok/queuety/manager"
+	"github.com/tomiok/queuety/server"
+)
+
+// benchBody is what the publishers send, the padding brings it to the requested size.
+type benchBody struct {
+	Publisher int    `json:"p"`
+	N         int    `json:"n"`
+	Sent      int64  `json:"t"`
+	Pad       string `json:"pad,omitempty"`
+}
+
+type benchConfig struct {
+	publishers int
+	consumers  int
+	messages   int
+	size       int
+	format     manager.MessageFormat
+	rate       int
+	wait       time.Duration
+	topic      string
+}
+
+// consumerResult is what one consumer saw, every consumer gets every message.
+type consumerResult struct {
+	received   int
+	duplicates int
+	latencies  []time.Duration
+	last       time.Time
+}
+
+func bench(args []string) error {
+	fs, c := newFlagSet("bench")
+	bc := benchConfig{}
+	fs.IntVar(&bc.publishers, "publishers", 1, "concurrent publishers, one connection each")
+	fs.IntVar(&bc.consumers, "consumers", 1, "concurrent consumers, one connection each")
+	fs.IntVar(&bc.messages, "messages", 10000, "messages sent by every publisher")
+	fs.IntVar(&bc.size, "size", 128, "approximate body size in bytes")
+	fs.IntVar(&bc.rate, "rate", 0, "messages per second of every publisher, 0 means as fast as possible")
+	fs.DurationVar(&bc.wait, "wait", 10*time.Second, "how long the consumers wait for the last messages")
+	fs.StringVar(&bc.topic, "topic", "", "topic to use, a new bench-<id> one by default")
+	format := fs.String("format", "json", "wire format: json or binary")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	switch *format {
+	case "json":
+		bc.format = manager.FormatJSON
+	case "binary":
+		bc.format = manager.FormatBinary
+	default:
+		return fmt.Errorf("%w: unknown format %q", errUsage, *format)
+	}
+	if bc.publishers < 1 || bc.consumers < 0 || bc.messages < 1 {
+		return fmt.Errorf("%w: at least one publisher and one message are needed", errUsage)
+	}
+	if bc.topic == "" {
+		bc.topic = "bench-" + uuid.NewString()[:8]
+	}
+
+	return runBench(c, bc)
+}
+
+func runBench(c *config, bc benchConfig) error {
+	admin, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	topic, err := admin.NewTopic(bc.topic)
+	if err != nil {
+		return err
+	}
+
+	var errorsSeen atomic.Int64
+	watch := func(q *manager.QConn) {
+		for range q.Errors() {
+			errorsSeen.Add(1)
+		}
+	}
+
+	expected := bc.publishers * bc.messages
+	results := make([]consumerResult, bc.consumers)
+	var consumers sync.WaitGroup
+	for i := range bc.consumers {
+		q, errConn := c.connect()
+		if errConn != nil {
+			return errConn
+		}
+		defer q.Close()
+		q.SetDefaultFormat(bc.format)
+		go watch(q)
+
+		deliveries := manager.ConsumeJSON[benchBody](q, topic)
+		if deliveries == nil {
+			return fmt.Errorf("cannot subscribe to %s", topic.Name)
+		}
+
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			results[i] = consume(deliveries, expected, bc.wait)
+		}()
+	}
+
+	// the subscriptions are asynchronous, give the broker a moment to register them.
+	time.Sleep(200 * time.Millisecond)
+
+	pad := strings.Repeat("x", max(bc.size-len(`{"p":0,"n":0,"t":0000000000000000000,"pad":""}`), 0))
+	start := time.Now()
+
+	var (
+		publishers sync.WaitGroup
+		published  atomic.Int64
+		sentBytes  atomic.Int64
+	)
+	for p := range bc.publishers {
+		q, errConn := c.connect()
+		if errConn != nil {
+			return errConn
+		}
+		defer q.Close()
+		go watch(q)
+
+		publishers.Add(1)
+		go func() {
+			defer publishers.Done()
+			n, b := publishAll(q, topic, p, bc, pad)
+			published.Add(int64(n))
+			sentBytes.Add(int64(b))
+		}()
+	}
+
+	publishers.Wait()
+	publishTime := time.Since(start)
+	consumers.Wait()
+
+	report(bc, start, publishTime, int(published.Load()), sentBytes.Load(), results, errorsSeen.Load())
+	return nil
+}
+
+func publishAll(q *manager.QConn, topic server.Topic, publisher int, bc benchConfig, pad string) (sent, bytes int) {
+	var tick <-chan time.Time
+	if bc.rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(bc.rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for n := range bc.messages {
+		if tick != nil {
+			<-tick
+		}
+
+		body, err := json.Marshal(benchBody{Publisher: publisher, N: n, Sent: time.Now().UnixNano(), Pad: pad})
+		if err != nil {
+			continue
+		}
+
+		if bc.format == manager.FormatBinary {
+			err = q.PublishBinary(topic, body)
+		} else {
+			err = q.PublishJSON(topic, body)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "publisher %d stopped: %v\n", publisher, err)
+			return sent, bytes
+		}
+
+		sent++
+		bytes += len(body)
+	}
+
+	return sent, bytes
+}
+
+// consume reads until every message arrived or nothing came for wait.
+func consume(deliveries <-chan benchBody, expected int, wait time.Duration) consumerResult {
+	r := consumerResult{latencies: make([]time.Duration, 0, expected)}
+	seen := make(map[[2]int]bool, expected)
+
+	idle := time.NewTimer(wait)
+	defer idle.Stop()
+
+	for r.received < expected {
+		select {
+		case b, ok := <-deliveries:
+			if !ok {
+				return r
+			}
+
+			now := time.Now()
+			key := [2]int{b.Publisher, b.N}
+			if seen[key] {
+				r.duplicates++
+				continue
+			}
+			seen[key] = true
+
+			r.received++
+			r.last = now
+			r.latencies = append(r.latencies, now.Sub(time.Unix(0, b.Sent)))
+
+			idle.Reset(wait)
+		case <-idle.C:
+			return r
+		}
+	}
+
+	return r
+}
+
+func report(bc benchConfig, start time.Time, publishTime time.Duration, published int, sentBytes int64, results []consumerResult, errs int64) {
+	var (
+		received, duplicates int
+		latencies            []time.Duration
+		last                 time.Time
+	)
+	for _, r := range results {
+		received += r.received
+		duplicates += r.duplicates
+		latencies = append(latencies, r.latencies...)
+		if r.last.After(last) {
+			last = r.last
+		}
+	}
+	slices.Sort(latencies)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "topic\t%s\n", bc.topic)
+	fmt.Fprintf(w, "publishers / consumers\t%d / %d\n", bc.publishers, bc.consumers)
+	fmt.Fprintf(w, "published\t%d messages, %d bytes in %s\n", published, sentBytes, publishTime.Round(time.Millisecond))
+	fmt.Fprintf(w, "publish throughput\t%.0f msg/s, %.2f MB/s\n", perSecond(float64(published), publishTime), perSecond(float64(sentBytes)/1e6, publishTime))
+
+	if bc.consumers > 0 {
+		expected := published * bc.consumers
+		deliveryTime := last.Sub(start)
+		lost := expected - received
+
+		fmt.Fprintf(w, "delivered\t%d of %d in %s\n", received, expected, deliveryTime.Round(time.Millisecond))
+		fmt.Fprintf(w, "delivery throughput\t%.0f msg/s\n", perSecond(float64(received), deliveryTime))
+		fmt.Fprintf(w, "lost\t%d (%.2f%%)\n", lost, 100*float64(lost)/float64(max(expected, 1)))
+		fmt.Fprintf(w, "duplicates\t%d\n", duplicates)
+		fmt.Fprintf(w, "latency p50 / p90 / p99 / max\t%s / %s / %s / %s\n",
+			percentile(latencies, 0.50), percentile(latencies, 0.90), percentile(latencies, 0.99), percentile(latencies, 1))
+	}
+	fmt.Fprintf(w, "broker errors\t%d\n", errs)
+
+	_ = w.Flush()
+}
+
+// percentile expects sorted latencies.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+
+	i := int(p*float64(len(latencies))+0.5) - 1
+	return latencies[min(max(i, 0), len(latencies)-1)].Round(time.Microsecond)
+}
+
+func perSecond(n float64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return n / d.Seconds()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/tomiok/queuety/manager"
+	"github.com/tomiok/queuety/server"
+)
+
+// rejectWait is how long publish waits for the broker to reject a message before exiting,
+// errors come back asynchronously.
+const rejectWait = 300 * time.Millisecond
+
+func (c *config) connect() (*manager.QConn, error) {
+	var auth *manager.Auth
+	if c.user != "" || c.password != "" {
+		auth = &manager.Auth{User: c.user, Pass: c.password}
+	}
+
+	return manager.Connect("tcp", c.addr, auth, manager.WithClientInfo("queuety-cli", "", nil))
+}
+
+func publish(args []string) error {
+	fs, c := newFlagSet("publish")
+	format := fs.String("format", "text", "body format: text, json or binary")
+	key := fs.String("key", "", "message key, the one a compacted topic keeps the latest of")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errUsage
+	}
+
+	publishJSON := func(q *manager.QConn, t server.Topic, body []byte) error {
+		if *key == "" {
+			return q.PublishJSON(t, body)
+		}
+		return q.PublishMessage(server.PublishMessage{Topic: t, Body: body, Key: *key})
+	}
+
+	var send func(*manager.QConn, server.Topic, string) error
+	switch *format {
+	case "text":
+		// the body travels as JSON, a text message is a JSON string.
+		send = func(q *manager.QConn, t server.Topic, m string) error {
+			body, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			return publishJSON(q, t, body)
+		}
+	case "json":
+		send = func(q *manager.QConn, t server.Topic, m string) error {
+			if !json.Valid([]byte(m)) {
+				return fmt.Errorf("not valid JSON: %s", m)
+			}
+			return publishJSON(q, t, []byte(m))
+		}
+	case "binary":
+		if *key != "" {
+			return fmt.Errorf("%w: -key needs the text or json format", errUsage)
+		}
+		send = func(q *manager.QConn, t server.Topic, m string) error { return q.PublishBinary(t, []byte(m)) }
+	default:
+		return fmt.Errorf("%w: unknown format %q", errUsage, *format)
+	}
+
+	q, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	topic := server.NewTopic(fs.Arg(0))
+	messages := fs.Args()[1:]
+	published := 0
+
+	if len(messages) > 0 {
+		for _, m := range messages {
+			if err = send(q, topic, m); err != nil {
+				return err
+			}
+			published++
+		}
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if err = send(q, topic, scanner.Text()); err != nil {
+				return err
+			}
+			published++
+		}
+		if err = scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case err = <-q.Errors():
+		return err
+	case <-time.After(rejectWait):
+	}
+
+	fmt.Fprintf(os.Stderr, "published %d messages to %s\n", published, topic.Name)
+	return nil
+}
+
+func subscribe(args []string) error {
+	fs, c := newFlagSet("subscribe")
+	durable := fs.String("durable", "", "durable subscription or consumer group name")
+	count := fs.Int("n", 0, "exit after n messages, 0 means never")
+	maxRate := fs.Int("max-rate", 0, "messages per second the broker delivers at most, 0 means unlimited")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	q, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	var opts []manager.ConsumeOption
+	if *durable != "" {
+		opts = append(opts, manager.Durable(*durable))
+	}
+	if *maxRate > 0 {
+		opts = append(opts, manager.MaxRate(*maxRate))
+	}
+
+	messages := manager.Consume(q, server.NewTopic(fs.Arg(0)), opts...)
+	if messages == nil {
+		return fmt.Errorf("cannot subscribe to %s", fs.Arg(0))
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	received := 0
+	for {
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			fmt.Println(display(m))
+
+			received++
+			if *count > 0 && received >= *count {
+				return nil
+			}
+		case err = <-q.Errors():
+			return err
+		case <-interrupt:
+			return nil
+		}
+	}
+}
+
+// display unquotes the bodies holding a JSON string, the other ones are printed as they are.
+func display(body string) string {
+	var s string
+	if err := json.Unmarshal([]byte(body), &s); err == nil {
+		return s
+	}
+
+	return body
+}
+
+func createTopic(args []string) error {
+	fs, c := newFlagSet("topics create")
+	transient := fs.Bool("transient", false, "keep the messages out of the store")
+	compacted := fs.Bool("compacted", false, "keep only the latest message of every key")
+	queue := fs.Bool("queue", false, "deliver every message to one subscriber instead of all")
+	exclusive := fs.Bool("exclusive", false, "deliver to one subscriber at a time, the others stand by")
+	autoDelete := fs.Duration("auto-delete", 0, "delete the topic once idle for this long")
+	visibility := fs.Duration("visibility", 0, "with -queue, hand a message not acked for this long to the next subscriber")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || (*queue && *exclusive) || (*visibility > 0 && !*queue) {
+		return errUsage
+	}
+
+	q, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	var opts []manager.TopicOption
+	if *transient {
+		opts = append(opts, manager.Transient())
+	}
+	if *compacted {
+		opts = append(opts, manager.Compacted())
+	}
+	if *queue {
+		opts = append(opts, manager.Queue())
+	}
+	if *exclusive {
+		opts = append(opts, manager.Exclusive())
+	}
+	if *autoDelete > 0 {
+		opts = append(opts, manager.AutoDelete(*autoDelete))
+	}
+	if *visibility > 0 {
+		opts = append(opts, manager.VisibilityTimeout(*visibility))
+	}
+
+	if _, err = q.NewTopic(fs.Arg(0), opts...); err != nil {
+		return err
+	}
+
+	select {
+	case err = <-q.Errors():
+		return err
+	case <-time.After(rejectWait):
+	}
+
+	fmt.Fprintf(os.Stderr, "topic %s created\n", fs.Arg(0))
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tomiok/queuety/server"
+)
+
+const (
+	// frameHeaderSize is the format flag plus the little endian length of the payload.
+	frameHeaderSize = 5
+	// maxFrameSize is the largest payload the broker accepts by default, a longer one means
+	// the flag byte did not start a frame.
+	maxFrameSize = 16 << 20
+)
+
+// decode prints the frames of a captured stream, from the file or stdin: the header, the
+// envelope and the body. Bytes that do not start a frame are skipped and reported.
+func decode(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	hexInput := fs.Bool("hex", false, "the input is a hex dump, whitespace ignored")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errUsage
+	}
+
+	in := io.Reader(os.Stdin)
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if *hexInput {
+		if data, err = hex.DecodeString(strings.Map(dropSpace, string(data))); err != nil {
+			return fmt.Errorf("invalid hex input: %w", err)
+		}
+	}
+
+	return printFrames(os.Stdout, data)
+}
+
+func printFrames(w io.Writer, data []byte) error {
+	var frames, skipped int
+	for offset := 0; offset < len(data); {
+		if !isFormat(data[offset]) {
+			start := offset
+			for offset < len(data) && !isFormat(data[offset]) {
+				offset++
+			}
+			skipped += offset - start
+			fmt.Fprintf(w, "offset %d: skipped %d bytes without a format flag\n\n", start, offset-start)
+			continue
+		}
+
+		format := server.MessageFormat(data[offset])
+		if len(data)-offset < frameHeaderSize {
+			fmt.Fprintf(w, "offset %d: truncated header, %d bytes\n", offset, len(data)-offset)
+			break
+		}
+
+		size := int(binary.LittleEndian.Uint32(data[offset+1 : offset+frameHeaderSize]))
+		if size > maxFrameSize {
+			fmt.Fprintf(w, "offset %d: skipped a %s flag announcing %d bytes\n\n", offset, formatName(format), size)
+			skipped++
+			offset++
+			continue
+		}
+
+		payload := data[offset+frameHeaderSize:]
+		if len(payload) < size {
+			fmt.Fprintf(w, "offset %d: %s frame of %d bytes truncated at %d\n", offset, formatName(format), size, len(payload))
+			break
+		}
+		payload = payload[:size]
+
+		frames++
+		fmt.Fprintf(w, "frame %d at offset %d: %s, %d bytes\n", frames, offset, formatName(format), size)
+		printEnvelope(w, format, payload)
+		fmt.Fprintln(w)
+
+		offset += frameHeaderSize + size
+	}
+
+	fmt.Fprintf(w, "%d frames, %d bytes skipped\n", frames, skipped)
+	return nil
+}
+
+func printEnvelope(w io.Writer, format server.MessageFormat, payload []byte) {
+	var (
+		msg server.Message
+		err error
+	)
+	if format == server.FormatBinary {
+		err = msg.UnmarshalBinary(payload)
+	} else {
+		msg, err = server.DecodeMessage(payload)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "  cannot decode: %v\n  payload: %q\n", err, payload)
+		return
+	}
+
+	field := func(name string, v any) {
+		fmt.Fprintf(w, "  %-11s %v\n", name+":", v)
+	}
+	field("type", msg.Type())
+	field("id", msg.ID())
+	if msg.NextID() != "" {
+		field("next_id", msg.NextID())
+	}
+	field("topic", msg.Topic().Name)
+	if msg.User() != "" {
+		field("user", msg.User())
+	}
+	if msg.Password() != "" {
+		// a capture is shared around, the password is not.
+		field("password", "<set>")
+	}
+	if msg.Timestamp() != 0 {
+		field("timestamp", fmt.Sprintf("%d (%s)", msg.Timestamp(), time.Unix(msg.Timestamp(), 0).UTC().Format(time.RFC3339)))
+	}
+	field("ack", msg.ACK())
+	field("attempts", msg.Attempts())
+	if msg.ConnID() != 0 {
+		field("conn_id", msg.ConnID())
+	}
+	if msg.Seq() != 0 {
+		field("seq", msg.Seq())
+	}
+	if msg.Subscriber() != "" {
+		field("subscriber", msg.Subscriber())
+	}
+	if msg.TTL() != 0 {
+		field("ttl", msg.TTL())
+	}
+
+	body := msg.Body()
+	if len(body) == 0 || string(body) == "null" {
+		return
+	}
+
+	var indented bytes.Buffer
+	if json.Indent(&indented, body, "    ", "  ") != nil {
+		field("body", fmt.Sprintf("%q", body))
+		return
+	}
+	fmt.Fprintf(w, "  body:\n    %s\n", indented.String())
+}
+
+func isFormat(b byte) bool {
+	return server.MessageFormat(b) == server.FormatJSON || server.MessageFormat(b) == server.FormatBinary
+}
+
+func formatName(f server.MessageFormat) string {
+	if f == server.FormatBinary {
+		return "binary"
+	}
+	return "json"
+}
+
+func dropSpace(r rune) rune {
+	if unicode.IsSpace(r) {
+		return -1
+	}
+	return r
+}
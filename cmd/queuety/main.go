@@ -0,0 +1,197 @@
+// Command queuety talks to a running broker: it publishes and consumes through the native
+// protocol and reaches the admin endpoints of the web server for the rest.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const usage = `usage: queuety <command> [flags] [args]
+
+commands:
+  publish <topic> [message...]   publish the messages, one per line of stdin when none are given
+  subscribe <topic>              print the messages of the topic until interrupted
+  topics list                    list the topics with their subscribers and pending messages
+  topics create [-queue [-visibility <d>]|-exclusive] [-compacted] [-auto-delete <d>] <name>
+                                 create a topic, delivering each message to one subscriber
+                                 with -queue, to a single active one with -exclusive, keeping the latest message per key with
+                                 -compacted, deleted once idle for d when given
+  topics delete <name>           delete a topic with its messages (admin API)
+  topics samples <name>          print the messages of the topic captured by SAMPLE_RATES (admin API)
+  stats                          print the broker statistics (admin API)
+  dlq list [topic]               list the dead lettered messages (admin API)
+  dlq requeue -topic <t> -ids <id,...>|-all [-before <ts>]
+                                 send the dead letters back to their topic (admin API)
+  schedules list                 list the recurring publications (admin API)
+  schedules set -cron <expr> -topic <t> [-key <k>] <name> <body template>
+                                 publish the body to the topic whenever the cron expression
+                                 fires, in UTC (admin API)
+  schedules delete <name>        stop a recurring publication (admin API)
+  schemas list <topic>           list the versions of the schema of a topic (admin API)
+  schemas register [-compatibility <c>] <topic> <file|->
+                                 add a version to the schema of the topic, a JSON file with
+                                 its fields, rejected when it breaks the compatibility (admin API)
+  schemas delete <topic>         stop checking the messages of a topic (admin API)
+  replay <topic>                 publish the stored messages of a time or seq range again (admin API)
+  history -from <t> -to <t> <topic>
+                                 print the stored messages of the topic published in the range,
+                                 one JSON line each (admin API)
+  search -header <h> -value <v>  print the stored messages of any topic with the header value,
+                                 the header indexed by INDEXED_HEADERS (admin API)
+  erase [-topic <t>] [-ids <id,...>] [-key <k>] [-header <h> -value <v>]
+                                 delete for good the stored messages matching every criterion
+                                 given, audited (admin API)
+  mirror status                  print how far a standby is behind its primary (admin API)
+  mirror promote                 make a standby the primary, taking clients (admin API)
+  bench                          publish and consume a load, reporting throughput, latency and loss
+  decode [file]                  print the frames of captured bytes, from stdin when no file is given
+  migrate <badger dir>           upgrade a stopped broker's store, old queuety/server data included
+
+environment:
+  QUEUETY_ADDR      broker address, localhost:9845 by default
+  QUEUETY_WEB       web server URL, http://localhost:9846 by default
+  QUEUETY_USER      user for the broker and the admin API
+  QUEUETY_PASSWORD  password for the broker and the admin API
+
+run "queuety <command> -h" for the flags of a command.
+`
+
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	err := run(os.Args[1], os.Args[2:])
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(2)
+	case errors.Is(err, errUsage):
+		if err != errUsage {
+			fmt.Fprintln(os.Stderr, "queuety:", err)
+		}
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	case err != nil:
+		// the errors of the broker already say where they come from.
+		msg := err.Error()
+		if !strings.HasPrefix(msg, "queuety:") {
+			msg = "queuety: " + msg
+		}
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(1)
+	}
+}
+
+func run(command string, args []string) error {
+	switch command {
+	case "publish":
+		return publish(args)
+	case "subscribe":
+		return subscribe(args)
+	case "topics":
+		return topics(args)
+	case "stats":
+		return stats(args)
+	case "dlq":
+		return dlq(args)
+	case "schedules":
+		return schedules(args)
+	case "schemas":
+		return schemas(args)
+	case "replay":
+		return replay(args)
+	case "history":
+		return history(args)
+	case "search":
+		return search(args)
+	case "erase":
+		return erase(args)
+	case "mirror":
+		return mirror(args)
+	case "bench":
+		return bench(args)
+	case "decode":
+		return decode(args)
+	case "migrate":
+		return migrate(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown command %q", errUsage, command)
+	}
+}
+
+func topics(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		return listTopics(args[1:])
+	case "create":
+		return createTopic(args[1:])
+	case "delete":
+		return deleteTopic(args[1:])
+	case "samples":
+		return topicSamples(args[1:])
+	default:
+		return fmt.Errorf("%w: unknown topics command %q", errUsage, args[0])
+	}
+}
+
+func dlq(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		return listDeadLetters(args[1:])
+	case "requeue":
+		return requeue(args[1:])
+	default:
+		return fmt.Errorf("%w: unknown dlq command %q", errUsage, args[0])
+	}
+}
+
+// config is where the broker is and who we are, from the environment and the common flags.
+type config struct {
+	addr     string
+	web      string
+	user     string
+	password string
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *config) {
+	c := &config{
+		addr:     envOr("QUEUETY_ADDR", "localhost:9845"),
+		web:      envOr("QUEUETY_WEB", "http://localhost:9846"),
+		user:     os.Getenv("QUEUETY_USER"),
+		password: os.Getenv("QUEUETY_PASSWORD"),
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&c.addr, "addr", c.addr, "broker address")
+	fs.StringVar(&c.web, "web", c.web, "web server URL")
+	fs.StringVar(&c.user, "user", c.user, "user")
+	fs.StringVar(&c.password, "password", c.password, "password")
+
+	return fs, c
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+
+	return fallback
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/tomiok/queuety/server"
+)
+
+// migrate upgrades a Badger directory in place, the old queuety/server records included. The
+// broker does the same when it opens the store, this runs it ahead with the broker stopped.
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	dir := fs.Arg(0)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+
+	// badger locks the directory, a running broker makes this fail instead of racing it.
+	db, err := badger.Open(badger.DefaultOptions(dir).WithSyncWrites(true).WithLogger(nil))
+	if err != nil {
+		return err
+	}
+
+	store := server.BadgerDB{DB: db, Logger: slog.New(slog.NewTextHandler(os.Stderr, nil))}
+	if err = store.Migrate(); err != nil {
+		_ = db.Close()
+		return err
+	}
+	if err = db.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "store in %s is up to date\n", dir)
+	return nil
+}
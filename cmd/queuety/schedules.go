@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+
+	"github.com/tomiok/queuety/server"
+)
+
+func schedules(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		return listSchedules(args[1:])
+	case "set":
+		return setSchedule(args[1:])
+	case "delete":
+		return deleteSchedule(args[1:])
+	default:
+		return fmt.Errorf("%w: unknown schedules command %q", errUsage, args[0])
+	}
+}
+
+func listSchedules(args []string) error {
+	fs, c := newFlagSet("schedules list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var list []server.Schedule
+	if err := c.do(http.MethodGet, "/schedules", nil, &list); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCRON\tTOPIC\tBODY")
+	for _, s := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, s.Cron, s.Topic, s.Body)
+	}
+
+	return w.Flush()
+}
+
+func setSchedule(args []string) error {
+	fs, c := newFlagSet("schedules set")
+	cron := fs.String("cron", "", `when to publish, "*/5 * * * *" or "@hourly", in UTC`)
+	topic := fs.String("topic", "", "topic to publish to")
+	key := fs.String("key", "", "key of the messages")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 || *cron == "" || *topic == "" {
+		return errUsage
+	}
+
+	schedule := server.Schedule{Cron: *cron, Topic: *topic, Body: fs.Arg(1), Key: *key}
+	if err := c.send(http.MethodPut, "/schedules/"+url.PathEscape(fs.Arg(0)), nil, schedule, nil); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "schedule %s set\n", fs.Arg(0))
+	return nil
+}
+
+func deleteSchedule(args []string) error {
+	fs, c := newFlagSet("schedules delete")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	if err := c.do(http.MethodDelete, "/schedules/"+url.PathEscape(fs.Arg(0)), nil, nil); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "schedule %s deleted\n", fs.Arg(0))
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tomiok/queuety/server"
+)
+
+func schemas(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		return listSchemas(args[1:])
+	case "register":
+		return registerSchema(args[1:])
+	case "delete":
+		return deleteSchemas(args[1:])
+	default:
+		return fmt.Errorf("%w: unknown schemas command %q", errUsage, args[0])
+	}
+}
+
+func schemasPath(topic string) string {
+	return "/topics/" + url.PathEscape(topic) + "/schemas"
+}
+
+func listSchemas(args []string) error {
+	fs, c := newFlagSet("schemas list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	var versions []server.TopicSchema
+	if err := c.do(http.MethodGet, schemasPath(fs.Arg(0)), nil, &versions); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tCOMPATIBILITY\tCREATED\tFIELDS")
+	for _, v := range versions {
+		// name:type, with a ! for the required ones.
+		fields := make([]string, len(v.Fields))
+		for i, f := range v.Fields {
+			fields[i] = f.Name + ":" + f.Type
+			if f.Required {
+				fields[i] += "!"
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", v.Version, v.Compatibility, v.CreatedAt.Format(time.RFC3339), strings.Join(fields, " "))
+	}
+
+	return w.Flush()
+}
+
+func registerSchema(args []string) error {
+	fs, c := newFlagSet("schemas register")
+	compatibility := fs.String("compatibility", "", "backward, forward, full or none, the one of the latest version by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	if fs.Arg(1) == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(fs.Arg(1))
+	}
+	if err != nil {
+		return err
+	}
+
+	var schema server.TopicSchema
+	if err = json.Unmarshal(b, &schema); err != nil {
+		return fmt.Errorf("invalid schema file: %w", err)
+	}
+	if *compatibility != "" {
+		schema.Compatibility = server.SchemaCompatibility(*compatibility)
+	}
+
+	var created server.TopicSchema
+	if err = c.send(http.MethodPost, schemasPath(fs.Arg(0)), nil, schema, &created); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "schema of %s at version %d\n", fs.Arg(0), created.Version)
+	return nil
+}
+
+func deleteSchemas(args []string) error {
+	fs, c := newFlagSet("schemas delete")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	if err := c.do(http.MethodDelete, schemasPath(fs.Arg(0)), nil, nil); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "schema of %s deleted\n", fs.Arg(0))
+	return nil
+}
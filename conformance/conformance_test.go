@@ -0,0 +1,155 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tomiok/queuety/queuetytest"
+	"github.com/tomiok/queuety/server"
+)
+
+var (
+	addr     = flag.String("addr", "", "run the suite against the broker at addr instead of an in-process one")
+	user     = flag.String("user", "", "user of the broker given with -addr")
+	password = flag.String("password", "", "password of the broker given with -addr")
+)
+
+func Test_Conformance(t *testing.T) {
+	if *addr != "" {
+		Run(t, Target{Addr: *addr, User: *user, Password: *password})
+		return
+	}
+
+	t.Run("open", func(t *testing.T) {
+		b := queuetytest.New(t)
+		Run(t, Target{Addr: b.Addr})
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		b := queuetytest.New(t, queuetytest.WithAuth("conformance", "secret"))
+		Run(t, Target{Addr: b.Addr, User: "conformance", Password: "secret"})
+	})
+}
+
+func Test_Fixtures(t *testing.T) {
+	fixtures, err := Fixtures()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures, run go generate ./conformance")
+	}
+
+	for _, fx := range fixtures {
+		t.Run(fx.Name, func(t *testing.T) {
+			b, err := fx.Bytes()
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			raw, err := os.ReadFile(filepath.Join("testdata", "frames", fx.Name+".bin"))
+			if err != nil || !bytes.Equal(raw, b) {
+				t.Fatalf("frames/%s.bin does not hold the frame of frames.json: %v", fx.Name, err)
+			}
+
+			f, err := ReadFrame(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("cannot read frame: %v", err)
+			}
+
+			got, err := Decode(f)
+			if err != nil {
+				t.Fatalf("cannot decode: %v", err)
+			}
+			if !equalMessages(got, fx.Message) {
+				t.Fatalf("decoded %+v, want %+v", got, fx.Message)
+			}
+
+			if fx.DecodeOnly {
+				return
+			}
+
+			// the reference encoder writes the binary frames byte for byte.
+			if f.Format == FormatBinary {
+				ref, err := Encode(fx.Message, FormatBinary)
+				if err != nil {
+					t.Fatalf("%v", err)
+				}
+				if !bytes.Equal(ref.Payload, f.Payload) {
+					t.Fatalf("reference encoding %x, want %x", ref.Payload, f.Payload)
+				}
+			}
+
+			// and the broker still writes the fixture.
+			if payload := serverEncode(t, fx.Message, f.Format); !bytes.Equal(payload, f.Payload) {
+				t.Fatalf("server encoding %x, want %x", payload, f.Payload)
+			}
+		})
+	}
+}
+
+// serverEncode encodes m with the server package, the wire form is its JSON.
+func serverEncode(t *testing.T, m Message, format byte) []byte {
+	t.Helper()
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	msg, err := server.DecodeMessage(b)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if format == FormatBinary {
+		b, err = msg.MarshalBinary()
+	} else {
+		b, err = msg.Marshall()
+	}
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	return b
+}
+
+// equalMessages compares the bodies by value, a JSON frame may have been reformatted.
+func equalMessages(a, b Message) bool {
+	if !sameBody(a.Body, b.Body) {
+		return false
+	}
+	a.Body, b.Body = nil, nil
+	a.BodyString, b.BodyString = "", ""
+
+	return reflect.DeepEqual(a, b)
+}
+
+func Test_FixturesCoverEveryType(t *testing.T) {
+	fixtures, err := Fixtures()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	covered := make(map[string]map[byte]bool)
+	for _, fx := range fixtures {
+		b, _ := fx.Bytes()
+		if len(b) == 0 || fx.DecodeOnly {
+			continue
+		}
+		if covered[fx.Message.Type] == nil {
+			covered[fx.Message.Type] = make(map[byte]bool)
+		}
+		covered[fx.Message.Type][b[0]] = true
+	}
+
+	types := []string{TypeNewTopic, TypeNewMessage, TypeNewSub, TypeACK, TypeAuth, TypeAuthSuccess, TypeAuthFailed, TypeError, TypeReplay, TypeHello}
+	for _, mType := range types {
+		if !covered[mType][FormatJSON] || !covered[mType][FormatBinary] {
+			t.Errorf("%s lacks a JSON or a binary fixture", mType)
+		}
+	}
+}
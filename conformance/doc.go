@@ -0,0 +1,20 @@
+// Package conformance checks a broker against the queuety wire protocol, so alternative client
+// and broker implementations can be verified with the same cases as this one.
+//
+// A frame is a format flag, 0x01 for JSON and 0x02 for binary, a little endian uint32 with the
+// payload length and the payload, the encoded message. Deliveries are sent in the format of
+// the NEW_SUB frame of the subscription, errors in the format of the rejected frame and the
+// AUTH replies always in JSON.
+//
+// Run executes the cases against a running broker:
+//
+//	func TestBroker(t *testing.T) {
+//		conformance.Run(t, conformance.Target{Addr: "localhost:9845"})
+//	}
+//
+// Clients in other languages use the golden frames in testdata: frames.json lists a message of
+// every type in both formats with its frame in hex, frames/<name>.bin holds the same bytes.
+// Decoding each frame must give its message and, for the binary ones, encoding the message
+// must give the frame byte for byte. JSON encoders may order the keys differently, the JSON
+// frames are compared by value. go generate rewrites them from the server encoder.
+package conformance
@@ -0,0 +1,51 @@
+package conformance
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+//go:generate go run ./internal/genframes
+
+//go:embed testdata/frames.json
+var framesJSON []byte
+
+// Fixture is a golden frame: Frame, header included, carries Message.
+type Fixture struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Message     Message `json:"message"`
+	// Frame is hex encoded.
+	Frame string `json:"frame"`
+	// DecodeOnly frames come from older encoders, current ones do not produce them.
+	DecodeOnly bool `json:"decode_only,omitempty"`
+}
+
+// Bytes decodes the hex of the frame.
+func (f Fixture) Bytes() ([]byte, error) {
+	return hex.DecodeString(f.Frame)
+}
+
+// Fixtures returns the golden frames of testdata/frames.json, the bodies are compact JSON.
+func Fixtures() ([]Fixture, error) {
+	var fixtures []Fixture
+	if err := json.Unmarshal(framesJSON, &fixtures); err != nil {
+		return nil, fmt.Errorf("conformance: invalid fixtures: %w", err)
+	}
+
+	// the file is indented, the bodies of the frames are compact.
+	for i := range fixtures {
+		if body := fixtures[i].Message.Body; len(body) > 0 {
+			var b bytes.Buffer
+			if err := json.Compact(&b, body); err != nil {
+				return nil, fmt.Errorf("conformance: invalid body in %s: %w", fixtures[i].Name, err)
+			}
+			fixtures[i].Message.Body = b.Bytes()
+		}
+	}
+
+	return fixtures, nil
+}
@@ -0,0 +1,359 @@
+// Command genframes writes the golden frames of the conformance package: one message of every
+// type in JSON and in binary, encoded by the server package. testdata/frames.json indexes them
+// with the decoded message, testdata/frames/<name>.bin holds the raw bytes of each frame.
+//
+//	go run ./internal/genframes           rewrite testdata
+//	go run ./internal/genframes -verify   fail when testdata differs from the encoder
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/tomiok/queuety/conformance"
+	"github.com/tomiok/queuety/server"
+)
+
+const timestamp = 1700000000
+
+// batchBody is the body of BATCH and BATCH_ACK, the JSON array of two deliveries.
+const batchBody = `[{"id":"false-41c3","next_id":"41c3","type":"NEW_MESSAGE","user":"","password":"","topic":{"Name":"orders"},"body":{"id":7},"body_string":"{\"id\":7}","timestamp":1700000000,"ack":false,"attempts":0,"seq":42},` +
+	`{"id":"false-41c4","next_id":"41c4","type":"NEW_MESSAGE","user":"","password":"","topic":{"Name":"orders"},"body":{"id":8},"body_string":"{\"id\":8}","timestamp":1700000000,"ack":false,"attempts":0,"seq":43}]`
+
+// txnBody is the body of TXN, acking a delivery of orders and publishing to invoices.
+const txnBody = `{"acks":[{"id":"false-41c3","next_id":"41c3","type":"NEW_MESSAGE","user":"","password":"","topic":{"Name":"orders"},"body":{"id":7},"body_string":"{\"id\":7}","timestamp":1700000000,"ack":false,"attempts":0,"seq":42}],` +
+	`"publish":[{"topic":{"Name":"invoices"},"body":{"order":7}}]}`
+
+// metadataBody is the body of the METADATA answering for orders, a queue topic with a schema.
+const metadataBody = `{"topic":"orders","class":"durable","mode":"queue","partitions":1,"durability":"async","retention":86400,"visibility_timeout":30,"schema_version":2,"seq":42,"subscribers":3}`
+
+// golden are the messages of the fixtures, every one is written in both formats.
+var golden = []struct {
+	name, description string
+	message           conformance.Message
+}{
+	{
+		name:        "new_topic",
+		description: "NEW_TOPIC with the topic options as body",
+		message:     message("5d1e", conformance.TypeNewTopic, "orders", `{"class":"durable"}`),
+	},
+	{
+		name:        "new_sub",
+		description: "NEW_SUB of a durable subscriber, deliveries come in the format of this frame",
+		message:     with(message("9a0f", conformance.TypeNewSub, "orders", ""), func(m *conformance.Message) { m.Subscriber = "billing" }),
+	},
+	{
+		name:        "new_message",
+		description: "NEW_MESSAGE published by a client, the id is false-<next_id> until the broker acks it",
+		message:     with(message("41c3", conformance.TypeNewMessage, "orders", `{"id":7}`), func(m *conformance.Message) { m.ID = "false-41c3"; m.TTL = 60 }),
+	},
+	{
+		name:        "new_message_key",
+		description: "NEW_MESSAGE with the key a compacted topic keeps the latest message of",
+		message:     with(message("41c4", conformance.TypeNewMessage, "presence", `"online"`), func(m *conformance.Message) { m.ID = "false-41c4"; m.Key = "ana" }),
+	},
+	{
+		name:        "new_message_headers",
+		description: "NEW_MESSAGE with headers, delivered as they are, in binary after the key even an empty one",
+		message: with(message("41c7", conformance.TypeNewMessage, "orders", `{"id":8}`), func(m *conformance.Message) {
+			m.ID = "false-41c7"
+			m.Headers = map[string]string{"trace-id": "4bf92f35", "content-type": "application/json"}
+		}),
+	},
+	{
+		name:        "new_message_redelivered",
+		description: "NEW_MESSAGE delivered again with its attempts, in binary the flags after the empty key and headers",
+		message: with(message("41c3", conformance.TypeNewMessage, "orders", `{"id":7}`), func(m *conformance.Message) {
+			m.ID = "false-41c3"
+			m.Attempts = 2
+			m.Seq = 42
+			m.Redelivered = true
+		}),
+	},
+	{
+		name:        "new_message_fire_and_forget",
+		description: "NEW_MESSAGE neither stored nor confirmed nor acked, in binary the flags after the empty key and headers",
+		message: with(message("41c8", conformance.TypeNewMessage, "metrics", `{"cpu":0.42}`), func(m *conformance.Message) {
+			m.ID = "false-41c8"
+			m.FireAndForget = true
+		}),
+	},
+	{
+		name:        "new_message_effectively_once",
+		description: "NEW_MESSAGE deduplicated by its id, to brokers that negotiated dedup, in binary the flags after the empty key and headers",
+		message: with(message("41c9", conformance.TypeNewMessage, "payments", `{"id":9}`), func(m *conformance.Message) {
+			m.ID = "false-41c9"
+			m.Dedup = true
+		}),
+	},
+	{
+		name:        "published",
+		description: "PUBLISHED confirming a NEW_MESSAGE with its seq, to clients that negotiated publish_confirms",
+		message: with(message("41c3", conformance.TypePublished, "orders", ""), func(m *conformance.Message) {
+			m.ID = "false-41c3"
+			m.Seq = 42
+		}),
+	},
+	{
+		name:        "delivery",
+		description: "NEW_MESSAGE delivered by the broker with the fields it stamps",
+		message: with(message("41c3", conformance.TypeNewMessage, "orders", `{"id":7}`), func(m *conformance.Message) {
+			m.ID = "false-41c3"
+			m.User = "admin"
+			m.Attempts = 1
+			m.ConnID = 3
+			m.Seq = 42
+			m.TTL = 60
+		}),
+	},
+	{
+		name:        "ack",
+		description: "ACK echoing the delivery, seq advances the cursor of a durable subscriber",
+		message: with(message("41c3", conformance.TypeACK, "orders", `{"id":7}`), func(m *conformance.Message) {
+			m.ID = "false-41c3"
+			m.ACK = true
+			m.Seq = 42
+		}),
+	},
+	{
+		name:        "nack",
+		description: "NACK echoing the delivery as ACK does, the broker delivers it again",
+		message: with(message("41c3", conformance.TypeNack, "orders", `{"id":7}`), func(m *conformance.Message) {
+			m.ID = "false-41c3"
+			m.Attempts = 1
+			m.Seq = 42
+		}),
+	},
+	{
+		name:        "in_progress",
+		description: "IN_PROGRESS extending the ack deadline of a delivery, no redelivery before it runs out",
+		message: with(message("41c3", conformance.TypeInProgress, "orders", `{"seconds":120}`), func(m *conformance.Message) {
+			m.ID = "false-41c3"
+			m.Seq = 42
+		}),
+	},
+	{
+		name:        "batch",
+		description: "BATCH delivering two messages to a subscriber asking for batches",
+		message:     message("9e21", conformance.TypeBatch, "orders", batchBody),
+	},
+	{
+		name:        "batch_ack",
+		description: "BATCH_ACK echoing the body of the BATCH, every message of it is acked",
+		message:     message("9e21", conformance.TypeBatchAck, "orders", batchBody),
+	},
+	{
+		name:        "txn",
+		description: "TXN acking a delivery and publishing what came out of it at once, answered by PUBLISHED",
+		message:     message("6d0f", conformance.TypeTxn, "orders", txnBody),
+	},
+	{
+		name:        "metadata",
+		description: "METADATA asking how a topic is configured",
+		message:     message("7a30", conformance.TypeMetadata, "orders", ""),
+	},
+	{
+		name:        "metadata_reply",
+		description: "METADATA answering with the configuration of the topic, echoing the id",
+		message:     message("7a30", conformance.TypeMetadata, "orders", metadataBody),
+	},
+	{
+		name:        "auth",
+		description: "AUTH with the credentials of the client",
+		message:     with(message("c2b7", conformance.TypeAuth, "", ""), func(m *conformance.Message) { m.User = "admin"; m.Password = "secret" }),
+	},
+	{
+		name:        "auth_success",
+		description: "AUTH_SUCCESS, the reply to AUTH without the password",
+		message:     with(message("c2b7", conformance.TypeAuthSuccess, "", ""), func(m *conformance.Message) { m.User = "admin" }),
+	},
+	{
+		name:        "auth_failed",
+		description: "AUTH_FAILED, the reply to AUTH with wrong credentials",
+		message:     with(message("c2b8", conformance.TypeAuthFailed, "", ""), func(m *conformance.Message) { m.User = "admin" }),
+	},
+	{
+		name:        "error",
+		description: "ERROR rejecting a message published to a missing topic",
+		message:     message("", conformance.TypeError, "missing", `{"code":"UNKNOWN_TOPIC","description":"topic not found","message_id":"false-41c5"}`),
+	},
+	{
+		name:        "replay",
+		description: "REPLAY of a seq range, the messages arrive on the subscription to the topic",
+		message:     message("77aa", conformance.TypeReplay, "orders", `{"from_seq":10,"to_seq":20}`),
+	},
+	{
+		name:        "hello",
+		description: "HELLO identifying the client, the broker sends no reply",
+		message:     message("e410", conformance.TypeHello, "", `{"name":"billing","version":"1.4.2","labels":{"env":"prod"}}`),
+	},
+	{
+		name:        "hello_features",
+		description: "HELLO listing the features of the client, answered with the agreed ones",
+		message:     message("e411", conformance.TypeHello, "", `{"name":"billing","features":["binary","durable","manual_ack"]}`),
+	},
+}
+
+func message(id, mType, topic, body string) conformance.Message {
+	m := conformance.Message{ID: id, NextID: id, Type: mType, Topic: conformance.Topic{Name: topic}, Timestamp: timestamp}
+	if body != "" {
+		m.Body = json.RawMessage(body)
+		m.BodyString = body
+	}
+
+	return m
+}
+
+func with(m conformance.Message, fn func(*conformance.Message)) conformance.Message {
+	fn(&m)
+	return m
+}
+
+func main() {
+	dir := flag.String("dir", "testdata", "directory of frames.json and frames/")
+	verify := flag.Bool("verify", false, "compare the files with the encoder instead of writing them")
+	flag.Parse()
+
+	files, err := generate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "genframes:", err)
+		os.Exit(1)
+	}
+
+	if *verify {
+		stale := check(*dir, files)
+		if len(stale) > 0 {
+			fmt.Fprintf(os.Stderr, "genframes: stale fixtures, run go generate ./conformance: %v\n", stale)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err = write(*dir, files); err != nil {
+		fmt.Fprintln(os.Stderr, "genframes:", err)
+		os.Exit(1)
+	}
+}
+
+// generate returns the content of every file by its path relative to the directory.
+func generate() (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	fixtures := make([]conformance.Fixture, 0, 2*len(golden)+1)
+
+	add := func(name, description string, m conformance.Message, frame []byte, decodeOnly bool) {
+		fixtures = append(fixtures, conformance.Fixture{
+			Name: name, Description: description, Message: m,
+			Frame: hex.EncodeToString(frame), DecodeOnly: decodeOnly,
+		})
+		files[filepath.Join("frames", name+".bin")] = frame
+	}
+
+	for _, g := range golden {
+		for _, format := range []struct {
+			suffix string
+			flag   byte
+		}{{"json", conformance.FormatJSON}, {"binary", conformance.FormatBinary}} {
+			payload, err := serverEncode(g.message, format.flag)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", g.name, err)
+			}
+			frame, err := frameOf(format.flag, payload)
+			if err != nil {
+				return nil, err
+			}
+			add(g.name+"_"+format.suffix, g.description, g.message, frame, false)
+		}
+	}
+
+	// a frame of an encoder predating the conn_id, seq, subscriber and ttl trailer.
+	legacy := message("41c6", conformance.TypeNewMessage, "orders", `"old"`)
+	legacy.ID = "false-41c6"
+	payload, err := conformance.MarshalBinary(legacy)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := frameOf(conformance.FormatBinary, payload[:len(payload)-8-8-2-8])
+	if err != nil {
+		return nil, err
+	}
+	add("legacy_binary", "binary NEW_MESSAGE of an older encoder, without the trailer fields", legacy, frame, true)
+
+	index, err := json.MarshalIndent(fixtures, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	files["frames.json"] = append(index, '\n')
+
+	return files, nil
+}
+
+// serverEncode encodes m with the server package, the wire form is its JSON.
+func serverEncode(m conformance.Message, format byte) ([]byte, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := server.DecodeMessage(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == conformance.FormatBinary {
+		return msg.MarshalBinary()
+	}
+	return msg.Marshall()
+}
+
+func frameOf(format byte, payload []byte) ([]byte, error) {
+	var b bytes.Buffer
+	if err := conformance.WriteFrame(&b, conformance.Frame{Format: format, Payload: payload}); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func write(dir string, files map[string][]byte) error {
+	frames := filepath.Join(dir, "frames")
+	if err := os.RemoveAll(frames); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(frames, 0o755); err != nil {
+		return err
+	}
+
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// check returns the files missing, different or left over in dir.
+func check(dir string, files map[string][]byte) []string {
+	var stale []string
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(got, want) {
+			stale = append(stale, name)
+		}
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "frames"))
+	for _, e := range entries {
+		if name := filepath.Join("frames", e.Name()); files[name] == nil {
+			stale = append(stale, name)
+		}
+	}
+
+	slices.Sort(stale)
+	return stale
+}
@@ -0,0 +1,567 @@
+package conformance
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	defaultTimeout = 2 * time.Second
+	// quiet is how long a case waits for a frame that must not come.
+	quiet = 300 * time.Millisecond
+	// barrierType is unknown to every broker, the ERROR it gets back tells the frames sent
+	// before it on the connection were handled.
+	barrierType = "CONFORMANCE_BARRIER"
+)
+
+// Target is the broker under test.
+type Target struct {
+	Addr string
+	// User and Password log every connection in, the auth cases expect a broker requiring
+	// them when they are set and an open broker otherwise.
+	User     string
+	Password string
+	// Timeout bounds every expected frame, 2 seconds by default.
+	Timeout time.Duration
+}
+
+func (t Target) auth() bool {
+	return t.User != "" || t.Password != ""
+}
+
+// Run executes every case against the target as subtests.
+func Run(t *testing.T, target Target) {
+	t.Helper()
+
+	if target.Timeout <= 0 {
+		target.Timeout = defaultTimeout
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.run(t, target)
+		})
+	}
+}
+
+var cases = []struct {
+	name string
+	run  func(*testing.T, Target)
+}{
+	{"framing/json_delivery", testJSONDelivery},
+	{"framing/binary_delivery", testBinaryDelivery},
+	{"framing/format_follows_subscription", testFormatFollowsSubscription},
+	{"framing/unknown_format", testUnknownFormat},
+	{"framing/malformed_payload", testMalformedPayload},
+	{"errors/unknown_type", testUnknownType},
+	{"errors/unknown_topic", testUnknownTopic},
+	{"auth/required", testAuthRequired},
+	{"auth/failed", testAuthFailed},
+	{"auth/success", testAuthSuccess},
+	{"handshake/hello", testHello},
+	{"handshake/features", testHelloFeatures},
+	{"delivery/fanout", testFanout},
+	{"ack/acked_not_redelivered", testAckedNotRedelivered},
+	{"redelivery/unacked_redelivered", testUnackedRedelivered},
+}
+
+func testJSONDelivery(t *testing.T, target Target) {
+	topic := uniqueName("json")
+	pub := dial(t, target)
+	pub.newTopic(topic)
+
+	sub := dial(t, target)
+	sub.subscribe(topic, FormatJSON, "")
+
+	sent := pub.publish(topic, []byte(`{"n":1}`), FormatJSON)
+
+	f, got := sub.read()
+	if f.Format != FormatJSON {
+		t.Fatalf("delivery format = %#x, want %#x", f.Format, FormatJSON)
+	}
+	expectDelivery(t, got, sent)
+	if got.Seq == 0 {
+		t.Fatal("delivery without seq")
+	}
+}
+
+func testBinaryDelivery(t *testing.T, target Target) {
+	topic := uniqueName("binary")
+	pub := dial(t, target)
+	pub.newTopic(topic)
+
+	sub := dial(t, target)
+	sub.subscribe(topic, FormatBinary, "")
+
+	sent := pub.publish(topic, []byte{0x00, 0xff, 'r', 'a', 'w'}, FormatBinary)
+
+	f, got := sub.read()
+	if f.Format != FormatBinary {
+		t.Fatalf("delivery format = %#x, want %#x", f.Format, FormatBinary)
+	}
+	expectDelivery(t, got, sent)
+}
+
+func testFormatFollowsSubscription(t *testing.T, target Target) {
+	topic := uniqueName("mixed")
+	pub := dial(t, target)
+	pub.newTopic(topic)
+
+	jsonSub := dial(t, target)
+	jsonSub.subscribe(topic, FormatJSON, "")
+	binarySub := dial(t, target)
+	binarySub.subscribe(topic, FormatBinary, "")
+
+	sent := pub.publish(topic, []byte(`"hello"`), FormatBinary)
+
+	if f, got := jsonSub.read(); f.Format != FormatJSON {
+		t.Fatalf("JSON subscription got format %#x", f.Format)
+	} else {
+		expectDelivery(t, got, sent)
+	}
+	if f, got := binarySub.read(); f.Format != FormatBinary {
+		t.Fatalf("binary subscription got format %#x", f.Format)
+	} else {
+		expectDelivery(t, got, sent)
+	}
+}
+
+func testUnknownFormat(t *testing.T, target Target) {
+	c := dial(t, target)
+	c.sendFrame(Frame{Format: 0x7f, Payload: []byte(`{}`)})
+
+	f, m := c.read()
+	if f.Format != FormatJSON {
+		t.Fatalf("unknown formats are answered in JSON, got %#x", f.Format)
+	}
+	expectError(t, m, "UNKNOWN_FORMAT")
+}
+
+func testMalformedPayload(t *testing.T, target Target) {
+	c := dial(t, target)
+	c.sendFrame(Frame{Format: FormatJSON, Payload: []byte(`{"id":`)})
+
+	_, m := c.read()
+	expectError(t, m, "MALFORMED_FRAME")
+}
+
+func testUnknownType(t *testing.T, target Target) {
+	c := dial(t, target)
+	m := newMessage("NOT_A_TYPE", uniqueName("topic"))
+	c.send(m, FormatJSON)
+
+	_, got := c.read()
+	if body := expectError(t, got, "UNKNOWN_TYPE"); body.MessageID != m.ID {
+		t.Fatalf("error for message %q, want %q", body.MessageID, m.ID)
+	}
+}
+
+func testUnknownTopic(t *testing.T, target Target) {
+	c := dial(t, target)
+	sent := c.publish(uniqueName("missing"), []byte(`1`), FormatJSON)
+
+	_, got := c.read()
+	if body := expectError(t, got, "UNKNOWN_TOPIC"); body.MessageID != sent.ID {
+		t.Fatalf("error for message %q, want %q", body.MessageID, sent.ID)
+	}
+}
+
+func testAuthRequired(t *testing.T, target Target) {
+	if !target.auth() {
+		t.Skip("the target does not require auth")
+	}
+
+	c := dialRaw(t, target)
+	c.send(newMessage(TypeNewTopic, uniqueName("unauthenticated")), FormatJSON)
+
+	_, m := c.read()
+	expectError(t, m, "AUTH_REQUIRED")
+}
+
+func testAuthFailed(t *testing.T, target Target) {
+	if !target.auth() {
+		t.Skip("the target does not require auth")
+	}
+
+	c := dialRaw(t, target)
+	m := c.login(target.User, target.Password+"-wrong")
+	if m.Type != TypeAuthFailed {
+		t.Fatalf("wrong password answered with %s, want %s", m.Type, TypeAuthFailed)
+	}
+
+	// still unauthenticated.
+	c.send(newMessage(TypeNewTopic, uniqueName("after-failure")), FormatJSON)
+	_, m = c.read()
+	expectError(t, m, "AUTH_REQUIRED")
+}
+
+func testAuthSuccess(t *testing.T, target Target) {
+	c := dialRaw(t, target)
+	// an open broker accepts any credentials.
+	user, password := target.User, target.Password
+	if !target.auth() {
+		user, password = "anyone", "anything"
+	}
+
+	m := c.login(user, password)
+	if m.Type != TypeAuthSuccess {
+		t.Fatalf("login answered with %s, want %s", m.Type, TypeAuthSuccess)
+	}
+	if m.Password != "" {
+		t.Fatal("the AUTH reply echoes the password")
+	}
+}
+
+func testFanout(t *testing.T, target Target) {
+	topic := uniqueName("fanout")
+	pub := dial(t, target)
+	pub.newTopic(topic)
+
+	subs := []*client{dial(t, target), dial(t, target)}
+	for _, sub := range subs {
+		sub.subscribe(topic, FormatJSON, "")
+	}
+
+	sent := pub.publish(topic, []byte(`"everyone"`), FormatJSON)
+	for _, sub := range subs {
+		_, got := sub.read()
+		expectDelivery(t, got, sent)
+	}
+}
+
+func testAckedNotRedelivered(t *testing.T, target Target) {
+	topic, durable := uniqueName("acked"), uniqueName("durable")
+	pub := dial(t, target)
+	pub.newTopic(topic)
+
+	sub := dial(t, target)
+	sub.subscribe(topic, FormatJSON, durable)
+	first := pub.publish(topic, []byte(`"first"`), FormatJSON)
+
+	_, delivered := sub.read()
+	expectDelivery(t, delivered, first)
+	sub.ack(delivered)
+	sub.barrier()
+	sub.close()
+
+	// published while the durable subscriber is away, the first thing it gets back.
+	second := pub.publish(topic, []byte(`"second"`), FormatJSON)
+	pub.barrier()
+
+	_, got := resubscribe(t, target, topic, durable)
+	if got.Seq == delivered.Seq || sameBody(got.Body, first.Body) {
+		t.Fatalf("acked message %s delivered again", got.Body)
+	}
+	expectDelivery(t, got, second)
+}
+
+func testUnackedRedelivered(t *testing.T, target Target) {
+	topic, durable := uniqueName("unacked"), uniqueName("durable")
+	pub := dial(t, target)
+	pub.newTopic(topic)
+
+	sub := dial(t, target)
+	sub.subscribe(topic, FormatJSON, durable)
+	sent := pub.publish(topic, []byte(`"again"`), FormatJSON)
+
+	_, first := sub.read()
+	expectDelivery(t, first, sent)
+	sub.close()
+
+	_, got := resubscribe(t, target, topic, durable)
+	expectDelivery(t, got, sent)
+	if got.Seq != first.Seq {
+		t.Fatalf("redelivered with seq %d, first delivered with %d", got.Seq, first.Seq)
+	}
+}
+
+// client is one connection to the target, its failures end the test.
+type client struct {
+	t       *testing.T
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// dial connects and logs in when the target has credentials.
+func dial(t *testing.T, target Target) *client {
+	t.Helper()
+
+	c := dialRaw(t, target)
+	if target.auth() {
+		if m := c.login(target.User, target.Password); m.Type != TypeAuthSuccess {
+			t.Fatalf("login answered with %s", m.Type)
+		}
+	}
+
+	return c
+}
+
+func testHello(t *testing.T, target Target) {
+	c := dial(t, target)
+	hello := newMessage(TypeHello, "")
+	hello.Body = json.RawMessage(`{"name":"conformance","version":"1","labels":{"suite":"queuety"}}`)
+	hello.BodyString = string(hello.Body)
+	c.send(hello, FormatJSON)
+
+	// HELLO has no reply, the first frame must be the one of the barrier.
+	barrier := newMessage(barrierType, "")
+	c.send(barrier, FormatJSON)
+
+	_, m := c.read()
+	if body := expectError(t, m, "UNKNOWN_TYPE"); body.MessageID != barrier.ID {
+		t.Fatalf("HELLO answered with %s, want no reply", m.Body)
+	}
+}
+
+func testHelloFeatures(t *testing.T, target Target) {
+	c := dial(t, target)
+	hello := newMessage(TypeHello, "")
+	hello.Body = json.RawMessage(`{"name":"conformance","features":["binary","conformance_unknown"]}`)
+	hello.BodyString = string(hello.Body)
+	c.send(hello, FormatJSON)
+
+	_, m := c.read()
+	if m.Type != TypeHello {
+		t.Fatalf("HELLO with features answered with %s, want %s", m.Type, TypeHello)
+	}
+
+	var reply struct {
+		Features []string `json:"features"`
+	}
+	if err := json.Unmarshal(m.Body, &reply); err != nil {
+		t.Fatalf("undecodable HELLO reply %q: %v", m.Body, err)
+	}
+	for _, f := range reply.Features {
+		if f != "binary" {
+			t.Fatalf("HELLO reply agreed on %q, the client did not offer it", f)
+		}
+	}
+}
+
+func dialRaw(t *testing.T, target Target) *client {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", target.Addr, target.Timeout)
+	if err != nil {
+		t.Fatalf("cannot connect to %s: %v", target.Addr, err)
+	}
+	c := &client{t: t, conn: conn, timeout: target.Timeout}
+	t.Cleanup(c.close)
+
+	return c
+}
+
+func (c *client) close() {
+	_ = c.conn.Close()
+}
+
+func (c *client) sendFrame(f Frame) {
+	c.t.Helper()
+
+	if err := WriteFrame(c.conn, f); err != nil {
+		c.t.Fatalf("cannot write frame: %v", err)
+	}
+}
+
+func (c *client) send(m Message, format byte) {
+	c.t.Helper()
+
+	f, err := Encode(m, format)
+	if err != nil {
+		c.t.Fatalf("cannot encode %s: %v", m.Type, err)
+	}
+	c.sendFrame(f)
+}
+
+// read returns the next frame with its message, failing the test after the timeout.
+func (c *client) read() (Frame, Message) {
+	c.t.Helper()
+
+	f, m, err := c.readWithin(c.timeout)
+	if err != nil {
+		c.t.Fatalf("no frame: %v", err)
+	}
+
+	return f, m
+}
+
+func (c *client) readWithin(d time.Duration) (Frame, Message, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(d))
+	defer func() { _ = c.conn.SetReadDeadline(time.Time{}) }()
+
+	f, err := ReadFrame(c.conn)
+	if err != nil {
+		return Frame{}, Message{}, err
+	}
+
+	m, err := Decode(f)
+	return f, m, err
+}
+
+func (c *client) login(user, password string) Message {
+	c.t.Helper()
+
+	m := newMessage(TypeAuth, "")
+	m.User, m.Password = user, password
+	c.send(m, FormatJSON)
+
+	f, reply := c.read()
+	if f.Format != FormatJSON {
+		c.t.Fatalf("AUTH replies are JSON, got format %#x", f.Format)
+	}
+
+	return reply
+}
+
+// barrier returns once the broker handled every frame sent before it.
+func (c *client) barrier() {
+	c.t.Helper()
+
+	c.send(newMessage(barrierType, ""), FormatJSON)
+	for {
+		_, m := c.read()
+		var body ErrorBody
+		if m.Type == TypeError && json.Unmarshal(m.Body, &body) == nil && body.Code == "UNKNOWN_TYPE" {
+			return
+		}
+	}
+}
+
+func (c *client) newTopic(name string) {
+	c.t.Helper()
+
+	m := newMessage(TypeNewTopic, name)
+	m.Body = json.RawMessage(`{}`)
+	m.BodyString = string(m.Body)
+	c.send(m, FormatJSON)
+	c.barrier()
+}
+
+// subscribe registers the subscription, durable names it.
+func (c *client) subscribe(topic string, format byte, durable string) {
+	c.t.Helper()
+
+	m := newMessage(TypeNewSub, topic)
+	m.Subscriber = durable
+	c.send(m, format)
+	c.barrier()
+}
+
+func (c *client) publish(topic string, body []byte, format byte) Message {
+	c.t.Helper()
+
+	m := newMessage(TypeNewMessage, topic)
+	m.ID = "false-" + m.NextID
+	m.Body = body
+	m.BodyString = string(body)
+	c.send(m, format)
+
+	return m
+}
+
+// ack confirms a delivery, echoing what identifies it.
+func (c *client) ack(delivery Message) {
+	c.t.Helper()
+
+	m := delivery
+	m.Type = TypeACK
+	m.ACK = true
+	c.send(m, FormatJSON)
+}
+
+// resubscribe reconnects a durable subscriber until the broker sends it something. The broker
+// notices the previous connection left asynchronously, until then the new one may join as
+// a second member of the group and get no backlog.
+func resubscribe(t *testing.T, target Target, topic, durable string) (*client, Message) {
+	t.Helper()
+
+	deadline := time.Now().Add(target.Timeout)
+	for {
+		c := dial(t, target)
+		c.subscribe(topic, FormatJSON, durable)
+
+		_, m, err := c.readWithin(quiet)
+		if err == nil {
+			return c, m
+		}
+		c.close()
+
+		if !errors.Is(err, os.ErrDeadlineExceeded) || time.Now().After(deadline) {
+			t.Fatalf("durable subscriber %s got nothing back: %v", durable, err)
+		}
+	}
+}
+
+func newMessage(mType, topic string) Message {
+	id := randomID()
+	return Message{
+		ID:        id,
+		NextID:    id,
+		Type:      mType,
+		Topic:     Topic{Name: topic},
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+func expectDelivery(t *testing.T, got, sent Message) {
+	t.Helper()
+
+	if got.Type != TypeNewMessage {
+		t.Fatalf("got %s, want a %s delivery", got.Type, TypeNewMessage)
+	}
+	if got.Topic != sent.Topic {
+		t.Fatalf("delivery on %q, want %q", got.Topic.Name, sent.Topic.Name)
+	}
+	if !sameBody(got.Body, sent.Body) {
+		t.Fatalf("delivered body %q, want %q", got.Body, sent.Body)
+	}
+}
+
+func expectError(t *testing.T, m Message, code string) ErrorBody {
+	t.Helper()
+
+	if m.Type != TypeError {
+		t.Fatalf("got %s, want %s %s", m.Type, TypeError, code)
+	}
+	var body ErrorBody
+	if err := json.Unmarshal(m.Body, &body); err != nil {
+		t.Fatalf("undecodable error body %q: %v", m.Body, err)
+	}
+	if body.Code != code {
+		t.Fatalf("error code %s (%s), want %s", body.Code, body.Description, code)
+	}
+
+	return body
+}
+
+// sameBody compares JSON bodies by value, a broker may reformat them.
+func sameBody(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
+
+func uniqueName(prefix string) string {
+	return "conformance-" + prefix + "-" + randomID()[:8]
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,354 @@
+package conformance
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+// Formats of a frame.
+const (
+	FormatJSON   byte = 0x01
+	FormatBinary byte = 0x02
+)
+
+// Message types of the protocol.
+const (
+	TypeNewTopic    = "NEW_TOPIC"
+	TypeNewMessage  = "NEW_MESSAGE"
+	TypeNewSub      = "NEW_SUB"
+	TypeACK         = "ACK"
+	TypeAuth        = "AUTH"
+	TypeAuthSuccess = "AUTH_SUCCESS"
+	TypeAuthFailed  = "AUTH_FAILED"
+	TypeError       = "ERROR"
+	TypeReplay      = "REPLAY"
+	TypeHello       = "HELLO"
+	TypePublished   = "PUBLISHED"
+	TypeNack        = "NACK"
+	TypeInProgress  = "IN_PROGRESS"
+	TypeBatch       = "BATCH"
+	TypeBatchAck    = "BATCH_ACK"
+	TypeTxn         = "TXN"
+	TypeMetadata    = "METADATA"
+)
+
+// maxFrameSize bounds the frames read by the suite, as the broker bounds the ones it reads.
+const maxFrameSize = 16 << 20
+
+var errShortPayload = errors.New("conformance: payload too short")
+
+// Topic is how a topic travels, the key is capitalized on the wire.
+type Topic struct {
+	Name string `json:"Name"`
+}
+
+// Message is the wire form of a message, the JSON keys are the ones of the protocol.
+type Message struct {
+	ID         string            `json:"id"`
+	NextID     string            `json:"next_id"`
+	Type       string            `json:"type"`
+	User       string            `json:"user"`
+	Password   string            `json:"password"`
+	Topic      Topic             `json:"topic"`
+	Body       json.RawMessage   `json:"body"`
+	BodyString string            `json:"body_string"`
+	Timestamp  int64             `json:"timestamp"`
+	ACK        bool              `json:"ack"`
+	Attempts   int               `json:"attempts"`
+	ConnID     uint64            `json:"conn_id,omitempty"`
+	Seq        uint64            `json:"seq,omitempty"`
+	Subscriber string            `json:"subscriber,omitempty"`
+	TTL        int64             `json:"ttl,omitempty"`
+	Key        string            `json:"key,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	// Redelivered is set by the broker on a message it delivers again.
+	Redelivered bool `json:"redelivered,omitempty"`
+	// FireAndForget is set by the publisher of a message the broker neither stores nor confirms.
+	FireAndForget bool `json:"fire_and_forget,omitempty"`
+	// Dedup is set by the publisher of a message the broker drops when it has seen its id.
+	Dedup bool `json:"dedup,omitempty"`
+}
+
+// ErrorBody is the body of an ERROR message.
+type ErrorBody struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	MessageID   string `json:"message_id,omitempty"`
+}
+
+// Frame is one unit on the wire.
+type Frame struct {
+	Format  byte
+	Payload []byte
+}
+
+// WriteFrame writes the header and the payload of f in a single write.
+func WriteFrame(w io.Writer, f Frame) error {
+	if uint64(len(f.Payload)) > math.MaxUint32 {
+		return fmt.Errorf("conformance: payload of %d bytes", len(f.Payload))
+	}
+
+	b := make([]byte, 0, 5+len(f.Payload))
+	b = append(b, f.Format)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(f.Payload)))
+	b = append(b, f.Payload...)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadFrame reads one frame from r.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return Frame{}, fmt.Errorf("conformance: frame of %d bytes", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Frame{}, err
+	}
+
+	return Frame{Format: header[0], Payload: payload}, nil
+}
+
+// Encode builds the frame carrying m in format.
+func Encode(m Message, format byte) (Frame, error) {
+	switch format {
+	case FormatJSON:
+		b, err := json.Marshal(m)
+		return Frame{Format: format, Payload: b}, err
+	case FormatBinary:
+		b, err := MarshalBinary(m)
+		return Frame{Format: format, Payload: b}, err
+	default:
+		return Frame{}, fmt.Errorf("conformance: unknown format %d", format)
+	}
+}
+
+// Decode returns the message carried by f.
+func Decode(f Frame) (Message, error) {
+	var m Message
+	switch f.Format {
+	case FormatJSON:
+		err := json.Unmarshal(f.Payload, &m)
+		return m, err
+	case FormatBinary:
+		return UnmarshalBinary(f.Payload)
+	default:
+		return m, fmt.Errorf("conformance: unknown format %d", f.Format)
+	}
+}
+
+// MarshalBinary is the reference binary encoding, every integer is little endian:
+//
+//	id, next_id, type, user, password, topic   uint16 length + bytes each
+//	body, body_string                          uint32 length + bytes each
+//	timestamp int64, ack byte, attempts int32
+//	conn_id uint64, seq uint64, subscriber (uint16 length + bytes), ttl int64
+//	key (uint16 length + bytes), only when not empty or when there are headers or flags
+//	headers count uint16, then name and value (uint16 length + bytes each) sorted by name,
+//	only when there are headers or flags
+//	flags byte, bit 0 is redelivered and bit 1 fire_and_forget, only when one is set
+//
+// body_string is empty when it equals body, a decoder rebuilds it from body. The fields after
+// attempts were added later, a decoder accepts a payload ending before any of them.
+func MarshalBinary(m Message) ([]byte, error) {
+	var b []byte
+	for _, field := range [...]string{m.ID, m.NextID, m.Type, m.User, m.Password, m.Topic.Name, m.Subscriber, m.Key} {
+		if len(field) > math.MaxUint16 {
+			return nil, fmt.Errorf("conformance: field of %d bytes", len(field))
+		}
+	}
+
+	for _, field := range [...]string{m.ID, m.NextID, m.Type, m.User, m.Password, m.Topic.Name} {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(field)))
+		b = append(b, field...)
+	}
+
+	bodyString := m.BodyString
+	if bodyString == string(m.Body) {
+		bodyString = ""
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(m.Body)))
+	b = append(b, m.Body...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(bodyString)))
+	b = append(b, bodyString...)
+
+	b = binary.LittleEndian.AppendUint64(b, uint64(m.Timestamp))
+	if m.ACK {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(int32(m.Attempts)))
+
+	b = binary.LittleEndian.AppendUint64(b, m.ConnID)
+	b = binary.LittleEndian.AppendUint64(b, m.Seq)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.Subscriber)))
+	b = append(b, m.Subscriber...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(m.TTL))
+	var flags byte
+	if m.Redelivered {
+		flags |= 1
+	}
+	if m.FireAndForget {
+		flags |= 2
+	}
+	if m.Dedup {
+		flags |= 4
+	}
+	if m.Key != "" || len(m.Headers) > 0 || flags != 0 {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(m.Key)))
+		b = append(b, m.Key...)
+	}
+	if len(m.Headers) == 0 && flags == 0 {
+		return b, nil
+	}
+
+	names := make([]string, 0, len(m.Headers))
+	for name, value := range m.Headers {
+		if len(name) > math.MaxUint16 || len(value) > math.MaxUint16 {
+			return nil, fmt.Errorf("conformance: header %q too long", name)
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(names)))
+	for _, name := range names {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(name)))
+		b = append(b, name...)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(m.Headers[name])))
+		b = append(b, m.Headers[name]...)
+	}
+	if flags != 0 {
+		b = append(b, flags)
+	}
+
+	return b, nil
+}
+
+// UnmarshalBinary decodes the reference binary encoding, see MarshalBinary.
+func UnmarshalBinary(b []byte) (Message, error) {
+	d := decoder{b: b}
+
+	var m Message
+	m.ID = d.string16()
+	m.NextID = d.string16()
+	m.Type = d.string16()
+	m.User = d.string16()
+	m.Password = d.string16()
+	m.Topic.Name = d.string16()
+	if body := d.bytes32(); len(body) > 0 {
+		m.Body = json.RawMessage(body)
+	}
+	m.BodyString = string(d.bytes32())
+	m.Timestamp = int64(d.uint64())
+	m.ACK = d.byte() == 1
+	m.Attempts = int(int32(d.uint32()))
+	if d.err != nil {
+		return Message{}, d.err
+	}
+	if m.BodyString == "" {
+		m.BodyString = string(m.Body)
+	}
+
+	if len(d.b) > 0 {
+		m.ConnID = d.uint64()
+	}
+	if len(d.b) > 0 {
+		m.Seq = d.uint64()
+	}
+	if len(d.b) > 0 {
+		m.Subscriber = d.string16()
+	}
+	if len(d.b) > 0 {
+		m.TTL = int64(d.uint64())
+	}
+	if len(d.b) > 0 {
+		m.Key = d.string16()
+	}
+	if len(d.b) > 0 {
+		n := int(d.uint16())
+		for range n {
+			if m.Headers == nil {
+				m.Headers = make(map[string]string, n)
+			}
+			name := d.string16()
+			m.Headers[name] = d.string16()
+		}
+	}
+	if len(d.b) > 0 {
+		flags := d.byte()
+		m.Redelivered, m.FireAndForget, m.Dedup = flags&1 != 0, flags&2 != 0, flags&4 != 0
+	}
+
+	return m, d.err
+}
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = errShortPayload
+		return nil
+	}
+
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if v := d.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if v := d.take(4); v != nil {
+		return binary.LittleEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if v := d.take(8); v != nil {
+		return binary.LittleEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if v := d.take(2); v != nil {
+		return binary.LittleEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (d *decoder) string16() string {
+	return string(d.take(int(d.uint16())))
+}
+
+func (d *decoder) bytes32() []byte {
+	n := int(d.uint32())
+	return d.take(n)
+}
@@ -0,0 +1,46 @@
+// Package bufpool hands out byte slices for frame reads from size bucketed pools, so
+// reading a frame at high message rates does not allocate a fresh payload every time.
+package bufpool
+
+import "sync"
+
+// bucketSizes are the capacities kept in the pools, larger frames are allocated directly.
+var bucketSizes = [...]int{512, 4 << 10, 64 << 10, 1 << 20}
+
+var pools [len(bucketSizes)]sync.Pool
+
+// Get returns a slice of length n. The caller must not keep references to it after Put.
+func Get(n int) []byte {
+	i := bucket(n)
+	if i < 0 {
+		return make([]byte, n)
+	}
+
+	if p, ok := pools[i].Get().(*[]byte); ok {
+		return (*p)[:n]
+	}
+
+	return make([]byte, n, bucketSizes[i])
+}
+
+// Put gives b back to the pool matching its capacity. Slices not handed out by Get are dropped.
+func Put(b []byte) {
+	c := cap(b)
+	i := bucket(c)
+	if i < 0 || bucketSizes[i] != c {
+		return
+	}
+
+	b = b[:0]
+	pools[i].Put(&b)
+}
+
+func bucket(n int) int {
+	for i, size := range bucketSizes {
+		if n <= size {
+			return i
+		}
+	}
+
+	return -1
+}
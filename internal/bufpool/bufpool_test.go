@@ -0,0 +1,23 @@
+package bufpool
+
+import "testing"
+
+func Test_GetPut(t *testing.T) {
+	b := Get(100)
+	if len(b) != 100 || cap(b) != 512 {
+		t.Fatalf("expected len 100 cap 512, got len %d cap %d", len(b), cap(b))
+	}
+	Put(b)
+
+	b = Get(5000)
+	if len(b) != 5000 || cap(b) != 64<<10 {
+		t.Fatalf("expected len 5000 cap %d, got len %d cap %d", 64<<10, len(b), cap(b))
+	}
+	Put(b)
+
+	big := Get(2 << 20)
+	if len(big) != 2<<20 {
+		t.Fatalf("expected len %d, got %d", 2<<20, len(big))
+	}
+	Put(big) // dropped, must not panic.
+}
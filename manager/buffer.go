@@ -0,0 +1,96 @@
+package manager
+
+import (
+	"sync"
+
+	"github.com/tomiok/queuety/server"
+)
+
+// defaultBufferSize is the messages a subscription holds for the application without BufferSize.
+const defaultBufferSize = 1000
+
+// subscription is what the read loop feeds for a topic: the deliveries, and the bytes of the
+// ones the application did not take yet when MaxBufferedBytes bounds them.
+type subscription struct {
+	ch     chan server.Message
+	budget *byteBudget
+}
+
+// push waits for room in the budget, then hands the delivery to the consumer. The read loop
+// blocking here leaves the next frames in the socket, the broker notices it with TCP.
+func (s *subscription) push(msg server.Message) {
+	s.budget.acquire(len(msg.Body()))
+	s.ch <- msg
+}
+
+// taken returns the bytes of a delivery the application received.
+func (s *subscription) taken(msg server.Message) {
+	s.budget.release(len(msg.Body()))
+}
+
+// byteBudget bounds the body bytes buffered by a subscription, nil is unbounded. A message
+// larger than the budget still goes through alone, not to stall the subscription for good.
+type byteBudget struct {
+	max int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int
+}
+
+func newByteBudget(max int) *byteBudget {
+	if max <= 0 {
+		return nil
+	}
+
+	b := &byteBudget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *byteBudget) acquire(n int) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.used > 0 && b.used+n > b.max {
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+func (b *byteBudget) release(n int) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// bufferSize is the capacity of the channel the read loop feeds.
+func (o consumeOptions) bufferSize() int {
+	if o.buffer > 0 {
+		return o.buffer
+	}
+
+	return defaultBufferSize
+}
+
+// outSize is the capacity of the channel handed to the application, none under a byte budget
+// so a delivery is only released once the application received it.
+func (o consumeOptions) outSize(n int) int {
+	if o.maxBytes > 0 {
+		return 0
+	}
+	if o.buffer > 0 {
+		return o.buffer
+	}
+
+	return n
+}
@@ -0,0 +1,31 @@
+package manager
+
+import "github.com/tomiok/queuety/server"
+
+// Publisher is the publishing side of a connection. Code depending on it instead of QConn can
+// be tested with managertest.Mock, without a broker.
+type Publisher interface {
+	NewTopic(name string, opts ...TopicOption) (server.Topic, error)
+	Publish(t server.Topic, msg string) error
+	PublishJSON(t server.Topic, msg []byte) error
+	PublishBinary(t server.Topic, msg []byte) error
+	PublishMessage(pubMsg server.PublishMessage) error
+	PublishSync(pubMsg server.PublishMessage) (PublishResult, error)
+	PublishAsync(pubMsg server.PublishMessage) <-chan PublishResult
+	Errors() <-chan error
+}
+
+// Consumer is the consuming side of a connection, ConsumeJSON takes one as well.
+type Consumer interface {
+	Consume(topic server.Topic, opts ...ConsumeOption) <-chan string
+	Errors() <-chan error
+}
+
+// Client publishes and consumes, as QConn does.
+type Client interface {
+	Publisher
+	Consumer
+	Close() error
+}
+
+var _ Client = (*QConn)(nil)
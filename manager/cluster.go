@@ -0,0 +1,420 @@
+package manager
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tomiok/queuety/server"
+)
+
+// ErrNoPrimary is returned by a Cluster reaching none of its brokers telling it is a primary.
+var ErrNoPrimary = errors.New("queuety: no primary reachable")
+
+var errClusterClosed = errors.New("queuety: cluster closed")
+
+const (
+	defaultFailoverInterval = time.Second
+	// lostWait is how long a failed publish waits for its connection to be seen lost, anything
+	// else is an error of the publish itself.
+	lostWait = 100 * time.Millisecond
+)
+
+// ClusterOption customizes a Cluster created by ConnectCluster.
+type ClusterOption func(*Cluster)
+
+// SpreadSubscriptions has Consume subscribe on the replicas of the cluster, in turns, taking
+// the fan out off the primary. Without a replica reachable it subscribes on the primary.
+func SpreadSubscriptions() ClusterOption {
+	return func(c *Cluster) {
+		c.spread = true
+	}
+}
+
+// WithConnOptions applies opts to every connection of the cluster.
+func WithConnOptions(opts ...ConnOption) ClusterOption {
+	return func(c *Cluster) {
+		c.opts = append(c.opts, opts...)
+	}
+}
+
+// FailoverInterval is the wait of a subscription before subscribing again once its broker is
+// lost, a second by default.
+func FailoverInterval(d time.Duration) ClusterOption {
+	return func(c *Cluster) {
+		if d > 0 {
+			c.retry = d
+		}
+	}
+}
+
+// Cluster is a client of several brokers: a primary and the replicas following it, see
+// server.ReplicaConfig. It publishes on the primary, telling it from the replicas by the role
+// each broker answers HELLO with, a replica also tells where its primary is. When a broker is
+// lost the publish going on is sent once more to the primary found next, and the subscriptions
+// subscribe again, a durable one gets what it did not ack. A fire and forget publish sent as the
+// primary went down is lost, and a PublishSync sent again may be stored twice unless it is
+// server.QoSEffectivelyOnce.
+type Cluster struct {
+	protocol string
+	auth     *Auth
+	opts     []ConnOption
+	spread   bool
+	retry    time.Duration
+	logger   *slog.Logger
+
+	mu sync.Mutex
+	// addrs are the ones given plus the primaries the replicas told about.
+	addrs    []string
+	conns    map[string]*QConn
+	leader   *QConn
+	replicas []*QConn
+	next     int
+	closed   bool
+	quit     chan struct{}
+
+	errs     chan error
+	forwards sync.WaitGroup
+}
+
+var _ Client = (*Cluster)(nil)
+
+// ConnectCluster connects to the primary of the brokers at addrs, and to their replicas with
+// SpreadSubscriptions. Any broker of the cluster is enough to find the primary, the addresses
+// of the others let it go on when one is down.
+func ConnectCluster(protocol string, addrs []string, auth *Auth, opts ...ClusterOption) (*Cluster, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("queuety: a cluster needs an address")
+	}
+
+	c := &Cluster{
+		protocol: protocol,
+		auth:     auth,
+		retry:    defaultFailoverInterval,
+		addrs:    slices.Clone(addrs),
+		conns:    make(map[string]*QConn),
+		quit:     make(chan struct{}),
+		errs:     make(chan error, 100),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	// the logger of the connections, WithLogger included.
+	probe := &QConn{logger: slog.Default()}
+	for _, opt := range c.opts {
+		opt(probe)
+	}
+	c.logger = probe.logger
+
+	if _, err := c.primary(); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func alive(q *QConn) bool {
+	select {
+	case <-q.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// primary is the connection to the primary, found again when it was lost.
+func (c *Cluster) primary() (*QConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, errClusterClosed
+	}
+	if c.leader != nil && alive(c.leader) {
+		return c.leader, nil
+	}
+
+	c.prune()
+	c.discover()
+	if c.leader == nil {
+		return nil, ErrNoPrimary
+	}
+
+	return c.leader, nil
+}
+
+// subscriber is the connection a new subscription goes to, a replica in turns when spreading.
+func (c *Cluster) subscriber() (*QConn, error) {
+	if !c.spread {
+		return c.primary()
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errClusterClosed
+	}
+	c.prune()
+	if len(c.replicas) == 0 {
+		c.discover()
+	}
+	if len(c.replicas) > 0 {
+		q := c.replicas[c.next%len(c.replicas)]
+		c.next++
+		c.mu.Unlock()
+		return q, nil
+	}
+	c.mu.Unlock()
+
+	return c.primary()
+}
+
+// prune lets go of the connections lost, with mu held.
+func (c *Cluster) prune() {
+	for addr, q := range c.conns {
+		if !alive(q) {
+			delete(c.conns, addr)
+		}
+	}
+	if c.leader != nil && !alive(c.leader) {
+		c.leader = nil
+	}
+	c.replicas = slices.DeleteFunc(c.replicas, func(q *QConn) bool { return !alive(q) })
+}
+
+// discover connects to the brokers not connected yet until it has a primary, and the replicas
+// too when spreading. The primary a replica tells about is tried as well. It runs with mu held.
+func (c *Cluster) discover() {
+	for i := 0; i < len(c.addrs); i++ {
+		if c.leader != nil && !c.spread {
+			return
+		}
+
+		addr := c.addrs[i]
+		if _, ok := c.conns[addr]; ok {
+			continue
+		}
+
+		q, err := Connect(c.protocol, addr, c.auth, c.opts...)
+		if err != nil {
+			c.logger.Debug("broker of the cluster unreachable", "addr", addr, "err", err)
+			continue
+		}
+
+		if q.Role() == server.RoleReplica {
+			if q.primary != "" && !slices.Contains(c.addrs, q.primary) {
+				c.addrs = append(c.addrs, q.primary)
+			}
+			if !c.spread {
+				_ = q.Close()
+				continue
+			}
+			c.replicas = append(c.replicas, q)
+		} else {
+			if c.leader != nil {
+				c.logger.Warn("two primaries in the cluster, keeping the first one", "addr", addr)
+				_ = q.Close()
+				continue
+			}
+			c.leader = q
+		}
+
+		c.conns[addr] = q
+		c.forwards.Add(1)
+		go c.forward(q)
+	}
+}
+
+// forward hands the broker rejections of q to Errors until it is lost.
+func (c *Cluster) forward(q *QConn) {
+	defer c.forwards.Done()
+
+	for err := range q.Errors() {
+		select {
+		case c.errs <- err:
+		default:
+			c.logger.Warn("errors channel full, dropping", "err", err)
+		}
+	}
+}
+
+// publish runs fn on the primary, and once more on the one found next when it was lost.
+func (c *Cluster) publish(fn func(q *QConn) error) error {
+	q, err := c.primary()
+	if err != nil {
+		return err
+	}
+	if err = fn(q); err == nil || !c.lost(q, err) {
+		return err
+	}
+
+	c.logger.Warn("primary lost, failing over", "err", err)
+	if q, err = c.primary(); err != nil {
+		return err
+	}
+
+	return fn(q)
+}
+
+// lost tells if err comes from the connection to q going down.
+func (c *Cluster) lost(q *QConn, err error) bool {
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) || errors.Is(err, ErrUnsupported) {
+		return false
+	}
+
+	select {
+	case <-q.done:
+		return true
+	case <-time.After(lostWait):
+		return false
+	}
+}
+
+// NewTopic creates the topic on the primary.
+func (c *Cluster) NewTopic(name string, opts ...TopicOption) (server.Topic, error) {
+	var topic server.Topic
+	err := c.publish(func(q *QConn) error {
+		var err error
+		topic, err = q.NewTopic(name, opts...)
+		return err
+	})
+
+	return topic, err
+}
+
+func (c *Cluster) Publish(t server.Topic, msg string) error {
+	return c.publish(func(q *QConn) error { return q.Publish(t, msg) })
+}
+
+func (c *Cluster) PublishJSON(t server.Topic, msg []byte) error {
+	return c.publish(func(q *QConn) error { return q.PublishJSON(t, msg) })
+}
+
+func (c *Cluster) PublishBinary(t server.Topic, msg []byte) error {
+	return c.publish(func(q *QConn) error { return q.PublishBinary(t, msg) })
+}
+
+func (c *Cluster) PublishMessage(pubMsg server.PublishMessage) error {
+	return c.publish(func(q *QConn) error { return q.PublishMessage(pubMsg) })
+}
+
+func (c *Cluster) PublishSync(pubMsg server.PublishMessage) (PublishResult, error) {
+	var result PublishResult
+	err := c.publish(func(q *QConn) error {
+		var err error
+		result, err = q.PublishSync(pubMsg)
+		return err
+	})
+
+	return result, err
+}
+
+// Metadata asks the primary how the topic is configured, see QConn.Metadata.
+func (c *Cluster) Metadata(topic server.Topic) (server.TopicMetadata, error) {
+	var md server.TopicMetadata
+	err := c.publish(func(q *QConn) error {
+		var err error
+		md, err = q.Metadata(topic)
+		return err
+	})
+
+	return md, err
+}
+
+// PublishAsync publishes on the primary, a publish lost with it is not sent again.
+func (c *Cluster) PublishAsync(pubMsg server.PublishMessage) <-chan PublishResult {
+	q, err := c.primary()
+	if err != nil {
+		result := make(chan PublishResult, 1)
+		result <- PublishResult{Err: err}
+		return result
+	}
+
+	return q.PublishAsync(pubMsg)
+}
+
+// Consume subscribes on the primary, or on a replica with SpreadSubscriptions, and on another
+// broker of the cluster every time the one it is on is lost. The channel is closed by Close.
+func (c *Cluster) Consume(topic server.Topic, opts ...ConsumeOption) <-chan string {
+	q, err := c.subscriber()
+	if err != nil {
+		c.logger.Error("cannot subscribe", "topic", topic.Name, "err", err)
+		return nil
+	}
+	ch := q.Consume(topic, opts...)
+	if ch == nil {
+		return nil
+	}
+
+	out := make(chan string, newConsumeOptions(opts).outSize(1000))
+	go c.follow(topic, opts, ch, out)
+
+	return out
+}
+
+// follow hands the deliveries of ch to out, subscribing again on the next broker when ch closes.
+func (c *Cluster) follow(topic server.Topic, opts []ConsumeOption, ch <-chan string, out chan<- string) {
+	defer close(out)
+
+	for {
+		for body := range ch {
+			select {
+			case out <- body:
+			case <-c.quit:
+				return
+			}
+		}
+
+		ch = nil
+		for ch == nil {
+			select {
+			case <-c.quit:
+				return
+			case <-time.After(c.retry):
+			}
+
+			q, err := c.subscriber()
+			if err != nil {
+				if errors.Is(err, errClusterClosed) {
+					return
+				}
+				c.logger.Warn("cannot subscribe again", "topic", topic.Name, "err", err)
+				continue
+			}
+			ch = q.Consume(topic, opts...)
+		}
+		c.logger.Info("subscription failed over", "topic", topic.Name)
+	}
+}
+
+// Errors returns the channel where the rejections of every broker are delivered, closed by Close.
+func (c *Cluster) Errors() <-chan error {
+	return c.errs
+}
+
+// Close closes the connections to every broker, every consume channel is closed afterward.
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.quit)
+	conns := c.conns
+	c.conns, c.leader, c.replicas = nil, nil, nil
+	c.mu.Unlock()
+
+	for _, q := range conns {
+		_ = q.Close()
+	}
+	c.forwards.Wait()
+	close(c.errs)
+
+	return nil
+}
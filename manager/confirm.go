@@ -0,0 +1,123 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tomiok/queuety/server"
+)
+
+// confirmTimeout bounds the wait of PublishSync for the broker confirm.
+const confirmTimeout = 5 * time.Second
+
+// dedupAttempts is how often PublishSync sends a server.QoSEffectivelyOnce publish not
+// confirmed in time, the broker drops the copies it stored already.
+const dedupAttempts = 3
+
+// PublishResult is the broker confirm of a publish: the id and the seq it stores the message
+// with, the ones found in the ACKs, the logs and the dead letters. Err is set when the broker
+// rejected the message or did not confirm it.
+type PublishResult struct {
+	ID  string
+	Seq uint64
+	Err error
+
+	// reply is the answer to a request other than a publish, see Metadata.
+	reply server.Message
+}
+
+// PublishSync publishes the message and waits for the broker to confirm it. A
+// server.QoSEffectivelyOnce publish not confirmed in time is sent again, a few times.
+func (q *QConn) PublishSync(pubMsg server.PublishMessage) (PublishResult, error) {
+	m, result := q.publishConfirmed(pubMsg)
+	r := q.await("publish", m.ID(), result)
+
+	level, _ := pubMsg.Level()
+	for attempt := 1; level == server.QoSEffectivelyOnce && errors.Is(r.Err, os.ErrDeadlineExceeded) && attempt < dedupAttempts; attempt++ {
+		q.logger.Warn("publish not confirmed, sending it again", "id", m.ID(), "attempt", attempt+1)
+		r = q.await("publish", m.ID(), q.sendConfirmed(m))
+	}
+
+	return r, r.Err
+}
+
+// await waits for the broker to answer the frame id, confirmTimeout at most.
+func (q *QConn) await(what, id string, result <-chan PublishResult) PublishResult {
+	select {
+	case r := <-result:
+		return r
+	case <-time.After(confirmTimeout):
+		err := fmt.Errorf("queuety: %s not confirmed within %s: %w", what, confirmTimeout, os.ErrDeadlineExceeded)
+		q.confirm(id, PublishResult{ID: id, Err: err})
+		return PublishResult{ID: id, Err: err}
+	}
+}
+
+// PublishAsync publishes the message, the channel receives the broker confirm once it comes.
+func (q *QConn) PublishAsync(pubMsg server.PublishMessage) <-chan PublishResult {
+	_, result := q.publishConfirmed(pubMsg)
+	return result
+}
+
+func (q *QConn) publishConfirmed(pubMsg server.PublishMessage) (server.Message, <-chan PublishResult) {
+	result := make(chan PublishResult, 1)
+	if err := q.requires(server.FeaturePublishConfirms); err != nil {
+		result <- PublishResult{Err: err}
+		return server.Message{}, result
+	}
+
+	if level, _ := pubMsg.Level(); level == server.QoSAtMostOnce {
+		result <- PublishResult{Err: errors.New("queuety: a fire and forget publish is not confirmed")}
+		return server.Message{}, result
+	}
+
+	m, err := q.newPublish(pubMsg)
+	if err != nil {
+		result <- PublishResult{Err: err}
+		return server.Message{}, result
+	}
+
+	return m, q.sendConfirmed(m)
+}
+
+// sendConfirmed writes the publish, the channel receives its confirm.
+func (q *QConn) sendConfirmed(m server.Message) <-chan PublishResult {
+	result := make(chan PublishResult, 1)
+	q.confirmsMu.Lock()
+	q.confirms[m.ID()] = result
+	q.confirmsMu.Unlock()
+
+	if err := q.qWrite(m); err != nil {
+		q.confirm(m.ID(), PublishResult{ID: m.ID(), Err: err})
+	}
+
+	return result
+}
+
+// confirm hands the result to the publish waiting for it, it tells if there was one.
+func (q *QConn) confirm(id string, r PublishResult) bool {
+	q.confirmsMu.Lock()
+	result, ok := q.confirms[id]
+	delete(q.confirms, id)
+	q.confirmsMu.Unlock()
+
+	if ok {
+		result <- r
+	}
+
+	return ok
+}
+
+// closeConfirms fails the publishes still waiting once the connection is gone.
+func (q *QConn) closeConfirms() {
+	q.confirmsMu.Lock()
+	defer q.confirmsMu.Unlock()
+
+	for id, result := range q.confirms {
+		result <- PublishResult{ID: id, Err: net.ErrClosed}
+		delete(q.confirms, id)
+	}
+}
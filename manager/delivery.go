@@ -0,0 +1,212 @@
+package manager
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/tomiok/queuety/server"
+)
+
+// Delivery is a message as the broker delivered it, with what a consumer needs to process it
+// once and to debug it. It stays unacked, and is delivered again, until Ack or Nack is called.
+type Delivery struct {
+	ID    string
+	Topic server.Topic
+	// Timestamp is when the message was published, to the second.
+	Timestamp time.Time
+	Headers   map[string]string
+	Key       string
+	Seq       uint64
+	// Attempts are the deliveries the broker counted before this one, Redelivered is set on a
+	// message the broker delivers again. Against a broker without FeatureRedelivered it is
+	// guessed from Attempts, which counts the stores of a message too.
+	Attempts    int
+	Redelivered bool
+	Body        []byte
+
+	q   *QConn
+	msg server.Message
+}
+
+func newDelivery(q *QConn, msg server.Message) Delivery {
+	redelivered := msg.Redelivered()
+	if !q.Supports(server.FeatureRedelivered) {
+		redelivered = msg.Attempts() > 0
+	}
+
+	return Delivery{
+		ID:          msg.ID(),
+		Topic:       msg.Topic(),
+		Timestamp:   time.Unix(msg.Timestamp(), 0),
+		Headers:     msg.Headers(),
+		Key:         msg.Key(),
+		Seq:         msg.Seq(),
+		Attempts:    msg.Attempts(),
+		Redelivered: redelivered,
+		Body:        msg.Body(),
+		q:           q,
+		msg:         msg,
+	}
+}
+
+// Ack tells the broker the message is processed.
+func (d Delivery) Ack() error {
+	return d.q.writeMessage(ackOf(d.msg))
+}
+
+// Nack hands the message back to the broker, which delivers it again right away until it
+// runs out of attempts and goes to the dead letters.
+func (d Delivery) Nack() error {
+	if err := d.q.requires(server.FeatureNack); err != nil {
+		return err
+	}
+
+	// echoed whole, the broker stores it again with the attempt counted.
+	m := server.NewMessageBuilder().
+		WithID(d.msg.ID()).
+		WithNextID(d.msg.NextID()).
+		WithUser(d.msg.User()).
+		WithTopic(d.msg.Topic()).
+		WithBody(d.msg.Body()).
+		WithTimestamp(d.msg.Timestamp()).
+		WithAttempts(d.msg.Attempts()).
+		WithSeq(d.msg.Seq()).
+		WithTTL(d.msg.TTL()).
+		WithKey(d.msg.Key()).
+		WithHeaders(d.msg.Headers()).
+		WithType(server.MessageTypeNack).
+		Build()
+
+	return d.q.writeMessage(m)
+}
+
+// ExtendAckDeadline tells the broker the message is still being processed, it is not delivered
+// again for the extension, a minute when 0 and ten at most. A long handler calls it again
+// before the extension runs out.
+func (d Delivery) ExtendAckDeadline(extension time.Duration) error {
+	if err := d.q.requires(server.FeatureAckExtension); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(server.AckExtension{Seconds: int(extension / time.Second)})
+	if err != nil {
+		return err
+	}
+
+	m := server.NewMessageBuilder().
+		WithID(d.msg.ID()).
+		WithNextID(d.msg.NextID()).
+		WithTopic(d.msg.Topic()).
+		WithSeq(d.msg.Seq()).
+		WithBody(body).
+		WithTimestamp(time.Now().Unix()).
+		WithType(server.MessageTypeInProgress).
+		Build()
+
+	return d.q.writeMessage(m)
+}
+
+// ConsumeMessages subscribes to the topic as Consume does, keeping what the broker sent with
+// every message. Nothing is acked for the caller, every Delivery needs its Ack or Nack.
+func ConsumeMessages(q *QConn, topic server.Topic, opts ...ConsumeOption) <-chan Delivery {
+	ch, err := q.consumeMessages(topic, newConsumeOptions(opts))
+	if err != nil {
+		q.logger.Error("cannot subscribe", "topic", topic.Name, "err", err)
+		return nil
+	}
+
+	return ch
+}
+
+func (q *QConn) consumeMessages(topic server.Topic, o consumeOptions) (<-chan Delivery, error) {
+	sub := q.register(topic, o)
+	if err := q.subscribe(topic, o); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Delivery, o.outSize(1000))
+	go func() {
+		defer close(ch)
+		for msg := range sub.ch {
+			ch <- newDelivery(q, msg)
+			sub.taken(msg)
+		}
+	}()
+
+	return ch, nil
+}
+
+// Batch is a frame of deliveries of a subscription made by ConsumeBatches, acked at once.
+type Batch struct {
+	Deliveries []Delivery
+
+	q     *QConn
+	frame server.Message
+}
+
+func newBatch(q *QConn, frame server.Message) (Batch, bool) {
+	messages, ok := frame.Batch()
+	if !ok {
+		// a redelivery may come on its own, a batch of one.
+		if frame.Type() == server.MessageTypeBatch {
+			return Batch{}, false
+		}
+		return Batch{Deliveries: []Delivery{newDelivery(q, frame)}, q: q, frame: frame}, true
+	}
+
+	b := Batch{Deliveries: make([]Delivery, len(messages)), q: q, frame: frame}
+	for i, msg := range messages {
+		b.Deliveries[i] = newDelivery(q, msg)
+	}
+	return b, true
+}
+
+// Ack tells the broker every message of the batch is processed, a single frame whatever the
+// size. The deliveries can still be acked or nacked one by one instead.
+func (b Batch) Ack() error {
+	if b.frame.Type() != server.MessageTypeBatch {
+		return b.Deliveries[0].Ack()
+	}
+
+	m := server.NewMessageBuilder().
+		WithID(b.frame.ID()).
+		WithNextID(b.frame.NextID()).
+		WithTopic(b.frame.Topic()).
+		WithBody(b.frame.Body()).
+		WithTimestamp(time.Now().Unix()).
+		WithType(server.MessageTypeBatchAck).
+		Build()
+
+	return b.q.writeMessage(m)
+}
+
+// ConsumeBatches subscribes to the topic asking the broker for BATCH frames of up to size
+// messages, it sends a batch once full or a few milliseconds after its first message. Nothing
+// is acked for the caller, every Batch needs its Ack.
+func ConsumeBatches(q *QConn, topic server.Topic, size int, opts ...ConsumeOption) <-chan Batch {
+	o := newConsumeOptions(opts)
+	o.batchSize = size
+
+	sub := q.register(topic, o)
+	if err := q.subscribe(topic, o); err != nil {
+		q.logger.Error("cannot subscribe", "topic", topic.Name, "err", err)
+		return nil
+	}
+
+	ch := make(chan Batch, o.outSize(100))
+	go func() {
+		defer close(ch)
+		for msg := range sub.ch {
+			b, ok := newBatch(q, msg)
+			if !ok {
+				sub.taken(msg)
+				q.logger.Warn("invalid batch", "id", msg.ID())
+				continue
+			}
+			ch <- b
+			sub.taken(msg)
+		}
+	}()
+
+	return ch
+}
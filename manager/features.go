@@ -0,0 +1,130 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/tomiok/queuety/internal/bufpool"
+	"github.com/tomiok/queuety/server"
+)
+
+// ErrUnsupported is returned for the operations the broker did not agree on with HELLO.
+var ErrUnsupported = errors.New("queuety: not supported by the broker")
+
+// helloTimeout bounds the wait for the answer to HELLO, a broker not answering in time is
+// treated as one predating the negotiation.
+const helloTimeout = 2 * time.Second
+
+const defaultClientName = "queuety-go"
+
+// legacyFeatures are the ones of the brokers predating the negotiation, a feature added
+// since has to be negotiated before it is used.
+var legacyFeatures = []string{
+	server.FeatureBinary,
+	server.FeatureDurable,
+	server.FeatureErrorFrames,
+	server.FeatureManualAck,
+	server.FeatureTransientTopics,
+}
+
+// clientFeatures are the features this client offers to the broker.
+var clientFeatures = append([]string{
+	server.FeatureAckExtension,
+	server.FeatureAutoDelete,
+	server.FeatureBatches,
+	server.FeatureCompactedTopics,
+	server.FeatureDedup,
+	server.FeatureDeliveryRate,
+	server.FeatureExclusiveTopics,
+	server.FeatureFireAndForget,
+	server.FeatureHeaders,
+	server.FeatureMessageKeys,
+	server.FeatureMetadata,
+	server.FeatureNack,
+	server.FeaturePublishConfirms,
+	server.FeatureQueueTopics,
+	server.FeatureRedelivered,
+	server.FeatureTransactions,
+	server.FeatureVisibilityTimeout,
+}, legacyFeatures...)
+
+// Supports reports whether the broker agreed on the feature, see server.Features. Against a
+// broker predating the negotiation it is true for the features of legacyFeatures.
+func (q *QConn) Supports(feature string) bool {
+	if q.features == nil {
+		return slices.Contains(legacyFeatures, feature)
+	}
+
+	return slices.Contains(q.features, feature)
+}
+
+// Role is the one the broker told in its HELLO, see server.RolePrimary. A broker not telling
+// it is a primary.
+func (q *QConn) Role() string {
+	if q.role == "" {
+		return server.RolePrimary
+	}
+
+	return q.role
+}
+
+// requires fails with ErrUnsupported when the broker did not agree on the feature.
+func (q *QConn) requires(feature string) error {
+	if !q.Supports(feature) {
+		return fmt.Errorf("%w: %s", ErrUnsupported, feature)
+	}
+
+	return nil
+}
+
+// negotiate reads the answer to HELLO. An ERROR, a timeout or anything else leaves the
+// features unset, the broker is one not knowing HELLO or not negotiating.
+func (q *QConn) negotiate(conn net.Conn) error {
+	if err := conn.SetReadDeadline(time.Now().Add(helloTimeout)); err != nil {
+		return err
+	}
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	var header [5]byte
+	format, payload, err := readFrame(conn, &header, q.logger)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			q.logger.Debug("broker did not answer hello, negotiation skipped")
+			return nil
+		}
+		return err
+	}
+	if payload == nil {
+		return nil
+	}
+
+	reply, err := decodeFrame(format, payload)
+	bufpool.Put(payload)
+	if err != nil {
+		return err
+	}
+
+	if reply.Type() != server.MessageTypeHello {
+		q.logger.Debug("broker does not negotiate features", "reply", reply.Type())
+		return nil
+	}
+
+	var hello server.BrokerHello
+	if err = json.Unmarshal(reply.Body(), &hello); err != nil {
+		return fmt.Errorf("invalid hello reply: %w", err)
+	}
+
+	q.features = hello.Features
+	if q.features == nil {
+		q.features = []string{}
+	}
+	q.role, q.primary = hello.Role, hello.Primary
+	q.logger.Debug("features negotiated", "broker_version", hello.Version, "role", hello.Role, "features", q.features)
+
+	return nil
+}
@@ -5,12 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/tomiok/queuety/internal/bufpool"
 	"github.com/tomiok/queuety/server"
 )
 
@@ -24,6 +26,29 @@ const (
 type QConn struct {
 	c             net.Conn
 	defaultFormat MessageFormat
+
+	// writeMu keeps ACKs sent from consumer goroutines from interleaving with publishes.
+	writeMu sync.Mutex
+
+	subsMu sync.Mutex
+	subs   map[string]*subscription
+	errs   chan error
+
+	// confirms are the publishes of PublishAsync waiting for the broker, by message id.
+	confirmsMu sync.Mutex
+	confirms   map[string]chan PublishResult
+
+	// client is sent with HELLO once connected, along with clientFeatures.
+	client *server.ClientInfo
+	// features are the ones agreed with the broker, nil when it did not negotiate.
+	features []string
+	// role and primary are told by the broker in its HELLO, see Role.
+	role    string
+	primary string
+	// done is closed once the connection is lost or closed.
+	done chan struct{}
+
+	logger *slog.Logger
 }
 
 type Auth struct {
@@ -31,15 +56,32 @@ type Auth struct {
 	Pass string
 }
 
-func Connect(protocol, addr string, auth *Auth) (*QConn, error) {
-	conn, err := net.Dial(protocol, addr)
+// Connect opens a connection to the broker at addr. A comma separated list of addresses is
+// tried in order, the first broker answering is the one connected to, see ConnectCluster for
+// one following the primary.
+func Connect(protocol, addr string, auth *Auth, opts ...ConnOption) (*QConn, error) {
+	var conn net.Conn
+	var err error
+	for _, a := range strings.Split(addr, ",") {
+		if conn, err = net.Dial(protocol, strings.TrimSpace(a)); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	qConn := QConn{
+	qConn := &QConn{
 		c:             conn,
 		defaultFormat: FormatJSON, // Default to JSON for backward compatibility
+		subs:          make(map[string]*subscription),
+		errs:          make(chan error, 100),
+		confirms:      make(map[string]chan PublishResult),
+		done:          make(chan struct{}),
+		logger:        slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(qConn)
 	}
 
 	if auth != nil {
@@ -56,42 +98,130 @@ func Connect(protocol, addr string, auth *Auth) (*QConn, error) {
 			return nil, err
 		}
 
-		// listen to the message back.
-		buff := make([]byte, 1024)
-		n, errRead := conn.Read(buff)
+		// listen to the message back, before the read loop takes over the connection.
+		var header [5]byte
+		format, payload, errRead := readFrame(conn, &header, qConn.logger)
 		if errRead != nil {
 			return nil, errRead
 		}
 
-		msgResponse, err := server.DecodeMessage(buff[:n])
+		msgResponse, err := decodeFrame(format, payload)
+		bufpool.Put(payload)
 		if err != nil {
 			return nil, err
 		}
 
 		if msgResponse.Type() == server.MessageAuthFailed {
+			_ = conn.Close()
 			return nil, errors.New("authentication failed")
 		}
+	}
 
-		return &qConn, nil
+	if err = qConn.hello(); err != nil {
+		_ = conn.Close()
+		return nil, err
 	}
 
-	return &qConn, nil
+	go qConn.readLoop()
+
+	return qConn, nil
 }
 
+// hello identifies the connection and negotiates the features with the broker, before the
+// read loop takes over the connection.
+func (q *QConn) hello() error {
+	info := server.ClientInfo{Name: defaultClientName}
+	if q.client != nil {
+		info = *q.client
+	}
+	info.Features = clientFeatures
+
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	m := server.NewMessageBuilder().
+		WithID(generateNextID()).
+		WithType(server.MessageTypeHello).
+		WithBody(body).
+		WithTimestamp(time.Now().Unix()).
+		Build()
+
+	if err = q.writeMessageWithFormat(m, FormatJSON); err != nil {
+		return err
+	}
+
+	return q.negotiate(q.c)
+}
+
+// Close closes the connection, every consume channel is closed afterward.
+func (q *QConn) Close() error {
+	return q.c.Close()
+}
+
+// SetDefaultFormat chooses the format of the frames, it stays JSON when the broker did not
+// agree on the binary one.
 func (q *QConn) SetDefaultFormat(format MessageFormat) {
+	if format == FormatBinary && !q.Supports(server.FeatureBinary) {
+		q.logger.Warn("broker does not support the binary format, keeping JSON")
+		return
+	}
 	q.defaultFormat = format
 }
 
-func (q *QConn) NewTopic(name string) (server.Topic, error) {
+func (q *QConn) NewTopic(name string, opts ...TopicOption) (server.Topic, error) {
+	var topicOpts server.TopicOptions
+	for _, opt := range opts {
+		opt(&topicOpts)
+	}
+
+	if topicOpts.Class == server.TopicTransient {
+		if err := q.requires(server.FeatureTransientTopics); err != nil {
+			return server.Topic{}, err
+		}
+	}
+	if topicOpts.Class == server.TopicCompacted {
+		if err := q.requires(server.FeatureCompactedTopics); err != nil {
+			return server.Topic{}, err
+		}
+	}
+	if topicOpts.Mode == server.TopicQueue {
+		if err := q.requires(server.FeatureQueueTopics); err != nil {
+			return server.Topic{}, err
+		}
+	}
+	if topicOpts.Mode == server.TopicExclusive {
+		if err := q.requires(server.FeatureExclusiveTopics); err != nil {
+			return server.Topic{}, err
+		}
+	}
+	if topicOpts.AutoDeleteAfter > 0 {
+		if err := q.requires(server.FeatureAutoDelete); err != nil {
+			return server.Topic{}, err
+		}
+	}
+	if topicOpts.VisibilityTimeout > 0 {
+		if err := q.requires(server.FeatureVisibilityTimeout); err != nil {
+			return server.Topic{}, err
+		}
+	}
+
+	body, err := json.Marshal(topicOpts)
+	if err != nil {
+		return server.Topic{}, err
+	}
+
 	m := server.NewMessageBuilder().
 		WithID(uuid.NewString()).
 		WithType(server.MessageTypeNewTopic).
 		WithTopic(server.NewTopic(name)).
+		WithBody(body).
 		WithTimestamp(time.Now().Unix()).
 		WithAck(false).
 		Build()
 
-	err := q.qWrite(m)
+	err = q.qWrite(m)
 	if err != nil {
 		return server.Topic{}, err
 	}
@@ -102,19 +232,65 @@ func (q *QConn) NewTopic(name string) (server.Topic, error) {
 }
 
 func (q *QConn) PublishMessage(pubMsg server.PublishMessage) error {
-	nextID := generateNextID()
+	m, err := q.newPublish(pubMsg)
+	if err != nil {
+		return err
+	}
 
-	m := server.NewMessageBuilder().
+	return q.qWrite(m)
+}
+
+func (q *QConn) newPublish(pubMsg server.PublishMessage) (server.Message, error) {
+	if err := q.checkPublish(pubMsg); err != nil {
+		return server.Message{}, err
+	}
+	level, _ := pubMsg.Level()
+
+	nextID := pubMsg.ID
+	if nextID == "" {
+		nextID = generateNextID()
+	}
+
+	return server.NewMessageBuilder().
 		WithID(generateID(server.MsgPrefixFalse, nextID)).
 		WithNextID(nextID).
 		WithType(server.MessageTypeNew).
 		WithTopic(pubMsg.Topic).
 		WithBody(pubMsg.Body).
 		WithTimestamp(time.Now().Unix()).
+		WithTTL(pubMsg.TTL).
+		WithKey(pubMsg.Key).
+		WithHeaders(pubMsg.Headers).
+		WithFireAndForget(level == server.QoSAtMostOnce).
+		WithDedup(level == server.QoSEffectivelyOnce).
 		WithAck(false).
-		Build()
+		Build(), nil
+}
 
-	return q.qWrite(m)
+// checkPublish fails for the fields of the message the broker did not agree on.
+func (q *QConn) checkPublish(pubMsg server.PublishMessage) error {
+	if pubMsg.Key != "" {
+		if err := q.requires(server.FeatureMessageKeys); err != nil {
+			return err
+		}
+	}
+	if len(pubMsg.Headers) > 0 {
+		if err := q.requires(server.FeatureHeaders); err != nil {
+			return err
+		}
+	}
+	level, err := pubMsg.Level()
+	if err != nil {
+		return err
+	}
+	switch level {
+	case server.QoSAtMostOnce:
+		return q.requires(server.FeatureFireAndForget)
+	case server.QoSEffectivelyOnce:
+		return q.requires(server.FeatureDedup)
+	}
+
+	return nil
 }
 
 func (q *QConn) Publish(t server.Topic, msg string) error {
@@ -150,6 +326,10 @@ func (q *QConn) PublishJSON(t server.Topic, msg []byte) error {
 }
 
 func (q *QConn) PublishBinary(t server.Topic, msg []byte) error {
+	if err := q.requires(server.FeatureBinary); err != nil {
+		return err
+	}
+
 	nextID := generateNextID()
 
 	m := server.NewMessageBuilder().
@@ -168,78 +348,62 @@ func (q *QConn) PublishBinary(t server.Topic, msg []byte) error {
 // ConsumeJSON will be used for type-safety. Is a generic function.
 // Both publish types has the ergonomics to send body as JSON and the string representation.
 // In this case, is just easier to reuse or replicate the JSON structure.
-func ConsumeJSON[T any](q *QConn, topic server.Topic) <-chan T {
-	return consumeJSONWithFraming[T](q, topic)
+func ConsumeJSON[T any](c Consumer, topic server.Topic, opts ...ConsumeOption) <-chan T {
+	if q, ok := c.(*QConn); ok {
+		return consumeJSONWithFraming[T](q, topic, newConsumeOptions(opts))
+	}
+
+	return decodeJSON[T](c.Consume(topic, opts...))
 }
 
-func consumeJSONWithFraming[T any](q *QConn, topic server.Topic) <-chan T {
-	if err := q.subscribe(topic); err != nil {
-		log.Printf("cannot sub %v\n", err)
+// decodeJSON unmarshals the bodies of a Consumer other than QConn, a mock most of the time.
+func decodeJSON[T any](bodies <-chan string) <-chan T {
+	if bodies == nil {
 		return nil
 	}
 
 	ch := make(chan T, 1000)
-
 	go func() {
 		defer close(ch)
 
-		for {
-			// read format flag (1 byte) -> maybe we need this in the future.
-			//formatBuff := make([]byte, 1)
-			//_, err := io.ReadFull(q.c, formatBuff)
-			//if err != nil {
-			//	if err == io.EOF {
-			//		log.Println("connection closed")
-			//		return
-			//	}
-			//	log.Printf("cannot read format flag: %v\n", err)
-			//	continue
-			//}
-
-			// read length (4 bytes little endian)
-			lengthBuff := make([]byte, 5)
-			_, err := io.ReadFull(q.c, lengthBuff)
-			if err != nil {
-				log.Printf("cannot read message length: %v\n", err)
+		for body := range bodies {
+			var t T
+			if err := json.Unmarshal([]byte(body), &t); err != nil {
+				slog.Warn("unable to unmarshal body", "err", err)
 				continue
 			}
 
-			// skip format flag (1 byte), read until 5th byte.
-			messageLength := binary.LittleEndian.Uint32(lengthBuff[1:5])
+			ch <- t
+		}
+	}()
 
-			// safety check
-			if messageLength > 10*1024*1024 { // 10MB max
-				log.Printf("message too large: %d bytes, discarding\n", messageLength)
-				_, _ = io.CopyN(io.Discard, q.c, int64(messageLength))
-				continue
-			}
+	return ch
+}
 
-			// read payload
-			payload := make([]byte, messageLength)
-			_, err = io.ReadFull(q.c, payload)
-			if err != nil {
-				log.Printf("cannot read payload: %v\n", err)
-				continue
-			}
+func consumeJSONWithFraming[T any](q *QConn, topic server.Topic, o consumeOptions) <-chan T {
+	sub := q.register(topic, o)
+	if err := q.subscribe(topic, o); err != nil {
+		q.logger.Error("cannot subscribe", "topic", topic.Name, "err", err)
+		return nil
+	}
 
-			// 5. Decodificar según formato
-			var msg server.Message
+	ch := make(chan T, o.outSize(1000))
 
-			msg, err = server.DecodeMessage(payload)
-			if err != nil {
-				log.Printf("cannot decode JSON message: %v\n", err)
-				continue
-			}
+	go func() {
+		defer close(ch)
 
-			// 6. Unmarshal body
+		for msg := range sub.ch {
+			// Unmarshal body
 			var t T
-			if err = json.Unmarshal(msg.Body(), &t); err != nil {
-				log.Printf("unable to unmarshal body: %v\n", err)
+			if err := json.Unmarshal(msg.Body(), &t); err != nil {
+				sub.taken(msg)
+				q.logger.Warn("unable to unmarshal body", "id", msg.ID(), "err", err)
 				continue
 			}
 
 			ch <- t
-			q.updateMessage(msg)
+			sub.taken(msg)
+			q.autoAck(msg, o)
 		}
 	}()
 
@@ -250,79 +414,71 @@ func consumeJSONWithFraming[T any](q *QConn, topic server.Topic) <-chan T {
 // Both publish types has the ergonomics to send body as JSON and the string representation.
 // Consumer must be aware of which type is the publisher sending but is split in diff methods for simplicity and
 // will be compatible in the future if any change is included.
-// Replace the existing Consume function in manager.go with this:
-func Consume(q *QConn, topic server.Topic) <-chan string {
-	if err := q.subscribe(topic); err != nil {
-		log.Printf("cannot sub %v\n", err)
+func Consume(c Consumer, topic server.Topic, opts ...ConsumeOption) <-chan string {
+	return c.Consume(topic, opts...)
+}
+
+// Consume is the method form of the Consume function, for the code holding a Consumer.
+func (q *QConn) Consume(topic server.Topic, opts ...ConsumeOption) <-chan string {
+	o := newConsumeOptions(opts)
+	sub := q.register(topic, o)
+	if err := q.subscribe(topic, o); err != nil {
+		q.logger.Error("cannot subscribe", "topic", topic.Name, "err", err)
 		return nil
 	}
 
-	ch := make(chan string, 1000)
+	ch := make(chan string, o.outSize(1000))
 	go func() {
 		defer close(ch)
-		for {
-			// Read format flag (1 byte)
-			formatBuff := make([]byte, 1)
-			_, err := io.ReadFull(q.c, formatBuff)
-			if err != nil {
-				log.Printf("cannot read format flag %v \n", err)
-				continue
-			}
-			format := MessageFormat(formatBuff[0])
-			fmt.Printf("DEBUG: Format flag = %d\n", format)
-
-			// Read length (4 bytes)
-			lengthBuff := make([]byte, 4)
-			_, err = io.ReadFull(q.c, lengthBuff)
-			if err != nil {
-				log.Printf("cannot read message length %v \n", err)
-				continue
-			}
-			messageLength := binary.LittleEndian.Uint32(lengthBuff)
-			fmt.Printf("DEBUG: Message length = %d\n", messageLength)
-
-			// SAFETY CHECK - prevent huge allocations
-			if messageLength > 10*1024*1024 { // 10MB max
-				log.Printf("Message length too large: %d bytes, skipping\n", messageLength)
-				continue
-			}
-
-			// Always process as binary (no format check)
-
-			// Read payload
-			payload := make([]byte, messageLength)
-			fmt.Printf("DEBUG: About to read payload of %d bytes\n", messageLength)
-			_, err = io.ReadFull(q.c, payload)
-			if err != nil {
-				log.Printf("cannot read message payload %v \n", err)
-				continue
-			}
-			fmt.Printf("DEBUG: Successfully read payload\n")
-
-			// Unmarshal binary message
-			msg := server.Message{}
-			err = msg.UnmarshalBinary(payload)
-			if err != nil {
-				log.Printf("cannot unmarshal binary message %v \n", err)
-				continue
-			}
-
-			fmt.Printf("DEBUG: Unmarshaled message: %+v\n", msg)
+		for msg := range sub.ch {
 			ch <- msg.BodyString()
-			q.updateMessage(msg)
+			sub.taken(msg)
+			q.autoAck(msg, o)
 		}
 	}()
 
 	return ch
 }
 
-func (q *QConn) subscribe(t server.Topic) error {
+func (q *QConn) subscribe(t server.Topic, o consumeOptions) error {
+	if o.durable != "" {
+		if err := q.requires(server.FeatureDurable); err != nil {
+			return err
+		}
+	}
+
+	if o.maxRate > 0 {
+		if err := q.requires(server.FeatureDeliveryRate); err != nil {
+			return err
+		}
+	}
+	if o.batchSize > 0 {
+		if err := q.requires(server.FeatureBatches); err != nil {
+			return err
+		}
+	}
+	if o.noAck {
+		if err := q.requires(server.FeatureFireAndForget); err != nil {
+			return err
+		}
+	}
+
+	var body []byte
+	if o.maxRate > 0 || o.batchSize > 0 || o.noAck {
+		var err error
+		if body, err = json.Marshal(server.SubscribeOptions{MaxRate: o.maxRate, BatchSize: o.batchSize, NoAck: o.noAck}); err != nil {
+			return err
+		}
+	}
+
 	id := generateNextID()
 	m := server.NewMessageBuilder().
 		WithID(id).
 		WithNextID(id).
 		WithType(server.MessageTypeNewSubscriber).
 		WithTopic(t).
+		WithSubscriber(o.durable).
+		WithBody(body).
 		WithTimestamp(time.Now().UnixMilli()).
 		WithAck(false).
 		Build()
@@ -334,8 +490,24 @@ func (q *QConn) unsubscribe() error {
 	return nil
 }
 
+// autoAck acks a message handed to a Consume, unless nothing waits for its ACK.
+func (q *QConn) autoAck(msg server.Message, o consumeOptions) {
+	if o.noAck || msg.FireAndForget() {
+		return
+	}
+
+	q.updateMessage(msg)
+}
+
 func (q *QConn) updateMessage(msg server.Message) {
-	m := server.NewMessageBuilder().
+	if err := q.writeMessage(ackOf(msg)); err != nil {
+		q.logger.Error("cannot send ACK confirmation", "id", msg.ID(), "err", err)
+	}
+}
+
+// ackOf is the ACK of a delivery, echoing it.
+func ackOf(msg server.Message) server.Message {
+	return server.NewMessageBuilder().
 		WithID(msg.ID()).
 		WithNextID(msg.NextID()).
 		WithUser(msg.User()).
@@ -344,13 +516,11 @@ func (q *QConn) updateMessage(msg server.Message) {
 		WithBody(msg.Body()).
 		WithTimestamp(msg.Timestamp()).
 		WithAttempts(msg.Attempts()).
+		WithSeq(msg.Seq()).
+		WithFireAndForget(msg.FireAndForget()).
 		WithType(server.MessageTypeACK).
 		WithAck(true).
 		Build()
-
-	if err := q.writeMessage(m); err != nil {
-		log.Printf("cannot send ACK confirmation, message id %s \n", msg.ID())
-	}
 }
 
 func (q *QConn) qWrite(m server.Message) error {
@@ -378,19 +548,16 @@ func (q *QConn) writeMessageWithFormat(m server.Message, format MessageFormat) e
 		return err
 	}
 
-	// Write format flag (1 byte)
-	if err = binary.Write(q.c, binary.LittleEndian, format); err != nil {
-		return err
-	}
+	// format flag (1 byte) + length (4 bytes) + payload, one writev without copying the payload.
+	var header [5]byte
+	header[0] = byte(format)
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(payload)))
+	frame := net.Buffers{header[:], payload}
 
-	// Write length (4 bytes)
-	length := uint32(len(payload))
-	if err = binary.Write(q.c, binary.LittleEndian, length); err != nil {
-		return err
-	}
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
 
-	// Write payload
-	_, err = q.c.Write(payload)
+	_, err = frame.WriteTo(q.c)
 	return err
 }
 
@@ -0,0 +1,225 @@
+// Package managertest provides a Mock implementing the interfaces of the manager package, for
+// unit testing the code that publishes or consumes without a broker.
+package managertest
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tomiok/queuety/manager"
+	"github.com/tomiok/queuety/server"
+)
+
+// consumeBuffer is how many messages a consume channel holds, as the ones of QConn.
+const consumeBuffer = 1000
+
+var errClosed = errors.New("managertest: mock is closed")
+
+// Published is a message recorded by the mock.
+type Published struct {
+	Topic   string
+	Body    []byte
+	Binary  bool
+	TTL     time.Duration
+	Key     string
+	Headers map[string]string
+	// ID and Seq are the ones confirmed to PublishSync and PublishAsync, empty otherwise.
+	ID  string
+	Seq uint64
+}
+
+// Mock records what is published and delivers it to its own consumers of the topic, as a
+// broker with a single connection would. The zero value is not usable, see NewMock.
+type Mock struct {
+	mu        sync.Mutex
+	topics    []string
+	published []Published
+	subs      map[string][]chan string
+	seqs      map[string]uint64
+	errs      chan error
+	failure   error
+	closed    bool
+}
+
+var _ manager.Client = (*Mock)(nil)
+
+// NewMock returns an empty mock.
+func NewMock() *Mock {
+	return &Mock{
+		subs: make(map[string][]chan string),
+		seqs: make(map[string]uint64),
+		errs: make(chan error, 100),
+	}
+}
+
+// NewTopic records the topic.
+func (m *Mock) NewTopic(name string, _ ...manager.TopicOption) (server.Topic, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(); err != nil {
+		return server.Topic{}, err
+	}
+	m.topics = append(m.topics, name)
+
+	return server.NewTopic(name), nil
+}
+
+func (m *Mock) Publish(t server.Topic, msg string) error {
+	_, err := m.publish(Published{Topic: t.Name, Body: []byte(msg)}, false)
+	return err
+}
+
+func (m *Mock) PublishJSON(t server.Topic, msg []byte) error {
+	_, err := m.publish(Published{Topic: t.Name, Body: slices.Clone(msg)}, false)
+	return err
+}
+
+func (m *Mock) PublishBinary(t server.Topic, msg []byte) error {
+	_, err := m.publish(Published{Topic: t.Name, Body: slices.Clone(msg), Binary: true}, false)
+	return err
+}
+
+func (m *Mock) PublishMessage(pubMsg server.PublishMessage) error {
+	_, err := m.publish(published(pubMsg), false)
+	return err
+}
+
+// PublishSync confirms the message at once, with an id and the next seq of its topic.
+func (m *Mock) PublishSync(pubMsg server.PublishMessage) (manager.PublishResult, error) {
+	p, err := m.publish(published(pubMsg), true)
+	return manager.PublishResult{ID: p.ID, Seq: p.Seq, Err: err}, err
+}
+
+// PublishAsync is PublishSync with the result sent on the channel.
+func (m *Mock) PublishAsync(pubMsg server.PublishMessage) <-chan manager.PublishResult {
+	result := make(chan manager.PublishResult, 1)
+	r, _ := m.PublishSync(pubMsg)
+	result <- r
+
+	return result
+}
+
+func published(pubMsg server.PublishMessage) Published {
+	return Published{Topic: pubMsg.Topic.Name, Body: slices.Clone(pubMsg.Body), TTL: pubMsg.TTL, Key: pubMsg.Key, Headers: maps.Clone(pubMsg.Headers)}
+}
+
+func (m *Mock) publish(p Published, confirm bool) (Published, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(); err != nil {
+		return Published{}, err
+	}
+	if confirm {
+		m.seqs[p.Topic]++
+		p.Seq = m.seqs[p.Topic]
+		p.ID = fmt.Sprintf("%s-%s-%d", server.MsgPrefixFalse, p.Topic, p.Seq)
+	}
+	m.published = append(m.published, p)
+	m.deliver(p.Topic, string(p.Body))
+
+	return p, nil
+}
+
+// Consume returns a channel receiving the messages published or delivered to the topic from
+// now on. It is closed by Close.
+func (m *Mock) Consume(topic server.Topic, _ ...manager.ConsumeOption) <-chan string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+
+	ch := make(chan string, consumeBuffer)
+	m.subs[topic.Name] = append(m.subs[topic.Name], ch)
+
+	return ch
+}
+
+// Deliver sends body to the consumers of the topic without recording it as published, as
+// a message coming from another client.
+func (m *Mock) Deliver(topic, body string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.closed {
+		m.deliver(topic, body)
+	}
+}
+
+// deliver blocks while a consumer has consumeBuffer messages pending.
+func (m *Mock) deliver(topic, body string) {
+	for _, ch := range m.subs[topic] {
+		ch <- body
+	}
+}
+
+// Errors returns the errors pushed with PushError.
+func (m *Mock) Errors() <-chan error {
+	return m.errs
+}
+
+// PushError sends err on Errors, as the broker rejecting a message does.
+func (m *Mock) PushError(err error) {
+	select {
+	case m.errs <- err:
+	default:
+	}
+}
+
+// Fail makes NewTopic and the publishes return err, nil makes them succeed again.
+func (m *Mock) Fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.failure = err
+}
+
+// Topics returns the names given to NewTopic.
+func (m *Mock) Topics() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Clone(m.topics)
+}
+
+// Published returns the recorded messages in publish order.
+func (m *Mock) Published() []Published {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Clone(m.published)
+}
+
+// Close closes the consume channels, the mock fails every call afterward.
+func (m *Mock) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
+	for _, subs := range m.subs {
+		for _, ch := range subs {
+			close(ch)
+		}
+	}
+
+	return nil
+}
+
+func (m *Mock) check() error {
+	if m.closed {
+		return errClosed
+	}
+
+	return m.failure
+}
@@ -0,0 +1,50 @@
+package managertest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/tomiok/queuety/manager"
+	"github.com/tomiok/queuety/server"
+)
+
+type order struct {
+	ID int `json:"id"`
+}
+
+// notify stands for application code depending on the interfaces only.
+func notify(p manager.Publisher, t server.Topic, id int) error {
+	return p.PublishJSON(t, fmt.Appendf(nil, `{"id":%d}`, id))
+}
+
+func Test_MockPublishAndConsume(t *testing.T) {
+	m := NewMock()
+	topic, err := m.NewTopic("orders")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	orders := manager.ConsumeJSON[order](m, topic)
+	if err = notify(m, topic, 7); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if o := <-orders; o.ID != 7 {
+		t.Fatalf("expected order 7, got %d", o.ID)
+	}
+	if p := m.Published(); len(p) != 1 || string(p[0].Body) != `{"id":7}` {
+		t.Fatalf("unexpected published messages %v", p)
+	}
+
+	boom := errors.New("boom")
+	m.Fail(boom)
+	if err = notify(m, topic, 8); !errors.Is(err, boom) {
+		t.Fatalf("expected the failure, got %v", err)
+	}
+
+	_ = m.Close()
+	if _, ok := <-orders; ok {
+		t.Fatal("expected the consume channel to be closed")
+	}
+}
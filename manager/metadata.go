@@ -0,0 +1,39 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tomiok/queuety/server"
+)
+
+// Metadata asks the broker how the topic is configured: its class and mode, retention, schema
+// version and last seq, for the code to adapt to it instead of assuming the defaults. A
+// ServerError of code server.ErrCodeUnknownTopic tells there is no such topic.
+func (q *QConn) Metadata(topic server.Topic) (server.TopicMetadata, error) {
+	if err := q.requires(server.FeatureMetadata); err != nil {
+		return server.TopicMetadata{}, err
+	}
+
+	id := generateNextID()
+	m := server.NewMessageBuilder().
+		WithID(id).
+		WithNextID(id).
+		WithType(server.MessageTypeMetadata).
+		WithTopic(topic).
+		WithTimestamp(time.Now().Unix()).
+		Build()
+
+	r := q.await("metadata", id, q.sendConfirmed(m))
+	if r.Err != nil {
+		return server.TopicMetadata{}, r.Err
+	}
+
+	var md server.TopicMetadata
+	if err := json.Unmarshal(r.reply.Body(), &md); err != nil {
+		return server.TopicMetadata{}, fmt.Errorf("queuety: invalid metadata: %w", err)
+	}
+
+	return md, nil
+}
@@ -0,0 +1,166 @@
+package manager
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/tomiok/queuety/server"
+)
+
+// ConsumeOption customizes a subscription created by Consume or ConsumeJSON.
+type ConsumeOption func(*consumeOptions)
+
+type consumeOptions struct {
+	durable string
+	maxRate int
+	// batchSize is set by ConsumeBatches only, the other consumers read one message a frame.
+	batchSize int
+	buffer    int
+	maxBytes  int
+	noAck     bool
+	// retries and retryBackoff are read by ConsumeWorkers only.
+	retries      int
+	retryBackoff time.Duration
+}
+
+// Durable names the subscription. The broker keeps a cursor for the name and, when the
+// subscriber comes back, sends it everything published after its last ACK.
+func Durable(name string) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.durable = name
+	}
+}
+
+// MaxRate asks the broker to deliver at most n messages per second to this subscription, the
+// other subscribers of the topic are not slowed down. The broker may cap it lower.
+func MaxRate(n int) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.maxRate = n
+	}
+}
+
+// BufferSize is how many deliveries the subscription holds before the application takes them,
+// 1000 by default. Past it the connection stops reading until the application catches up.
+func BufferSize(n int) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.buffer = n
+	}
+}
+
+// MaxBufferedBytes bounds the body bytes the subscription holds, whatever their count. Past it the
+// connection stops reading and the broker slows down against it, as with BufferSize, a message
+// larger than n goes through alone. A consumer of large messages is better on its own connection.
+func MaxBufferedBytes(n int) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.maxBytes = n
+	}
+}
+
+// Retry has ConsumeWorkers run a failed handler again up to n times before nacking, waiting
+// backoff before the first retry and twice as long before every next one, a minute at most.
+// A transient error downstream is absorbed without the message going around the broker, its
+// ack deadline is extended through the wait when the broker supports it.
+func Retry(n int, backoff time.Duration) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.retries = n
+		o.retryBackoff = backoff
+	}
+}
+
+// NoAck asks the broker to count every delivery of the subscription as done once written,
+// Consume and ConsumeJSON send no ACK. A message missed while disconnected or lost on the way
+// is not delivered again, for the metrics and the like. A topic only such subscribers listen
+// to stores nothing of what they get.
+func NoAck() ConsumeOption {
+	return func(o *consumeOptions) {
+		o.noAck = true
+	}
+}
+
+// Group joins the consumer group name. Members share one committed position, a member
+// joining while others are connected gets the live flow without the backlog again.
+func Group(name string) ConsumeOption {
+	return Durable(name)
+}
+
+// TopicOption customizes a topic created by NewTopic.
+type TopicOption func(*server.TopicOptions)
+
+// Transient creates the topic out of the broker store, messages are delivered to the
+// connected subscribers only and nothing survives a restart.
+func Transient() TopicOption {
+	return func(o *server.TopicOptions) {
+		o.Class = server.TopicTransient
+	}
+}
+
+// Compacted creates a topic keeping only the latest message of every key, a new subscriber
+// gets them before the live messages. Publish to it with PublishMessage and a Key, an empty
+// or null body deletes the key.
+func Compacted() TopicOption {
+	return func(o *server.TopicOptions) {
+		o.Class = server.TopicCompacted
+	}
+}
+
+// Queue creates a topic delivering every message to one of its subscribers, in turns, instead
+// of all of them. A message a subscriber does not ACK is redelivered to the next one.
+func Queue() TopicOption {
+	return func(o *server.TopicOptions) {
+		o.Mode = server.TopicQueue
+	}
+}
+
+// Exclusive creates a topic delivering the messages to one subscriber at a time, in order,
+// while the others stand by. When it leaves the next one takes over.
+func Exclusive() TopicOption {
+	return func(o *server.TopicOptions) {
+		o.Mode = server.TopicExclusive
+	}
+}
+
+// VisibilityTimeout hides a message of a Queue topic from the other subscribers for d once
+// delivered, a message not acked by then goes to the next one. The broker rounds d up to seconds.
+func VisibilityTimeout(d time.Duration) TopicOption {
+	return func(o *server.TopicOptions) {
+		o.VisibilityTimeout = int64((d + time.Second - 1) / time.Second)
+	}
+}
+
+// AutoDelete deletes the topic with its messages once it had no subscribers and no publishes
+// for d, for the short-lived job topics. The broker rounds d to seconds.
+func AutoDelete(d time.Duration) TopicOption {
+	return func(o *server.TopicOptions) {
+		o.AutoDeleteAfter = int64(d.Round(time.Second) / time.Second)
+	}
+}
+
+// ConnOption customizes a connection created by Connect.
+type ConnOption func(*QConn)
+
+// WithLogger sends the logs of the connection to l instead of slog.Default().
+func WithLogger(l *slog.Logger) ConnOption {
+	return func(q *QConn) {
+		if l != nil {
+			q.logger = l
+		}
+	}
+}
+
+// WithClientInfo identifies the connection to the broker with a name, a version and free
+// labels, shown in its connection listings, stats and logs. Without it the connection is
+// named queuety-go.
+func WithClientInfo(name, version string, labels map[string]string) ConnOption {
+	return func(q *QConn) {
+		q.client = &server.ClientInfo{Name: name, Version: version, Labels: labels}
+	}
+}
+
+func newConsumeOptions(opts []ConsumeOption) consumeOptions {
+	var o consumeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
@@ -0,0 +1,92 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"github.com/tomiok/queuety/server"
+)
+
+// KeyFunc tells the ordering key of a delivery, deliveries of the same key are handled in turn.
+type KeyFunc func(d Delivery) string
+
+// ByKey orders the deliveries by their message key.
+func ByKey() KeyFunc {
+	return func(d Delivery) string {
+		return d.Key
+	}
+}
+
+// ByHeader orders the deliveries by the value of the header name.
+func ByHeader(name string) KeyFunc {
+	return func(d Delivery) string {
+		return d.Headers[name]
+	}
+}
+
+// ByJSONField orders the deliveries by a field of their JSON body, dotted for a nested one as
+// in "customer.id". A body without the field, or not an object, has the empty key.
+func ByJSONField(path string) KeyFunc {
+	fields := strings.Split(path, ".")
+	return func(d Delivery) string {
+		raw := json.RawMessage(d.Body)
+		for _, field := range fields {
+			var object map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &object); err != nil {
+				return ""
+			}
+			raw = object[field]
+		}
+
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			return s
+		}
+		return string(raw)
+	}
+}
+
+// ConsumeOrdered runs handler on n workers as ConsumeWorkers does, the deliveries of one key
+// going to the same worker so that they are handled one after the other, in the order the
+// broker sent them, which is the publish order on an Exclusive topic or for keyed messages to a
+// Durable subscriber. The keys spread over the workers, a slow key holds back the ones sharing
+// its worker only. A nacked delivery comes back after the ones that followed it.
+func ConsumeOrdered(q *QConn, topic server.Topic, n int, key KeyFunc, handler Handler, opts ...ConsumeOption) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid workers %d", n)
+	}
+
+	o := newConsumeOptions(opts)
+	deliveries, err := q.consumeMessages(topic, o)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	queues := make([]chan Delivery, n)
+	for i := range queues {
+		queues[i] = make(chan Delivery, 100)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range queues[i] {
+				q.handle(d, handler, o)
+			}
+		}()
+	}
+
+	for d := range deliveries {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key(d)))
+		queues[h.Sum32()%uint32(n)] <- d
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+
+	return nil
+}
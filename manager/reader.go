@@ -0,0 +1,178 @@
+package manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+
+	"github.com/tomiok/queuety/internal/bufpool"
+	"github.com/tomiok/queuety/server"
+)
+
+// maxFrameSize protects the client from huge allocations, bigger frames are discarded.
+const maxFrameSize = 10 * 1024 * 1024 // 10MB max
+
+// ServerError is an operation rejected by the broker, received through QConn.Errors.
+type ServerError struct {
+	Code        server.ErrorCode
+	Description string
+	MessageID   string
+	Topic       string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("queuety: %s: %s", e.Code, e.Description)
+}
+
+// Errors returns the channel where the broker rejections are delivered. It is closed when
+// the connection is closed. Errors are dropped when nobody drains the channel.
+func (q *QConn) Errors() <-chan error {
+	return q.errs
+}
+
+// readFrame reads one frame: format flag (1 byte), length (4 bytes little endian) and payload.
+// The payload comes from the buffer pool and must be given back with bufpool.Put.
+func readFrame(r io.Reader, header *[5]byte, logger *slog.Logger) (MessageFormat, []byte, error) {
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	format := MessageFormat(header[0])
+	messageLength := binary.LittleEndian.Uint32(header[1:5])
+
+	// safety check
+	if messageLength > maxFrameSize {
+		logger.Warn("message too large, discarding", "bytes", messageLength)
+		if _, err := io.CopyN(io.Discard, r, int64(messageLength)); err != nil {
+			return 0, nil, err
+		}
+		return format, nil, nil
+	}
+
+	payload := bufpool.Get(int(messageLength))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		bufpool.Put(payload)
+		return 0, nil, err
+	}
+
+	return format, payload, nil
+}
+
+func decodeFrame(format MessageFormat, payload []byte) (server.Message, error) {
+	switch format {
+	case FormatJSON:
+		return server.DecodeMessage(payload)
+	case FormatBinary:
+		var msg server.Message
+		err := msg.UnmarshalBinary(payload)
+		return msg, err
+	default:
+		return server.Message{}, fmt.Errorf("unsupported format: %d", format)
+	}
+}
+
+// readLoop is the only reader of the connection. Deliveries go to the subscription of their
+// topic, PUBLISHED to the publish waiting for it and ERROR messages to the errors channel.
+func (q *QConn) readLoop() {
+	defer q.closeSubscriptions()
+
+	var header [5]byte
+	for {
+		format, payload, err := readFrame(q.c, &header, q.logger)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				q.logger.Error("cannot read frame", "err", err)
+			}
+			return
+		}
+
+		if payload == nil {
+			continue
+		}
+
+		msg, err := decodeFrame(format, payload)
+		bufpool.Put(payload)
+		if err != nil {
+			q.logger.Warn("cannot decode message", "err", err)
+			continue
+		}
+
+		q.dispatch(msg)
+	}
+}
+
+func (q *QConn) dispatch(msg server.Message) {
+	if body, ok := msg.ErrorBody(); ok {
+		err := &ServerError{
+			Code:        body.Code,
+			Description: body.Description,
+			MessageID:   body.MessageID,
+			Topic:       msg.Topic().Name,
+		}
+		// the rejection of a confirmed publish goes to its caller only.
+		if !q.confirm(body.MessageID, PublishResult{ID: body.MessageID, Err: err}) {
+			q.pushError(err)
+		}
+		return
+	}
+
+	if msg.Type() == server.MessageTypePublished {
+		// the publishes of Publish and PublishJSON are confirmed too, nobody waits for them.
+		q.confirm(msg.ID(), PublishResult{ID: msg.ID(), Seq: msg.Seq()})
+		return
+	}
+	if msg.Type() == server.MessageTypeMetadata {
+		q.confirm(msg.ID(), PublishResult{ID: msg.ID(), reply: msg})
+		return
+	}
+
+	q.subsMu.Lock()
+	sub, ok := q.subs[msg.Topic().Name]
+	q.subsMu.Unlock()
+
+	if !ok {
+		q.logger.Warn("message without subscription", "topic", msg.Topic().Name)
+		return
+	}
+
+	sub.push(msg)
+}
+
+func (q *QConn) pushError(err error) {
+	select {
+	case q.errs <- err:
+	default:
+		q.logger.Warn("errors channel full, dropping", "err", err)
+	}
+}
+
+func (q *QConn) closeSubscriptions() {
+	q.closeConfirms()
+
+	q.subsMu.Lock()
+	defer q.subsMu.Unlock()
+
+	for name, sub := range q.subs {
+		close(sub.ch)
+		delete(q.subs, name)
+	}
+	close(q.errs)
+	close(q.done)
+}
+
+// register creates the subscription the read loop feeds with deliveries for topic.
+func (q *QConn) register(topic server.Topic, o consumeOptions) *subscription {
+	sub := &subscription{
+		ch:     make(chan server.Message, o.bufferSize()),
+		budget: newByteBudget(o.maxBytes),
+	}
+
+	q.subsMu.Lock()
+	defer q.subsMu.Unlock()
+
+	q.subs[topic.Name] = sub
+	return sub
+}
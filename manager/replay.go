@@ -0,0 +1,29 @@
+package manager
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tomiok/queuety/server"
+)
+
+// ReplayTopic asks the broker to send again the stored messages of the topic, from a seq or a
+// publish time up to the optional to. They arrive on the channel of the existing subscription
+// to the topic, so Consume or ConsumeJSON must be called first.
+func ReplayTopic[P server.Position](q *QConn, topic server.Topic, from P, to ...P) error {
+	body, err := json.Marshal(server.NewReplayRange(from, to...))
+	if err != nil {
+		return err
+	}
+
+	m := server.NewMessageBuilder().
+		WithID(uuid.NewString()).
+		WithType(server.MessageTypeReplay).
+		WithTopic(topic).
+		WithBody(body).
+		WithTimestamp(time.Now().Unix()).
+		Build()
+
+	return q.qWrite(m)
+}
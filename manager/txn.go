@@ -0,0 +1,63 @@
+package manager
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tomiok/queuety/server"
+)
+
+// Commit acks the deliveries and publishes the messages in a single step of the broker, it
+// returns once the broker committed them. It is all or nothing: on an error the deliveries
+// stay unacked and come back and nothing was published, a pipeline going down halfway neither
+// loses its input nor duplicates its output. A ServerError of code server.ErrCodeTxnConflict
+// tells a delivery was acked already, by this consumer or by another one it was redelivered to.
+func (q *QConn) Commit(acks []Delivery, publish ...server.PublishMessage) error {
+	if err := q.requires(server.FeatureTransactions); err != nil {
+		return err
+	}
+	if len(acks) == 0 && len(publish) == 0 {
+		return errors.New("queuety: empty transaction")
+	}
+
+	var topic server.Topic
+	messages := make([]server.Message, len(acks))
+	for i, d := range acks {
+		messages[i] = d.msg
+		topic = d.Topic
+	}
+	for _, p := range publish {
+		if err := q.checkPublish(p); err != nil {
+			return err
+		}
+		if topic.IsEmpty() {
+			topic = p.Topic
+		}
+	}
+
+	body, err := server.EncodeTransaction(messages, publish)
+	if err != nil {
+		return err
+	}
+
+	id := generateNextID()
+	m := server.NewMessageBuilder().
+		WithID(id).
+		WithNextID(id).
+		WithType(server.MessageTypeTxn).
+		WithTopic(topic).
+		WithBody(body).
+		WithTimestamp(time.Now().Unix()).
+		Build()
+
+	result := make(chan PublishResult, 1)
+	q.confirmsMu.Lock()
+	q.confirms[id] = result
+	q.confirmsMu.Unlock()
+
+	if err = q.qWrite(m); err != nil {
+		q.confirm(id, PublishResult{ID: id, Err: err})
+	}
+
+	return q.await("transaction", id, result).Err
+}
@@ -0,0 +1,87 @@
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tomiok/queuety/server"
+)
+
+// maxRetryBackoff bounds the wait between two runs of a handler retried with Retry.
+const maxRetryBackoff = time.Minute
+
+// Handler processes one delivery, an error hands it back to the broker.
+type Handler func(d Delivery) error
+
+// ConsumeWorkers subscribes to the topic as ConsumeMessages does and runs handler on n workers,
+// n deliveries in process at most. A delivery is acked when handler returns nil and nacked when
+// it fails or panics, after the retries of Retry when given, a broker without FeatureNack delivers it again with the next round.
+// It returns once the connection is closed and the workers are done.
+func ConsumeWorkers(q *QConn, topic server.Topic, n int, handler Handler, opts ...ConsumeOption) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid workers %d", n)
+	}
+
+	o := newConsumeOptions(opts)
+	deliveries, err := q.consumeMessages(topic, o)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range deliveries {
+				q.handle(d, handler, o)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// handle runs handler on the delivery, retrying it as o asks, and acks or nacks it with the outcome.
+func (q *QConn) handle(d Delivery, handler Handler, o consumeOptions) {
+	err := runHandler(d, handler)
+	wait := o.retryBackoff
+	for retry := 1; err != nil && retry <= o.retries; retry++ {
+		q.logger.Debug("handler failed, retrying", "id", d.ID, "topic", d.Topic.Name, "retry", retry, "wait", wait, "err", err)
+		if q.Supports(server.FeatureAckExtension) {
+			if extErr := d.ExtendAckDeadline(wait + time.Minute); extErr != nil {
+				q.logger.Warn("cannot extend ack deadline", "id", d.ID, "err", extErr)
+			}
+		}
+
+		time.Sleep(wait)
+		wait = min(wait*2, maxRetryBackoff)
+		err = runHandler(d, handler)
+	}
+
+	if err != nil {
+		q.logger.Warn("handler failed", "id", d.ID, "topic", d.Topic.Name, "attempts", d.Attempts, "err", err)
+		if err = d.Nack(); err != nil {
+			q.logger.Error("cannot send NACK", "id", d.ID, "err", err)
+		}
+		return
+	}
+
+	if err := d.Ack(); err != nil {
+		q.logger.Error("cannot send ACK confirmation", "id", d.ID, "err", err)
+	}
+}
+
+// runHandler turns a panic of handler into its error, one bad message does not take the
+// worker down.
+func runHandler(d Delivery, handler Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+
+	return handler(d)
+}
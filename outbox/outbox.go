@@ -0,0 +1,227 @@
+// Package outbox publishes the rows of an outbox table to queuety, the messages written with
+// Enqueue in the transaction of the change they announce. A message is never published for a
+// change rolled back, nor lost for one committed.
+//
+// The table needs these columns, the id increasing with the inserts:
+//
+//	id            integer primary key, auto-incremented
+//	topic         text not null
+//	msg_key       text
+//	headers       text, a JSON object
+//	body          text not null, JSON
+//	published_at  timestamp
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/tomiok/queuety/manager"
+	"github.com/tomiok/queuety/server"
+)
+
+// IDHeader carries the table and the id of the row a message was published from, as in
+// "queuety_outbox:42". A relay going down between a publish and its mark publishes the row
+// again, consumers drop the ids they processed already.
+const IDHeader = "queuety-outbox-id"
+
+const (
+	defaultTable     = "queuety_outbox"
+	defaultBatchSize = 100
+	defaultInterval  = time.Second
+)
+
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// Config is the table of an Outbox and how it is read.
+type Config struct {
+	// Table is queuety_outbox when empty.
+	Table string
+	// Placeholder is "$" for the numbered parameters of PostgreSQL, "?" otherwise.
+	Placeholder string
+	// BatchSize is how many rows a round publishes at most, 100 when 0.
+	BatchSize int
+	// Interval is the wait of Run between two rounds finding nothing, a second when 0.
+	Interval time.Duration
+	Logger   *slog.Logger
+}
+
+// Execer is what Enqueue inserts with, *sql.Tx is one.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Publisher is what the rows are published with, *manager.QConn is one.
+type Publisher interface {
+	PublishSync(pubMsg server.PublishMessage) (manager.PublishResult, error)
+}
+
+// Outbox writes to and relays from an outbox table.
+type Outbox struct {
+	cfg Config
+}
+
+// New checks the configuration, filling in the defaults.
+func New(cfg Config) (*Outbox, error) {
+	if cfg.Table == "" {
+		cfg.Table = defaultTable
+	}
+	if !tableName.MatchString(cfg.Table) {
+		return nil, fmt.Errorf("outbox: invalid table %q", cfg.Table)
+	}
+	if cfg.Placeholder == "" {
+		cfg.Placeholder = "?"
+	}
+	if cfg.Placeholder != "?" && cfg.Placeholder != "$" {
+		return nil, fmt.Errorf("outbox: invalid placeholder %q", cfg.Placeholder)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	return &Outbox{cfg: cfg}, nil
+}
+
+// arg is the placeholder of the nth parameter of a query, from 1.
+func (o *Outbox) arg(n int) string {
+	if o.cfg.Placeholder == "$" {
+		return "$" + strconv.Itoa(n)
+	}
+
+	return "?"
+}
+
+// Enqueue writes the message to the outbox with tx, the transaction of the change it is about.
+// It is published once tx commits and a relay picks it up.
+func (o *Outbox) Enqueue(ctx context.Context, tx Execer, msg server.PublishMessage) error {
+	if msg.Topic.IsEmpty() {
+		return errors.New("outbox: a message needs a topic")
+	}
+	if !json.Valid(msg.Body) {
+		return errors.New("outbox: the body is not JSON")
+	}
+
+	var headers sql.NullString
+	if len(msg.Headers) > 0 {
+		b, err := json.Marshal(msg.Headers)
+		if err != nil {
+			return err
+		}
+		headers = sql.NullString{String: string(b), Valid: true}
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (topic, msg_key, headers, body) VALUES (%s, %s, %s, %s)",
+		o.cfg.Table, o.arg(1), o.arg(2), o.arg(3), o.arg(4))
+	_, err := tx.ExecContext(ctx, query, msg.Topic.Name, sql.NullString{String: msg.Key, Valid: msg.Key != ""}, headers, string(msg.Body))
+
+	return err
+}
+
+// Run relays the rows of the outbox until ctx is done, a round after the other while there
+// are rows left and every Interval otherwise. A failed round is logged and retried, the rows
+// go out in order. Run one relay per table, two would publish the same rows.
+func (o *Outbox) Run(ctx context.Context, db *sql.DB, pub Publisher) error {
+	for {
+		n, err := o.RelayOnce(ctx, db, pub)
+		if err != nil && ctx.Err() == nil {
+			o.cfg.Logger.Warn("cannot relay outbox", "table", o.cfg.Table, "err", err)
+		}
+
+		if err != nil || n < o.cfg.BatchSize {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(o.cfg.Interval):
+			}
+		}
+	}
+}
+
+// row is an outbox row not published yet.
+type row struct {
+	id      int64
+	topic   string
+	key     sql.NullString
+	headers sql.NullString
+	body    []byte
+}
+
+// RelayOnce publishes up to BatchSize rows not published yet, by id, marking each once the
+// broker confirmed it. It stops at the first failure, returning how many went out.
+func (o *Outbox) RelayOnce(ctx context.Context, db *sql.DB, pub Publisher) (int, error) {
+	rows, err := o.pending(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	mark := fmt.Sprintf("UPDATE %s SET published_at = CURRENT_TIMESTAMP WHERE id = %s", o.cfg.Table, o.arg(1))
+	for i, r := range rows {
+		msg, err := o.message(r)
+		if err != nil {
+			return i, fmt.Errorf("outbox row %d: %w", r.id, err)
+		}
+		if _, err = pub.PublishSync(msg); err != nil {
+			return i, fmt.Errorf("cannot publish outbox row %d: %w", r.id, err)
+		}
+		if _, err = db.ExecContext(ctx, mark, r.id); err != nil {
+			return i, fmt.Errorf("cannot mark outbox row %d: %w", r.id, err)
+		}
+	}
+
+	return len(rows), nil
+}
+
+func (o *Outbox) pending(ctx context.Context, db *sql.DB) ([]row, error) {
+	query := fmt.Sprintf("SELECT id, topic, msg_key, headers, body FROM %s WHERE published_at IS NULL ORDER BY id LIMIT %d",
+		o.cfg.Table, o.cfg.BatchSize)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []row
+	for rows.Next() {
+		var r row
+		if err = rows.Scan(&r.id, &r.topic, &r.key, &r.headers, &r.body); err != nil {
+			return nil, err
+		}
+		pending = append(pending, r)
+	}
+
+	return pending, rows.Err()
+}
+
+// message is the publish of a row, stamped with IDHeader.
+func (o *Outbox) message(r row) (server.PublishMessage, error) {
+	headers := make(map[string]string)
+	if r.headers.Valid && r.headers.String != "" {
+		if err := json.Unmarshal([]byte(r.headers.String), &headers); err != nil {
+			return server.PublishMessage{}, fmt.Errorf("invalid headers: %w", err)
+		}
+	}
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers[IDHeader] = o.cfg.Table + ":" + strconv.FormatInt(r.id, 10)
+
+	return server.PublishMessage{
+		Topic:   server.NewTopic(r.topic),
+		Body:    r.body,
+		Key:     r.key.String,
+		Headers: headers,
+	}, nil
+}
@@ -0,0 +1,172 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tomiok/queuety/manager"
+	"github.com/tomiok/queuety/server"
+)
+
+// table is the outbox of the fake driver, inserts of a transaction land on commit.
+type table struct {
+	mu        sync.Mutex
+	rows      [][]driver.Value
+	published map[int64]bool
+}
+
+type fakeDriver struct{ t *table }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return &fakeConn{t: d.t}, nil }
+
+type fakeConn struct {
+	t       *table
+	pending [][]driver.Value
+	inTx    bool
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { c.inTx = true; return c, nil }
+
+func (c *fakeConn) Commit() error {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	for _, r := range c.pending {
+		c.t.rows = append(c.t.rows, append([]driver.Value{int64(len(c.t.rows) + 1)}, r...))
+	}
+	c.pending, c.inTx = nil, false
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.pending, c.inTx = nil, false
+	return nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO queuety_outbox "):
+		values := make([]driver.Value, len(args))
+		for i, a := range args {
+			values[i] = a.Value
+		}
+		c.pending = append(c.pending, values)
+		if !c.inTx {
+			return driver.RowsAffected(1), c.Commit()
+		}
+	case strings.HasPrefix(query, "UPDATE queuety_outbox SET published_at"):
+		c.t.mu.Lock()
+		c.t.published[args[0].Value.(int64)] = true
+		c.t.mu.Unlock()
+	default:
+		return nil, errors.New("unexpected query " + query)
+	}
+
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT id, topic, msg_key, headers, body FROM queuety_outbox WHERE published_at IS NULL") {
+		return nil, errors.New("unexpected query " + query)
+	}
+
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	rows := &fakeRows{}
+	for _, r := range c.t.rows {
+		if !c.t.published[r[0].(int64)] {
+			rows.rows = append(rows.rows, r)
+		}
+	}
+	return rows, nil
+}
+
+type fakeRows struct{ rows [][]driver.Value }
+
+func (r *fakeRows) Columns() []string { return []string{"id", "topic", "msg_key", "headers", "body"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+type recorder struct {
+	published []server.PublishMessage
+	fail      bool
+}
+
+func (r *recorder) PublishSync(m server.PublishMessage) (manager.PublishResult, error) {
+	if r.fail {
+		return manager.PublishResult{}, errors.New("broker down")
+	}
+	r.published = append(r.published, m)
+	return manager.PublishResult{ID: "false-1"}, nil
+}
+
+func Test_RelayPublishesCommittedRows(t *testing.T) {
+	sql.Register(t.Name(), fakeDriver{t: &table{published: make(map[int64]bool)}})
+	db, err := sql.Open(t.Name(), "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	o, err := New(Config{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ctx := context.Background()
+	orders := server.NewTopic("orders")
+	for i, commit := range []bool{true, false, true} {
+		tx, errTx := db.BeginTx(ctx, nil)
+		if errTx != nil {
+			t.Fatalf("%v", errTx)
+		}
+		msg := server.PublishMessage{Topic: orders, Body: []byte(`{"n":` + strconv.Itoa(i) + `}`), Key: "acc-1", Headers: map[string]string{"source": "billing"}}
+		if err = o.Enqueue(ctx, tx, msg); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	pub := &recorder{fail: true}
+	if n, errRelay := o.RelayOnce(ctx, db, pub); errRelay == nil || n != 0 {
+		t.Fatalf("expected the round to stop at the failed publish, got %d %v", n, errRelay)
+	}
+
+	pub.fail = false
+	if n, errRelay := o.RelayOnce(ctx, db, pub); errRelay != nil || n != 2 {
+		t.Fatalf("expected the 2 committed rows relayed, got %d %v", n, errRelay)
+	}
+	if got := pub.published; string(got[0].Body) != `{"n":0}` || string(got[1].Body) != `{"n":2}` {
+		t.Fatalf("expected the committed rows in order, got %v", got)
+	}
+	if h := pub.published[1].Headers; h[IDHeader] != "queuety_outbox:2" || h["source"] != "billing" || pub.published[1].Key != "acc-1" {
+		t.Fatalf("expected the row marker with the headers and key, got %v %q", h, pub.published[1].Key)
+	}
+
+	if n, errRelay := o.RelayOnce(ctx, db, pub); errRelay != nil || n != 0 {
+		t.Fatalf("expected nothing left once marked, got %d %v", n, errRelay)
+	}
+}
@@ -0,0 +1,106 @@
+package queuetytest
+
+import (
+	"os"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tomiok/queuety/manager"
+	"github.com/tomiok/queuety/server"
+)
+
+// BenchmarkPublishConsume is the latency from Publish to the consumer over loopback, one
+// message in flight at a time. The percentiles are reported next to ns/op.
+func BenchmarkPublishConsume(b *testing.B) {
+	broker := New(b)
+
+	publisher := broker.Connect(nil)
+	topic, err := publisher.NewTopic("orders")
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	broker.WaitForTopic("orders", 0)
+
+	consumer := broker.Connect(nil)
+	deliveries := manager.ConsumeMessages(consumer, topic)
+	broker.WaitForSubscribers("orders", 1, 0)
+
+	body := []byte(`{"order_id":"A-1024","total":1999}`)
+	latencies := make([]time.Duration, 0, b.N)
+	b.ResetTimer()
+	for range b.N {
+		start := time.Now()
+		if err = publisher.PublishMessage(server.PublishMessage{Topic: topic, Body: body}); err != nil {
+			b.Fatalf("%v", err)
+		}
+
+		select {
+		case d := <-deliveries:
+			latencies = append(latencies, time.Since(start))
+			_ = d.Ack()
+		case <-time.After(DefaultTimeout):
+			b.Fatal("message not received")
+		}
+	}
+	b.StopTimer()
+
+	slices.Sort(latencies)
+	b.ReportMetric(float64(latencies[len(latencies)/2]), "p50-ns")
+	b.ReportMetric(float64(latencies[len(latencies)*99/100]), "p99-ns")
+}
+
+// Test_Soak publishes and consumes for QUEUETY_SOAK (a duration, 10m) and fails on a lost
+// message. Skipped without it.
+func Test_Soak(t *testing.T) {
+	duration, err := time.ParseDuration(os.Getenv("QUEUETY_SOAK"))
+	if err != nil {
+		t.Skip("QUEUETY_SOAK is not set")
+	}
+
+	b := New(t)
+	publisher := b.Connect(nil)
+	topic, err := publisher.NewTopic("orders")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("orders", 0)
+
+	consumer := b.Connect(nil)
+	deliveries := manager.ConsumeMessages(consumer, topic)
+	b.WaitForSubscribers("orders", 1, 0)
+
+	received := make(chan int)
+	go func() {
+		seen := make(map[string]struct{})
+		for d := range deliveries {
+			seen[string(d.Body)] = struct{}{}
+			_ = d.Ack()
+			received <- len(seen)
+		}
+	}()
+
+	var published, got int
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		if err = publisher.PublishMessage(server.PublishMessage{Topic: topic, Body: []byte(strconv.Itoa(published))}); err != nil {
+			t.Fatalf("publish %d: %v", published, err)
+		}
+		published++
+
+		// keeps at most a thousand messages in flight.
+		for published-got > 1000 {
+			got = <-received
+		}
+	}
+
+	for got < published {
+		select {
+		case got = <-received:
+		case <-time.After(DefaultTimeout):
+			t.Fatalf("received %d of %d messages", got, published)
+		}
+	}
+	t.Logf("%d messages in %s, %.0f/s", published, duration, float64(published)/duration.Seconds())
+}
@@ -0,0 +1,93 @@
+package queuetytest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tomiok/queuety/server"
+)
+
+// Capture records the messages published to a topic, as the broker accepted them.
+type Capture struct {
+	b    *Broker
+	stop func()
+	done chan struct{}
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	messages []server.Message
+}
+
+// Capture starts recording the messages published to the topic, it stops with the test.
+func (b *Broker) Capture(topic string) *Capture {
+	messages, stop := b.Tap(server.NewTopic(topic))
+
+	c := &Capture{b: b, stop: stop, done: make(chan struct{})}
+	c.cond = sync.NewCond(&c.mu)
+
+	go func() {
+		for {
+			select {
+			case m := <-messages:
+				c.mu.Lock()
+				c.messages = append(c.messages, m)
+				c.cond.Broadcast()
+				c.mu.Unlock()
+			case <-c.done:
+				return
+			}
+		}
+	}()
+
+	b.t.Cleanup(c.Stop)
+	return c
+}
+
+// Messages returns what was captured so far.
+func (c *Capture) Messages() []server.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]server.Message(nil), c.messages...)
+}
+
+// Wait returns the first n captured messages, failing the test when they do not come in time.
+func (c *Capture) Wait(n int, timeout time.Duration) []server.Message {
+	c.b.t.Helper()
+
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	// the timer wakes the waiter up, it checks the deadline itself.
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		c.mu.Lock()
+		expired = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.messages) < n && !expired {
+		c.cond.Wait()
+	}
+	if len(c.messages) < n {
+		c.b.t.Fatalf("queuetytest: captured %d of %d messages after %s", len(c.messages), n, timeout)
+	}
+
+	return append([]server.Message(nil), c.messages[:n]...)
+}
+
+// Stop ends the capture, the messages recorded stay available.
+func (c *Capture) Stop() {
+	select {
+	case <-c.done:
+	default:
+		c.stop()
+		close(c.done)
+	}
+}
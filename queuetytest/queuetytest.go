@@ -0,0 +1,188 @@
+// Package queuetytest runs a broker inside a test: in-memory storage, ephemeral ports and a
+// shutdown registered with the test, plus helpers to wait for deliveries instead of sleeping.
+package queuetytest
+
+import (
+	"net"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tomiok/queuety/manager"
+	"github.com/tomiok/queuety/server"
+)
+
+// DefaultTimeout bounds the waits of the helpers that take no timeout of their own.
+const DefaultTimeout = 5 * time.Second
+
+// Broker is a running broker owned by a test.
+type Broker struct {
+	*server.Server
+
+	// Addr is the broker address for manager.Connect, WebURL the base URL of the admin API.
+	Addr   string
+	WebURL string
+
+	t       testing.TB
+	l       net.Listener
+	web     *httptest.Server
+	served  chan error
+	closeMu sync.Mutex
+	closed  bool
+}
+
+// Option changes the configuration of the broker before it starts.
+type Option func(*server.Config)
+
+// WithConfig hands the whole configuration to fn, for the settings without an option.
+func WithConfig(fn func(*server.Config)) Option {
+	return Option(fn)
+}
+
+// WithAuth requires the user and password from the clients and on the admin API.
+func WithAuth(user, password string) Option {
+	return func(c *server.Config) {
+		c.Auth = &server.Auth{User: user, Password: password}
+	}
+}
+
+// New starts a broker storing everything in memory, it is closed when the test ends.
+func New(t testing.TB, opts ...Option) *Broker {
+	t.Helper()
+
+	cfg := server.Config{
+		Protocol: "tcp",
+		Port:     "127.0.0.1:0",
+		// never listened on, WebURL serves the admin API instead.
+		WebServerPort: "localhost:0",
+		InMemoryData:  true,
+		Duration:      time.Hour,
+		// nothing of a test broker outlives it.
+		CheckpointInterval:  -1,
+		HealthCheckInterval: -1,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	srv, err := server.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("queuetytest: cannot create broker: %v", err)
+	}
+
+	l, err := net.Listen(cfg.Protocol, cfg.Port)
+	if err != nil {
+		t.Fatalf("queuetytest: cannot listen: %v", err)
+	}
+
+	b := &Broker{
+		Server: srv,
+		Addr:   l.Addr().String(),
+		t:      t,
+		l:      l,
+		web:    httptest.NewServer(srv.WebHandler()),
+		served: make(chan error, 1),
+	}
+	b.WebURL = b.web.URL
+
+	go func() {
+		b.served <- srv.Serve(l)
+	}()
+
+	t.Cleanup(b.Close)
+	return b
+}
+
+// Connect opens a client connection to the broker, closed when the test ends.
+func (b *Broker) Connect(auth *manager.Auth, opts ...manager.ConnOption) *manager.QConn {
+	b.t.Helper()
+
+	q, err := manager.Connect("tcp", b.Addr, auth, opts...)
+	if err != nil {
+		b.t.Fatalf("queuetytest: cannot connect: %v", err)
+	}
+	b.t.Cleanup(func() { _ = q.Close() })
+
+	return q
+}
+
+// WaitForDelivery waits until the messages of the topic were written n times to its
+// subscribers, a message sent to two subscribers counts twice. It fails the test on timeout.
+func (b *Broker) WaitForDelivery(topic string, n int, timeout time.Duration) {
+	b.t.Helper()
+
+	t := server.NewTopic(topic)
+	if !poll(timeout, func() bool { return b.Delivered(t) >= n }) {
+		b.t.Fatalf("queuetytest: %d of %d deliveries on %s after %s", b.Delivered(t), n, topic, timeout)
+	}
+}
+
+// WaitForTopic waits until a client created the topic, NewTopic does not wait for the broker.
+func (b *Broker) WaitForTopic(topic string, timeout time.Duration) {
+	b.t.Helper()
+
+	exists := func() bool { return b.TopicExists(server.NewTopic(topic)) }
+	if !poll(timeout, exists) {
+		b.t.Fatalf("queuetytest: topic %s not created after %s", topic, timeout)
+	}
+}
+
+// WaitForSubscribers waits until the topic has n connected subscribers.
+func (b *Broker) WaitForSubscribers(topic string, n int, timeout time.Duration) {
+	b.t.Helper()
+
+	connected := func() bool {
+		var subscribed int
+		for _, c := range b.Connections() {
+			if slices.Contains(c.Topics, topic) {
+				subscribed++
+			}
+		}
+		return subscribed >= n
+	}
+	if !poll(timeout, connected) {
+		b.t.Fatalf("queuetytest: topic %s has less than %d subscribers after %s", topic, n, timeout)
+	}
+}
+
+// Close stops the broker and waits for it, the test registers it already.
+func (b *Broker) Close() {
+	b.closeMu.Lock()
+	defer b.closeMu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	b.web.Close()
+	if err := b.Server.Close(); err != nil {
+		b.t.Errorf("queuetytest: cannot close broker: %v", err)
+	}
+	// Serve may not have taken the listener yet, closing it here ends it either way.
+	_ = b.l.Close()
+	if err := <-b.served; err != nil {
+		b.t.Errorf("queuetytest: broker stopped: %v", err)
+	}
+	if err := b.DB.Close(); err != nil {
+		b.t.Errorf("queuetytest: cannot close store: %v", err)
+	}
+}
+
+func poll(timeout time.Duration, done func() bool) bool {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return true
+}
@@ -0,0 +1,644 @@
+package queuetytest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tomiok/queuety/manager"
+	"github.com/tomiok/queuety/server"
+)
+
+func Test_BrokerRoundTrip(t *testing.T) {
+	b := New(t)
+
+	publisher := b.Connect(nil)
+	topic, err := publisher.NewTopic("orders")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("orders", 0)
+
+	consumer := b.Connect(nil)
+	messages := manager.Consume(consumer, topic)
+	b.WaitForSubscribers("orders", 1, 0)
+
+	capture := b.Capture("orders")
+	if err = publisher.PublishJSON(topic, []byte(`"hello"`)); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	b.WaitForDelivery("orders", 1, 0)
+	if captured := capture.Wait(1, 0); captured[0].Topic() != server.NewTopic("orders") {
+		t.Fatalf("unexpected capture %v", captured)
+	}
+
+	select {
+	case m := <-messages:
+		if m != `"hello"` {
+			t.Fatalf("unexpected message %s", m)
+		}
+	case <-time.After(DefaultTimeout):
+		t.Fatal("message not received")
+	}
+}
+
+func Test_ConnectNegotiatesFeatures(t *testing.T) {
+	b := New(t)
+
+	q := b.Connect(nil, manager.WithClientInfo("billing", "1.0.0", nil))
+	if !q.Supports(server.FeatureBinary) || q.Supports("compression") {
+		t.Fatal("expected the binary format agreed and nothing unknown")
+	}
+
+	conns := b.Connections()
+	if len(conns) != 1 || conns[0].Client == nil || conns[0].Client.Name != "billing" || len(conns[0].Features) == 0 {
+		t.Fatalf("expected the connection with its negotiated features, got %+v", conns)
+	}
+}
+
+func Test_PublishSyncReturnsBrokerSeq(t *testing.T) {
+	b := New(t)
+
+	q := b.Connect(nil)
+	topic, err := q.NewTopic("orders")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("orders", 0)
+
+	for want := uint64(1); want <= 2; want++ {
+		r, err := q.PublishSync(server.PublishMessage{Topic: topic, Body: []byte(`"hello"`)})
+		if err != nil || r.Seq != want || r.ID == "" {
+			t.Fatalf("expected seq %d confirmed, got %+v %v", want, r, err)
+		}
+	}
+
+	r, err := q.PublishSync(server.PublishMessage{Topic: server.NewTopic("missing"), Body: []byte(`"hello"`)})
+	var rejected *manager.ServerError
+	if !errors.As(err, &rejected) || rejected.Code != server.ErrCodeUnknownTopic || rejected.MessageID != r.ID {
+		t.Fatalf("expected the publish to a missing topic rejected, got %+v %v", r, err)
+	}
+}
+
+func Test_ConsumeMessagesRedeliversNacked(t *testing.T) {
+	b := New(t)
+
+	publisher := b.Connect(nil)
+	topic, err := publisher.NewTopic("orders")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("orders", 0)
+
+	consumer := b.Connect(nil)
+	deliveries := manager.ConsumeMessages(consumer, topic)
+	b.WaitForSubscribers("orders", 1, 0)
+
+	headers := map[string]string{"trace-id": "4bf92f35"}
+	if err = publisher.PublishMessage(server.PublishMessage{Topic: topic, Body: []byte(`"hello"`), Headers: headers}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	receive := func() manager.Delivery {
+		select {
+		case d := <-deliveries:
+			return d
+		case <-time.After(DefaultTimeout):
+			t.Fatal("message not received")
+			return manager.Delivery{}
+		}
+	}
+
+	d := receive()
+	if d.Redelivered || d.Seq != 1 || d.Headers["trace-id"] != "4bf92f35" || string(d.Body) != `"hello"` {
+		t.Fatalf("unexpected delivery %+v", d)
+	}
+	if err = d.Nack(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	again := receive()
+	if !again.Redelivered || again.ID != d.ID || again.Headers["trace-id"] != "4bf92f35" {
+		t.Fatalf("expected the nacked message redelivered, got %+v", again)
+	}
+	if err = again.Ack(); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func Test_ConsumeBatchesGathersMessages(t *testing.T) {
+	b := New(t)
+
+	publisher := b.Connect(nil)
+	topic, err := publisher.NewTopic("orders")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("orders", 0)
+
+	consumer := b.Connect(nil)
+	batches := manager.ConsumeBatches(consumer, topic, 3)
+	b.WaitForSubscribers("orders", 1, 0)
+
+	for _, body := range []string{`"a"`, `"b"`, `"c"`} {
+		if err = publisher.PublishMessage(server.PublishMessage{Topic: topic, Body: []byte(body)}); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case batch := <-batches:
+			for _, d := range batch.Deliveries {
+				got = append(got, string(d.Body))
+			}
+			if err = batch.Ack(); err != nil {
+				t.Fatalf("%v", err)
+			}
+		case <-time.After(DefaultTimeout):
+			t.Fatalf("expected 3 messages, got %v", got)
+		}
+	}
+	if strings.Join(got, ",") != `"a","b","c"` {
+		t.Fatalf("unexpected deliveries %v", got)
+	}
+}
+
+func Test_MaxBufferedBytesPassesLargeMessages(t *testing.T) {
+	b := New(t)
+
+	publisher := b.Connect(nil)
+	topic, err := publisher.NewTopic("uploads")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("uploads", 0)
+
+	// every message is larger than the budget, they go through one at a time.
+	consumer := b.Connect(nil)
+	messages := manager.Consume(consumer, topic, manager.MaxBufferedBytes(100), manager.BufferSize(2))
+	b.WaitForSubscribers("uploads", 1, 0)
+
+	body := `"` + strings.Repeat("x", 300) + `"`
+	for range 5 {
+		if err = publisher.PublishJSON(topic, []byte(body)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	for i := range 5 {
+		select {
+		case got := <-messages:
+			if got != body {
+				t.Fatalf("unexpected message %d of %d bytes", i, len(got))
+			}
+		case <-time.After(DefaultTimeout):
+			t.Fatalf("received %d of 5 messages", i)
+		}
+	}
+}
+
+func Test_ConsumeWorkersNacksFailures(t *testing.T) {
+	b := New(t)
+
+	publisher := b.Connect(nil)
+	topic, err := publisher.NewTopic("jobs")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("jobs", 0)
+
+	done := make(chan string, 10)
+	handler := func(d manager.Delivery) error {
+		switch body := string(d.Body); {
+		case body == `"panic"` && !d.Redelivered:
+			panic("boom")
+		case body == `"fail"` && !d.Redelivered:
+			return errors.New("downstream unavailable")
+		default:
+			done <- body
+			return nil
+		}
+	}
+
+	consumer := b.Connect(nil)
+	returned := make(chan error, 1)
+	go func() { returned <- manager.ConsumeWorkers(consumer, topic, 4, handler) }()
+	b.WaitForSubscribers("jobs", 1, 0)
+
+	for _, body := range []string{`"ok"`, `"panic"`, `"fail"`} {
+		if err = publisher.PublishJSON(topic, []byte(body)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	got := map[string]bool{}
+	for len(got) < 3 {
+		select {
+		case body := <-done:
+			got[body] = true
+		case <-time.After(DefaultTimeout):
+			t.Fatalf("expected every job handled once it succeeds, got %v", got)
+		}
+	}
+
+	_ = consumer.Close()
+	select {
+	case err = <-returned:
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	case <-time.After(DefaultTimeout):
+		t.Fatal("expected ConsumeWorkers to return once the connection closed")
+	}
+}
+
+func Test_RetryHandlesTransientFailuresLocally(t *testing.T) {
+	b := New(t)
+
+	publisher := b.Connect(nil)
+	topic, err := publisher.NewTopic("jobs")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("jobs", 0)
+
+	runs := make(chan manager.Delivery, 10)
+	failures := 0
+	handler := func(d manager.Delivery) error {
+		runs <- d
+		if failures < 2 {
+			failures++
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	}
+
+	consumer := b.Connect(nil)
+	go func() { _ = manager.ConsumeWorkers(consumer, topic, 1, handler, manager.Retry(2, 10*time.Millisecond)) }()
+	b.WaitForSubscribers("jobs", 1, 0)
+
+	if err = publisher.PublishJSON(topic, []byte(`"job"`)); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for i := range 3 {
+		select {
+		case d := <-runs:
+			if d.Redelivered {
+				t.Fatalf("expected run %d retried in the client, got a redelivery", i)
+			}
+		case <-time.After(DefaultTimeout):
+			t.Fatalf("expected 3 runs of the handler, got %d", i)
+		}
+	}
+
+	select {
+	case d := <-runs:
+		t.Fatalf("expected the job acked after its retry, got it again with %d attempts", d.Attempts)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func Test_ConsumeOrderedKeepsKeyOrder(t *testing.T) {
+	b := New(t)
+
+	publisher := b.Connect(nil)
+	topic, err := publisher.NewTopic("ledger", manager.Exclusive())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("ledger", 0)
+
+	type entry struct {
+		Account string `json:"account"`
+		N       int    `json:"n"`
+	}
+
+	var (
+		mu  sync.Mutex
+		got = map[string][]int{}
+	)
+	done := make(chan struct{}, 20)
+	handler := func(d manager.Delivery) error {
+		var e entry
+		if err := json.Unmarshal(d.Body, &e); err != nil {
+			return err
+		}
+		time.Sleep(time.Duration(5-e.N%5) * time.Millisecond)
+
+		mu.Lock()
+		got[e.Account] = append(got[e.Account], e.N)
+		mu.Unlock()
+		done <- struct{}{}
+		return nil
+	}
+
+	consumer := b.Connect(nil)
+	go func() {
+		_ = manager.ConsumeOrdered(consumer, topic, 4, manager.ByJSONField("account"), handler)
+	}()
+	b.WaitForSubscribers("ledger", 1, 0)
+
+	for i := range 20 {
+		body, _ := json.Marshal(entry{Account: fmt.Sprintf("acc-%d", i%3), N: i})
+		if err = publisher.PublishJSON(topic, body); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	for i := range 20 {
+		select {
+		case <-done:
+		case <-time.After(DefaultTimeout):
+			t.Fatalf("expected 20 entries handled, got %d", i)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for account, ns := range got {
+		for i := 1; i < len(ns); i++ {
+			if ns[i] < ns[i-1] {
+				t.Fatalf("expected the entries of %s in order, got %v", account, ns)
+			}
+		}
+	}
+}
+
+func Test_CommitAcksAndPublishesAtOnce(t *testing.T) {
+	b := New(t)
+
+	client := b.Connect(nil)
+	orders, err := client.NewTopic("orders")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	invoices, err := client.NewTopic("invoices")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("orders", 0)
+	b.WaitForTopic("invoices", 0)
+
+	billing := b.Connect(nil)
+	out := manager.ConsumeMessages(billing, invoices)
+	in := manager.ConsumeMessages(client, orders)
+	b.WaitForSubscribers("invoices", 1, 0)
+	b.WaitForSubscribers("orders", 1, 0)
+
+	if err = client.PublishJSON(orders, []byte(`{"order":7}`)); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var d manager.Delivery
+	select {
+	case d = <-in:
+	case <-time.After(DefaultTimeout):
+		t.Fatal("expected the order delivered")
+	}
+
+	invoice := server.PublishMessage{Topic: invoices, Body: []byte(`{"invoice":7}`)}
+	if err = client.Commit([]manager.Delivery{d}, invoice); err != nil {
+		t.Fatalf("cannot commit %v", err)
+	}
+
+	select {
+	case got := <-out:
+		if string(got.Body) != `{"invoice":7}` {
+			t.Fatalf("expected the invoice published, got %s", got.Body)
+		}
+		_ = got.Ack()
+	case <-time.After(DefaultTimeout):
+		t.Fatal("expected the invoice delivered once committed")
+	}
+
+	var serverErr *manager.ServerError
+	if err = client.Commit([]manager.Delivery{d}, invoice); !errors.As(err, &serverErr) || serverErr.Code != server.ErrCodeTxnConflict {
+		t.Fatalf("expected a conflict committing the order again, got %v", err)
+	}
+	select {
+	case got := <-out:
+		t.Fatalf("expected nothing published by the conflicting commit, got %s", got.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_FireAndForgetStoresNothing(t *testing.T) {
+	b := New(t)
+
+	publisher := b.Connect(nil)
+	metrics, err := publisher.NewTopic("metrics")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("metrics", 0)
+
+	acking := publisher.Consume(metrics)
+	sampler := b.Connect(nil).Consume(metrics, manager.NoAck())
+	b.WaitForSubscribers("metrics", 2, 0)
+
+	if err = publisher.PublishMessage(server.PublishMessage{Topic: metrics, Body: []byte(`{"cpu":0.42}`), FireAndForget: true}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = publisher.PublishSync(server.PublishMessage{Topic: metrics, Body: []byte(`{"cpu":0.5}`), FireAndForget: true}); err == nil {
+		t.Fatal("expected a fire and forget publish to have no confirm")
+	}
+
+	for name, ch := range map[string]<-chan string{"acking": acking, "no ack": sampler} {
+		select {
+		case body := <-ch:
+			if body != `{"cpu":0.42}` {
+				t.Fatalf("expected the sample delivered to the %s subscriber, got %s", name, body)
+			}
+		case <-time.After(DefaultTimeout):
+			t.Fatalf("expected the sample delivered to the %s subscriber", name)
+		}
+	}
+
+	if items, _ := b.DB.StoredItems(); len(items) != 0 {
+		t.Fatalf("expected nothing stored for a fire and forget message, got %v", items)
+	}
+}
+
+func Test_EffectivelyOnceDropsDuplicatePublishes(t *testing.T) {
+	b := New(t)
+
+	publisher := b.Connect(nil)
+	payments, err := publisher.NewTopic("payments")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("payments", 0)
+
+	received := b.Connect(nil).Consume(payments)
+	b.WaitForSubscribers("payments", 1, 0)
+
+	pubMsg := server.PublishMessage{Topic: payments, Body: []byte(`{"id":9}`), QoS: server.QoSEffectivelyOnce, ID: "payment-9"}
+	first, err := publisher.PublishSync(pubMsg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	again, err := publisher.PublishSync(pubMsg)
+	if err != nil || again.Seq != first.Seq {
+		t.Fatalf("expected the duplicate confirmed with seq %d, got %v %v", first.Seq, again, err)
+	}
+	pubMsg.ID, pubMsg.Body = "payment-10", []byte(`{"id":10}`)
+	if _, err = publisher.PublishSync(pubMsg); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, want := range []string{`{"id":9}`, `{"id":10}`} {
+		select {
+		case body := <-received:
+			if body != want {
+				t.Fatalf("expected %s delivered, got %s", want, body)
+			}
+		case <-time.After(DefaultTimeout):
+			t.Fatalf("expected %s delivered", want)
+		}
+	}
+
+	if _, err = publisher.PublishSync(server.PublishMessage{Topic: payments, Body: []byte(`{}`), QoS: server.QoSEffectivelyOnce, FireAndForget: true}); err == nil {
+		t.Fatal("expected a fire and forget publish asking for effectively once rejected")
+	}
+}
+
+func Test_ReplicaServesSubscribersReadOnly(t *testing.T) {
+	primary := New(t)
+
+	publisher := primary.Connect(nil)
+	prices, err := publisher.NewTopic("prices")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	primary.WaitForTopic("prices", 0)
+
+	replica := New(t, WithConfig(func(c *server.Config) {
+		c.Replica = &server.ReplicaConfig{Primary: primary.Addr, Topics: []string{"prices"}, Name: "replica-1", RetryInterval: 50 * time.Millisecond}
+	}))
+	primary.WaitForSubscribers("prices", 1, 0)
+
+	reader := replica.Connect(nil)
+	received := reader.Consume(prices)
+	replica.WaitForSubscribers("prices", 1, 0)
+
+	if _, err = publisher.PublishSync(server.PublishMessage{Topic: prices, Body: []byte(`{"btc":1}`)}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	select {
+	case body := <-received:
+		if body != `{"btc":1}` {
+			t.Fatalf("expected the price replicated, got %s", body)
+		}
+	case <-time.After(DefaultTimeout):
+		t.Fatal("expected the price replicated")
+	}
+
+	var serverErr *manager.ServerError
+	_, err = reader.PublishSync(server.PublishMessage{Topic: prices, Body: []byte(`{"btc":2}`)})
+	if !errors.As(err, &serverErr) || serverErr.Code != server.ErrCodeReadOnly {
+		t.Fatalf("expected a publish to the replica rejected, got %v", err)
+	}
+}
+
+func Test_ClusterFindsPrimaryAndFailsOver(t *testing.T) {
+	primary := New(t)
+	primary.Connect(nil).NewTopic("prices")
+	primary.WaitForTopic("prices", 0)
+	replica := New(t, WithConfig(func(c *server.Config) {
+		c.Replica = &server.ReplicaConfig{Primary: primary.Addr, Topics: []string{"prices"}, Name: "replica-1"}
+	}))
+	primary.WaitForSubscribers("prices", 1, 0)
+
+	// the replica is enough to find the primary.
+	cluster, err := manager.ConnectCluster("tcp", []string{replica.Addr}, nil, manager.SpreadSubscriptions(), manager.FailoverInterval(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer cluster.Close()
+
+	prices := server.NewTopic("prices")
+	received := cluster.Consume(prices)
+	replica.WaitForSubscribers("prices", 1, 0)
+
+	if _, err = cluster.PublishSync(server.PublishMessage{Topic: prices, Body: []byte(`{"btc":1}`)}); err != nil {
+		t.Fatalf("expected the publish sent to the primary, got %v", err)
+	}
+	select {
+	case body := <-received:
+		if body != `{"btc":1}` {
+			t.Fatalf("expected the price from the replica, got %s", body)
+		}
+	case <-time.After(DefaultTimeout):
+		t.Fatal("expected the price from the replica")
+	}
+
+	// the replica lost, the subscription goes to the primary. The prices published before it
+	// subscribed there are missed, it is not durable.
+	replica.Close()
+	left := poll(0, func() bool {
+		for _, c := range primary.Connections() {
+			if slices.Contains(c.Topics, "prices") {
+				return false
+			}
+		}
+		return true
+	})
+	if !left {
+		t.Fatal("expected the replica gone from the primary")
+	}
+	replica.KickTopic(prices)
+	deadline := time.After(DefaultTimeout)
+	for {
+		if _, err = cluster.PublishSync(server.PublishMessage{Topic: prices, Body: []byte(`{"btc":2}`)}); err != nil {
+			t.Fatalf("%v", err)
+		}
+		select {
+		case body := <-received:
+			if body != `{"btc":2}` {
+				t.Fatalf("expected the price from the primary, got %s", body)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("expected the subscription failed over to the primary")
+		}
+	}
+}
+
+func Test_MetadataDescribesTopic(t *testing.T) {
+	b := New(t)
+
+	q := b.Connect(nil)
+	jobs, err := q.NewTopic("jobs", manager.Queue(), manager.VisibilityTimeout(30*time.Second))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b.WaitForTopic("jobs", 0)
+	for range 2 {
+		if _, err = q.PublishSync(server.PublishMessage{Topic: jobs, Body: []byte(`{}`)}); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	md, err := q.Metadata(jobs)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if md.Mode != server.TopicQueue || md.Class != server.TopicDurable || md.VisibilityTimeout != 30 || md.Seq != 2 || md.Partitions != 1 {
+		t.Fatalf("unexpected metadata %+v", md)
+	}
+
+	var serverErr *manager.ServerError
+	if _, err = q.Metadata(server.NewTopic("missing")); !errors.As(err, &serverErr) || serverErr.Code != server.ErrCodeUnknownTopic {
+		t.Fatalf("expected an unknown topic, got %v", err)
+	}
+}
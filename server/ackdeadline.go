@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// defaultAckExtension is the extension of an IN_PROGRESS without seconds.
+	defaultAckExtension = time.Minute
+	// maxAckExtension bounds one IN_PROGRESS, a consumer working longer sends it again.
+	maxAckExtension = 10 * time.Minute
+)
+
+// AckExtension is the body of IN_PROGRESS.
+type AckExtension struct {
+	// Seconds is how long from now the message stays with the consumer, 0 is a minute and
+	// the most is 600.
+	Seconds int `json:"seconds,omitempty"`
+}
+
+// ackDeadline is the extension a connection holds on a message it is still processing.
+// A hidden one is the visibility timeout of a queue delivery, it outlives the connection.
+type ackDeadline struct {
+	connID uint64
+	until  time.Time
+	hidden bool
+}
+
+func parseAckExtension(body []byte) (time.Duration, error) {
+	var ext AckExtension
+	if len(body) > 0 && string(body) != "null" {
+		if err := json.Unmarshal(body, &ext); err != nil {
+			return 0, fmt.Errorf("invalid ack extension: %w", err)
+		}
+	}
+
+	if ext.Seconds < 0 {
+		return 0, fmt.Errorf("invalid seconds %d", ext.Seconds)
+	}
+	if ext.Seconds == 0 {
+		return defaultAckExtension, nil
+	}
+
+	return min(time.Duration(ext.Seconds)*time.Second, maxAckExtension), nil
+}
+
+// extendAck keeps the redeliveries away from a message the consumer is still working on,
+// until the extension runs out or the consumer acks, nacks or goes away.
+func (s *Server) extendAck(conn net.Conn, format MessageFormat, message Message) {
+	extension, err := parseAckExtension(message.Body())
+	if err != nil {
+		s.sendError(conn, format, ErrCodeMalformedFrame, err.Error(), message)
+		return
+	}
+	if s.isTransient(message.Topic()) {
+		return
+	}
+
+	d := ackDeadline{connID: s.clientConn(conn).id, until: time.Now().Add(extension)}
+	if v, ok := s.ackDeadlines.Load(message.ID()); ok {
+		d.hidden = v.(ackDeadline).hidden
+	}
+	s.ackDeadlines.Store(message.ID(), d)
+	s.logger().Debug("ack deadline extended", "id", message.ID(), "extension", extension)
+}
+
+// ackExtended tells if a consumer holds an extension on the message, dropping the one that ran out.
+func (s *Server) ackExtended(id string, now time.Time) bool {
+	v, ok := s.ackDeadlines.Load(id)
+	if !ok {
+		return false
+	}
+
+	if now.Before(v.(ackDeadline).until) {
+		return true
+	}
+
+	s.ackDeadlines.CompareAndDelete(id, v)
+	return false
+}
+
+// dropAckExtensions releases the extensions of a connection going away, its messages are
+// redelivered with the next round.
+func (s *Server) dropAckExtensions(connID uint64) {
+	s.ackDeadlines.Range(func(id, v any) bool {
+		if d := v.(ackDeadline); d.connID == connID && !d.hidden {
+			s.ackDeadlines.Delete(id)
+		}
+		return true
+	})
+}
+
+// hide keeps a queue delivery from the other consumers for the visibility timeout of its
+// topic, it reappears for the next one when it is still not acked by then.
+func (s *Server) hide(message Message, connID uint64, timeout time.Duration) {
+	s.ackDeadlines.Store(message.ID(), ackDeadline{connID: connID, until: time.Now().Add(timeout), hidden: true})
+	time.AfterFunc(timeout, func() { s.reappear(message) })
+}
+
+// reappear delivers a hidden message again once its deadline passed, an IN_PROGRESS may have
+// moved it. An ACK or a NACK since took it out of ackDeadlines.
+func (s *Server) reappear(message Message) {
+	v, ok := s.ackDeadlines.Load(message.ID())
+	if !ok || !v.(ackDeadline).hidden {
+		return
+	}
+
+	if wait := time.Until(v.(ackDeadline).until); wait > 0 {
+		time.AfterFunc(wait, func() { s.reappear(message) })
+		return
+	}
+
+	if !s.ackDeadlines.CompareAndDelete(message.ID(), v) {
+		return
+	}
+	if !s.hasTopic(message.Topic()) {
+		return
+	}
+
+	s.logger().Debug("visibility timeout passed", "id", message.ID(), "topic", message.Topic().Name)
+	s.retry(nil, message)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrConnectionNotFound = errors.New("connection not found")
+
+// adminUserKey holds the admin a request was verified as, see adminUser.
+type adminUserKey struct{}
+
+// adminUser is who the audit entries of an admin request name, the basic auth user or the
+// subject of the bearer token. Empty on a server keeping the admin API open.
+func adminUser(r *http.Request) string {
+	user, _ := r.Context().Value(adminUserKey{}).(string)
+	return user
+}
+
+// adminOnly protects an admin handler with basic auth using the broker credentials, or a
+// bearer access token of OIDCConfig.AdminGroups. A server without credentials keeps the admin
+// API open, the same as the TCP side.
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && s.oidc != nil {
+			claims, err := s.oidc.verify(token)
+			if err != nil || !s.oidc.admin(claims) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="queuety"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next(w, r.WithContext(context.WithValue(r.Context(), adminUserKey{}, claims.Username)))
+			return
+		}
+
+		if s.needAuth() {
+			user, pass, ok := r.BasicAuth()
+			if !ok || !s.hasPassword() || !s.validAdmin(user, pass) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="queuety"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), adminUserKey{}, user))
+		}
+
+		next(w, r)
+	}
+}
+
+func (s *Server) validAdmin(user, pass string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.User)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.Password)) == 1
+	return userOK && passOK
+}
+
+// Kick force closes the connection with the given ID. The read loop of that connection
+// notices the close and removes it from every topic.
+func (s *Server) Kick(id uint64) error {
+	target := s.connByID(id)
+	if target == nil {
+		return ErrConnectionNotFound
+	}
+
+	return target.Close()
+}
+
+// KickTopic force closes every subscriber of the topic and returns how many were closed.
+func (s *Server) KickTopic(topic Topic) int {
+	var kicked int
+	for _, client := range s.clientsOf(topic) {
+		if err := client.conn.Close(); err == nil {
+			kicked++
+		}
+	}
+
+	return kicked
+}
+
+func (s *Server) handleKickConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+		return
+	}
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditKickConnection, User: user, RemoteAddr: r.RemoteAddr, Detail: r.PathValue("id")})
+
+	if err = s.Kick(id); err != nil {
+		if errors.Is(err, ErrConnectionNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleKickTopic(w http.ResponseWriter, r *http.Request) {
+	kicked := s.KickTopic(NewTopic(r.PathValue("name")))
+
+	user := adminUser(r)
+	s.audit(AuditEntry{
+		Action:     AuditKickTopic,
+		User:       user,
+		RemoteAddr: r.RemoteAddr,
+		Topic:      r.PathValue("name"),
+		Detail:     strconv.Itoa(kicked) + " subscribers",
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"kicked": kicked}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
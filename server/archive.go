@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ObjectStore is where acked messages are archived. Implement it on top of the S3, GCS or
+// MinIO SDK of your choice, DirObjectStore writes to a local (or mounted) directory.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+}
+
+// DirObjectStore stores objects as files under Root, keys become relative paths.
+type DirObjectStore struct {
+	Root string
+}
+
+func (d DirObjectStore) Put(_ context.Context, key string, r io.Reader) error {
+	path := filepath.Join(d.Root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+type ArchiveConfig struct {
+	Store ObjectStore
+	// BatchSize is how many messages of a topic go in one object, 500 by default.
+	BatchSize int
+	// FlushInterval uploads incomplete batches, 1 minute by default.
+	FlushInterval time.Duration
+	// LocalRetention keeps the acked local copy around after the upload, 0 deletes it right away.
+	LocalRetention time.Duration
+}
+
+const (
+	defaultArchiveBatchSize     = 500
+	defaultArchiveFlushInterval = time.Minute
+)
+
+// archiver batches acked messages per topic and uploads them as gzip compressed JSON lines,
+// partitioned as <topic>/<yyyy>/<mm>/<dd>/<unix nano>.jsonl.gz.
+type archiver struct {
+	cfg   ArchiveConfig
+	store Store
+
+	in   chan Message
+	quit chan struct{}
+	done chan struct{}
+	// started is set by start, or by stop on an archiver that never ran.
+	started atomic.Bool
+
+	mu       sync.Mutex
+	archived []archivedCopy
+
+	logger *slog.Logger
+}
+
+// archivedCopy is a local acked record waiting for its retention to expire.
+type archivedCopy struct {
+	message Message
+	at      time.Time
+}
+
+func newArchiver(cfg ArchiveConfig, store Store, logger *slog.Logger) *archiver {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultArchiveBatchSize
+	}
+
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultArchiveFlushInterval
+	}
+
+	return &archiver{
+		cfg:   cfg,
+		store: store,
+		in:    make(chan Message, cfg.BatchSize),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+
+		logger: logger,
+	}
+}
+
+// add queues an acked message, it never blocks the ACK path for longer than a full channel.
+func (a *archiver) add(message Message) {
+	if a == nil {
+		return
+	}
+
+	select {
+	case a.in <- message:
+	case <-a.quit:
+	}
+}
+
+// start runs the archiver once, none after stop.
+func (a *archiver) start() {
+	if a.started.CompareAndSwap(false, true) {
+		go a.run()
+	}
+}
+
+func (a *archiver) run() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batches := make(map[Topic][]Message)
+	for {
+		select {
+		case message := <-a.in:
+			topic := message.Topic()
+			batches[topic] = append(batches[topic], message)
+			if len(batches[topic]) >= a.cfg.BatchSize {
+				a.flush(topic, batches[topic])
+				delete(batches, topic)
+			}
+
+		case <-ticker.C:
+			for topic, batch := range batches {
+				a.flush(topic, batch)
+				delete(batches, topic)
+			}
+			a.expireLocalCopies()
+
+		case <-a.quit:
+			a.drain(batches)
+			for topic, batch := range batches {
+				a.flush(topic, batch)
+			}
+			return
+		}
+	}
+}
+
+// drain moves the messages still queued into the batches.
+func (a *archiver) drain(batches map[Topic][]Message) {
+	for {
+		select {
+		case message := <-a.in:
+			batches[message.Topic()] = append(batches[message.Topic()], message)
+		default:
+			return
+		}
+	}
+}
+
+func (a *archiver) stop() {
+	if a == nil {
+		return
+	}
+
+	close(a.quit)
+	// an archiver never started has nothing to wait for.
+	if !a.started.CompareAndSwap(false, true) {
+		<-a.done
+	}
+}
+
+func (a *archiver) flush(topic Topic, batch []Message) {
+	body, err := encodeArchive(batch)
+	if err != nil {
+		a.logger.Error("cannot encode archive batch", "topic", topic.Name, "err", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%s/%s/%d.jsonl.gz", topic.Name, now.Format("2006/01/02"), now.UnixNano())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err = a.cfg.Store.Put(ctx, key, bytes.NewReader(body)); err != nil {
+		// the local copies stay, nothing is lost.
+		a.logger.Error("cannot archive messages", "topic", topic.Name, "messages", len(batch), "err", err)
+		return
+	}
+
+	a.mu.Lock()
+	for _, message := range batch {
+		a.archived = append(a.archived, archivedCopy{message: message, at: now})
+	}
+	a.mu.Unlock()
+
+	if a.cfg.LocalRetention == 0 {
+		a.expireLocalCopies()
+	}
+}
+
+func encodeArchive(batch []Message) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for _, message := range batch {
+		line, err := message.Marshall()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = zw.Write(append(line, '\n')); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// expireLocalCopies deletes the archived acked records older than the local retention.
+func (a *archiver) expireLocalCopies() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	deadline := time.Now().Add(-a.cfg.LocalRetention)
+	kept := a.archived[:0]
+	for _, c := range a.archived {
+		if c.at.After(deadline) {
+			kept = append(kept, c)
+			continue
+		}
+
+		if err := a.store.Delete(c.message); err != nil {
+			a.logger.Warn("cannot delete archived message", "id", c.message.ID(), "err", err)
+		}
+	}
+	a.archived = kept
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ArchiverUploadsAndDeletesLocalCopy(t *testing.T) {
+	root := t.TempDir()
+	store := NewMemoryStore(0)
+
+	msg := NewMessageBuilder().
+		WithID("false-1").
+		WithNextID("1").
+		WithTopic(NewTopic("orders")).
+		WithBody([]byte(`{"value":1}`)).
+		Build()
+	_ = store.SaveMessage(msg, FormatJSON)
+	_ = store.Ack(msg)
+	msg.updateACK()
+
+	a := newArchiver(ArchiveConfig{Store: DirObjectStore{Root: root}}, store, slog.Default())
+	a.start()
+	a.add(msg)
+	a.stop()
+
+	files, _ := filepath.Glob(filepath.Join(root, "orders", "*", "*", "*", "*.jsonl.gz"))
+	if len(files) != 1 {
+		t.Fatalf("expected one archive object, got %v", files)
+	}
+
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	content, _ := io.ReadAll(zr)
+	if !strings.Contains(string(content), `"next_id":"1"`) {
+		t.Fatalf("unexpected archive content %s", content)
+	}
+
+	items, _ := store.StoredItems()
+	if len(items) != 0 {
+		t.Fatalf("expected the local copy deleted, got %v", items)
+	}
+}
+
+func Test_ArchiverStopsWithoutRunning(t *testing.T) {
+	a := newArchiver(ArchiveConfig{Store: DirObjectStore{Root: t.TempDir()}}, NewMemoryStore(0), slog.Default())
+
+	stopped := make(chan struct{})
+	go func() {
+		a.stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected an archiver never started to stop")
+	}
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// attrPrefix indexes the messages by their headers named in Config.IndexedHeaders, under
+// attr/<header>/<value>/<message key>. The value is the message key, an entry outliving its
+// message is skipped by the searches.
+const attrPrefix = "attr/"
+
+var errNotIndexed = errors.New("the header is not indexed")
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+func attrSearchPrefix(name, value string) []byte {
+	// escaped, a / in the value would read as the next part of the key.
+	return []byte(attrPrefix + url.PathEscape(name) + "/" + url.PathEscape(value) + "/")
+}
+
+func (b BadgerDB) IndexAttributes(message Message, attrs map[string]string) error {
+	key := messageKey(message.Topic(), message.Seq())
+	return b.updateWithRetry(func(txn *badger.Txn) error {
+		for name, value := range attrs {
+			entry := badger.NewEntry(append(attrSearchPrefix(name, value), key...), key)
+			if ttl := message.TTL(); ttl > 0 {
+				entry = entry.WithTTL(ttl)
+			}
+			if err := txn.SetEntry(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b BadgerDB) DropAttributes(message Message, attrs map[string]string) error {
+	key := messageKey(message.Topic(), message.Seq())
+	return b.updateWithRetry(func(txn *badger.Txn) error {
+		for name, value := range attrs {
+			if err := txn.Delete(append(attrSearchPrefix(name, value), key...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b BadgerDB) SearchAttribute(name, value string, limit int) ([]Message, error) {
+	var (
+		messages []Message
+		corrupt  []corruptRecord
+	)
+	err := b.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = attrSearchPrefix(name, value)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if limit > 0 && len(messages) >= limit {
+				return nil
+			}
+
+			key, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			item, err := txn.Get(key)
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			err = item.Value(func(v []byte) error {
+				msg, errDecode := decodeRecord(v)
+				if errDecode != nil {
+					return errDecode
+				}
+				messages = append(messages, msg)
+				return nil
+			})
+			if err != nil {
+				corrupt = append(corrupt, newCorruptRecord(item, err))
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	b.quarantine(corrupt)
+	return messages, nil
+}
+
+// attrRef is a message indexed by a MemoryStore.
+type attrRef struct {
+	topic Topic
+	seq   uint64
+}
+
+// maxMemoryAttributes is the number of indexed messages a MemoryStore drops the stale ones at.
+const maxMemoryAttributes = 100_000
+
+func (m *MemoryStore) IndexAttributes(message Message, attrs map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.attrs == nil {
+		m.attrs = make(map[string]map[attrRef]struct{})
+	}
+	// a message saved again, as a redelivery, is indexed once.
+	ref := attrRef{topic: message.Topic(), seq: message.Seq()}
+	for name, value := range attrs {
+		key := string(attrSearchPrefix(name, value))
+		if m.attrs[key] == nil {
+			m.attrs[key] = make(map[attrRef]struct{})
+		}
+		if _, ok := m.attrs[key][ref]; !ok {
+			m.attrs[key][ref] = struct{}{}
+			m.attrCount++
+		}
+	}
+
+	if m.attrCount > maxMemoryAttributes {
+		m.attrCount = 0
+		for key := range m.attrs {
+			m.resolveAttr(key, 0)
+			m.attrCount += len(m.attrs[key])
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) DropAttributes(message Message, attrs map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ref := attrRef{topic: message.Topic(), seq: message.Seq()}
+	for name, value := range attrs {
+		key := string(attrSearchPrefix(name, value))
+		if _, ok := m.attrs[key][ref]; ok {
+			delete(m.attrs[key], ref)
+			m.attrCount--
+		}
+		if len(m.attrs[key]) == 0 {
+			delete(m.attrs, key)
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) SearchAttribute(name, value string, limit int) ([]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.resolveAttr(string(attrSearchPrefix(name, value)), limit), nil
+}
+
+// resolveAttr returns up to limit messages indexed under key by topic and seq, as a BadgerDB
+// does, dropping the ones gone.
+func (m *MemoryStore) resolveAttr(key string, limit int) []Message {
+	refs := slices.SortedFunc(maps.Keys(m.attrs[key]), func(a, b attrRef) int {
+		return cmp.Or(strings.Compare(a.topic.Name, b.topic.Name), cmp.Compare(a.seq, b.seq))
+	})
+
+	now := time.Now()
+	var messages []Message
+	for _, ref := range refs {
+		found := false
+		for _, id := range m.seqIndex[ref.topic][ref.seq] {
+			if msg, ok := m.messages[id]; ok && !msg.expired(now) {
+				if limit <= 0 || len(messages) < limit {
+					messages = append(messages, msg)
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			delete(m.attrs[key], ref)
+		}
+	}
+
+	if len(m.attrs[key]) == 0 {
+		delete(m.attrs, key)
+	}
+
+	return messages
+}
+
+// indexedAttrs are the headers of Config.IndexedHeaders the message carries, nil for none.
+func (s *Server) indexedAttrs(message Message) map[string]string {
+	if message.Seq() == 0 {
+		return nil
+	}
+
+	var attrs map[string]string
+	for _, name := range s.indexedHeaders {
+		if value, ok := message.Headers()[name]; ok {
+			if attrs == nil {
+				attrs = make(map[string]string)
+			}
+			attrs[name] = value
+		}
+	}
+
+	return attrs
+}
+
+// index records the message under the headers of Config.IndexedHeaders it carries.
+func (s *Server) index(message Message) {
+	attrs := s.indexedAttrs(message)
+	if attrs == nil {
+		return
+	}
+
+	if err := s.DB.IndexAttributes(message, attrs); err != nil {
+		s.logger().Warn("cannot index message", "id", message.ID(), "err", err)
+	}
+}
+
+// SearchMessages returns up to limit stored messages of any topic with the header value, the
+// header being one of Config.IndexedHeaders.
+func (s *Server) SearchMessages(header, value string, limit int) ([]StoredMessage, error) {
+	if !slices.Contains(s.indexedHeaders, header) {
+		return nil, errNotIndexed
+	}
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+
+	messages, err := s.DB.SearchAttribute(header, value, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]StoredMessage, 0, len(messages))
+	for _, m := range messages {
+		found = append(found, newStoredMessage(m))
+	}
+
+	return found, nil
+}
+
+// handleSearch lists the stored messages with the ?header= of ?value=, ?limit= of them.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	header, value := q.Get("header"), q.Get("value")
+	if header == "" {
+		http.Error(w, "missing header", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchLimit)
+	}
+
+	found, err := s.SearchMessages(header, value, limit)
+	switch {
+	case errors.Is(err, errNotIndexed):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditSearch, User: user, RemoteAddr: r.RemoteAddr, Detail: header + "=" + value})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(found); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// auditPrefix keeps the append-only audit records apart from the messages.
+const auditPrefix = "audit/"
+
+const (
+	AuditAuthSuccess     = "auth_success"
+	AuditAuthFailure     = "auth_failure"
+	AuditTopicCreate     = "topic_create"
+	AuditKickConnection  = "kick_connection"
+	AuditKickTopic       = "kick_topic"
+	AuditBackup          = "backup"
+	AuditRestore         = "restore"
+	AuditPromote         = "promote"
+	AuditReplay          = "replay"
+	AuditRepublish       = "republish"
+	AuditSnapshot        = "snapshot"
+	AuditTopicDelete     = "topic_delete"
+	AuditTopicPurge      = "topic_purge"
+	AuditRequeue         = "dlq_requeue"
+	AuditRetention       = "retention"
+	AuditTail            = "topic_tail"
+	AuditSamples         = "topic_samples"
+	AuditHistory         = "topic_history"
+	AuditSearch          = "message_search"
+	AuditErase           = "message_erase"
+	AuditConnectionTrace = "connection_trace"
+	AuditIPFilter        = "ip_filter"
+	AuditSchedule        = "schedule"
+	AuditSchema          = "schema"
+)
+
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Topic      string    `json:"topic,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+var auditSeq atomic.Uint64
+
+// appendAudit stores the entry under a key ordered by time, entries are never rewritten.
+func (b BadgerDB) AppendAudit(entry AuditEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s%020d-%06d", auditPrefix, entry.Time.UnixNano(), auditSeq.Add(1)%1_000_000)
+	return b.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), value)
+	})
+}
+
+// auditEntries returns up to limit entries, newest first, optionally filtered by action.
+func (b BadgerDB) AuditEntries(limit int, action string) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := b.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		opts.Prefix = []byte(auditPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// reverse iteration seeks to the last key of the prefix.
+		for it.Seek([]byte(auditPrefix + "~")); it.ValidForPrefix(opts.Prefix); it.Next() {
+			if limit > 0 && len(entries) >= limit {
+				return nil
+			}
+
+			var entry AuditEntry
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &entry)
+			})
+			if err != nil {
+				return err
+			}
+
+			if action != "" && entry.Action != action {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// audit records an action, failures are logged but never block the action itself.
+func (s *Server) audit(entry AuditEntry) {
+	entry.Time = time.Now()
+	if err := s.DB.AppendAudit(entry); err != nil {
+		s.logger().Error("cannot write audit entry", "action", entry.Action, "err", err)
+	}
+}
+
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	entries, err := s.DB.AuditEntries(limit, r.URL.Query().Get("action"))
+	if err != nil {
+		http.Error(w, "cannot read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(entries); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
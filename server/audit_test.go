@@ -0,0 +1,33 @@
+package server
+
+import "testing"
+
+func Test_AuditEntriesNewestFirst(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	srv := Server{DB: BadgerDB{DB: db}}
+
+	srv.audit(AuditEntry{Action: AuditAuthFailure, User: "mallory"})
+	srv.audit(AuditEntry{Action: AuditTopicCreate, Topic: "orders"})
+	srv.audit(AuditEntry{Action: AuditAuthSuccess, User: "admin"})
+
+	entries, err := srv.DB.AuditEntries(2, "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if len(entries) != 2 || entries[0].Action != AuditAuthSuccess || entries[1].Action != AuditTopicCreate {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	entries, err = srv.DB.AuditEntries(0, AuditAuthFailure)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if len(entries) != 1 || entries[0].User != "mallory" {
+		t.Fatalf("unexpected filtered entries %+v", entries)
+	}
+}
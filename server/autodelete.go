@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// autoDeleteOf is how long the topic may stay idle before it is deleted, 0 when it never is.
+// The option the topic was created with wins over TopicAutoDelete.
+func (s *Server) autoDeleteOf(topic Topic) time.Duration {
+	if v, ok := s.autoDelete.Load(topic); ok {
+		return v.(time.Duration)
+	}
+
+	return s.topicAutoDelete[topic.Name]
+}
+
+// setTopicOptions records the options of a topic being created, saved so they survive a
+// restart. The default ones are not saved.
+func (s *Server) setTopicOptions(topic Topic, opts TopicOptions) {
+	// a topic keeps the class and the mode it was created with first.
+	if s.values.compacted(topic) {
+		opts.Class = TopicCompacted
+	} else if opts.Class == TopicCompacted {
+		opts.Class = TopicDurable
+	}
+	opts.Mode = s.modeOf(topic)
+	opts.VisibilityTimeout = int64(s.visibilityOf(topic) / time.Second)
+	if opts.AutoDeleteAfter <= 0 && opts.Class != TopicCompacted && opts.Mode == TopicFanout {
+		return
+	}
+
+	if opts.AutoDeleteAfter > 0 {
+		s.autoDelete.Store(topic, time.Duration(opts.AutoDeleteAfter)*time.Second)
+		s.touchTopic(topic)
+	}
+	if err := s.DB.SaveTopicOptions(topic, opts); err != nil {
+		s.logger().Error("cannot save topic options", "topic", topic.Name, "err", err)
+	}
+}
+
+// loadTopicOptions brings back the options of the topics created before a restart, the
+// latest values of the compacted ones included.
+func (s *Server) loadTopicOptions() error {
+	options, err := s.DB.SavedTopicOptions()
+	if err != nil {
+		return err
+	}
+
+	for topic, opts := range options {
+		if opts.AutoDeleteAfter > 0 {
+			s.autoDelete.Store(topic, time.Duration(opts.AutoDeleteAfter)*time.Second)
+		}
+		s.setMode(topic, opts)
+		if opts.Class == TopicCompacted {
+			if err = s.loadValues(topic); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// touchTopic restarts the idle period of the topic, on a publish or a subscriber.
+func (s *Server) touchTopic(topic Topic) {
+	v, _ := s.topicActivity.LoadOrStore(topic, &atomic.Int64{})
+	v.(*atomic.Int64).Store(time.Now().UnixNano())
+}
+
+// idleSince is the last activity of the topic. A topic never touched, the ones loaded after a
+// restart, starts its idle period now.
+func (s *Server) idleSince(topic Topic, now time.Time) time.Time {
+	v, loaded := s.topicActivity.LoadOrStore(topic, &atomic.Int64{})
+	last := v.(*atomic.Int64)
+	if !loaded {
+		last.Store(now.UnixNano())
+	}
+
+	return time.Unix(0, last.Load())
+}
+
+// deleteIdleTopics deletes the topics idle for longer than their auto delete period, with
+// everything stored about them.
+func (s *Server) deleteIdleTopics(now time.Time) {
+	// the idle topics are picked under the lock, DeleteTopic takes it again for each of them.
+	idle := make(map[Topic]time.Duration)
+	s.clientsMu.RLock()
+	for topic, clients := range s.clients {
+		after := s.autoDeleteOf(topic)
+		if after <= 0 {
+			continue
+		}
+
+		if len(clients) > 0 {
+			s.touchTopic(topic)
+			continue
+		}
+
+		if d := now.Sub(s.idleSince(topic, now)); d >= after {
+			idle[topic] = d
+		}
+	}
+	s.clientsMu.RUnlock()
+
+	for topic, d := range idle {
+		result, err := s.DeleteTopic(topic)
+		if err != nil {
+			s.logger().Error("cannot delete idle topic", "topic", topic.Name, "err", err)
+			continue
+		}
+
+		s.maintenance.idleTopicsDeleted.Add(1)
+		s.audit(AuditEntry{
+			Action: AuditTopicDelete,
+			Topic:  topic.Name,
+			Detail: fmt.Sprintf("idle for %s, %d messages deleted", d.Round(time.Second), result.Messages),
+		})
+		s.logger().Info("idle topic deleted", "topic", topic.Name, "idle", d.Round(time.Second), "messages", result.Messages)
+	}
+}
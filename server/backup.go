@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/pb"
+	"github.com/dgraph-io/ristretto/v2/z"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxPendingRestoreWrites bounds the memory used while loading a Badger backup.
+const maxPendingRestoreWrites = 256
+
+// Backup writes a full snapshot of the broker state (pending and acked messages, sequences,
+// cursors, topics, audit log) to w.
+func (s *Server) Backup(w io.Writer) error {
+	return s.DB.Backup(w)
+}
+
+// Restore loads a snapshot written by Backup. Records in the snapshot overwrite the current ones,
+// the topics it holds are registered right away.
+func (s *Server) Restore(r io.Reader) error {
+	if err := s.DB.Restore(r); err != nil {
+		return err
+	}
+
+	return s.loadTopics()
+}
+
+func (b BadgerDB) Backup(w io.Writer) error {
+	_, err := b.DB.Backup(w, 0)
+	return err
+}
+
+// bitDelete is the meta of a Badger delete marker, loaded as a delete by Restore.
+const bitDelete byte = 1 << 0
+
+// BackupSince streams the latest version of the keys written since the version, deletes
+// included, in the format of Backup. The one of Badger skips the keys holding older versions.
+func (b BadgerDB) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	if since == 0 {
+		last, err := b.DB.Backup(w, 0)
+		return last + 1, err
+	}
+
+	stream := b.DB.NewStream()
+	stream.LogPrefix = "BackupSince"
+	// the iterator reads the versions above SinceTs, since is the first one to send.
+	stream.SinceTs = since - 1
+	stream.KeyToList = func(key []byte, itr *badger.Iterator) (*pb.KVList, error) {
+		item := itr.Item()
+		if item.Version() < since {
+			return nil, nil
+		}
+
+		kv := &pb.KV{Key: key, Version: item.Version(), ExpiresAt: item.ExpiresAt(), UserMeta: []byte{item.UserMeta()}}
+		if item.IsDeletedOrExpired() {
+			kv.Meta = []byte{bitDelete}
+		} else {
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return nil, err
+			}
+			kv.Value = value
+		}
+
+		return &pb.KVList{Kv: []*pb.KV{kv}}, nil
+	}
+
+	last := since - 1
+	stream.Send = func(buf *z.Buffer) error {
+		list, err := badger.BufferToKVList(buf)
+		if err != nil {
+			return err
+		}
+		out := list.Kv[:0]
+		for _, kv := range list.Kv {
+			if !kv.StreamDone {
+				last = max(last, kv.Version)
+				out = append(out, kv)
+			}
+		}
+		list.Kv = out
+
+		size := proto.Size(list)
+		if err = binary.Write(w, binary.LittleEndian, uint64(size)); err != nil {
+			return err
+		}
+		data, err := proto.Marshal(list)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	if err := stream.Orchestrate(context.Background()); err != nil {
+		return since, err
+	}
+
+	return last + 1, nil
+}
+
+func (b BadgerDB) Restore(r io.Reader) error {
+	return b.DB.Load(r, maxPendingRestoreWrites)
+}
+
+// memorySnapshot is the Backup format of a MemoryStore.
+type memorySnapshot struct {
+	Messages map[string]json.RawMessage      `json:"messages"`
+	Order    []string                        `json:"order"`
+	Seqs     map[string]uint64               `json:"seqs"`
+	SeqIndex map[string]map[uint64][2]string `json:"seq_index"`
+	Cursors  map[string]map[string]uint64    `json:"cursors"`
+	Topics   map[string][]string             `json:"topics"`
+	// TopicOptions are missing from the snapshots taken before auto delete.
+	TopicOptions map[string]TopicOptions `json:"topic_options,omitempty"`
+	Audit        []AuditEntry            `json:"audit"`
+}
+
+func (m *MemoryStore) Backup(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := memorySnapshot{
+		Messages: make(map[string]json.RawMessage, len(m.messages)),
+		Order:    m.order,
+		Seqs:     make(map[string]uint64, len(m.seqs)),
+		SeqIndex: make(map[string]map[uint64][2]string, len(m.seqIndex)),
+		Cursors:  make(map[string]map[string]uint64, len(m.cursors)),
+		Topics:   make(map[string][]string, len(m.topics)),
+		Audit:    m.audit,
+
+		TopicOptions: make(map[string]TopicOptions, len(m.topicOptions)),
+	}
+
+	for key, msg := range m.messages {
+		b, err := msg.Marshall()
+		if err != nil {
+			return err
+		}
+		snapshot.Messages[key] = b
+	}
+
+	for topic, seq := range m.seqs {
+		snapshot.Seqs[topic.Name] = seq
+	}
+
+	for topic, index := range m.seqIndex {
+		snapshot.SeqIndex[topic.Name] = index
+	}
+
+	for topic, cursors := range m.cursors {
+		snapshot.Cursors[topic.Name] = cursors
+	}
+
+	for topic, subscribers := range m.topics {
+		snapshot.Topics[topic.Name] = subscribers
+	}
+
+	for topic, opts := range m.topicOptions {
+		snapshot.TopicOptions[topic.Name] = opts
+	}
+
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+func (m *MemoryStore) BackupSince(w io.Writer, _ uint64) (uint64, error) {
+	return 0, m.Backup(w)
+}
+
+func (m *MemoryStore) Restore(r io.Reader) error {
+	var snapshot memorySnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, raw := range snapshot.Messages {
+		msg, err := DecodeMessage(raw)
+		if err != nil {
+			return err
+		}
+		m.put(key, msg)
+	}
+
+	for name, seq := range snapshot.Seqs {
+		m.seqs[NewTopic(name)] = max(m.seqs[NewTopic(name)], seq)
+	}
+
+	for name, index := range snapshot.SeqIndex {
+		topic := NewTopic(name)
+		if m.seqIndex[topic] == nil {
+			m.seqIndex[topic] = make(map[uint64][2]string)
+		}
+		for seq, keys := range index {
+			m.seqIndex[topic][seq] = keys
+		}
+	}
+
+	for name, cursors := range snapshot.Cursors {
+		topic := NewTopic(name)
+		if m.cursors[topic] == nil {
+			m.cursors[topic] = make(map[string]uint64)
+		}
+		for subscriber, cursor := range cursors {
+			m.cursors[topic][subscriber] = max(m.cursors[topic][subscriber], cursor)
+		}
+	}
+
+	for name, subscribers := range snapshot.Topics {
+		topic := NewTopic(name)
+		if _, ok := m.topics[topic]; !ok {
+			m.topics[topic] = []string{}
+		}
+		for _, subscriber := range subscribers {
+			if !slices.Contains(m.topics[topic], subscriber) {
+				m.topics[topic] = append(m.topics[topic], subscriber)
+			}
+		}
+	}
+
+	for name, opts := range snapshot.TopicOptions {
+		m.topicOptions[NewTopic(name)] = opts
+	}
+
+	m.audit = append(m.audit, snapshot.Audit...)
+	return nil
+}
+
+// handleBackup writes a full backup, or with ?since= the changes since a version, the one to
+// ask for next in the X-Queuety-Backup-Version trailer. A standby pulls them every second, only
+// the full ones are audited.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if since == 0 {
+		user := adminUser(r)
+		s.audit(AuditEntry{Action: AuditBackup, User: user, RemoteAddr: r.RemoteAddr})
+	}
+
+	w.Header().Set("Trailer", backupVersionTrailer)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="queuety-`+time.Now().UTC().Format("20060102T150405Z")+`.bak"`)
+
+	next, err := s.DB.BackupSince(w, since)
+	if err != nil {
+		// the headers are gone already, the client sees a truncated body.
+		s.logger().Error("backup failed", "err", err)
+		return
+	}
+	w.Header().Set(backupVersionTrailer, strconv.FormatUint(next, 10))
+}
+
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditRestore, User: user, RemoteAddr: r.RemoteAddr})
+
+	if err := s.Restore(r.Body); err != nil {
+		http.Error(w, "restore failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
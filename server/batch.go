@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxBatchSize bounds SubscribeOptions.BatchSize.
+	maxBatchSize = 1000
+	// batchLinger is how long a batch that is not full waits for more messages.
+	batchLinger = 10 * time.Millisecond
+)
+
+// deliveryBatch gathers the messages of a subscriber asking for batches until there are size
+// of them or batchLinger passed, they go out in a single BATCH frame.
+type deliveryBatch struct {
+	size int
+
+	mu       sync.Mutex
+	messages []Message
+	timer    *time.Timer
+}
+
+func newDeliveryBatch(size int) *deliveryBatch {
+	if size <= 1 {
+		return nil
+	}
+
+	return &deliveryBatch{size: size}
+}
+
+// take empties the batch, returning what it held.
+func (b *deliveryBatch) take() []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	messages := b.messages
+	b.messages = nil
+
+	return messages
+}
+
+// addToBatch queues the message for the subscriber, the batch goes out once full or when it
+// lingered long enough. It never writes, the publisher does not wait for the subscriber.
+func (s *Server) addToBatch(client Client, message Message) {
+	b := client.batch
+
+	b.mu.Lock()
+	b.messages = append(b.messages, message)
+	full := len(b.messages) >= b.size
+	if !full && b.timer == nil {
+		b.timer = time.AfterFunc(batchLinger, func() { s.flushBatch(client) })
+	}
+	b.mu.Unlock()
+
+	if full {
+		go s.flushBatch(client)
+	}
+}
+
+// flushBatch writes what the batch of the subscriber holds. Every message is then saved or
+// counted as a failed attempt, as a single delivery is.
+func (s *Server) flushBatch(client Client) {
+	messages := client.batch.take()
+	if len(messages) == 0 {
+		return
+	}
+
+	err := s.deliverBatch(client, messages)
+	for _, m := range messages {
+		s.afterDelivery(client, m, err)
+	}
+}
+
+// dropBatch hands back what the batch of a subscriber going away still holds, its messages are
+// saved as not delivered and go out with the next round.
+func (s *Server) dropBatch(client Client) {
+	for _, m := range client.batch.take() {
+		s.afterDelivery(client, m, errors.New("subscriber disconnected"))
+	}
+}
+
+func (s *Server) deliverBatch(client Client, messages []Message) error {
+	body, err := encodeBatch(messages)
+	if err != nil {
+		return err
+	}
+
+	id := uuid.NewString()
+	frame := NewMessageBuilder().
+		WithID(id).
+		WithNextID(id).
+		WithType(MessageTypeBatch).
+		WithTopic(messages[0].Topic()).
+		WithBody(body).
+		WithTimestamp(time.Now().Unix()).
+		Build()
+
+	payload, err := encodeMessage(frame, client.Format)
+	if err != nil {
+		return err
+	}
+
+	return s.deliverFrame(client, messages, payload)
+}
+
+// encodeBatch is the body of a BATCH, the JSON array of its messages.
+func encodeBatch(messages []Message) ([]byte, error) {
+	encoded := make([]json.RawMessage, len(messages))
+	for i, m := range messages {
+		b, err := m.Marshall()
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = b
+	}
+
+	return json.Marshal(encoded)
+}
+
+func decodeBatch(body []byte) ([]Message, error) {
+	var encoded []json.RawMessage
+	if err := json.Unmarshal(body, &encoded); err != nil {
+		return nil, fmt.Errorf("invalid batch: %w", err)
+	}
+
+	messages := make([]Message, len(encoded))
+	for i, b := range encoded {
+		if err := messages[i].Unmarshal(b); err != nil {
+			return nil, fmt.Errorf("invalid batch message %d: %w", i, err)
+		}
+	}
+
+	return messages, nil
+}
+
+// Batch returns the messages of a BATCH, false for the other types.
+func (m *Message) Batch() ([]Message, bool) {
+	if m.mType != MessageTypeBatch {
+		return nil, false
+	}
+
+	messages, err := decodeBatch(m.body)
+	if err != nil {
+		return nil, false
+	}
+
+	return messages, true
+}
+
+// ackBatch acks every message of the BATCH echoed by BATCH_ACK.
+func (s *Server) ackBatch(conn net.Conn, format MessageFormat, message Message) {
+	messages, err := decodeBatch(message.Body())
+	if err != nil {
+		s.sendError(conn, format, ErrCodeMalformedFrame, err.Error(), message)
+		return
+	}
+
+	for _, m := range messages {
+		s.ack(conn, m)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func benchMessage() Message {
+	return NewMessageBuilder().
+		WithID("false-6f1c2d8e-93b4-4a57-b0f1-1d0e2c3b4a59").
+		WithNextID("6f1c2d8e-93b4-4a57-b0f1-1d0e2c3b4a59").
+		WithType(MessageTypeNew).
+		WithTopic(NewTopic("orders")).
+		WithBody([]byte(`{"order_id":"A-1024","items":[` + eventBody() + `]}`)).
+		WithTimestamp(time.Now().Unix()).
+		WithSeq(1024).
+		WithKey("customer-42").
+		WithHeaders(map[string]string{"trace-id": "4bf92f3577b34da6", "content-type": "application/json"}).
+		Build()
+}
+
+// eventBody is a body of about a kilobyte, the size of a typical event.
+func eventBody() string {
+	return string(bytes.Repeat([]byte(`{"sku":"sku-0001","qty":1},`), 38)) + `{"sku":"sku-0002","qty":2}`
+}
+
+func BenchmarkMarshall(b *testing.B) {
+	msg := benchMessage()
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := msg.Marshall(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalBinary(b *testing.B) {
+	msg := benchMessage()
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := msg.MarshalBinary(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeMessage(b *testing.B) {
+	msg := benchMessage()
+	payload, _ := msg.Marshall()
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := DecodeMessage(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	msg := benchMessage()
+	payload, _ := msg.MarshalBinary()
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for b.Loop() {
+		var m Message
+		if err := m.UnmarshalBinary(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSendMessageSync is the delivery path of a publish, the store included, to N
+// subscribers reading as fast as they can. An op is one message written to all of them.
+func BenchmarkSendMessageSync(b *testing.B) {
+	for _, n := range []int{1, 10, 100} {
+		b.Run(strconv.Itoa(n)+"-subscribers", func(b *testing.B) {
+			srv := &Server{
+				DB:            NewMemoryStore(0),
+				clients:       make(map[Topic][]Client),
+				durableTopics: make(map[Topic][]string),
+				sentMessages:  make(map[Topic]*atomic.Int32),
+				log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			topic := NewTopic("orders")
+			for range n {
+				conn, peer := net.Pipe()
+				b.Cleanup(func() { _ = conn.Close() })
+				go func() { _, _ = io.Copy(io.Discard, peer) }()
+				srv.addNewSubscriber(conn, topic, FormatBinary, SubscribeOptions{})
+			}
+
+			msg := benchMessage()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := range b.N {
+				msg.id = "false-" + strconv.Itoa(i)
+				srv.sendMessageSync(msg, topic)
+			}
+
+			// the subscribers are written to concurrently, the last write ends the run.
+			for srv.Delivered(topic) < b.N*n {
+				time.Sleep(100 * time.Microsecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"slices"
+)
+
+// The features a client and the broker agree on with HELLO. A client lists the ones it
+// supports in ClientInfo.Features, the broker answers with the ones it supports too, so
+// neither side sends frames the other cannot parse.
+const (
+	// FeatureBinary is the binary frame format, FormatBinary.
+	FeatureBinary = "binary"
+	// FeatureManualAck is the redelivery of the messages a subscriber does not ACK.
+	FeatureManualAck = "manual_ack"
+	// FeatureDurable is the named subscriptions and consumer groups of NEW_SUB.
+	FeatureDurable = "durable"
+	// FeatureRedelivered is the redelivered flag of the messages delivered again.
+	FeatureRedelivered = "redelivered"
+	// FeatureReplay is the REPLAY of a range of seqs.
+	FeatureReplay = "replay"
+	// FeatureTransactions is the TXN acking deliveries and publishing messages at once.
+	FeatureTransactions = "transactions"
+	// FeatureTransientTopics is the NEW_TOPIC body choosing TopicTransient.
+	FeatureTransientTopics = "transient_topics"
+	// FeatureErrorFrames is the ERROR frames carrying an ErrorBody.
+	FeatureErrorFrames = "error_frames"
+	// FeatureAckExtension is the IN_PROGRESS extending the ack deadline of a delivery.
+	FeatureAckExtension = "ack_extension"
+	// FeatureBatches is the SubscribeOptions.BatchSize of NEW_SUB and the BATCH_ACK of its batches.
+	FeatureBatches = "batches"
+	// FeatureAutoDelete is the TopicOptions.AutoDeleteAfter of NEW_TOPIC.
+	FeatureAutoDelete = "auto_delete"
+	// FeatureCompactedTopics is the TopicCompacted class and the message key it compacts on.
+	FeatureCompactedTopics = "compacted_topics"
+	// FeatureDedup is the QoSEffectivelyOnce of NEW_MESSAGE, the publishes deduplicated by id.
+	FeatureDedup = "dedup"
+	// FeatureDeliveryRate is the SubscribeOptions.MaxRate of NEW_SUB.
+	FeatureDeliveryRate = "delivery_rate"
+	// FeatureHeaders is the PublishMessage.Headers of NEW_MESSAGE, delivered to the consumers.
+	FeatureHeaders = "headers"
+	// FeatureMessageKeys is the key of NEW_MESSAGE, routing a key to one member of each consumer group.
+	FeatureMessageKeys = "message_keys"
+	// FeatureMetadata is the METADATA telling how a topic is configured.
+	FeatureMetadata = "metadata"
+	// FeatureNack is the NACK handing a delivery back to be delivered again.
+	FeatureNack = "nack"
+	// FeaturePublishConfirms is the PUBLISHED answering every NEW_MESSAGE the broker accepts.
+	FeaturePublishConfirms = "publish_confirms"
+	// FeatureQueueTopics is the TopicQueue mode of NEW_TOPIC.
+	FeatureQueueTopics = "queue_topics"
+	// FeatureExclusiveTopics is the TopicExclusive mode of NEW_TOPIC.
+	FeatureExclusiveTopics = "exclusive_topics"
+	// FeatureFireAndForget is the PublishMessage.FireAndForget of NEW_MESSAGE and the
+	// SubscribeOptions.NoAck of NEW_SUB.
+	FeatureFireAndForget = "fire_and_forget"
+	// FeatureVisibilityTimeout is the TopicOptions.VisibilityTimeout of a queue topic.
+	FeatureVisibilityTimeout = "visibility_timeout"
+)
+
+const maxClientFeatures = 64
+
+// Features lists what the broker supports, sorted.
+func Features() []string {
+	return []string{
+		FeatureAckExtension,
+		FeatureAutoDelete,
+		FeatureBatches,
+		FeatureBinary,
+		FeatureCompactedTopics,
+		FeatureDedup,
+		FeatureDeliveryRate,
+		FeatureDurable,
+		FeatureErrorFrames,
+		FeatureExclusiveTopics,
+		FeatureFireAndForget,
+		FeatureHeaders,
+		FeatureManualAck,
+		FeatureMessageKeys,
+		FeatureMetadata,
+		FeatureNack,
+		FeaturePublishConfirms,
+		FeatureQueueTopics,
+		FeatureRedelivered,
+		FeatureReplay,
+		FeatureTransactions,
+		FeatureTransientTopics,
+		FeatureVisibilityTimeout,
+	}
+}
+
+// BrokerHello is the body of the HELLO answering a client that listed its features.
+type BrokerHello struct {
+	Version string `json:"version"`
+	// Features are the ones of the client the broker supports as well, the rest must not be used.
+	Features []string `json:"features"`
+	// Role is the one of the broker, see RolePrimary. A replica tells the address of its
+	// Primary, for the clients to publish there.
+	Role    string `json:"role,omitempty"`
+	Primary string `json:"primary,omitempty"`
+}
+
+// negotiate keeps the features of the client the broker supports, sorted and without
+// duplicates. The unknown ones are dropped, they come from newer clients.
+func negotiate(client []string) []string {
+	supported := Features()
+
+	agreed := make([]string, 0, len(client))
+	for _, f := range client {
+		if slices.Contains(supported, f) && !slices.Contains(agreed, f) {
+			agreed = append(agreed, f)
+		}
+	}
+	slices.Sort(agreed)
+
+	return agreed
+}
+
+// confirmPublish answers an accepted NEW_MESSAGE with PUBLISHED, for the clients that
+// negotiated FeaturePublishConfirms. The topic, id and seq are the ones the broker keeps.
+func (s *Server) confirmPublish(conn net.Conn, format MessageFormat, message Message) {
+	cc := s.clientConn(conn)
+	if !cc.supports(FeaturePublishConfirms) {
+		return
+	}
+
+	s.writePublished(cc, format, message)
+}
+
+// writePublished answers the frame with a PUBLISHED echoing its id and seq.
+func (s *Server) writePublished(cc *clientConn, format MessageFormat, message Message) {
+	reply := NewMessageBuilder().
+		WithID(message.ID()).
+		WithNextID(message.NextID()).
+		WithType(MessageTypePublished).
+		WithTopic(message.Topic()).
+		WithSeq(message.Seq()).
+		WithTimestamp(message.Timestamp()).
+		Build()
+
+	payload, err := encodeMessage(reply, format)
+	if err != nil {
+		s.logger().Error("cannot marshall publish confirm", "err", err)
+		return
+	}
+
+	if err = cc.writeFrame(format, payload); err != nil {
+		s.logger().Warn("cannot write publish confirm", "id", message.ID(), "err", err)
+	}
+}
+
+// helloReply answers the HELLO of a client that listed its features with the negotiated ones.
+// The clients not listing any get nothing, they predate the negotiation.
+func (s *Server) helloReply(conn net.Conn, format MessageFormat, message Message, features []string) {
+	body, err := json.Marshal(BrokerHello{Version: Version, Features: features, Role: s.Role(), Primary: s.primaryAddr()})
+	if err != nil {
+		s.logger().Error("cannot marshall hello reply", "err", err)
+		return
+	}
+
+	reply := NewMessageBuilder().
+		WithID(message.ID()).
+		WithType(MessageTypeHello).
+		WithBody(body).
+		WithTimestamp(message.Timestamp()).
+		Build()
+
+	payload, err := encodeMessage(reply, format)
+	if err != nil {
+		s.logger().Error("cannot marshall hello reply", "err", err)
+		return
+	}
+
+	if err = s.clientConn(conn).writeFrame(format, payload); err != nil {
+		s.logger().Warn("cannot write hello reply", "err", err)
+	}
+}
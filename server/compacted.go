@@ -0,0 +1,216 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var errMissingKey = errors.New("compacted topic needs a message key")
+
+// lastValues is the latest message by key of every compacted topic, the state sent to their
+// new subscribers. A topic is compacted when it has an entry, even an empty one.
+type lastValues struct {
+	mu     sync.Mutex
+	topics map[Topic]map[string]Message
+}
+
+func (l *lastValues) enable(topic Topic) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.topics == nil {
+		l.topics = make(map[Topic]map[string]Message)
+	}
+	if _, ok := l.topics[topic]; !ok {
+		l.topics[topic] = make(map[string]Message)
+	}
+}
+
+func (l *lastValues) drop(topic Topic) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.topics, topic)
+}
+
+func (l *lastValues) compacted(topic Topic) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.topics[topic]
+	return ok
+}
+
+// set keeps message as the value of its key, an empty body removes the key. It returns the
+// value replaced, if any. An older message than the current value changes nothing.
+func (l *lastValues) set(message Message) (Message, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	values, ok := l.topics[message.Topic()]
+	if !ok {
+		return Message{}, false
+	}
+
+	prev, replaced := values[message.Key()]
+	if replaced && prev.Seq() > message.Seq() {
+		return message, true
+	}
+
+	if isTombstone(message) {
+		delete(values, message.Key())
+	} else {
+		values[message.Key()] = message
+	}
+
+	return prev, replaced
+}
+
+// snapshot returns the current values of the topic, in publish order.
+func (l *lastValues) snapshot(topic Topic) []Message {
+	l.mu.Lock()
+	values := make([]Message, 0, len(l.topics[topic]))
+	for _, m := range l.topics[topic] {
+		values = append(values, m)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(values, func(i, j int) bool { return values[i].Seq() < values[j].Seq() })
+	return values
+}
+
+// current tells if message is the value of its key.
+func (l *lastValues) current(message Message) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	m, ok := l.topics[message.Topic()][message.Key()]
+	return ok && m.Seq() == message.Seq()
+}
+
+// forget removes message from its key when it is the value, as once erased.
+func (l *lastValues) forget(message Message) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	values := l.topics[message.Topic()]
+	if m, ok := values[message.Key()]; ok && m.Seq() == message.Seq() {
+		delete(values, message.Key())
+	}
+}
+
+// isTombstone tells if the message removes its key from a compacted topic.
+func isTombstone(message Message) bool {
+	body := message.Body()
+	return len(body) == 0 || string(body) == "null"
+}
+
+// addCompactedTopic creates a topic keeping the latest message by key. An existing topic
+// stays what it is.
+func (s *Server) addCompactedTopic(name string) {
+	topic := NewTopic(name)
+	if s.hasTopic(topic) && !s.values.compacted(topic) {
+		s.logger().Warn("topic exists already, ignoring the compacted class", "topic", name)
+		return
+	}
+
+	s.addNewTopic(name)
+	s.values.enable(topic)
+}
+
+// checkKey rejects the messages without a key published to a compacted topic.
+func (s *Server) checkKey(message Message) error {
+	if message.Key() == "" && s.values.compacted(message.Topic()) {
+		return fmt.Errorf("%w: %s", errMissingKey, message.Topic().Name)
+	}
+
+	return nil
+}
+
+// compact makes message the value of its key and deletes the value it replaced from the
+// store. What cannot be deleted now, a value still in flight, goes with the next compactTopics.
+func (s *Server) compact(message Message) {
+	prev, replaced := s.values.set(message)
+	if !replaced || prev.Seq() == message.Seq() {
+		return
+	}
+
+	if err := s.DB.Delete(prev); err != nil {
+		s.logger().Warn("cannot delete compacted message", "id", prev.ID(), "err", err)
+		return
+	}
+	if err := s.DB.ClearDeliveries(prev.ID()); err != nil {
+		s.logger().Warn("cannot clear deliveries", "id", prev.ID(), "err", err)
+	}
+}
+
+// loadValues rebuilds the values of a compacted topic from the store after a restart.
+func (s *Server) loadValues(topic Topic) error {
+	s.values.enable(topic)
+
+	messages, err := s.DB.MessagesAfter(topic, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range messages {
+		s.values.set(m)
+	}
+
+	return nil
+}
+
+// compactTopics deletes from the store the messages of the compacted topics that are no
+// longer the value of their key, tombstones included.
+func (s *Server) compactTopics() {
+	s.values.mu.Lock()
+	topics := make([]Topic, 0, len(s.values.topics))
+	for topic := range s.values.topics {
+		topics = append(topics, topic)
+	}
+	s.values.mu.Unlock()
+
+	for _, topic := range topics {
+		messages, err := s.DB.MessagesAfter(topic, 0)
+		if err != nil {
+			s.logger().Error("cannot compact topic", "topic", topic.Name, "err", err)
+			continue
+		}
+
+		var deleted int
+		for _, m := range messages {
+			if s.values.current(m) {
+				continue
+			}
+			if err = s.DB.Delete(m); err != nil {
+				s.logger().Error("cannot delete compacted message", "id", m.ID(), "err", err)
+				continue
+			}
+			deleted++
+		}
+
+		if deleted > 0 {
+			s.maintenance.compactedMessages.Add(int64(deleted))
+			s.logger().Debug("topic compacted", "topic", topic.Name, "deleted", deleted)
+		}
+	}
+}
+
+// sendSnapshot sends the current values of a compacted topic to a new subscriber, before
+// and along the live flow: a key may arrive twice, the one with the highest seq is current.
+func (s *Server) sendSnapshot(client Client, topic Topic) {
+	for _, m := range s.values.snapshot(topic) {
+		payload, err := encodeMessage(m, client.Format)
+		if err != nil {
+			s.logger().Error("cannot marshall message", "err", err)
+			continue
+		}
+
+		if err = s.deliver(client, m, payload); err != nil {
+			s.logger().Warn("snapshot stopped", "topic", topic.Name, "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clientConn serializes the writes to one connection. Frames are assembled in a buffered
+// writer, so the format flag, the length and the payload leave in a single syscall and
+// two goroutines delivering to the same subscriber cannot interleave their frames.
+// It is also the registry entry describing who is connected and to what.
+type clientConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	w       *bufio.Writer
+	pending atomic.Int32
+
+	id          uint64
+	remoteAddr  string
+	connectedAt time.Time
+
+	stateMu sync.Mutex
+	user    string
+	client  *ClientInfo
+	// features are the ones negotiated with HELLO, nil when the client did not negotiate.
+	features []string
+	topics   map[string]struct{}
+	// deliveries counts the messages written to the connection by topic, published the
+	// messages it published by topic.
+	deliveries map[string]uint64
+	published  map[string]uint64
+	// unacked are the messages delivered to the ephemeral subscribers of the connection and
+	// not acked yet, their records go with the connection.
+	unacked map[string]struct{}
+
+	// tracer logs the frames of the connection, nil when tracing is off.
+	tracer atomic.Pointer[frameTracer]
+
+	framesIn  atomic.Uint64
+	bytesIn   atomic.Uint64
+	framesOut atomic.Uint64
+	bytesOut  atomic.Uint64
+}
+
+func newClientConn(id uint64, conn net.Conn) *clientConn {
+	var remoteAddr string
+	if addr := conn.RemoteAddr(); addr != nil {
+		remoteAddr = addr.String()
+	}
+
+	return &clientConn{
+		Conn:        conn,
+		w:           bufio.NewWriter(conn),
+		id:          id,
+		remoteAddr:  remoteAddr,
+		connectedAt: time.Now(),
+		topics:      make(map[string]struct{}),
+		deliveries:  make(map[string]uint64),
+		published:   make(map[string]uint64),
+		unacked:     make(map[string]struct{}),
+	}
+}
+
+// ClientInfo is how a client identifies itself with HELLO, shown with its connection.
+type ClientInfo struct {
+	Name    string            `json:"name"`
+	Version string            `json:"version,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// Features are the ones the client supports, nil skips the negotiation. See Features.
+	Features []string `json:"features,omitempty"`
+}
+
+const (
+	maxClientInfoLen = 128
+	maxClientLabels  = 32
+)
+
+func parseClientInfo(body []byte) (ClientInfo, error) {
+	var info ClientInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		return ClientInfo{}, fmt.Errorf("invalid client info: %w", err)
+	}
+
+	if info.Name == "" {
+		return ClientInfo{}, errors.New("invalid client info: missing name")
+	}
+	if len(info.Name) > maxClientInfoLen || len(info.Version) > maxClientInfoLen {
+		return ClientInfo{}, fmt.Errorf("invalid client info: name and version are limited to %d bytes", maxClientInfoLen)
+	}
+	if len(info.Labels) > maxClientLabels {
+		return ClientInfo{}, fmt.Errorf("invalid client info: at most %d labels", maxClientLabels)
+	}
+	if len(info.Features) > maxClientFeatures {
+		return ClientInfo{}, fmt.Errorf("invalid client info: at most %d features", maxClientFeatures)
+	}
+	for k, v := range info.Labels {
+		if k == "" || len(k) > maxClientInfoLen || len(v) > maxClientInfoLen {
+			return ClientInfo{}, fmt.Errorf("invalid client info: label keys and values are limited to %d bytes", maxClientInfoLen)
+		}
+	}
+
+	return info, nil
+}
+
+// ConnectionInfo is the public view of a registered connection.
+type ConnectionInfo struct {
+	ID         uint64 `json:"id"`
+	RemoteAddr string `json:"remote_addr"`
+	User       string `json:"user,omitempty"`
+	// Client is what the client sent with HELLO, nil when it did not identify itself.
+	Client *ClientInfo `json:"client,omitempty"`
+	// Features are the ones agreed with the client, see Features.
+	Features []string `json:"features,omitempty"`
+	Topics   []string `json:"topics"`
+	// Published counts the messages published by the connection by topic.
+	Published   map[string]uint64 `json:"published,omitempty"`
+	ConnectedAt time.Time         `json:"connected_at"`
+	FramesIn    uint64            `json:"frames_in"`
+	BytesIn     uint64            `json:"bytes_in"`
+	FramesOut   uint64            `json:"frames_out"`
+	BytesOut    uint64            `json:"bytes_out"`
+	Traced      bool              `json:"traced,omitempty"`
+}
+
+func (c *clientConn) info() ConnectionInfo {
+	c.stateMu.Lock()
+	topics := make([]string, 0, len(c.topics))
+	for name := range c.topics {
+		topics = append(topics, name)
+	}
+	client := c.client
+	features := c.features
+	published := maps.Clone(c.published)
+	c.stateMu.Unlock()
+
+	sort.Strings(topics)
+
+	return ConnectionInfo{
+		ID:          c.id,
+		RemoteAddr:  c.remoteAddr,
+		User:        c.identity(),
+		Client:      client,
+		Features:    features,
+		Topics:      topics,
+		Published:   published,
+		ConnectedAt: c.connectedAt,
+		FramesIn:    c.framesIn.Load(),
+		BytesIn:     c.bytesIn.Load(),
+		FramesOut:   c.framesOut.Load(),
+		BytesOut:    c.bytesOut.Load(),
+		Traced:      c.tracer.Load() != nil,
+	}
+}
+
+func (c *clientConn) setUser(user string) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.user = user
+}
+
+func (c *clientConn) setClient(info ClientInfo, features []string) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.client = &info
+	c.features = features
+}
+
+// supports tells if the feature was negotiated with HELLO.
+func (c *clientConn) supports(feature string) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return slices.Contains(c.features, feature)
+}
+
+// clientName is the name sent with HELLO, empty until the client identifies itself.
+func (c *clientConn) clientName() string {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	if c.client == nil {
+		return ""
+	}
+	return c.client.Name
+}
+
+// identity is the authenticated user of the connection, empty when auth is disabled.
+func (c *clientConn) identity() string {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.user
+}
+
+func (c *clientConn) addTopic(topic Topic) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.topics[topic.Name] = struct{}{}
+}
+
+func (c *clientConn) addUnacked(id string) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.unacked[id] = struct{}{}
+}
+
+func (c *clientConn) dropUnacked(id string) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	delete(c.unacked, id)
+}
+
+// takeUnacked returns the unacked messages of the connection and forgets them.
+func (c *clientConn) takeUnacked() []string {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	ids := make([]string, 0, len(c.unacked))
+	for id := range c.unacked {
+		ids = append(ids, id)
+	}
+	c.unacked = make(map[string]struct{})
+
+	return ids
+}
+
+func (c *clientConn) delivered(topic Topic) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.deliveries[topic.Name]++
+}
+
+func (c *clientConn) publishedTo(topic Topic) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.published[topic.Name]++
+}
+
+func (c *clientConn) publishedOf(topic Topic) uint64 {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.published[topic.Name]
+}
+
+func (c *clientConn) deliveriesOf(topic Topic) uint64 {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.deliveries[topic.Name]
+}
+
+func (c *clientConn) received(n int) {
+	c.framesIn.Add(1)
+	c.bytesIn.Add(uint64(n))
+}
+
+// writeFrame buffers a whole frame. When other frames are already waiting for the lock the
+// flush is left to the last one of the batch, coalescing concurrent deliveries. A frame larger
+// than the buffer goes out with one vectored write, header and payload, instead of being copied.
+func (c *clientConn) writeFrame(format MessageFormat, payload []byte) error {
+	c.traceFrame("out", format, payload)
+
+	c.pending.Add(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	waiting := c.pending.Add(-1)
+
+	var header [frameHeaderSize]byte
+	header[0] = byte(format)
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	if len(payload) >= c.w.Size() {
+		return c.writeVectored(header[:], payload)
+	}
+
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+
+	if _, err := c.w.Write(payload); err != nil {
+		return err
+	}
+
+	c.wrote(len(payload))
+
+	if waiting > 0 {
+		return nil
+	}
+
+	return c.w.Flush()
+}
+
+// writeVectored flushes the buffered frames, then writes header and payload in a single writev
+// on TCP connections. Called with mu held, the frames of the other writers stay whole.
+func (c *clientConn) writeVectored(header, payload []byte) error {
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	bufs := net.Buffers{header, payload}
+	if _, err := bufs.WriteTo(c.Conn); err != nil {
+		return err
+	}
+
+	c.wrote(len(payload))
+	return nil
+}
+
+func (c *clientConn) wrote(n int) {
+	c.framesOut.Add(1)
+	c.bytesOut.Add(uint64(frameHeaderSize + n))
+}
+
+// clientConn returns the writer registered for conn, creating it the first time.
+func (s *Server) clientConn(conn net.Conn) *clientConn {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*clientConn)
+	}
+
+	c, ok := s.conns[conn]
+	if !ok {
+		c = newClientConn(s.connIDs.Add(1), conn)
+		s.conns[conn] = c
+	}
+
+	return c
+}
+
+// Connections lists every registered connection ordered by ID.
+func (s *Server) Connections() []ConnectionInfo {
+	s.connsMu.Lock()
+	infos := make([]ConnectionInfo, 0, len(s.conns))
+	for _, c := range s.conns {
+		infos = append(infos, c.info())
+	}
+	s.connsMu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos
+}
+
+// lookupClientConn returns the registered writer without creating one, a missing entry
+// means the connection was already disconnected.
+func (s *Server) lookupClientConn(conn net.Conn) (*clientConn, bool) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	c, ok := s.conns[conn]
+	return c, ok
+}
+
+// connByID returns the registered connection with the given ID, nil when there is none.
+func (s *Server) connByID(id uint64) *clientConn {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for _, c := range s.conns {
+		if c.id == id {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) removeClientConn(conn net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	delete(s.conns, conn)
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// countersKey holds the last checkpoint of the counters shown in /stats.
+const countersKey = metaPrefix + "counters"
+
+const defaultCheckpointInterval = time.Minute
+
+// Counters are the running totals of the broker, checkpointed to the store so they survive
+// a restart.
+type Counters struct {
+	// Sent is the messages written to the subscribers by topic.
+	Sent map[string]int64 `json:"sent"`
+	// Connections is how many connections were accepted, the last connection ID handed out.
+	Connections     uint64 `json:"connections"`
+	MaintenanceRuns int64  `json:"maintenance_runs"`
+	AckedDeleted    int64  `json:"acked_deleted"`
+	ReclaimedBytes  int64  `json:"reclaimed_bytes"`
+	PurgedMessages  int64  `json:"purged_messages"`
+	PurgedBytes     int64  `json:"purged_bytes"`
+}
+
+func (b BadgerDB) SaveCounters(counters Counters) error {
+	value, err := json.Marshal(counters)
+	if err != nil {
+		return err
+	}
+
+	return b.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(countersKey), value)
+	})
+}
+
+// LoadCounters returns zero counters when none were checkpointed yet.
+func (b BadgerDB) LoadCounters() (Counters, error) {
+	var counters Counters
+	err := b.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(countersKey))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, &counters)
+		})
+	})
+
+	return counters, err
+}
+
+func (m *MemoryStore) SaveCounters(counters Counters) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters = counters
+	return nil
+}
+
+func (m *MemoryStore) LoadCounters() (Counters, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.counters, nil
+}
+
+// counters snapshots the running totals.
+func (s *Server) counters() Counters {
+	c := Counters{
+		Sent:            make(map[string]int64),
+		Connections:     s.connIDs.Load(),
+		MaintenanceRuns: s.maintenance.runs.Load(),
+		AckedDeleted:    s.maintenance.ackedDeleted.Load(),
+		ReclaimedBytes:  s.maintenance.reclaimedBytes.Load(),
+		PurgedMessages:  s.maintenance.purgedMessages.Load(),
+		PurgedBytes:     s.maintenance.purgedBytes.Load(),
+	}
+
+	s.sentMu.Lock()
+	for topic, sent := range s.sentMessages {
+		c.Sent[topic.Name] = int64(sent.Load())
+	}
+	s.sentMu.Unlock()
+
+	return c
+}
+
+// restoreCounters picks up the totals where the last checkpoint left them, called before
+// any connection is accepted.
+func (s *Server) restoreCounters() error {
+	c, err := s.DB.LoadCounters()
+	if err != nil {
+		return err
+	}
+
+	s.connIDs.Store(c.Connections)
+	s.maintenance.runs.Store(c.MaintenanceRuns)
+	s.maintenance.ackedDeleted.Store(c.AckedDeleted)
+	s.maintenance.reclaimedBytes.Store(c.ReclaimedBytes)
+	s.maintenance.purgedMessages.Store(c.PurgedMessages)
+	s.maintenance.purgedBytes.Store(c.PurgedBytes)
+
+	s.sentMu.Lock()
+	defer s.sentMu.Unlock()
+
+	if s.sentMessages == nil {
+		s.sentMessages = make(map[Topic]*atomic.Int32)
+	}
+	for name, sent := range c.Sent {
+		val := &atomic.Int32{}
+		val.Store(int32(sent))
+		s.sentMessages[NewTopic(name)] = val
+	}
+
+	return nil
+}
+
+func (s *Server) checkpointCounters() {
+	if err := s.DB.SaveCounters(s.counters()); err != nil {
+		s.logger().Warn("cannot checkpoint counters", "err", err)
+	}
+}
+
+func (s *Server) runCheckpoints(quit <-chan struct{}) {
+	ticker := time.NewTicker(s.checkpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkpointCounters()
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a parsed cron expression: minute, hour, day of month, month and day of week,
+// one bit per value of each. A "*" day field leaves the other one alone to choose the days.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+var cronAliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron reads the five fields of a cron expression, each a "*", a value, a range or a
+// list of them, with an optional "/step". Sunday is 0 or 7.
+func parseCron(expr string) (cronSpec, error) {
+	if alias, ok := cronAliases[strings.TrimSpace(expr)]; ok {
+		expr = alias
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSpec{}, fmt.Errorf("cron %q: expected 5 fields, got %d", expr, len(fields))
+	}
+
+	var (
+		spec cronSpec
+		err  error
+	)
+	if spec.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return cronSpec{}, err
+	}
+	if spec.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return cronSpec{}, err
+	}
+	if spec.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return cronSpec{}, err
+	}
+	if spec.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return cronSpec{}, err
+	}
+	if spec.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return cronSpec{}, err
+	}
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	spec.anyDom, spec.anyDow = fields[2] == "*", fields[4] == "*"
+
+	return spec, nil
+}
+
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("cron field %q: invalid step", field)
+			}
+		}
+
+		from, to := lo, hi
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("cron field %q: invalid value %q", field, first)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("cron field %q: invalid value %q", field, last)
+				}
+			} else if hasStep {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("cron field %q: out of %d-%d", field, lo, hi)
+		}
+
+		for v := from; v <= to; v += step {
+			bits |= 1 << v
+		}
+	}
+
+	return bits, nil
+}
+
+// matches tells if the spec fires at the minute of t. When both day fields are restricted a
+// day matching either fires, as cron does.
+func (c cronSpec) matches(t time.Time) bool {
+	if c.minute&(1<<t.Minute()) == 0 || c.hour&(1<<t.Hour()) == 0 || c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
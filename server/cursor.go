@@ -0,0 +1,283 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const (
+	// sequencePrefix holds the last seq handed out for each topic.
+	sequencePrefix = "sequence/"
+	// cursorPrefix holds the acked prefix of every durable subscriber, per topic.
+	cursorPrefix = "cursor/"
+)
+
+func cursorKey(topic Topic, subscriber string) []byte {
+	return fmt.Appendf(nil, "%s%s/%s", cursorPrefix, topic.Name, subscriber)
+}
+
+// NextSeq hands out the next position of the topic, starting at 1.
+func (b BadgerDB) NextSeq(topic Topic) (uint64, error) {
+	var next uint64
+	err := b.updateWithRetry(func(txn *badger.Txn) error {
+		key := []byte(sequencePrefix + topic.Name)
+		next = 1
+
+		item, err := txn.Get(key)
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+		case err != nil:
+			return err
+		default:
+			if err = item.Value(func(v []byte) error {
+				next = binary.BigEndian.Uint64(v) + 1
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		return txn.Set(key, binary.BigEndian.AppendUint64(nil, next))
+	})
+
+	return next, err
+}
+
+func (b BadgerDB) LoadCursor(topic Topic, subscriber string) (uint64, error) {
+	var cursor uint64
+	err := b.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(cursorKey(topic, subscriber))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			cursor = binary.BigEndian.Uint64(v)
+			return nil
+		})
+	})
+
+	return cursor, err
+}
+
+// AdvanceCursor records the seq acked by the subscriber. The cursor moves across the acked
+// prefix only, an ACK past a seq still pending is kept after the cursor until that one is
+// acked, the catch up resends the seqs after the cursor. The value is the cursor then the
+// seqs acked past it, 8 bytes each.
+func (b BadgerDB) AdvanceCursor(topic Topic, subscriber string, seq uint64) error {
+	return b.updateWithRetry(func(txn *badger.Txn) error {
+		key := cursorKey(topic, subscriber)
+		var (
+			cursor uint64
+			acked  []uint64
+		)
+		item, err := txn.Get(key)
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+		case err != nil:
+			return err
+		default:
+			if err = item.Value(func(v []byte) error {
+				cursor, acked = decodeCursor(v)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		if seq <= cursor || slices.Contains(acked, seq) {
+			return nil
+		}
+		acked = append(acked, seq)
+		slices.Sort(acked)
+
+		for len(acked) > 0 {
+			pending, errPending := b.firstPending(txn, topic, cursor, acked[0])
+			if errPending != nil {
+				return errPending
+			}
+			if pending > 0 {
+				cursor = pending - 1
+				break
+			}
+			cursor, acked = acked[0], acked[1:]
+		}
+
+		return txn.Set(key, encodeCursor(cursor, acked))
+	})
+}
+
+// firstPending returns the first seq between after and before, both excluded, of a message
+// still to deliver, 0 when there is none. The seqs without a message, acked or dead lettered
+// hold no cursor back.
+func (b BadgerDB) firstPending(txn *badger.Txn, topic Topic, after, before uint64) (uint64, error) {
+	if before <= after+1 {
+		return 0, nil
+	}
+
+	prefix := topicPrefix(topic)
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Seek(messageKey(topic, after+1)); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		if !isMessageKey(prefix, item.Key()) {
+			continue
+		}
+
+		var msg Message
+		if err := item.Value(func(v []byte) error {
+			var err error
+			msg, err = decodeRecord(v)
+			return err
+		}); err != nil {
+			// a corrupt record is quarantined by the reads, it holds nothing back.
+			continue
+		}
+
+		if msg.Seq() >= before {
+			return 0, nil
+		}
+		if msg.deliverable() {
+			return msg.Seq(), nil
+		}
+	}
+
+	return 0, nil
+}
+
+func decodeCursor(v []byte) (uint64, []uint64) {
+	if len(v) < 8 {
+		return 0, nil
+	}
+
+	cursor := binary.BigEndian.Uint64(v)
+	acked := make([]uint64, 0, (len(v)-8)/8)
+	for rest := v[8:]; len(rest) >= 8; rest = rest[8:] {
+		acked = append(acked, binary.BigEndian.Uint64(rest))
+	}
+
+	return cursor, acked
+}
+
+func encodeCursor(cursor uint64, acked []uint64) []byte {
+	b := binary.BigEndian.AppendUint64(make([]byte, 0, 8*(len(acked)+1)), cursor)
+	for _, seq := range acked {
+		b = binary.BigEndian.AppendUint64(b, seq)
+	}
+
+	return b
+}
+
+// messagesAfter returns the stored messages of the topic with a seq greater than cursor.
+func (b BadgerDB) MessagesAfter(topic Topic, cursor uint64) ([]Message, error) {
+	var (
+		messages []Message
+		corrupt  []corruptRecord
+	)
+	err := b.View(func(txn *badger.Txn) error {
+		prefix := topicPrefix(topic)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(messageKey(topic, cursor+1)); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if !isMessageKey(prefix, item.Key()) {
+				continue
+			}
+
+			err := item.Value(func(v []byte) error {
+				msg, err := decodeRecord(v)
+				if err != nil {
+					return err
+				}
+
+				messages = append(messages, msg)
+				return nil
+			})
+			if err != nil {
+				corrupt = append(corrupt, newCorruptRecord(item, err))
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	b.quarantine(corrupt)
+	return messages, nil
+}
+
+func (s *Server) addDurableSubscriber(conn net.Conn, topic Topic, format MessageFormat, subscriber string, opts SubscribeOptions) {
+	// a member joining a group already connected gets the live flow only, the backlog
+	// went to the members before it.
+	catchUp := !s.groupConnected(topic, subscriber)
+
+	s.registerSubscriber(topic, subscriber)
+	client := s.subscribe(conn, topic, format, subscriber, opts)
+
+	if catchUp {
+		go s.catchUp(client, topic)
+	}
+}
+
+// catchUp sends a durable subscriber everything published after its cursor.
+func (s *Server) catchUp(client Client, topic Topic) {
+	cursor, err := s.DB.LoadCursor(topic, client.subscriber)
+	if err != nil {
+		s.logger().Error("cannot load cursor", "topic", topic.Name, "subscriber", client.subscriber, "err", err)
+		return
+	}
+
+	messages, err := s.DB.MessagesAfter(topic, cursor)
+	if err != nil {
+		s.logger().Error("cannot load messages after cursor", "topic", topic.Name, "cursor", cursor, "err", err)
+		return
+	}
+
+	for _, msg := range messages {
+		payload, err := encodeMessage(msg, client.Format)
+		if err != nil {
+			s.logger().Error("cannot marshall message", "err", err)
+			continue
+		}
+
+		if err = s.deliver(client, msg, payload); err != nil {
+			s.logger().Warn("catch up stopped", "topic", topic.Name, "subscriber", client.subscriber, "err", err)
+			return
+		}
+	}
+}
+
+// durableSubscriber returns the durable name conn subscribed to topic with, if any.
+func (s *Server) durableSubscriber(conn net.Conn, topic Topic) string {
+	for _, client := range s.clientsOf(topic) {
+		if client.conn == conn && client.subscriber != "" {
+			return client.subscriber
+		}
+	}
+
+	return ""
+}
+
+// groupConnected tells if a member of the consumer group is subscribed to topic.
+func (s *Server) groupConnected(topic Topic, group string) bool {
+	for _, client := range s.clientsOf(topic) {
+		if client.subscriber == group {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// registerDebugEndpoints serves the pprof profiles under /debug/pprof/ and the expvar
+// variables under /debug/vars, both admin only since they expose the process internals.
+func (s *Server) registerDebugEndpoints(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", s.adminOnly(pprof.Index))
+	mux.HandleFunc("GET /debug/pprof/cmdline", s.adminOnly(pprof.Cmdline))
+	mux.HandleFunc("GET /debug/pprof/profile", s.adminOnly(pprof.Profile))
+	mux.HandleFunc("GET /debug/pprof/symbol", s.adminOnly(pprof.Symbol))
+	mux.HandleFunc("POST /debug/pprof/symbol", s.adminOnly(pprof.Symbol))
+	mux.HandleFunc("GET /debug/pprof/trace", s.adminOnly(pprof.Trace))
+	mux.HandleFunc("GET /debug/vars", s.adminOnly(expvar.Handler().ServeHTTP))
+}
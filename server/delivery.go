@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/tomiok/queuety/server/observability"
+)
+
+// deliveryPrefix holds one record per (message, recipient), the value is deliveryPending
+// until that recipient acks.
+const deliveryPrefix = "delivery/"
+
+var (
+	deliveryPending = []byte{0}
+	deliveryAcked   = []byte{1}
+)
+
+// errDeliveryNotTracked is the ACK of a delivery the store has no record of, one the
+// recipient never got or was already taken back.
+var errDeliveryNotTracked = errors.New("delivery not tracked")
+
+func deliveryKey(messageID, recipient string) []byte {
+	return fmt.Appendf(nil, "%s%s/%s", deliveryPrefix, messageID, recipient)
+}
+
+// recipient names the subscriber of a delivery record. A durable subscriber goes by its name,
+// its record outlives the reconnects, an ephemeral one by its connection.
+func recipient(subscriber string, connID uint64) string {
+	if subscriber != "" {
+		return "sub/" + subscriber
+	}
+
+	return "conn/" + strconv.FormatUint(connID, 10)
+}
+
+func deliveryMessagePrefix(messageID string) []byte {
+	return fmt.Appendf(nil, "%s%s/", deliveryPrefix, messageID)
+}
+
+// trackDelivery records that the message was handed to the subscriber, an existing record
+// (a redelivery) keeps its state.
+func (b BadgerDB) TrackDelivery(messageID, recipient string) error {
+	return b.updateWithRetry(func(txn *badger.Txn) error {
+		key := deliveryKey(messageID, recipient)
+		if _, err := txn.Get(key); err == nil {
+			return nil
+		}
+
+		return txn.Set(key, deliveryPending)
+	})
+}
+
+func (b BadgerDB) UntrackDelivery(messageID, recipient string) error {
+	return b.DB.Update(func(txn *badger.Txn) error {
+		return txn.Delete(deliveryKey(messageID, recipient))
+	})
+}
+
+// ackDelivery marks the delivery to the recipient as acked and returns how many recipients
+// got the message and how many of them acked it, errDeliveryNotTracked without a record.
+func (b BadgerDB) AckDelivery(messageID, recipient string) (acked, total int, err error) {
+	err = b.updateWithRetry(func(txn *badger.Txn) error {
+		acked, total = 0, 0
+		key := deliveryKey(messageID, recipient)
+		if _, err := txn.Get(key); errors.Is(err, badger.ErrKeyNotFound) {
+			return errDeliveryNotTracked
+		} else if err != nil {
+			return err
+		}
+		if err := txn.Set(key, deliveryAcked); err != nil {
+			return err
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = deliveryMessagePrefix(messageID)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			total++
+			err := it.Item().Value(func(v []byte) error {
+				if bytes.Equal(v, deliveryAcked) {
+					acked++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return acked, total, err
+}
+
+// clearDeliveries drops the per subscriber records once the message is fully delivered.
+func (b BadgerDB) ClearDeliveries(messageID string) error {
+	return b.DB.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = deliveryMessagePrefix(messageID)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := txn.Delete(it.Item().KeyCopy(nil)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// fullyAcked tells whether enough subscribers acked, all of them unless a quorum is configured.
+func (s *Server) fullyAcked(acked, total int) bool {
+	if s.ackQuorum > 0 {
+		return acked >= s.ackQuorum || acked >= total
+	}
+
+	return acked >= total
+}
+
+func (s *Server) ack(conn net.Conn, message Message) {
+	if s.isTransient(message.Topic()) || message.fireAndForget {
+		return
+	}
+
+	cc := s.clientConn(conn)
+	connID := cc.id
+	subscriber := s.durableSubscriber(conn, message.Topic())
+	acked, total, err := s.DB.AckDelivery(message.ID(), recipient(subscriber, connID))
+	if errors.Is(err, errDeliveryNotTracked) {
+		// not one of its deliveries, it counts for nothing.
+		s.logger().Warn("ACK of an untracked delivery", "id", message.ID(), "conn_id", connID)
+		return
+	}
+	if err != nil {
+		s.logger().Error("cannot track ACK", "id", message.ID(), "err", err)
+		return
+	}
+	cc.dropUnacked(message.ID())
+	observability.MessagesAcked.WithLabelValues(message.Topic().Name).Inc()
+
+	s.trace(message, TraceEvent{Stage: TraceAcked, ConnectionID: connID, Subscriber: subscriber})
+
+	if subscriber != "" && message.Seq() > 0 {
+		if err = s.DB.AdvanceCursor(message.Topic(), subscriber, message.Seq()); err != nil {
+			s.logger().Error("cannot advance cursor", "subscriber", subscriber, "err", err)
+		}
+	}
+
+	// queue and exclusive topics deliver to one subscriber, a redelivery to another one too.
+	if s.modeOf(message.Topic()) == TopicFanout && !s.fullyAcked(acked, total) {
+		return
+	}
+
+	start := time.Now()
+	err = s.DB.Ack(message)
+	s.telemetry.StoreOp(context.Background(), "ack", start, err)
+	if err != nil {
+		s.logger().Error("cannot ACK message", "id", message.ID(), "err", err)
+		return
+	}
+
+	s.completed(message, acked, total)
+}
+
+// completed lets go of what the broker kept about a message stored as acked.
+func (s *Server) completed(message Message, acked, total int) {
+	if err := s.DB.ClearDeliveries(message.ID()); err != nil {
+		s.logger().Error("cannot clear deliveries", "id", message.ID(), "err", err)
+	}
+	s.ackDeadlines.Delete(message.ID())
+	s.trace(message, TraceEvent{Stage: TraceCompleted, Detail: fmt.Sprintf("%d of %d subscribers acked", acked, total)})
+
+	message.updateACK()
+	s.archiver.add(message)
+}
+
+// nack takes back a delivery the subscriber could not process, see retry.
+func (s *Server) nack(conn net.Conn, message Message) {
+	cc := s.clientConn(conn)
+	topic := message.Topic()
+	s.trace(message, TraceEvent{Stage: TraceNacked, ConnectionID: cc.id, Subscriber: s.durableSubscriber(conn, topic)})
+	observability.MessagesNacked.WithLabelValues(topic.Name).Inc()
+
+	s.ackDeadlines.Delete(message.ID())
+	s.retry(conn, message)
+}
+
+// retry counts a failed attempt of the message and delivers it again right away, to conn on
+// a fanout topic and to the next consumer on the other ones, until it runs out of attempts.
+func (s *Server) retry(conn net.Conn, message Message) {
+	topic := message.Topic()
+	message.mType = MessageTypeNew
+	message.ack = false
+	message.redelivered = true
+	if !s.isTransient(topic) {
+		saveUnsentMessage(message, FormatJSON, s.save)
+	}
+
+	// the attempt is counted by saveUnsentMessage and by the store, the redelivery carries it.
+	message.attempts += 2
+	if message.attempts >= maxDeliveryAttempts {
+		s.trace(message, TraceEvent{Stage: TraceDeadLettered, Attempts: message.attempts})
+		return
+	}
+	s.trace(message, TraceEvent{Stage: TraceRedelivered, Attempts: message.attempts})
+
+	if s.modeOf(topic) != TopicFanout {
+		go s.sendMessageSync(message, topic)
+		return
+	}
+
+	for _, client := range s.clientsOf(topic) {
+		if client.conn != conn {
+			continue
+		}
+
+		payload, err := encodeMessage(message, client.Format)
+		if err != nil {
+			s.logger().Error("cannot marshall message", "id", message.ID(), "err", err)
+			return
+		}
+		s.trackDeliveries(client, []Message{message})
+		go s.sendToClient(client, message, payload)
+		return
+	}
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+func Test_AckWaitsForEverySubscriber(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	srv := Server{DB: BadgerDB{DB: db}}
+
+	first, _ := net.Pipe()
+	second, _ := net.Pipe()
+
+	msg := NewMessageBuilder().
+		WithID("false-abc").
+		WithNextID("abc").
+		WithType(MessageTypeNew).
+		WithTopic(NewTopic("orders")).
+		Build()
+	srv.save(msg, FormatJSON)
+
+	for _, conn := range []net.Conn{first, second} {
+		if err = srv.DB.TrackDelivery(msg.ID(), recipient("", srv.clientConn(conn).id)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	srv.ack(first, msg)
+	if !keyExists(t, db, string(pendingKey(msg.ID()))) {
+		t.Fatal("message acked by one of two subscribers should still be pending")
+	}
+
+	// never got it, its ACK does not count for the second subscriber.
+	stranger, _ := net.Pipe()
+	srv.ack(stranger, msg)
+	if !keyExists(t, db, string(pendingKey(msg.ID()))) {
+		t.Fatal("message acked by a connection it was not delivered to should still be pending")
+	}
+
+	srv.ack(second, msg)
+	if keyExists(t, db, string(pendingKey(msg.ID()))) {
+		t.Fatal("message acked by every subscriber should not be pending")
+	}
+}
+
+func keyExists(t *testing.T, db *badger.DB, key string) bool {
+	t.Helper()
+
+	var found bool
+	err := db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(key))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	return found
+}
+
+func Test_RequeueDeadLetters(t *testing.T) {
+	topic := NewTopic("orders")
+	srv := Server{DB: NewMemoryStore(0), clients: map[Topic][]Client{topic: {}}}
+
+	for i, attempts := range []int{maxDeliveryAttempts, 0} {
+		id := strconv.Itoa(i)
+		seq, _ := srv.DB.NextSeq(topic)
+		msg := NewMessageBuilder().WithID("false-" + id).WithNextID(id).WithTopic(topic).WithSeq(seq).WithAttempts(attempts).Build()
+		if err := srv.DB.SaveMessage(msg, FormatJSON); err != nil {
+			t.Fatalf("cannot save %v", err)
+		}
+	}
+
+	letters, err := srv.DeadLetters(topic)
+	if err != nil || len(letters) != 1 || letters[0].ID() != "false-0" {
+		t.Fatalf("expected false-0 dead lettered, got %v %v", letters, err)
+	}
+
+	requeued, err := srv.RequeueDeadLetters(topic, nil)
+	if err != nil || requeued != 1 {
+		t.Fatalf("expected 1 requeued, got %d %v", requeued, err)
+	}
+
+	if letters, _ = srv.DeadLetters(topic); len(letters) != 0 {
+		t.Fatalf("expected no dead letters after the requeue, got %v", letters)
+	}
+	if pending, _ := srv.DB.PendingMessages(); len(pending) != 2 {
+		t.Fatalf("expected both messages redelivered by the scheduler, got %v", pending)
+	}
+}
+
+func Test_RequeueDeadLettersBefore(t *testing.T) {
+	topic := NewTopic("orders")
+	srv := Server{DB: NewMemoryStore(0), clients: map[Topic][]Client{topic: {}}}
+
+	for i := int64(1); i <= 3; i++ {
+		id := strconv.FormatInt(i, 10)
+		seq, _ := srv.DB.NextSeq(topic)
+		msg := NewMessageBuilder().WithID("false-" + id).WithNextID(id).WithTopic(topic).WithSeq(seq).WithTimestamp(i * 100).WithAttempts(maxDeliveryAttempts).Build()
+		if err := srv.DB.SaveMessage(msg, FormatJSON); err != nil {
+			t.Fatalf("cannot save %v", err)
+		}
+	}
+
+	requeued, err := srv.RequeueDeadLettersBefore(topic, time.Unix(300, 0))
+	if err != nil || requeued != 2 {
+		t.Fatalf("expected 2 requeued, got %d %v", requeued, err)
+	}
+
+	if letters, _ := srv.DeadLetters(topic); len(letters) != 1 || letters[0].ID() != "false-3" {
+		t.Fatalf("expected false-3 left dead lettered, got %v", letters)
+	}
+}
+
+func Test_MessageTrace(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	srv := Server{DB: BadgerDB{DB: db}}
+
+	first, _ := net.Pipe()
+	second, _ := net.Pipe()
+
+	msg := NewMessageBuilder().
+		WithID("false-abc").
+		WithNextID("abc").
+		WithType(MessageTypeNew).
+		WithTopic(NewTopic("orders")).
+		Build()
+	srv.save(msg, FormatJSON)
+
+	for _, conn := range []net.Conn{first, second} {
+		if err = srv.DB.TrackDelivery(msg.ID(), recipient("", srv.clientConn(conn).id)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	srv.ack(first, msg)
+	srv.ack(second, msg)
+
+	// the publishers know the message by its next ID too.
+	events, err := srv.MessageTrace("abc")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	want := []TraceStage{TracePersisted, TraceAcked, TraceAcked, TraceCompleted}
+	if len(events) != len(want) {
+		t.Fatalf("expected %v, got %+v", want, events)
+	}
+	for i, event := range events {
+		if event.Stage != want[i] || event.Time.IsZero() {
+			t.Fatalf("expected %v at %d, got %+v", want[i], i, event)
+		}
+	}
+	if events[2].ConnectionID != srv.clientConn(second).id {
+		t.Fatalf("expected the second ACK from connection %d, got %+v", srv.clientConn(second).id, events[2])
+	}
+}
+
+func Test_AckExtensionHoldsRedelivery(t *testing.T) {
+	srv := Server{DB: NewMemoryStore(0)}
+	consumer, _ := net.Pipe()
+
+	msg := NewMessageBuilder().
+		WithID("false-abc").
+		WithType(MessageTypeInProgress).
+		WithTopic(NewTopic("orders")).
+		WithBody([]byte(`{"seconds":120}`)).
+		Build()
+	srv.extendAck(consumer, FormatJSON, msg)
+
+	now := time.Now()
+	if !srv.ackExtended(msg.ID(), now) {
+		t.Fatal("expected the extended message held")
+	}
+	if srv.ackExtended(msg.ID(), now.Add(3*time.Minute)) || srv.ackExtended(msg.ID(), now) {
+		t.Fatal("expected the extension dropped once it ran out")
+	}
+
+	srv.extendAck(consumer, FormatJSON, msg)
+	srv.dropAckExtensions(srv.clientConn(consumer).id)
+	if srv.ackExtended(msg.ID(), now) {
+		t.Fatal("expected the extension gone with its connection")
+	}
+
+	if d, err := parseAckExtension([]byte(`{"seconds":3600}`)); err != nil || d != maxAckExtension {
+		t.Fatalf("expected the extension capped, got %s %v", d, err)
+	}
+}
+
+func Test_BatchIsOneFrameAckedAtOnce(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	srv := &Server{
+		DB:            BadgerDB{DB: db},
+		clients:       make(map[Topic][]Client),
+		durableTopics: make(map[Topic][]string),
+		sentMessages:  make(map[Topic]*atomic.Int32),
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	topic := NewTopic("orders")
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	srv.addNewSubscriber(conn, topic, FormatJSON, SubscribeOptions{BatchSize: 2})
+
+	for _, id := range []string{"1", "2"} {
+		msg := NewMessageBuilder().WithID("false-" + id).WithNextID(id).WithType(MessageTypeNew).WithTopic(topic).Build()
+		srv.sendMessageSync(msg, topic)
+	}
+
+	var header [5]byte
+	if _, err = io.ReadFull(peer, header[:]); err != nil {
+		t.Fatalf("%v", err)
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+	if _, err = io.ReadFull(peer, payload); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	frame, err := DecodeMessage(payload)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	messages, ok := frame.Batch()
+	if !ok || len(messages) != 2 || messages[0].ID() != "false-1" || messages[1].ID() != "false-2" {
+		t.Fatalf("expected both messages in one batch, got %v", frame)
+	}
+	// saved once the frame is written.
+	for _, m := range messages {
+		for deadline := time.Now().Add(time.Second); !keyExists(t, db, string(pendingKey(m.ID()))); {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %s pending before the ACK", m.ID())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	frame.mType = MessageTypeBatchAck
+	srv.ackBatch(conn, FormatJSON, frame)
+	for _, m := range messages {
+		if keyExists(t, db, string(pendingKey(m.ID()))) {
+			t.Fatalf("expected %s acked with the batch", m.ID())
+		}
+	}
+}
+
+func Test_DeliveriesOutliveReconnects(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	srv := &Server{
+		DB:            BadgerDB{DB: db},
+		clients:       make(map[Topic][]Client),
+		durableTopics: make(map[Topic][]string),
+		sentMessages:  make(map[Topic]*atomic.Int32),
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	topic := NewTopic("orders")
+	pipe := func() net.Conn {
+		conn, peer := net.Pipe()
+		go func() { _, _ = io.Copy(io.Discard, peer) }()
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+
+	msg := NewMessageBuilder().WithID("false-1").WithNextID("1").WithType(MessageTypeNew).WithTopic(topic).Build()
+	srv.save(msg, FormatJSON)
+	payload, err := encodeMessage(msg, FormatJSON)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ephemeral, billing := pipe(), pipe()
+	for _, c := range []Client{
+		srv.subscribe(ephemeral, topic, FormatJSON, "", SubscribeOptions{}),
+		srv.subscribe(billing, topic, FormatJSON, "billing", SubscribeOptions{}),
+	} {
+		if err = srv.deliver(c, msg, payload); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// billing comes back on a new connection, the ephemeral subscriber is gone for good.
+	srv.disconnect(ephemeral)
+	srv.disconnect(billing)
+	again := pipe()
+	srv.subscribe(again, topic, FormatJSON, "billing", SubscribeOptions{})
+
+	srv.ack(again, msg)
+	if keyExists(t, db, string(pendingKey(msg.ID()))) {
+		t.Fatal("expected the message acked once billing acked it on its new connection")
+	}
+}
+
+func Test_FanoutTracksEveryRecipientBeforeWriting(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	srv := &Server{
+		DB:            BadgerDB{DB: db},
+		clients:       make(map[Topic][]Client),
+		durableTopics: make(map[Topic][]string),
+		sentMessages:  make(map[Topic]*atomic.Int32),
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	topic := NewTopic("orders")
+	fast, fastPeer := net.Pipe()
+	slow, slowPeer := net.Pipe()
+	defer fast.Close()
+	defer slow.Close()
+	go func() { _, _ = io.Copy(io.Discard, slowPeer) }()
+
+	srv.subscribe(fast, topic, FormatJSON, "", SubscribeOptions{})
+	// the spent token holds its write back for a second.
+	srv.subscribe(slow, topic, FormatJSON, "", SubscribeOptions{MaxRate: 1}).deliveryLimiter.limiter.Allow()
+
+	msg := NewMessageBuilder().WithID("false-1").WithNextID("1").WithType(MessageTypeNew).WithTopic(topic).Build()
+	srv.sendMessageSync(msg, topic)
+
+	var header [5]byte
+	if _, err = io.ReadFull(fastPeer, header[:]); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = io.ReadFull(fastPeer, make([]byte, binary.LittleEndian.Uint32(header[1:]))); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for deadline := time.Now().Add(time.Second); !keyExists(t, db, string(pendingKey(msg.ID()))); {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the message pending before the ACK")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	srv.ack(fast, msg)
+	if !keyExists(t, db, string(pendingKey(msg.ID()))) {
+		t.Fatal("expected the message pending until the slow subscriber gets it and acks")
+	}
+}
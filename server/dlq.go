@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeadLetter is a pending message the scheduler gave up on, out of delivery attempts.
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	Topic     string    `json:"topic"`
+	Seq       uint64    `json:"seq"`
+	Attempts  int       `json:"attempts"`
+	Published time.Time `json:"published"`
+	Body      []byte    `json:"body"`
+}
+
+// DeadLetters returns the dead letters of the topic in publish order.
+func (s *Server) DeadLetters(topic Topic) ([]Message, error) {
+	messages, err := s.DB.MessagesAfter(topic, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(messages, func(m Message) bool {
+		return !strings.HasPrefix(m.ID(), MsgPrefixFalse) || m.Attempts() < maxDeliveryAttempts
+	}), nil
+}
+
+// RequeueDeadLetters gives the dead letters of the topic with the given IDs, or all of them
+// when ids is empty, a fresh set of delivery attempts and sends them again.
+func (s *Server) RequeueDeadLetters(topic Topic, ids []string) (int, error) {
+	return s.requeue(topic, func(m Message) bool {
+		return len(ids) == 0 || slices.Contains(ids, m.ID())
+	})
+}
+
+// RequeueDeadLettersBefore requeues the dead letters of the topic published before t.
+func (s *Server) RequeueDeadLettersBefore(topic Topic, t time.Time) (int, error) {
+	return s.requeue(topic, func(m Message) bool {
+		return m.Timestamp() < t.Unix()
+	})
+}
+
+func (s *Server) requeue(topic Topic, selected func(Message) bool) (int, error) {
+	letters, err := s.DeadLetters(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	var requeued int
+	for _, msg := range letters {
+		if !selected(msg) {
+			continue
+		}
+
+		msg.attempts = 0
+		if err = s.sendNewMessage(msg); err != nil {
+			return requeued, err
+		}
+		requeued++
+	}
+
+	return requeued, nil
+}
+
+// dlqTopics are the topics holding dead letters, ?topic= narrows them to one.
+func (s *Server) dlqTopics(r *http.Request) ([]Topic, error) {
+	if name := r.URL.Query().Get("topic"); name != "" {
+		return []Topic{NewTopic(name)}, nil
+	}
+
+	pending, err := s.DB.PendingStats()
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []Topic
+	for topic, p := range pending {
+		if p.DeadLettered > 0 {
+			topics = append(topics, topic)
+		}
+	}
+	slices.SortFunc(topics, func(a, b Topic) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return topics, nil
+}
+
+func (s *Server) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	topics, err := s.dlqTopics(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	letters := []DeadLetter{}
+	for _, topic := range topics {
+		messages, err := s.DeadLetters(topic)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, m := range messages {
+			letters = append(letters, DeadLetter{
+				ID:        m.ID(),
+				Topic:     topic.Name,
+				Seq:       m.Seq(),
+				Attempts:  m.Attempts(),
+				Published: time.Unix(m.Timestamp(), 0),
+				Body:      m.Body(),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(letters); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleRequeue sends the dead letters again, ?topic= is required and either ?ids= (comma
+// separated) or ?before= (RFC 3339 publish time) picks some of them.
+func (s *Server) handleRequeue(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("topic")
+	if name == "" {
+		http.Error(w, "missing topic", http.StatusBadRequest)
+		return
+	}
+
+	var ids []string
+	if v := q.Get("ids"); v != "" {
+		ids = strings.Split(v, ",")
+	}
+
+	var (
+		requeued int
+		err      error
+	)
+	if v := q.Get("before"); v != "" {
+		if len(ids) > 0 {
+			http.Error(w, "ids and before are exclusive", http.StatusBadRequest)
+			return
+		}
+		before, errParse := time.Parse(time.RFC3339, v)
+		if errParse != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+		requeued, err = s.RequeueDeadLettersBefore(NewTopic(name), before)
+	} else {
+		requeued, err = s.RequeueDeadLetters(NewTopic(name), ids)
+	}
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditRequeue, User: user, RemoteAddr: r.RemoteAddr, Topic: name, Detail: strconv.Itoa(requeued) + " messages"})
+
+	switch {
+	case errors.Is(err, errTopicNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errRateLimited):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(map[string]int{"requeued": requeued}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
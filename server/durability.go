@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Durability trades publish latency against what survives a crash.
+type Durability int
+
+const (
+	// DurabilityAsync persists every message and lets the storage engine fsync when it wants.
+	DurabilityAsync Durability = iota
+	// DurabilityNone never persists, undelivered messages are lost on a crash.
+	DurabilityNone
+	// DurabilitySync fsyncs after every persisted message.
+	DurabilitySync
+	// DurabilityBatch fsyncs every Config.SyncInterval when something was written.
+	DurabilityBatch
+)
+
+const defaultSyncInterval = 100 * time.Millisecond
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNone:
+		return "none"
+	case DurabilitySync:
+		return "sync"
+	case DurabilityBatch:
+		return "batch"
+	default:
+		return "async"
+	}
+}
+
+// durabilityOf resolves the mode of a topic, transient topics are never persisted and the
+// others fall back to the server default.
+func (s *Server) durabilityOf(topic Topic) Durability {
+	if s.isTransient(topic) {
+		return DurabilityNone
+	}
+
+	if d, ok := s.topicDurability[topic.Name]; ok {
+		return d
+	}
+
+	return s.durability
+}
+
+// batchSyncer fsyncs the store on an interval, only when a batch durable write happened.
+type batchSyncer struct {
+	store    Store
+	interval time.Duration
+	dirty    atomic.Bool
+	quit     chan struct{}
+	logger   *slog.Logger
+}
+
+func newBatchSyncer(store Store, interval time.Duration, logger *slog.Logger) *batchSyncer {
+	if interval <= 0 {
+		interval = defaultSyncInterval
+	}
+
+	return &batchSyncer{
+		store:    store,
+		interval: interval,
+		quit:     make(chan struct{}),
+		logger:   logger,
+	}
+}
+
+func (b *batchSyncer) markDirty() {
+	if b == nil {
+		return
+	}
+	b.dirty.Store(true)
+}
+
+func (b *batchSyncer) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.sync()
+		case <-b.quit:
+			b.sync()
+			return
+		}
+	}
+}
+
+func (b *batchSyncer) sync() {
+	if !b.dirty.Swap(false) {
+		return
+	}
+
+	if err := b.store.Sync(); err != nil {
+		b.dirty.Store(true)
+		b.logger.Error("cannot sync store", "err", err)
+	}
+}
+
+func (b *batchSyncer) stop() {
+	if b == nil {
+		return
+	}
+	close(b.quit)
+}
+
+// TopicClass is chosen when the topic is created with NEW_TOPIC.
+type TopicClass string
+
+const (
+	// TopicDurable persists the messages following the durability of the server, the default.
+	TopicDurable TopicClass = "durable"
+	// TopicTransient never touches the store, neither its messages nor the topic survive a restart.
+	TopicTransient TopicClass = "transient"
+	// TopicCompacted is durable and keeps only the latest message of every key, the state
+	// each new subscriber gets before the live messages.
+	TopicCompacted TopicClass = "compacted"
+	// TopicEphemeral is another name of TopicTransient.
+	TopicEphemeral TopicClass = "ephemeral"
+)
+
+// TopicOptions is the body of a NEW_TOPIC message, an empty body creates a durable topic.
+type TopicOptions struct {
+	Class TopicClass `json:"class,omitempty"`
+	// AutoDeleteAfter deletes a durable topic with its data once it had no subscribers and no
+	// publishes for as many seconds, 0 keeps it. The maintenance job checks it every GCInterval.
+	AutoDeleteAfter int64 `json:"auto_delete_after,omitempty"`
+	// Mode chooses between fan-out, the default, a queue and an exclusive consumer.
+	Mode TopicMode `json:"mode,omitempty"`
+	// VisibilityTimeout hides a message of a queue topic from the other consumers for as many
+	// seconds once delivered, it goes to the next one when it is not acked by then.
+	VisibilityTimeout int64 `json:"visibility_timeout,omitempty"`
+}
+
+func parseTopicOptions(body []byte) (TopicOptions, error) {
+	var opts TopicOptions
+	if len(body) > 0 && string(body) != "null" {
+		if err := json.Unmarshal(body, &opts); err != nil {
+			return TopicOptions{}, fmt.Errorf("invalid topic options: %w", err)
+		}
+	}
+
+	switch opts.Class {
+	case "":
+		opts.Class = TopicDurable
+	case TopicEphemeral:
+		opts.Class = TopicTransient
+	case TopicDurable, TopicTransient, TopicCompacted:
+	default:
+		return TopicOptions{}, fmt.Errorf("unknown topic class %q", opts.Class)
+	}
+
+	switch opts.Mode {
+	case "":
+		opts.Mode = TopicFanout
+	case TopicFanout, TopicQueue, TopicExclusive:
+	default:
+		return TopicOptions{}, fmt.Errorf("unknown topic mode %q", opts.Mode)
+	}
+	if opts.Mode != TopicFanout && opts.Class == TopicCompacted {
+		return TopicOptions{}, fmt.Errorf("a compacted topic cannot be a %s topic", opts.Mode)
+	}
+
+	if opts.AutoDeleteAfter < 0 {
+		return TopicOptions{}, fmt.Errorf("invalid auto_delete_after %d", opts.AutoDeleteAfter)
+	}
+	if opts.VisibilityTimeout < 0 {
+		return TopicOptions{}, fmt.Errorf("invalid visibility_timeout %d", opts.VisibilityTimeout)
+	}
+	if opts.VisibilityTimeout > 0 && opts.Mode != TopicQueue {
+		return TopicOptions{}, fmt.Errorf("a visibility timeout needs a %s topic", TopicQueue)
+	}
+
+	return opts, nil
+}
+
+// addTransientTopic creates a topic kept out of the store, it goes away with its last subscriber.
+// An existing durable topic stays durable.
+func (s *Server) addTransientTopic(name string) {
+	topic := NewTopic(name)
+	s.clientsMu.Lock()
+	if _, durable := s.durableTopics[topic]; durable {
+		s.clientsMu.Unlock()
+		s.logger().Warn("topic is durable already, ignoring the transient class", "topic", name)
+		return
+	}
+
+	if _, ok := s.clients[topic]; !ok {
+		s.clients[topic] = []Client{}
+	}
+	s.clientsMu.Unlock()
+	s.transientTopics.LoadOrStore(topic, new(atomic.Uint64))
+}
+
+func (s *Server) isTransient(topic Topic) bool {
+	_, ok := s.transientTopics.Load(topic)
+	return ok
+}
+
+// nextSeq hands out the next seq of the topic, from memory for transient topics.
+func (s *Server) nextSeq(topic Topic) (uint64, error) {
+	if seq, ok := s.transientTopics.Load(topic); ok {
+		return seq.(*atomic.Uint64).Add(1), nil
+	}
+
+	return s.DB.NextSeq(topic)
+}
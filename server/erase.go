@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var errNoCriteria = errors.New("an erasure needs ids, a key or a header")
+
+// Erasure selects the stored messages to delete for good, the body of POST /erase. The criteria
+// given must all match. Without an indexed header the stored messages of the topic are scanned,
+// of every topic when there is none.
+type Erasure struct {
+	// Topic narrows the erasure to one topic, every topic when empty.
+	Topic string `json:"topic,omitempty"`
+	// IDs are the ids of the messages, as given to the publisher or once acked.
+	IDs []string `json:"ids,omitempty"`
+	Key string   `json:"key,omitempty"`
+	// Header and Value match the messages carrying the header with the value, found through
+	// the index when the header is one of Config.IndexedHeaders.
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+func (e Erasure) matches(m Message) bool {
+	if e.Topic != "" && m.Topic().Name != e.Topic {
+		return false
+	}
+	if len(e.IDs) > 0 && !slices.Contains(e.IDs, m.ID()) && !slices.Contains(e.IDs, m.NextID()) {
+		return false
+	}
+	if e.Key != "" && m.Key() != e.Key {
+		return false
+	}
+	if e.Header != "" {
+		if value, ok := m.Headers()[e.Header]; !ok || value != e.Value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String is the erasure as the audit log records it.
+func (e Erasure) String() string {
+	var criteria []string
+	if len(e.IDs) > 0 {
+		criteria = append(criteria, "ids="+strings.Join(e.IDs, ","))
+	}
+	if e.Key != "" {
+		criteria = append(criteria, "key="+e.Key)
+	}
+	if e.Header != "" {
+		criteria = append(criteria, "header="+e.Header+"="+e.Value)
+	}
+
+	return strings.Join(criteria, " ")
+}
+
+// candidates are the stored messages the erasure looks at, the ones of the index when it can.
+func (s *Server) candidates(e Erasure) ([]Message, error) {
+	if e.Header != "" && slices.Contains(s.indexedHeaders, e.Header) {
+		return s.DB.SearchAttribute(e.Header, e.Value, 0)
+	}
+
+	var topics []Topic
+	if e.Topic != "" {
+		topics = []Topic{NewTopic(e.Topic)}
+	} else {
+		for topic := range s.topicsClients() {
+			topics = append(topics, topic)
+		}
+	}
+
+	var messages []Message
+	for _, topic := range topics {
+		stored, err := s.DB.MessagesAfter(topic, 0)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, stored...)
+	}
+
+	return messages, nil
+}
+
+// Erase deletes the stored messages matching e, pending or acked, with their deliveries, and
+// drops them from the index, the compacted values and the samples. It returns the ids erased.
+// The copies already sent to a sink or an archive stay there.
+func (s *Server) Erase(e Erasure) ([]string, error) {
+	if len(e.IDs) == 0 && e.Key == "" && e.Header == "" {
+		return nil, errNoCriteria
+	}
+	if e.Topic != "" {
+		if !s.hasTopic(NewTopic(e.Topic)) {
+			return nil, errTopicNotFound
+		}
+	}
+
+	messages, err := s.candidates(e)
+	if err != nil {
+		return nil, err
+	}
+
+	erased := []string{}
+	for _, m := range messages {
+		if !e.matches(m) {
+			continue
+		}
+
+		if err = s.DB.Delete(m); err != nil {
+			return erased, fmt.Errorf("cannot erase %s: %w", m.ID(), err)
+		}
+		if err = s.DB.ClearDeliveries(m.ID()); err != nil {
+			s.logger().Warn("cannot clear deliveries", "id", m.ID(), "err", err)
+		}
+		// the index keys hold the header values, they go too.
+		if attrs := s.indexedAttrs(m); attrs != nil {
+			if err = s.DB.DropAttributes(m, attrs); err != nil {
+				s.logger().Warn("cannot drop the index entries", "id", m.ID(), "err", err)
+			}
+		}
+		s.values.forget(m)
+		s.sampler.forget(m)
+		erased = append(erased, m.ID())
+	}
+
+	return erased, nil
+}
+
+// handleErase deletes the messages selected by the Erasure of the body. The erasure is audited
+// with its criteria and the ids erased, not with the content of the messages.
+func (s *Server) handleErase(w http.ResponseWriter, r *http.Request) {
+	var e Erasure
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, "invalid erasure: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	erased, err := s.Erase(e)
+
+	if !errors.Is(err, errNoCriteria) && !errors.Is(err, errTopicNotFound) {
+		user := adminUser(r)
+		s.audit(AuditEntry{
+			Action:     AuditErase,
+			User:       user,
+			RemoteAddr: r.RemoteAddr,
+			Topic:      e.Topic,
+			Detail:     fmt.Sprintf("%s: %d messages %s", e, len(erased), strings.Join(erased, ",")),
+		})
+	}
+
+	switch {
+	case errors.Is(err, errNoCriteria):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errTopicNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(map[string]any{"erased": len(erased), "ids": erased}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
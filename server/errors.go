@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrorCode tells clients why the broker rejected an operation.
+type ErrorCode string
+
+const (
+	ErrCodeUnknownTopic    ErrorCode = "UNKNOWN_TOPIC"
+	ErrCodeMalformedFrame  ErrorCode = "MALFORMED_FRAME"
+	ErrCodeUnknownFormat   ErrorCode = "UNKNOWN_FORMAT"
+	ErrCodeUnknownType     ErrorCode = "UNKNOWN_TYPE"
+	ErrCodeAuthRequired    ErrorCode = "AUTH_REQUIRED"
+	ErrCodeRateLimited     ErrorCode = "RATE_LIMITED"
+	ErrCodeInternal        ErrorCode = "INTERNAL"
+	ErrCodeSubscriberLimit ErrorCode = "SUBSCRIBER_LIMIT"
+	// ErrCodeSchemaMismatch rejects a publish whose body does not match the topic schema.
+	ErrCodeSchemaMismatch ErrorCode = "SCHEMA_MISMATCH"
+	// ErrCodeTxnConflict rejects a TXN acking a delivery acked already, by it or another consumer,
+	// or one it was never handed.
+	ErrCodeTxnConflict ErrorCode = "TXN_CONFLICT"
+	// ErrCodeReadOnly rejects a publish, a topic or a TXN sent to a replica, they go to the primary.
+	ErrCodeReadOnly ErrorCode = "READ_ONLY"
+)
+
+var (
+	errTopicNotFound   = errors.New("topic not found")
+	errRateLimited     = errors.New("rate limit queue full")
+	errSubscriberLimit = errors.New("topic has all its subscribers")
+	errReadOnly        = errors.New("read-only replica, publish to the primary")
+)
+
+// ErrorBody is the body of a MessageTypeError message.
+type ErrorBody struct {
+	Code        ErrorCode `json:"code"`
+	Description string    `json:"description"`
+	// MessageID is the ID of the rejected message, when there is one.
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// NewErrorMessage builds the ERROR message sent back for a rejected operation.
+func NewErrorMessage(code ErrorCode, description string, rejected Message) Message {
+	body, _ := json.Marshal(ErrorBody{
+		Code:        code,
+		Description: description,
+		MessageID:   rejected.ID(),
+	})
+
+	return NewMessageBuilder().
+		WithType(MessageTypeError).
+		WithTopic(rejected.Topic()).
+		WithBody(body).
+		WithTimestamp(time.Now().Unix()).
+		Build()
+}
+
+// ErrorBody decodes the code and description of an ERROR message.
+func (m *Message) ErrorBody() (ErrorBody, bool) {
+	if m.mType != MessageTypeError {
+		return ErrorBody{}, false
+	}
+
+	var body ErrorBody
+	if err := json.Unmarshal(m.body, &body); err != nil {
+		return ErrorBody{}, false
+	}
+
+	return body, true
+}
+
+func errorCode(err error) ErrorCode {
+	switch {
+	case errors.Is(err, errTopicNotFound):
+		return ErrCodeUnknownTopic
+	case errors.Is(err, errRateLimited):
+		return ErrCodeRateLimited
+	case errors.Is(err, errSubscriberLimit):
+		return ErrCodeSubscriberLimit
+	case errors.Is(err, errReadOnly):
+		return ErrCodeReadOnly
+	default:
+		return ErrCodeInternal
+	}
+}
+
+// sendError tells the client its operation was rejected. Unknown formats are answered in JSON.
+func (s *Server) sendError(conn net.Conn, format MessageFormat, code ErrorCode, description string, rejected Message) {
+	if format != FormatBinary {
+		format = FormatJSON
+	}
+
+	errMsg := NewErrorMessage(code, description, rejected)
+	payload, err := encodeMessage(errMsg, format)
+	if err != nil {
+		s.logger().Error("cannot marshall error message", "err", err)
+		return
+	}
+
+	if err = s.clientConn(conn).writeFrame(format, payload); err != nil {
+		s.logger().Warn("cannot write error frame", "err", err)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// frameTracer logs every frame of one connection, turned on from the admin API.
+type frameTracer struct {
+	logger *slog.Logger
+	// bodies logs the message bodies too, off unless asked for explicitly.
+	bodies bool
+}
+
+// traceFrame logs a frame going in or out of the connection when tracing is on for it.
+func (c *clientConn) traceFrame(direction string, format MessageFormat, payload []byte) {
+	t := c.tracer.Load()
+	if t == nil {
+		return
+	}
+
+	attrs := []any{"conn_id", c.id, "client", c.clientName(), "direction", direction, "format", format.name(), "size", frameHeaderSize + len(payload)}
+
+	msg, err := decodeFrame(format, payload)
+	if err != nil {
+		t.logger.Info("frame", append(attrs, "err", err)...)
+		return
+	}
+
+	attrs = append(attrs, "type", msg.Type(), "id", msg.ID(), "topic", msg.Topic().Name)
+	if t.bodies {
+		attrs = append(attrs, "body", string(msg.Body()))
+	}
+	t.logger.Info("frame", attrs...)
+}
+
+func decodeFrame(format MessageFormat, payload []byte) (Message, error) {
+	if format == FormatBinary {
+		var msg Message
+		err := msg.UnmarshalBinary(payload)
+		return msg, err
+	}
+
+	return DecodeMessage(payload)
+}
+
+func (f MessageFormat) name() string {
+	switch f {
+	case FormatJSON:
+		return "json"
+	case FormatBinary:
+		return "binary"
+	default:
+		return strconv.Itoa(int(f))
+	}
+}
+
+// TraceConnection logs the frames of the connection with the given ID, the message bodies
+// only when bodies is set.
+func (s *Server) TraceConnection(id uint64, bodies bool) error {
+	c := s.connByID(id)
+	if c == nil {
+		return ErrConnectionNotFound
+	}
+
+	c.tracer.Store(&frameTracer{logger: s.logger().With("component", "frame_trace"), bodies: bodies})
+	return nil
+}
+
+// UntraceConnection stops logging the frames of the connection.
+func (s *Server) UntraceConnection(id uint64) error {
+	c := s.connByID(id)
+	if c == nil {
+		return ErrConnectionNotFound
+	}
+
+	c.tracer.Store(nil)
+	return nil
+}
+
+func (s *Server) handleConnectionTrace(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+		return
+	}
+
+	detail := "off"
+	if r.Method == http.MethodPut {
+		bodies := r.URL.Query().Get("bodies") == "true"
+		detail = "on"
+		if bodies {
+			detail = "on with bodies"
+		}
+		err = s.TraceConnection(id, bodies)
+	} else {
+		err = s.UntraceConnection(id)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditConnectionTrace, User: user, RemoteAddr: r.RemoteAddr, Detail: r.PathValue("id") + " " + detail})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/tomiok/queuety/server/observability"
+)
+
+// GroupOffset is the committed position of a consumer group on a topic. Durable subscribers
+// sharing a name form the group, and share its cursor.
+type GroupOffset struct {
+	Topic     string `json:"topic"`
+	Group     string `json:"group"`
+	Committed uint64 `json:"committed"`
+	Latest    uint64 `json:"latest"`
+	Lag       uint64 `json:"lag"`
+}
+
+// routeByKey keeps a single member of every consumer group for a message with a key, the
+// same one for the key while the members stay, so each member gets the messages of its keys
+// in order. The other subscribers and the messages without a key are left as they are.
+func routeByKey(message Message, clients []Client) []Client {
+	if message.Key() == "" || len(clients) <= 1 {
+		return clients
+	}
+
+	members := make(map[string][]Client)
+	for _, c := range clients {
+		if c.subscriber != "" {
+			members[c.subscriber] = append(members[c.subscriber], c)
+		}
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(message.Key()))
+	hash := h.Sum32()
+
+	routed := make([]Client, 0, len(clients))
+	for _, c := range clients {
+		group := members[c.subscriber]
+		if c.subscriber == "" || len(group) == 1 || group[hash%uint32(len(group))].conn == c.conn {
+			routed = append(routed, c)
+		}
+	}
+
+	return routed
+}
+
+// LatestSeq returns the last seq handed out for the topic, 0 when nothing was published.
+func (b BadgerDB) LatestSeq(topic Topic) (uint64, error) {
+	var latest uint64
+	err := b.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(sequencePrefix + topic.Name))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			latest = binary.BigEndian.Uint64(v)
+			return nil
+		})
+	})
+
+	return latest, err
+}
+
+func (m *MemoryStore) LatestSeq(topic Topic) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.seqs[topic], nil
+}
+
+// GroupOffsets returns the committed position and lag of every consumer group, sorted by
+// topic and group.
+func (s *Server) GroupOffsets() ([]GroupOffset, error) {
+	s.clientsMu.RLock()
+	durable := make(map[Topic][]string, len(s.durableTopics))
+	for topic, groups := range s.durableTopics {
+		durable[topic] = slices.Clone(groups)
+	}
+	s.clientsMu.RUnlock()
+
+	offsets := []GroupOffset{}
+	for topic, groups := range durable {
+		latest, err := s.DB.LatestSeq(topic)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, group := range groups {
+			committed, err := s.DB.LoadCursor(topic, group)
+			if err != nil {
+				return nil, err
+			}
+
+			offsets = append(offsets, GroupOffset{
+				Topic:     topic.Name,
+				Group:     group,
+				Committed: committed,
+				Latest:    latest,
+				Lag:       latest - min(committed, latest),
+			})
+		}
+	}
+
+	slices.SortFunc(offsets, func(a, b GroupOffset) int {
+		if c := strings.Compare(a.Topic, b.Topic); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Group, b.Group)
+	})
+
+	return offsets, nil
+}
+
+func (s *Server) handleGroups(w http.ResponseWriter, _ *http.Request) {
+	offsets, err := s.GroupOffsets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(offsets); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// groupLags feeds the lag gauges of /metrics.
+func (s *Server) groupLags() ([]observability.GroupLag, error) {
+	offsets, err := s.GroupOffsets()
+	if err != nil {
+		return nil, err
+	}
+
+	lags := make([]observability.GroupLag, len(offsets))
+	for i, o := range offsets {
+		lags[i] = observability.GroupLag{Topic: o.Topic, Group: o.Group, Lag: o.Lag}
+	}
+
+	return lags, nil
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/tomiok/queuety/server/observability"
+)
+
+// canaryKey is overwritten by every storage probe.
+const canaryKey = metaPrefix + "canary"
+
+const defaultHealthCheckInterval = 10 * time.Second
+
+// Probe writes a canary value and reads it back, failing when the store cannot take writes.
+func (b BadgerDB) Probe() error {
+	value := strconv.AppendInt(nil, time.Now().UnixNano(), 10)
+	if err := b.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(canaryKey), value)
+	}); err != nil {
+		return err
+	}
+
+	return b.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(canaryKey))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			if !bytes.Equal(v, value) {
+				return errors.New("canary read back a different value")
+			}
+			return nil
+		})
+	})
+}
+
+func (m *MemoryStore) Probe() error {
+	return nil
+}
+
+// storageHealth is the outcome of the last storage probe.
+type storageHealth struct {
+	mu        sync.Mutex
+	checked   bool
+	err       error
+	lastCheck time.Time
+	failures  int
+}
+
+type readiness struct {
+	Ready     bool      `json:"ready"`
+	Error     string    `json:"error,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+	// Failures is how many probes in a row failed.
+	Failures int `json:"failures,omitempty"`
+	// Standby is set while the broker mirrors a primary, it is not ready until promoted.
+	Standby bool `json:"standby,omitempty"`
+}
+
+func (h *storageHealth) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checked = true
+	h.err = err
+	h.lastCheck = time.Now()
+	if err != nil {
+		h.failures++
+	} else {
+		h.failures = 0
+	}
+}
+
+func (h *storageHealth) readiness() readiness {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := readiness{Ready: h.checked && h.err == nil, LastCheck: h.lastCheck, Failures: h.failures}
+	if h.err != nil {
+		r.Error = h.err.Error()
+	}
+	return r
+}
+
+func (s *Server) probeStorage() {
+	err := s.DB.Probe()
+	s.health.record(err)
+
+	if err != nil {
+		observability.StorageHealthy.Set(0)
+		observability.StorageProbeFailures.Inc()
+		s.logger().Error("storage probe failed", "err", err)
+		return
+	}
+	observability.StorageHealthy.Set(1)
+}
+
+func (s *Server) runHealthChecks(quit <-chan struct{}) {
+	ticker := time.NewTicker(s.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.probeStorage()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// handleReady answers 503 until the first storage probe succeeds and whenever the last one failed.
+func (s *Server) handleReady(w http.ResponseWriter, _ *http.Request) {
+	r := s.health.readiness()
+	if s.mirror.isStandby() {
+		r.Ready, r.Standby = false, true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !r.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// Version and Commit identify the build, set with
+// -ldflags "-X github.com/tomiok/queuety/server.Version=v1.2.0 -X github.com/tomiok/queuety/server.Commit=abc123".
+// Commit falls back to the VCS revision stamped by go build.
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// The roles of a broker in its cluster, told in Info and BrokerHello.
+const (
+	// RolePrimary takes the publishes.
+	RolePrimary = "primary"
+	// RoleReplica serves subscribers of the topics of a primary, see ReplicaConfig.
+	RoleReplica = "replica"
+	// RoleStandby mirrors a primary and takes no client until promoted, see MirrorConfig.
+	RoleStandby = "standby"
+)
+
+// Info describes the running broker, see handleInfo.
+type Info struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+	Role    string `json:"role"`
+	// Primary is the broker address of the primary of a replica.
+	Primary   string    `json:"primary,omitempty"`
+	GoVersion string    `json:"go_version"`
+	StartedAt time.Time `json:"started_at"`
+	// Uptime is in seconds.
+	Uptime   int64      `json:"uptime"`
+	Limits   InfoLimits `json:"limits"`
+	Features []string   `json:"features"`
+	Formats  []string   `json:"formats"`
+	// Capabilities are negotiated by the clients with HELLO, see Features.
+	Capabilities []string `json:"capabilities"`
+	Types        []MType  `json:"message_types"`
+}
+
+// InfoLimits are the limits configured on the broker, 0 means unlimited.
+type InfoLimits struct {
+	MaxFrameSize                   int `json:"max_frame_size"`
+	MaxMessagesPerSecond           int `json:"max_messages_per_second"`
+	RateLimitQueueSize             int `json:"rate_limit_queue_size"`
+	MaxBytesPerSecond              int `json:"max_bytes_per_second"`
+	MaxSubscriberBytesPerSecond    int `json:"max_subscriber_bytes_per_second"`
+	MaxSubscriberMessagesPerSecond int `json:"max_subscriber_messages_per_second"`
+	MaxDeliveryAttempts            int `json:"max_delivery_attempts"`
+	// AckQuorum is 0 when every subscriber has to ACK.
+	AckQuorum int `json:"ack_quorum"`
+}
+
+func commit() string {
+	if Commit != "" {
+		return Commit
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, setting := range bi.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+
+	return ""
+}
+
+// Info returns the build, the limits and the features of the broker.
+func (s *Server) Info() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    commit(),
+		Role:      s.Role(),
+		Primary:   s.primaryAddr(),
+		GoVersion: runtime.Version(),
+		StartedAt: s.startedAt,
+		Uptime:    int64(time.Since(s.startedAt).Seconds()),
+		Limits: InfoLimits{
+			MaxFrameSize:                   s.frameLimit(),
+			MaxSubscriberBytesPerSecond:    s.subscriberBytesPerSecond,
+			MaxSubscriberMessagesPerSecond: s.subscriberMessagesPerSecond,
+			MaxDeliveryAttempts:            maxDeliveryAttempts,
+			AckQuorum:                      s.ackQuorum,
+		},
+		Features:     s.features(),
+		Formats:      []string{"json", "binary"},
+		Capabilities: Features(),
+		Types: []MType{
+			MessageTypeAuth, MessageTypeHello, MessageTypeNewTopic, MessageTypeNewSubscriber,
+			MessageTypeNew, MessageTypeACK, MessageTypeNack, MessageTypeInProgress, MessageTypeBatch,
+			MessageTypeBatchAck, MessageTypeTxn, MessageTypeReplay, MessageTypeMetadata,
+		},
+	}
+
+	if s.rateLimiter != nil {
+		info.Limits.MaxMessagesPerSecond = int(s.rateLimiter.limiter.Limit())
+		info.Limits.RateLimitQueueSize = cap(s.rateLimiter.queue)
+	}
+	if s.byteLimiter != nil {
+		info.Limits.MaxBytesPerSecond = int(s.byteLimiter.limiter.Limit())
+	}
+
+	return info
+}
+
+// Role tells what the broker is in its cluster, RolePrimary unless configured otherwise.
+func (s *Server) Role() string {
+	switch {
+	case s.mirror.isStandby():
+		return RoleStandby
+	case s.replica != nil:
+		return RoleReplica
+	default:
+		return RolePrimary
+	}
+}
+
+// primaryAddr is the broker address of the primary a replica follows, empty otherwise.
+func (s *Server) primaryAddr() string {
+	if s.replica == nil {
+		return ""
+	}
+
+	return s.replica.cfg.Primary
+}
+
+// features lists the optional parts of the broker enabled in this process, sorted.
+func (s *Server) features() []string {
+	ipf := s.CurrentIPFilter()
+	enabled := map[string]bool{
+		"auth":            s.needAuth(),
+		"rate_limit":      s.rateLimiter != nil,
+		"archive":         s.archiver != nil,
+		"sinks":           len(s.sinks) > 0,
+		"write_behind":    s.writeBehind != nil,
+		"snapshots":       s.snapshotDir != "",
+		"prometheus":      s.prometheusMetrics,
+		"telemetry":       s.telemetry != nil,
+		"webhooks":        s.notifier != nil,
+		"debug_endpoints": s.debugEndpoints,
+		"ip_filter":       len(ipf.Allowed)+len(ipf.Denied) > 0,
+		"http_consume":    true,
+	}
+
+	features := make([]string, 0, len(enabled))
+	for name, on := range enabled {
+		if on {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+
+	return features
+}
+
+// handleInfo serves GET /info, for the fleet tooling to check a rollout and for the clients to
+// adapt to the broker.
+func (s *Server) handleInfo(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Info()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
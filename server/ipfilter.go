@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IPFilter is the subnets the broker accepts connections from. A denied subnet wins over an
+// allowed one, an empty Allowed accepts everything not denied.
+type IPFilter struct {
+	Allowed []string `json:"allowed"`
+	Denied  []string `json:"denied"`
+}
+
+// ipFilter is the parsed IPFilter checked in the accept loop.
+type ipFilter struct {
+	cfg     IPFilter
+	allowed []netip.Prefix
+	denied  []netip.Prefix
+}
+
+func newIPFilter(cfg IPFilter) (*ipFilter, error) {
+	allowed, err := parseCIDRs(cfg.Allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	denied, err := parseCIDRs(cfg.Denied)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Allowed == nil {
+		cfg.Allowed = []string{}
+	}
+	if cfg.Denied == nil {
+		cfg.Denied = []string{}
+	}
+
+	return &ipFilter{cfg: cfg, allowed: allowed, denied: denied}, nil
+}
+
+// parseCIDRs parses the subnets, a bare address stands for itself alone.
+func parseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func (f *ipFilter) permits(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range f.denied {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+
+	if len(f.allowed) == 0 {
+		return true
+	}
+	for _, p := range f.allowed {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// permitted reports whether the filter accepts the remote address, the addresses without an
+// IP (pipes, unix sockets) are always accepted.
+func (s *Server) permitted(remote net.Addr) bool {
+	f := s.ipFilter.Load()
+	if f == nil || remote == nil {
+		return true
+	}
+
+	addrPort, err := netip.ParseAddrPort(remote.String())
+	if err != nil {
+		return true
+	}
+
+	return f.permits(addrPort.Addr())
+}
+
+// SetIPFilter replaces the subnets accepted by the broker and closes the connections the new
+// filter rejects, returning how many were closed.
+func (s *Server) SetIPFilter(cfg IPFilter) (int, error) {
+	f, err := newIPFilter(cfg)
+	if err != nil {
+		return 0, err
+	}
+	s.ipFilter.Store(f)
+
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	var closed int
+	for conn := range s.conns {
+		if !s.permitted(conn.RemoteAddr()) {
+			if conn.Close() == nil {
+				closed++
+			}
+		}
+	}
+
+	return closed, nil
+}
+
+// CurrentIPFilter returns the subnets accepted by the broker.
+func (s *Server) CurrentIPFilter() IPFilter {
+	f := s.ipFilter.Load()
+	if f == nil {
+		return IPFilter{Allowed: []string{}, Denied: []string{}}
+	}
+
+	return f.cfg
+}
+
+// handleIPFilter serves GET /ipfilter and PUT /ipfilter, the body of the PUT is an IPFilter
+// replacing the current one.
+func (s *Server) handleIPFilter(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var cfg IPFilter
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		closed, err := s.SetIPFilter(cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user := adminUser(r)
+		s.audit(AuditEntry{
+			Action:     AuditIPFilter,
+			User:       user,
+			RemoteAddr: r.RemoteAddr,
+			Detail:     fmt.Sprintf("allowed %v denied %v, %d connections closed", cfg.Allowed, cfg.Denied, closed),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.CurrentIPFilter()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_IPFilterPermits(t *testing.T) {
+	f, err := newIPFilter(IPFilter{Allowed: []string{"10.0.0.0/8", "192.168.1.7"}, Denied: []string{"10.1.0.0/16"}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for addr, want := range map[string]bool{
+		"10.2.3.4":          true,
+		"10.1.2.3":          false,
+		"192.168.1.7":       true,
+		"192.168.1.8":       false,
+		"::ffff:10.2.3.4":   true,
+		"2001:db8::1":       false,
+		"::ffff:10.1.255.1": false,
+	} {
+		if got := f.permits(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("%s: expected %v, got %v", addr, want, got)
+		}
+	}
+
+	if _, err = newIPFilter(IPFilter{Denied: []string{"10.0.0.0/33"}}); err == nil {
+		t.Fatal("expected an invalid CIDR to fail")
+	}
+}
+
+func Test_IPFilterRejectsConnections(t *testing.T) {
+	srv, err := NewServer(Config{
+		Protocol:      "tcp",
+		WebServerPort: "localhost:0",
+		InMemoryData:  true,
+		Duration:      time.Hour,
+		DeniedCIDRs:   []string{"127.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go func() { _ = srv.Serve(l) }()
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	expectClosed := func(conn net.Conn) {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+			t.Fatalf("expected the connection closed by the broker, got %v", err)
+		}
+	}
+
+	denied, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer denied.Close()
+	expectClosed(denied)
+
+	if _, err = srv.SetIPFilter(IPFilter{Allowed: []string{"127.0.0.1"}}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	allowed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer allowed.Close()
+
+	for deadline := time.Now().Add(time.Second); len(srv.Connections()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the allowed connection registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	closed, err := srv.SetIPFilter(IPFilter{Allowed: []string{"10.0.0.0/8"}})
+	if err != nil || closed != 1 {
+		t.Fatalf("expected the connection outside the new filter closed, got %d %v", closed, err)
+	}
+	expectClosed(allowed)
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
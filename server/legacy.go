@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// legacyMessage is how the old queuety/server stored a message, its exported fields encoded
+// without tags. The keys differ from messageJSON in next_id and body_string only, the others
+// match case-insensitively, so a legacy record decoded as a current one loses those two.
+type legacyMessage struct {
+	ID         string
+	NextID     string
+	Type       MType
+	User       string
+	Password   string
+	Topic      Topic
+	Body       json.RawMessage
+	BodyString string
+	Timestamp  int64
+	ACK        bool
+	Attempts   int
+}
+
+// decodeLegacyRecord decodes a record of the old queuety/server, false when v is not one.
+func decodeLegacyRecord(v []byte) (Message, bool) {
+	v = bytes.TrimSpace(v)
+	if len(v) == 0 || v[0] != '{' {
+		return Message{}, false
+	}
+
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(v, &keys); err != nil {
+		return Message{}, false
+	}
+	if _, ok := keys["NextID"]; !ok {
+		return Message{}, false
+	}
+
+	var lm legacyMessage
+	if err := json.Unmarshal(v, &lm); err != nil {
+		return Message{}, false
+	}
+
+	// the string form was the body as sent, Body may be its base64 when it was a []byte.
+	body := lm.Body
+	if lm.BodyString != "" {
+		body = json.RawMessage(lm.BodyString)
+	}
+
+	return NewMessageBuilder().
+		WithID(lm.ID).
+		WithNextID(lm.NextID).
+		WithType(lm.Type).
+		WithUser(lm.User).
+		WithTopic(lm.Topic).
+		WithBody(body).
+		WithTimestamp(lm.Timestamp).
+		WithAck(lm.ACK).
+		WithAttempts(lm.Attempts).
+		Build(), true
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// LogFormat is the encoding of the log records.
+type LogFormat string
+
+const (
+	LogFormatText LogFormat = "text"
+	LogFormatJSON LogFormat = "json"
+)
+
+// NewLogger creates the logger of Config.Logger, writing records of level and above to w.
+func NewLogger(w io.Writer, level slog.Level, format LogFormat) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// ParseLogLevel reads debug, info, warn or error, as found in flags and env vars.
+func ParseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+
+	return level, nil
+}
+
+// loggerOr falls back to the default logger, for the values built without NewServer.
+func loggerOr(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+
+	return l
+}
+
+func (s *Server) logger() *slog.Logger {
+	return loggerOr(s.log)
+}
+
+func (b BadgerDB) logger() *slog.Logger {
+	return loggerOr(b.Logger)
+}
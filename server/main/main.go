@@ -1,8 +1,13 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/tomiok/queuety/server"
@@ -19,7 +24,17 @@ func main() {
 		badgerPath = "/tmp/badger1" //for local and NOT using docker, use tmp. Otherwise, go through Dockerfile env variable.
 	}
 
-	s, err := server.NewServer(server.Config{
+	level, err := server.ParseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		level = slog.LevelInfo
+	}
+	logger := server.NewLogger(os.Stderr, level, server.LogFormat(os.Getenv("LOG_FORMAT")))
+
+	// docker stop sends SIGTERM, a terminal SIGINT.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	cfg := server.Config{
 		Protocol:      "tcp4",
 		Port:          portBrokerDefault,
 		WebServerPort: portWebDefault,
@@ -30,16 +45,109 @@ func main() {
 		RateLimitEnabled:     true,
 		MaxMessagesPerSecond: 10,
 		RateLimitQueueSize:   1000,
-	})
 
-	if err != nil {
-		panic(err)
+		Logger:            logger,
+		DebugEndpoints:    os.Getenv("DEBUG_ENDPOINTS") == "true",
+		PrometheusMetrics: os.Getenv("PROMETHEUS_METRICS") == "true",
+	}
+
+	if v := os.Getenv("ALLOWED_CIDRS"); v != "" {
+		cfg.AllowedCIDRs = strings.Split(v, ",")
+	}
+	if v := os.Getenv("DENIED_CIDRS"); v != "" {
+		cfg.DeniedCIDRs = strings.Split(v, ",")
+	}
+
+	// a standby copies the store of MIRROR_PRIMARY until promoted.
+	if primary := os.Getenv("MIRROR_PRIMARY"); primary != "" {
+		cfg.Mirror = &server.MirrorConfig{
+			Primary:  primary,
+			User:     os.Getenv("MIRROR_USER"),
+			Password: os.Getenv("MIRROR_PASSWORD"),
+		}
+	}
+
+	// a replica follows REPLICA_TOPICS, comma separated, on REPLICA_PRIMARY.
+	if primary := os.Getenv("REPLICA_PRIMARY"); primary != "" {
+		cfg.Replica = &server.ReplicaConfig{
+			Primary:  primary,
+			User:     os.Getenv("REPLICA_USER"),
+			Password: os.Getenv("REPLICA_PASSWORD"),
+			Topics:   strings.Split(os.Getenv("REPLICA_TOPICS"), ","),
+			Name:     os.Getenv("REPLICA_NAME"),
+		}
+	}
+
+	// the tokens of OIDC_ISSUER log in, OIDC_GROUPS and OIDC_ADMIN_GROUPS comma separated.
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		cfg.OIDC = &server.OIDCConfig{Issuer: issuer, Audience: os.Getenv("OIDC_AUDIENCE")}
+		if v := os.Getenv("OIDC_GROUPS"); v != "" {
+			cfg.OIDC.Groups = strings.Split(v, ",")
+		}
+		if v := os.Getenv("OIDC_ADMIN_GROUPS"); v != "" {
+			cfg.OIDC.AdminGroups = strings.Split(v, ",")
+		}
+	}
+
+	if v := os.Getenv("INDEXED_HEADERS"); v != "" {
+		cfg.IndexedHeaders = strings.Split(v, ",")
 	}
+	if v := os.Getenv("SAMPLE_RATES"); v != "" {
+		cfg.SampleRates = sampleRatesFromEnv(v, logger)
+	}
+
+	if bucket := os.Getenv("SINK_BUCKET"); bucket != "" {
+		cfg.Sinks = []server.SinkConfig{sinkFromEnv(bucket)}
+	}
+
+	logger.Info("broker running", "port", portBrokerDefault, "web_port", portWebDefault)
+
+	if err = server.Run(ctx, cfg); err != nil {
+		logger.Error("broker stopped", "err", err)
+		os.Exit(1)
+	}
+
+	logger.Info("broker stopped")
+}
 
-	log.Printf("broker running on port %s \n Web server running on port %s \n",
-		portBrokerDefault,
-		portWebDefault,
-	)
+// sampleRatesFromEnv reads SAMPLE_RATES, topic=fraction pairs comma separated as in
+// orders=0.01,payments=1. A pair that does not parse is skipped.
+func sampleRatesFromEnv(v string, logger *slog.Logger) map[string]float64 {
+	rates := make(map[string]float64)
+	for _, pair := range strings.Split(v, ",") {
+		name, fraction, _ := strings.Cut(pair, "=")
+		rate, err := strconv.ParseFloat(fraction, 64)
+		if name == "" || err != nil || rate <= 0 || rate > 1 {
+			logger.Warn("invalid sample rate, skipping", "pair", pair)
+			continue
+		}
+		rates[name] = rate
+	}
+
+	return rates
+}
+
+// sinkFromEnv copies the topics of SINK_TOPICS, all of them when empty, to the bucket.
+func sinkFromEnv(bucket string) server.SinkConfig {
+	region := os.Getenv("SINK_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	var topics []string
+	if v := os.Getenv("SINK_TOPICS"); v != "" {
+		topics = strings.Split(v, ",")
+	}
 
-	log.Fatal(s.Start())
+	return server.SinkConfig{
+		Store: server.S3ObjectStore{
+			Endpoint:  os.Getenv("SINK_ENDPOINT"),
+			Region:    region,
+			Bucket:    bucket,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		},
+		Topics: topics,
+		Prefix: os.Getenv("SINK_PREFIX"),
+	}
 }
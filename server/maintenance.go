@@ -0,0 +1,188 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const (
+	defaultGCInterval = 10 * time.Minute
+	// gcDiscardRatio rewrites a value log file when half of it is garbage.
+	gcDiscardRatio = 0.5
+)
+
+// maintenanceStats are the counters of the cleanup job, shown in /stats.
+type maintenanceStats struct {
+	Runs           int64 `json:"runs"`
+	AckedDeleted   int64 `json:"acked_deleted"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+	PurgedMessages int64 `json:"purged_messages"`
+	PurgedBytes    int64 `json:"purged_bytes"`
+	// IdleTopicsDeleted counts the topics deleted by their auto delete period.
+	IdleTopicsDeleted int64 `json:"idle_topics_deleted"`
+	// CompactedMessages counts the superseded messages of compacted topics deleted.
+	CompactedMessages int64     `json:"compacted_messages"`
+	LastRun           time.Time `json:"last_run"`
+}
+
+type maintenance struct {
+	runs              atomic.Int64
+	ackedDeleted      atomic.Int64
+	reclaimedBytes    atomic.Int64
+	purgedMessages    atomic.Int64
+	purgedBytes       atomic.Int64
+	idleTopicsDeleted atomic.Int64
+	compactedMessages atomic.Int64
+	lastRun           atomic.Int64
+}
+
+func (m *maintenance) stats() maintenanceStats {
+	var last time.Time
+	if ts := m.lastRun.Load(); ts > 0 {
+		last = time.Unix(0, ts)
+	}
+
+	return maintenanceStats{
+		Runs:              m.runs.Load(),
+		AckedDeleted:      m.ackedDeleted.Load(),
+		ReclaimedBytes:    m.reclaimedBytes.Load(),
+		PurgedMessages:    m.purgedMessages.Load(),
+		PurgedBytes:       m.purgedBytes.Load(),
+		IdleTopicsDeleted: m.idleTopicsDeleted.Load(),
+		CompactedMessages: m.compactedMessages.Load(),
+		LastRun:           last,
+	}
+}
+
+// runMaintenance deletes the acked messages past their grace period, applies the topic
+// retention policies, deletes the idle topics, compacts the compacted ones and collects the storage garbage, every gcInterval.
+func (s *Server) runMaintenance(quit <-chan struct{}) {
+	ticker := time.NewTicker(s.gcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.maintain()
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (s *Server) maintain() {
+	// with archiving on, the local acked copies are removed once uploaded.
+	if s.ackedRetention > 0 && s.archiver == nil {
+		deleted, err := s.DB.DeleteAckedBefore(time.Now().Add(-s.ackedRetention))
+		if err != nil {
+			s.logger().Error("cannot delete acked messages", "err", err)
+		}
+		s.maintenance.ackedDeleted.Add(int64(deleted))
+	}
+
+	s.applyRetention(time.Now())
+	s.deleteIdleTopics(time.Now())
+	s.compactTopics()
+
+	reclaimed, err := s.DB.CollectGarbage()
+	if err != nil {
+		s.logger().Error("cannot collect storage garbage", "err", err)
+	}
+	s.maintenance.reclaimedBytes.Add(reclaimed)
+
+	s.maintenance.runs.Add(1)
+	s.maintenance.lastRun.Store(time.Now().UnixNano())
+}
+
+// DeleteAckedBefore removes the acked messages published before cutoff.
+func (b BadgerDB) DeleteAckedBefore(cutoff time.Time) (int, error) {
+	var keys [][]byte
+	err := b.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(messagePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+
+			err := item.Value(func(v []byte) error {
+				msg, err := decodeRecord(v)
+				if err != nil {
+					return nil // not a message, leave it alone.
+				}
+
+				if msg.ACK() && msg.Timestamp() < cutoff.Unix() {
+					keys = append(keys, item.KeyCopy(nil))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	wb := b.DB.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, key := range keys {
+		if err = wb.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = wb.Flush(); err != nil {
+		return 0, err
+	}
+
+	return len(keys), nil
+}
+
+// CollectGarbage rewrites the value log files until nothing is left to reclaim and returns
+// how much the value log shrank.
+func (b BadgerDB) CollectGarbage() (int64, error) {
+	if b.DB.Opts().InMemory {
+		return 0, nil
+	}
+
+	_, before := b.DB.Size()
+	for {
+		err := b.DB.RunValueLogGC(gcDiscardRatio)
+		if errors.Is(err, badger.ErrNoRewrite) || errors.Is(err, badger.ErrRejected) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, after := b.DB.Size()
+
+	return max(before-after, 0), nil
+}
+
+func (m *MemoryStore) DeleteAckedBefore(cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int
+	for key, msg := range m.messages {
+		if msg.ACK() && msg.Timestamp() < cutoff.Unix() {
+			delete(m.messages, key)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (m *MemoryStore) CollectGarbage() (int64, error) {
+	return 0, nil
+}
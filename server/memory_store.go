@@ -0,0 +1,389 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in maps, without Badger. Nothing survives a restart, it is
+// meant for tests and fire-and-forget deployments where durability is not wanted.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	// maxMessages caps the stored messages, the oldest are dropped first. 0 means no cap.
+	maxMessages int
+	messages    map[string]Message
+	order       []string
+
+	seqs     map[Topic]uint64
+	seqIndex map[Topic]map[uint64][2]string
+	cursors  map[Topic]map[string]uint64
+	// cursorAcks are the seqs acked past the cursors, see BadgerDB.AdvanceCursor.
+	cursorAcks map[Topic]map[string][]uint64
+	deliveries map[string]map[string]bool
+	topics     map[Topic][]string
+	// topicOptions are the ones saved by SaveTopicOptions.
+	topicOptions map[Topic]TopicOptions
+	schedules    map[string]Schedule
+	schemas      map[string][]TopicSchema
+
+	audit []AuditEntry
+
+	traces     map[string][]TraceEvent
+	traceOrder []string
+
+	dedup map[string]dedupEntry
+
+	// attrs are the messages indexed by IndexAttributes, attrCount how many.
+	attrs     map[string]map[attrRef]struct{}
+	attrCount int
+
+	counters Counters
+}
+
+// maxMemoryAuditEntries bounds the audit log of a MemoryStore.
+const maxMemoryAuditEntries = 10_000
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore creates a store holding up to maxMessages messages, 0 means unbounded.
+func NewMemoryStore(maxMessages int) *MemoryStore {
+	return &MemoryStore{
+		maxMessages:  maxMessages,
+		messages:     make(map[string]Message),
+		seqs:         make(map[Topic]uint64),
+		seqIndex:     make(map[Topic]map[uint64][2]string),
+		cursors:      make(map[Topic]map[string]uint64),
+		cursorAcks:   make(map[Topic]map[string][]uint64),
+		topics:       make(map[Topic][]string),
+		topicOptions: make(map[Topic]TopicOptions),
+		deliveries:   make(map[string]map[string]bool),
+	}
+}
+
+func (m *MemoryStore) SaveMessage(message Message, format MessageFormat) error {
+	return m.SaveBatch([]SaveRequest{{Message: message, Format: format}})
+}
+
+func (m *MemoryStore) SaveBatch(batch []SaveRequest) error {
+	for _, r := range batch {
+		if !strings.HasPrefix(r.Message.ID(), MsgPrefixFalse) {
+			return errors.New("invalid key, should start with 'false'")
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range batch {
+		m.save(r.Message)
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) save(message Message) {
+	// acked before the save got here, do not bring it back as pending.
+	if stored, ok := m.messages[message.NextID()]; ok && stored.ACK() {
+		return
+	}
+
+	message.IncAttempts() // store the messages with attempt 1.
+	m.put(message.ID(), message)
+
+	if message.Seq() > 0 {
+		index, ok := m.seqIndex[message.Topic()]
+		if !ok {
+			index = make(map[uint64][2]string)
+			m.seqIndex[message.Topic()] = index
+		}
+		index[message.Seq()] = [2]string{message.ID(), message.NextID()}
+	}
+}
+
+// put stores the message and evicts the oldest ones past the cap.
+func (m *MemoryStore) put(key string, message Message) {
+	if _, ok := m.messages[key]; !ok {
+		m.order = append(m.order, key)
+	}
+	m.messages[key] = message
+
+	for m.maxMessages > 0 && len(m.messages) > m.maxMessages && len(m.order) > 0 {
+		oldest := m.order[0]
+		m.order = m.order[1:]
+		delete(m.messages, oldest)
+	}
+
+	// acked messages leave their old key behind, drop them once they dominate.
+	if len(m.order) > 2*len(m.messages)+64 {
+		live := m.order[:0]
+		for _, k := range m.order {
+			if _, ok := m.messages[k]; ok {
+				live = append(live, k)
+			}
+		}
+		m.order = live
+	}
+}
+
+func (m *MemoryStore) Ack(message Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ack(message)
+	return nil
+}
+
+func (m *MemoryStore) ack(message Message) {
+	// the ACK does not carry the TTL, keep the one of the stored message.
+	if stored, ok := m.messages[message.ID()]; ok && message.ttl == 0 {
+		message.ttl = stored.ttl
+	}
+
+	delete(m.messages, message.ID())
+	message.updateACK()
+	m.put(message.ID(), message)
+}
+
+func (m *MemoryStore) Delete(message Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.messages, message.ID())
+	return nil
+}
+
+func (m *MemoryStore) PendingMessages() ([]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var messages []Message
+	for _, key := range m.order {
+		msg, ok := m.messages[key]
+		if !ok || !strings.HasPrefix(key, MsgPrefixFalse) {
+			continue
+		}
+
+		if msg.expired(now) {
+			delete(m.messages, key)
+			continue
+		}
+
+		msg.IncAttempts()
+		if msg.Attempts() <= maxDeliveryAttempts {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages, nil
+}
+
+func (m *MemoryStore) StoredItems() ([]StoredItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items := []StoredItem{}
+	for _, key := range m.order {
+		msg, ok := m.messages[key]
+		if !ok {
+			continue
+		}
+
+		b, err := msg.Marshall()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, StoredItem{Key: key, Value: string(b)})
+	}
+
+	return items, nil
+}
+
+func (m *MemoryStore) NextSeq(topic Topic) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seqs[topic]++
+	return m.seqs[topic], nil
+}
+
+func (m *MemoryStore) MessagesAfter(topic Topic, seq uint64) ([]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	index := m.seqIndex[topic]
+	seqs := make([]uint64, 0, len(index))
+	for s := range index {
+		if s > seq {
+			seqs = append(seqs, s)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	now := time.Now()
+	var messages []Message
+	for _, s := range seqs {
+		for _, key := range index[s] {
+			if msg, ok := m.messages[key]; ok {
+				if !msg.expired(now) {
+					messages = append(messages, msg)
+				}
+				break
+			}
+		}
+	}
+
+	return messages, nil
+}
+
+func (m *MemoryStore) LoadCursor(topic Topic, subscriber string) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.cursors[topic][subscriber], nil
+}
+
+func (m *MemoryStore) AdvanceCursor(topic Topic, subscriber string, seq uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cursors, ok := m.cursors[topic]
+	if !ok {
+		cursors = make(map[string]uint64)
+		m.cursors[topic] = cursors
+	}
+
+	acks, ok := m.cursorAcks[topic]
+	if !ok {
+		acks = make(map[string][]uint64)
+		m.cursorAcks[topic] = acks
+	}
+
+	cursor, acked := cursors[subscriber], acks[subscriber]
+	if seq <= cursor || slices.Contains(acked, seq) {
+		return nil
+	}
+	acked = append(acked, seq)
+	slices.Sort(acked)
+
+	for len(acked) > 0 {
+		if pending := m.firstPending(topic, cursor, acked[0]); pending > 0 {
+			cursor = pending - 1
+			break
+		}
+		cursor, acked = acked[0], acked[1:]
+	}
+	cursors[subscriber], acks[subscriber] = cursor, acked
+
+	return nil
+}
+
+// firstPending returns the first seq between after and before of a message still to deliver,
+// as BadgerDB.firstPending does.
+func (m *MemoryStore) firstPending(topic Topic, after, before uint64) uint64 {
+	for seq := after + 1; seq < before; seq++ {
+		for _, id := range m.seqIndex[topic][seq] {
+			if msg, ok := m.messages[id]; ok && msg.deliverable() {
+				return seq
+			}
+		}
+	}
+
+	return 0
+}
+
+func (m *MemoryStore) TrackDelivery(messageID, recipient string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deliveries, ok := m.deliveries[messageID]
+	if !ok {
+		deliveries = make(map[string]bool)
+		m.deliveries[messageID] = deliveries
+	}
+
+	if _, ok = deliveries[recipient]; !ok {
+		deliveries[recipient] = false
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) UntrackDelivery(messageID, recipient string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.deliveries[messageID], recipient)
+	return nil
+}
+
+func (m *MemoryStore) AckDelivery(messageID, recipient string) (acked, total int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deliveries := m.deliveries[messageID]
+	if _, ok := deliveries[recipient]; !ok {
+		return 0, 0, errDeliveryNotTracked
+	}
+	deliveries[recipient] = true
+
+	for _, done := range deliveries {
+		total++
+		if done {
+			acked++
+		}
+	}
+
+	return acked, total, nil
+}
+
+func (m *MemoryStore) ClearDeliveries(messageID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.deliveries, messageID)
+	return nil
+}
+
+func (m *MemoryStore) AppendAudit(entry AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.audit = append(m.audit, entry)
+	if len(m.audit) > maxMemoryAuditEntries {
+		m.audit = m.audit[len(m.audit)-maxMemoryAuditEntries:]
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) AuditEntries(limit int, action string) ([]AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := []AuditEntry{}
+	for i := len(m.audit) - 1; i >= 0; i-- {
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+		if action != "" && m.audit[i].Action != action {
+			continue
+		}
+		entries = append(entries, m.audit[i])
+	}
+
+	return entries, nil
+}
+
+func (m *MemoryStore) Sync() error {
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
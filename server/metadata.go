@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// TopicMetadata is how a topic is configured, the body of the METADATA answering a client.
+type TopicMetadata struct {
+	Topic string     `json:"topic"`
+	Class TopicClass `json:"class"`
+	Mode  TopicMode  `json:"mode"`
+	// Partitions is always 1, a topic is a single ordered log. It is there for the clients to
+	// stay right once the broker partitions some.
+	Partitions int    `json:"partitions"`
+	Durability string `json:"durability"`
+	// Retention, VisibilityTimeout and AutoDeleteAfter are in seconds, 0 when the topic has none.
+	Retention         int64 `json:"retention,omitempty"`
+	VisibilityTimeout int64 `json:"visibility_timeout,omitempty"`
+	AutoDeleteAfter   int64 `json:"auto_delete_after,omitempty"`
+	// SchemaVersion is the latest version of the schema of the topic, 0 without one.
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// Seq is the last seq handed out, the next publish gets a higher one.
+	Seq         uint64 `json:"seq"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// TopicMetadata describes the topic, errTopicNotFound when there is none.
+func (s *Server) TopicMetadata(topic Topic) (TopicMetadata, error) {
+	clients, ok := s.topicClients(topic)
+	if !ok {
+		return TopicMetadata{}, errTopicNotFound
+	}
+
+	md := TopicMetadata{
+		Topic:             topic.Name,
+		Class:             TopicDurable,
+		Mode:              s.modeOf(topic),
+		Partitions:        1,
+		Durability:        s.durabilityOf(topic).String(),
+		Retention:         int64(s.topicRetention[topic.Name] / time.Second),
+		VisibilityTimeout: int64(s.visibilityOf(topic) / time.Second),
+		AutoDeleteAfter:   int64(s.autoDeleteOf(topic) / time.Second),
+		Subscribers:       len(clients),
+	}
+	if schema, found := s.latestSchema(topic.Name); found {
+		md.SchemaVersion = schema.Version
+	}
+
+	switch {
+	case s.isTransient(topic):
+		md.Class = TopicTransient
+		if seq, found := s.transientTopics.Load(topic); found {
+			md.Seq = seq.(*atomic.Uint64).Load()
+		}
+		return md, nil
+	case s.values.compacted(topic):
+		md.Class = TopicCompacted
+	}
+
+	seq, err := s.DB.LatestSeq(topic)
+	if err != nil {
+		return TopicMetadata{}, err
+	}
+	md.Seq = seq
+
+	return md, nil
+}
+
+// handleMetadata answers a METADATA with the one of its topic, echoing its id.
+func (s *Server) handleMetadata(conn net.Conn, format MessageFormat, msg Message) {
+	md, err := s.TopicMetadata(msg.Topic())
+	if err != nil {
+		s.sendError(conn, format, errorCode(err), err.Error(), msg)
+		return
+	}
+
+	body, err := json.Marshal(md)
+	if err != nil {
+		s.sendError(conn, format, ErrCodeInternal, err.Error(), msg)
+		return
+	}
+
+	reply := NewMessageBuilder().
+		WithID(msg.ID()).
+		WithNextID(msg.NextID()).
+		WithType(MessageTypeMetadata).
+		WithTopic(msg.Topic()).
+		WithBody(body).
+		WithTimestamp(time.Now().Unix()).
+		Build()
+
+	payload, err := encodeMessage(reply, format)
+	if err != nil {
+		s.logger().Error("cannot marshall metadata", "err", err)
+		return
+	}
+
+	if err = s.clientConn(conn).writeFrame(format, payload); err != nil {
+		s.logger().Warn("cannot write metadata", "topic", msg.Topic().Name, "err", err)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// legacySeqIndexPrefix is the seq index older versions kept next to the flat message keys.
+const legacySeqIndexPrefix = "seqidx/"
+
+// legacyRecord is a message still stored under its ID, false-<uuid> while pending and
+// <nextID> once acked.
+type legacyRecord struct {
+	key     []byte
+	value   []byte
+	message Message
+}
+
+// MigrateKeys moves the messages stored by older versions under their ID to the
+// topic/<name>/<seq> layout, handing out a seq to those published before seqs existed.
+// It returns how many messages were moved, running it again is a no-op.
+func (b BadgerDB) MigrateKeys() (int, error) {
+	var (
+		records  []legacyRecord
+		obsolete [][]byte
+	)
+
+	err := b.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := string(item.Key())
+			if strings.HasPrefix(key, legacySeqIndexPrefix) {
+				obsolete = append(obsolete, item.KeyCopy(nil))
+				continue
+			}
+			if strings.HasPrefix(key, messagePrefix) || isInternalKey(key) {
+				continue
+			}
+
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			msg, err := decodeRecord(value)
+			if err != nil {
+				b.logger().Warn("cannot migrate, not a message", "key", key, "err", err)
+				continue
+			}
+
+			records = append(records, legacyRecord{key: item.KeyCopy(nil), value: value, message: msg})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// seqs are handed out in publish order.
+	slices.SortStableFunc(records, func(a, b legacyRecord) int {
+		return int(a.message.Timestamp() - b.message.Timestamp())
+	})
+
+	for _, r := range records {
+		seq := r.message.Seq()
+		if seq == 0 {
+			if seq, err = b.NextSeq(r.message.Topic()); err != nil {
+				return 0, err
+			}
+			r.message.seq = seq
+			if r.value, err = encodeRecord(r.message, FormatJSON); err != nil {
+				return 0, err
+			}
+		}
+
+		err = b.DB.Update(func(txn *badger.Txn) error {
+			key := messageKey(r.message.Topic(), seq)
+			if err := txn.Set(key, r.value); err != nil {
+				return err
+			}
+
+			if bytes.HasPrefix(r.key, []byte(MsgPrefixFalse)) {
+				if err := txn.Set(pendingKey(string(r.key)), key); err != nil {
+					return err
+				}
+			}
+
+			return txn.Delete(r.key)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	wb := b.DB.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, key := range obsolete {
+		if err = wb.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = wb.Flush(); err != nil {
+		return 0, err
+	}
+
+	return len(records), nil
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backupVersionTrailer carries the version to ask GET /backup?since= for next, once the
+// backup is written.
+const backupVersionTrailer = "X-Queuety-Backup-Version"
+
+const defaultMirrorInterval = time.Second
+
+var errNotStandby = errors.New("the broker is not a standby")
+
+// MirrorConfig makes a broker the warm standby of a primary: it copies what changes in the
+// store of the primary, from its GET /backup, and takes no client until it is promoted. Both
+// need the Badger store, a memory one sends all of it every pull and its deletes do not go.
+type MirrorConfig struct {
+	// Primary is the URL of the web server of the primary, as in http://primary:9846.
+	Primary string
+	// User and Password are the admin credentials of the primary, empty for an open one.
+	User     string
+	Password string
+	// Interval is the wait between two pulls, a second when 0. What the primary stored since the
+	// last pull is lost when it goes down.
+	Interval time.Duration
+	// Client makes the pulls, one with a 30 seconds timeout when nil.
+	Client *http.Client
+}
+
+// MirrorStatus is the answer of GET /mirror.
+type MirrorStatus struct {
+	Standby bool   `json:"standby"`
+	Primary string `json:"primary,omitempty"`
+	// Version is the store version of the primary the standby asks for the changes since.
+	Version  uint64    `json:"version"`
+	LastSync time.Time `json:"last_sync,omitempty"`
+	Pulls    int       `json:"pulls"`
+	Error    string    `json:"error,omitempty"`
+	// PromotedAt is set once the standby was promoted.
+	PromotedAt time.Time `json:"promoted_at,omitempty"`
+}
+
+// mirror pulls the store of the primary while the broker is a standby.
+type mirror struct {
+	cfg     MirrorConfig
+	log     *slog.Logger
+	standby atomic.Bool
+
+	mu sync.Mutex
+	// serving is set once Serve runs, started while the pulls do.
+	serving  bool
+	started  bool
+	quit     chan struct{}
+	done     chan struct{}
+	since    uint64
+	lastSync time.Time
+	pulls    int
+	err      error
+	promoted time.Time
+}
+
+func newMirror(cfg MirrorConfig, logger *slog.Logger) *mirror {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultMirrorInterval
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	cfg.Primary = strings.TrimSuffix(cfg.Primary, "/")
+
+	m := &mirror{cfg: cfg, log: logger, quit: make(chan struct{}), done: make(chan struct{})}
+	m.standby.Store(true)
+
+	return m
+}
+
+// isStandby tells if the broker still mirrors a primary, nil for a primary.
+func (m *mirror) isStandby() bool {
+	return m != nil && m.standby.Load()
+}
+
+// begin starts the pulls of a standby, it tells if there is one.
+func (m *mirror) begin(s *Server) bool {
+	if !m.isStandby() {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.serving = true
+	if !m.started {
+		m.started = true
+		go m.run(s)
+	}
+
+	return true
+}
+
+// end stops the pulls, waiting for the one going on to be loaded. It tells if Serve runs.
+func (m *mirror) end() bool {
+	if m == nil {
+		return false
+	}
+
+	m.mu.Lock()
+	started, serving := m.started, m.serving
+	if started {
+		m.started = false
+		close(m.quit)
+	}
+	m.mu.Unlock()
+
+	if started {
+		<-m.done
+	}
+
+	return serving
+}
+
+func (m *mirror) run(s *Server) {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		m.record(m.pull(s))
+
+		select {
+		case <-ticker.C:
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+func (m *mirror) record(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pulls++
+	m.err = err
+	if err != nil {
+		m.log.Warn("cannot mirror primary", "primary", m.cfg.Primary, "err", err)
+		return
+	}
+	m.lastSync = time.Now()
+}
+
+// pull loads what the primary stored since the last pull. The backup is downloaded to a file
+// first, a primary going down halfway leaves the store as it was.
+func (m *mirror) pull(s *Server) error {
+	m.mu.Lock()
+	since := m.since
+	m.mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, m.cfg.Primary+"/backup?since="+strconv.FormatUint(since, 10), nil)
+	if err != nil {
+		return err
+	}
+	if m.cfg.User != "" || m.cfg.Password != "" {
+		req.SetBasicAuth(m.cfg.User, m.cfg.Password)
+	}
+
+	resp, err := m.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("GET /backup: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	f, err := os.CreateTemp("", "queuety-mirror-*.bak")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		return err
+	}
+
+	// a primary without incremental backups sends all of it every time.
+	next, _ := strconv.ParseUint(resp.Trailer.Get(backupVersionTrailer), 10, 64)
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err = s.DB.Restore(f); err != nil {
+		return fmt.Errorf("cannot load backup: %w", err)
+	}
+
+	m.mu.Lock()
+	m.since = next
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *mirror) status() MirrorStatus {
+	if m == nil {
+		return MirrorStatus{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := MirrorStatus{
+		Standby:    m.standby.Load(),
+		Primary:    m.cfg.Primary,
+		Version:    m.since,
+		LastSync:   m.lastSync,
+		Pulls:      m.pulls,
+		PromotedAt: m.promoted,
+	}
+	if m.err != nil {
+		st.Error = m.err.Error()
+	}
+
+	return st
+}
+
+// Promote turns the standby into a primary: the pulls stop, the topics, schemas and counters
+// mirrored are loaded, and the broker takes clients. The old primary must stay down, two
+// primaries on one store diverge.
+func (s *Server) Promote() error {
+	if !s.mirror.isStandby() {
+		return errNotStandby
+	}
+
+	serving := s.mirror.end()
+	if err := s.loadTopics(); err != nil {
+		return err
+	}
+	if err := s.loadSchemas(); err != nil {
+		return err
+	}
+	if err := s.restoreCounters(); err != nil {
+		return err
+	}
+
+	s.mirror.mu.Lock()
+	s.mirror.promoted = time.Now()
+	s.mirror.mu.Unlock()
+	s.mirror.standby.Store(false)
+
+	if serving {
+		s.startBackground()
+	}
+	s.logger().Info("standby promoted", "primary", s.mirror.cfg.Primary)
+
+	return nil
+}
+
+// MirrorStatus tells how far a standby is behind its primary.
+func (s *Server) MirrorStatus() MirrorStatus {
+	return s.mirror.status()
+}
+
+func (s *Server) handleMirror(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.MirrorStatus()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) handlePromote(w http.ResponseWriter, r *http.Request) {
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditPromote, User: user, RemoteAddr: r.RemoteAddr, Detail: s.mirror.status().Primary})
+
+	if err := s.Promote(); err != nil {
+		if errors.Is(err, errNotStandby) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "promotion failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.handleMirror(w, r)
+}
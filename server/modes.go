@@ -0,0 +1,102 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TopicMode is how the messages of a topic are spread over its subscribers.
+type TopicMode string
+
+const (
+	// TopicFanout delivers every message to every subscriber, the default.
+	TopicFanout TopicMode = "fanout"
+	// TopicQueue delivers every message to one subscriber, in turns. A message not delivered
+	// or not acked goes to the next one when it is redelivered, right after its
+	// TopicOptions.VisibilityTimeout when there is one.
+	TopicQueue TopicMode = "queue"
+	// TopicExclusive delivers every message to the oldest subscriber only, in publish order,
+	// the others stand by. When it leaves the next one takes over, with the messages it did
+	// not ack redelivered first.
+	TopicExclusive TopicMode = "exclusive"
+)
+
+// topicMode is the mode of a topic other than fan-out, turn the one of the next message of a
+// queue and visibility how long a queue delivery stays with its consumer.
+type topicMode struct {
+	mode       TopicMode
+	turn       atomic.Uint64
+	visibility time.Duration
+}
+
+// setMode records the mode of a topic being created, fan-out needs nothing.
+func (s *Server) setMode(topic Topic, opts TopicOptions) {
+	if opts.Mode == TopicQueue || opts.Mode == TopicExclusive {
+		visibility := time.Duration(opts.VisibilityTimeout) * time.Second
+		s.modes.LoadOrStore(topic, &topicMode{mode: opts.Mode, visibility: visibility})
+	}
+}
+
+// modeOf is the TopicMode of the topic.
+func (s *Server) modeOf(topic Topic) TopicMode {
+	if v, ok := s.modes.Load(topic); ok {
+		return v.(*topicMode).mode
+	}
+
+	return TopicFanout
+}
+
+// visibilityOf is the visibility timeout of a queue topic, 0 when it has none.
+func (s *Server) visibilityOf(topic Topic) time.Duration {
+	if v, ok := s.modes.Load(topic); ok {
+		return v.(*topicMode).visibility
+	}
+
+	return 0
+}
+
+// consumerOf picks the subscribers of the topic getting the next message: one in turns for a
+// queue, the oldest for an exclusive topic and all of them for a fan-out one.
+func (s *Server) consumerOf(topic Topic, clients []Client) []Client {
+	v, ok := s.modes.Load(topic)
+	if !ok || len(clients) <= 1 {
+		return clients
+	}
+
+	m := v.(*topicMode)
+	if m.mode == TopicExclusive {
+		return clients[:1]
+	}
+
+	i := (m.turn.Add(1) - 1) % uint64(len(clients))
+	return clients[i : i+1]
+}
+
+// failover hands an exclusive topic over to its next subscriber, the messages left unacked by
+// the one before are sent to it again, in seq order.
+func (s *Server) failover(topic Topic, client Client) {
+	s.logger().Info("exclusive consumer failed over", "topic", topic.Name)
+
+	messages, err := s.DB.MessagesAfter(topic, 0)
+	if err != nil {
+		s.logger().Error("cannot load unacked messages", "topic", topic.Name, "err", err)
+		return
+	}
+
+	for _, msg := range messages {
+		if msg.ACK() {
+			continue
+		}
+
+		payload, err := encodeMessage(msg, client.Format)
+		if err != nil {
+			s.logger().Error("cannot marshall message", "err", err)
+			continue
+		}
+
+		if err = s.deliver(client, msg, payload); err != nil {
+			s.logger().Warn("failover stopped", "topic", topic.Name, "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package observability
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GroupLag is how far a consumer group is behind the last message of its topic.
+type GroupLag struct {
+	Topic string
+	Group string
+	Lag   uint64
+}
+
+// LagSource computes the lag of every consumer group, at scrape time.
+type LagSource func() ([]GroupLag, error)
+
+var (
+	groupLagDesc = prometheus.NewDesc(namespace+"_consumer_group_lag",
+		"Messages published after the committed position of the consumer group.",
+		[]string{"topic", "group"}, nil)
+
+	topicLagDesc = prometheus.NewDesc(namespace+"_topic_lag",
+		"Lag of the consumer group furthest behind on the topic.",
+		[]string{"topic"}, nil)
+
+	lagSource atomic.Pointer[LagSource]
+)
+
+func init() {
+	prometheus.MustRegister(lagCollector{})
+}
+
+// SetLagSource makes /metrics report the lag computed by source, nil stops reporting it.
+func SetLagSource(source LagSource) {
+	if source == nil {
+		lagSource.Store(nil)
+		return
+	}
+	lagSource.Store(&source)
+}
+
+type lagCollector struct{}
+
+func (lagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- groupLagDesc
+	ch <- topicLagDesc
+}
+
+func (lagCollector) Collect(ch chan<- prometheus.Metric) {
+	source := lagSource.Load()
+	if source == nil {
+		return
+	}
+
+	lags, err := (*source)()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(groupLagDesc, err)
+		return
+	}
+
+	topics := make(map[string]uint64)
+	for _, l := range lags {
+		ch <- prometheus.MustNewConstMetric(groupLagDesc, prometheus.GaugeValue, float64(l.Lag), l.Topic, l.Group)
+		topics[l.Topic] = max(topics[l.Topic], l.Lag)
+	}
+
+	for topic, lag := range topics {
+		ch <- prometheus.MustNewConstMetric(topicLagDesc, prometheus.GaugeValue, float64(lag), topic)
+	}
+}
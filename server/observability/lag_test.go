@@ -0,0 +1,31 @@
+package observability
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_LagCollector(t *testing.T) {
+	SetLagSource(func() ([]GroupLag, error) {
+		return []GroupLag{
+			{Topic: "orders", Group: "billing", Lag: 3},
+			{Topic: "orders", Group: "shipping", Lag: 7},
+		}, nil
+	})
+	defer SetLagSource(nil)
+
+	want := `
+# HELP queuety_consumer_group_lag Messages published after the committed position of the consumer group.
+# TYPE queuety_consumer_group_lag gauge
+queuety_consumer_group_lag{group="billing",topic="orders"} 3
+queuety_consumer_group_lag{group="shipping",topic="orders"} 7
+# HELP queuety_topic_lag Lag of the consumer group furthest behind on the topic.
+# TYPE queuety_topic_lag gauge
+queuety_topic_lag{topic="orders"} 7
+`
+	if err := testutil.CollectAndCompare(lagCollector{}, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
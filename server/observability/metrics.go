@@ -0,0 +1,81 @@
+// Package observability holds the Prometheus collectors of the broker, served on /metrics
+// when server.Config.PrometheusMetrics is set.
+package observability
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "queuety"
+
+var (
+	MessagesPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_published_total",
+		Help:      "Messages accepted from publishers.",
+	}, []string{"topic"})
+
+	MessagesDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_delivered_total",
+		Help:      "Messages written to a subscriber.",
+	}, []string{"topic"})
+
+	DeliveryFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delivery_failures_total",
+		Help:      "Deliveries that failed and were left for redelivery.",
+	}, []string{"topic"})
+
+	MessagesAcked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_acked_total",
+		Help:      "Messages acked by their subscribers.",
+	}, []string{"topic"})
+
+	MessagesNacked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_nacked_total",
+		Help:      "Messages handed back by their subscribers with NACK.",
+	}, []string{"topic"})
+
+	MessagesPersisted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_persisted_total",
+		Help:      "Messages written to the store.",
+	}, []string{"topic"})
+
+	PersistErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "persist_errors_total",
+		Help:      "Writes to the store that failed.",
+	}, []string{"topic"})
+
+	PersistDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "persist_duration_seconds",
+		Help:      "Time to save a message, fsync included for sync topics.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	})
+
+	StorageHealthy = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "storage_healthy",
+		Help:      "1 when the last canary write and read of the store succeeded, 0 otherwise.",
+	})
+
+	StorageProbeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_probe_failures_total",
+		Help:      "Canary writes or reads of the store that failed.",
+	})
+)
+
+// Handler serves the collectors in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
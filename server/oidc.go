@@ -0,0 +1,343 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcRefetchInterval bounds how often a token signed with an unknown key fetches the keys
+	// of the issuer again.
+	oidcRefetchInterval = 10 * time.Second
+	// oidcLeeway is the clock skew tolerated on the exp and nbf of a token.
+	oidcLeeway = 30 * time.Second
+)
+
+var errInvalidToken = errors.New("invalid access token")
+
+// OIDCConfig accepts the access tokens of an OpenID Connect issuer as the password of an AUTH,
+// the user is then the claim of the token. The keys of the issuer are fetched from its
+// discovery document on the first token. A connection stays logged in once the token expires.
+type OIDCConfig struct {
+	// Issuer is the iss of the tokens, its /.well-known/openid-configuration tells the keys.
+	Issuer string
+	// Audience must be in the aud of the tokens, any audience when empty.
+	Audience string
+	// UsernameClaim names the identity of the token, sub by default.
+	UsernameClaim string
+	// GroupsClaim holds the groups of the token, groups by default.
+	GroupsClaim string
+	// Groups are the ones allowed to connect, a token in none of them is refused. Every token of
+	// the issuer connects when empty.
+	Groups []string
+	// AdminGroups may use the admin API with the token as a bearer, none when empty.
+	AdminGroups []string
+	// Client fetches the keys, one with a 10 seconds timeout when nil.
+	Client *http.Client
+}
+
+// tokenClaims are the claims of an access token the broker looks at.
+type tokenClaims struct {
+	Username string
+	Groups   []string
+}
+
+// oidcVerifier checks the tokens of the issuer, with its keys cached by kid.
+type oidcVerifier struct {
+	cfg OIDCConfig
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newOIDCVerifier(cfg OIDCConfig) *oidcVerifier {
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "sub"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &oidcVerifier{cfg: cfg}
+}
+
+// isToken tells if the password of an AUTH is a JWT rather than the password of Config.User.
+func isToken(password string) bool {
+	return strings.Count(password, ".") == 2 && strings.HasPrefix(password, "eyJ")
+}
+
+// verify checks the signature and the claims of the token, the claims being the ones of a
+// token the broker accepts connections of.
+func (v *oidcVerifier) verify(token string) (tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return tokenClaims{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return tokenClaims{}, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return tokenClaims{}, err
+	}
+	if err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return tokenClaims{}, err
+	}
+
+	var claims map[string]any
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return tokenClaims{}, err
+	}
+
+	return v.check(claims, time.Now())
+}
+
+func (v *oidcVerifier) check(claims map[string]any, now time.Time) (tokenClaims, error) {
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.cfg.Issuer {
+		return tokenClaims{}, fmt.Errorf("%w: issued by %q", errInvalidToken, iss)
+	}
+	if v.cfg.Audience != "" && !slices.Contains(stringsClaim(claims["aud"]), v.cfg.Audience) {
+		return tokenClaims{}, fmt.Errorf("%w: not for %q", errInvalidToken, v.cfg.Audience)
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return tokenClaims{}, fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return tokenClaims{}, fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+
+	tc := tokenClaims{Groups: stringsClaim(claims[v.cfg.GroupsClaim])}
+	if tc.Username, _ = claims[v.cfg.UsernameClaim].(string); tc.Username == "" {
+		return tokenClaims{}, fmt.Errorf("%w: no %s claim", errInvalidToken, v.cfg.UsernameClaim)
+	}
+	if len(v.cfg.Groups) > 0 && !inAnyGroup(tc.Groups, v.cfg.Groups) {
+		return tokenClaims{}, fmt.Errorf("%w: %s is in none of the allowed groups", errInvalidToken, tc.Username)
+	}
+
+	return tc, nil
+}
+
+// admin tells if the token may use the admin API.
+func (v *oidcVerifier) admin(tc tokenClaims) bool {
+	return inAnyGroup(tc.Groups, v.cfg.AdminGroups)
+}
+
+func inAnyGroup(groups, allowed []string) bool {
+	return slices.ContainsFunc(groups, func(g string) bool { return slices.Contains(allowed, g) })
+}
+
+// stringsClaim reads a claim holding a string or a list of them, as aud does.
+func stringsClaim(claim any) []string {
+	switch c := claim.(type) {
+	case string:
+		return []string{c}
+	case []any:
+		values := make([]string, 0, len(c))
+		for _, v := range c {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+
+	return nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("%w: unsupported alg %q", errInvalidToken, alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") || rsa.VerifyPKCS1v15(k, hash, digest, signature) != nil {
+			return fmt.Errorf("%w: bad signature", errInvalidToken)
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return fmt.Errorf("%w: bad signature", errInvalidToken)
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("%w: bad signature", errInvalidToken)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported key", errInvalidToken)
+	}
+
+	return nil
+}
+
+// key returns the key of kid, fetching the keys of the issuer when it does not know it yet.
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.fetched) < oidcRefetchInterval {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidToken, kid)
+	}
+
+	// a failing issuer is asked again after the interval too.
+	v.fetched = time.Now()
+	keys, err := v.fetchKeys()
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch the keys of %s: %w", v.cfg.Issuer, err)
+	}
+	v.keys = keys
+
+	key, ok := v.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidToken, kid)
+	}
+
+	return key, nil
+}
+
+func (v *oidcVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(v.cfg.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("no jwks_uri in the discovery document")
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// the keys of a type the broker does not verify are skipped.
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (v *oidcVerifier) getJSON(url string, out any) error {
+	resp, err := v.cfg.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// jsonWebKey is a key of the JWKS of the issuer, RSA or EC.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if err := errors.Join(errN, errE); err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if err := errors.Join(errX, errY); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIssuer serves the discovery document and the JWKS of an RSA key.
+func testIssuer(t *testing.T) (*httptest.Server, *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var issuer *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.URL, "jwks_uri": issuer.URL + "/keys"})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	issuer = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+
+	return issuer, key
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func Test_OIDCTokensLogIn(t *testing.T) {
+	issuer, key := testIssuer(t)
+	srv := &Server{oidc: newOIDCVerifier(OIDCConfig{
+		Issuer:      issuer.URL,
+		Audience:    "queuety",
+		Groups:      []string{"payments", "ops"},
+		AdminGroups: []string{"ops"},
+	})}
+
+	claims := func(groups ...string) map[string]any {
+		return map[string]any{
+			"iss":    issuer.URL,
+			"aud":    []string{"queuety", "other"},
+			"sub":    "svc-billing",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": groups,
+		}
+	}
+	auth := func(token string) Message {
+		return NewMessageBuilder().WithType(MessageTypeAuth).WithPassword(token).Build()
+	}
+
+	token := signToken(t, key, "k1", claims("payments"))
+	if user, ok := srv.authenticate(auth(token)); !ok || user != "svc-billing" {
+		t.Fatalf("expected the token to log in as its subject, got %q %v", user, ok)
+	}
+	if _, ok := srv.authenticate(NewMessageBuilder().WithType(MessageTypeAuth).Build()); ok {
+		t.Fatal("expected empty credentials refused on a broker without a password")
+	}
+
+	expired := claims("payments")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	wrongAud := claims("payments")
+	wrongAud["aud"] = "other"
+	for name, token := range map[string]string{
+		"expired":         signToken(t, key, "k1", expired),
+		"wrong audience":  signToken(t, key, "k1", wrongAud),
+		"outside groups":  signToken(t, key, "k1", claims("marketing")),
+		"unknown key":     signToken(t, key, "k2", claims("payments")),
+		"tampered claims": strings.Replace(token, ".", ".e30", 1),
+	} {
+		if _, ok := srv.authenticate(auth(token)); ok {
+			t.Errorf("%s: expected the token refused", name)
+		}
+	}
+
+	admin := srv.adminOnly(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	for token, want := range map[string]int{
+		signToken(t, key, "k1", claims("ops")):      http.StatusNoContent,
+		signToken(t, key, "k1", claims("payments")): http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		admin(w, r)
+		if w.Code != want {
+			t.Errorf("expected %d for the admin API, got %d", want, w.Code)
+		}
+	}
+}
+
+func Test_OIDCAdminIsAudited(t *testing.T) {
+	issuer, key := testIssuer(t)
+	srv := &Server{DB: NewMemoryStore(0), oidc: newOIDCVerifier(OIDCConfig{
+		Issuer:      issuer.URL,
+		Audience:    "queuety",
+		AdminGroups: []string{"ops"},
+	})}
+
+	token := signToken(t, key, "k1", map[string]any{
+		"iss":    issuer.URL,
+		"aud":    "queuety",
+		"sub":    "svc-ops",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"groups": []string{"ops"},
+	})
+	r := httptest.NewRequest(http.MethodDelete, "/topics/orders/subscribers", nil)
+	r.SetPathValue("name", "orders")
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	srv.adminOnly(srv.handleKickTopic)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the kick done, got %d", w.Code)
+	}
+
+	entries, err := srv.DB.AuditEntries(0, AuditKickTopic)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(entries) != 1 || entries[0].User != "svc-ops" {
+		t.Fatalf("expected the kick audited as the token subject, got %+v", entries)
+	}
+}
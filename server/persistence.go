@@ -3,14 +3,19 @@ package server
 import (
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
 )
 
 type BadgerDB struct {
 	*badger.DB
+
+	// Logger reports the records skipped and quarantined, slog.Default() when nil.
+	Logger *slog.Logger
 }
 
 func NewBadger(path string, inMemory bool) (*badger.DB, error) {
@@ -18,96 +23,374 @@ func NewBadger(path string, inMemory bool) (*badger.DB, error) {
 		return badger.Open(badger.DefaultOptions("").WithInMemory(true))
 	}
 
+	return OpenBadger(path, false)
+}
+
+// OpenBadger opens the database on disk, syncWrites fsyncs every write before returning.
+func OpenBadger(path string, syncWrites bool) (*badger.DB, error) {
 	if path == "" {
 		path = "/data/badger"
 	}
-	return badger.Open(badger.DefaultOptions(path))
+	return badger.Open(badger.DefaultOptions(path).WithSyncWrites(syncWrites))
+}
+
+// internalPrefixes are the keys used for broker bookkeeping rather than messages.
+var internalPrefixes = []string{auditPrefix, tracePrefix, dedupPrefix, deliveryPrefix, sequencePrefix, cursorPrefix, pendingPrefix, registryPrefix, quarantinePrefix, metaPrefix, legacySeqIndexPrefix, attrPrefix}
+
+func isInternalKey(key string) bool {
+	for _, prefix := range internalPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maxConflictRetries bounds the retries of read-modify-write transactions racing each other.
+const maxConflictRetries = 10
+
+// updateWithRetry runs fn in an update transaction, retrying when a concurrent transaction
+// touched the keys it read.
+func (b BadgerDB) updateWithRetry(fn func(txn *badger.Txn) error) error {
+	var err error
+	for range maxConflictRetries {
+		err = b.DB.Update(fn)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+
+	return err
+}
+
+const (
+	// messagePrefix holds every message under topic/<name>/<seq>, pending or acked.
+	messagePrefix = "topic/"
+	// pendingPrefix maps the ID of an unacked message to its key under messagePrefix.
+	pendingPrefix = "pending/"
+)
+
+func topicPrefix(topic Topic) []byte {
+	return fmt.Appendf(nil, "%s%s/", messagePrefix, topic.Name)
+}
+
+// messageKey pads the seq so the keys of a topic sort in publish order.
+func messageKey(topic Topic, seq uint64) []byte {
+	return fmt.Appendf(topicPrefix(topic), "%020d", seq)
+}
+
+func pendingKey(id string) []byte {
+	return []byte(pendingPrefix + id)
+}
+
+// isMessageKey tells apart the keys of a topic from the ones of a longer name sharing
+// the prefix, e.g. "a" and "a/b".
+func isMessageKey(prefix, key []byte) bool {
+	_, err := strconv.ParseUint(string(key[len(prefix):]), 10, 64)
+	return err == nil
+}
+
+// keyOf resolves where message is stored, through the pending index first since the ID
+// a client sends back may predate the seq.
+func keyOf(txn *badger.Txn, message Message) ([]byte, error) {
+	item, err := txn.Get(pendingKey(message.ID()))
+	if err == nil {
+		return item.ValueCopy(nil)
+	}
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, err
+	}
+
+	if message.Seq() == 0 {
+		return nil, badger.ErrKeyNotFound
+	}
+
+	return messageKey(message.Topic(), message.Seq()), nil
+}
+
+// encodeRecord prefixes the encoded message with its format, so any record can be read
+// back whatever format the publisher used.
+func encodeRecord(message Message, format MessageFormat) ([]byte, error) {
+	if format == FormatBinary {
+		b := make([]byte, 1, 1+message.binarySize())
+		b[0] = byte(FormatBinary)
+		return message.AppendBinary(b)
+	}
+
+	b, err := message.Marshall()
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{byte(FormatJSON)}, b...), nil
+}
+
+// decodeRecord reads a record written by encodeRecord. Records of older versions hold
+// bare JSON, it starts with '{' rather than a format flag.
+func decodeRecord(v []byte) (Message, error) {
+	if len(v) == 0 {
+		return Message{}, errors.New("empty record")
+	}
+
+	switch MessageFormat(v[0]) {
+	case FormatBinary:
+		var msg Message
+		err := msg.UnmarshalBinary(v[1:])
+		return msg, err
+	case FormatJSON:
+		return DecodeMessage(v[1:])
+	default:
+		if msg, ok := decodeLegacyRecord(v); ok {
+			return msg, nil
+		}
+		return DecodeMessage(v)
+	}
 }
 
 // saveMessage will store the message at the first time, the id should start with false since is the
 // 1st time we are storing the message.
-func (b BadgerDB) saveMessage(message Message, format MessageFormat) error {
-	if !strings.HasPrefix(message.ID(), MsgPrefixFalse) {
-		return errors.New("invalid key, should start with 'false'")
+func (b BadgerDB) SaveMessage(message Message, format MessageFormat) error {
+	return b.SaveBatch([]SaveRequest{{Message: message, Format: format}})
+}
+
+// SaveBatch stores the messages in a single transaction. A message acked before its save
+// reached the store is not brought back as pending.
+func (b BadgerDB) SaveBatch(batch []SaveRequest) error {
+	records, err := b.pendingRecords(batch)
+	if err != nil {
+		return err
 	}
 
-	return b.DB.Update(func(txn *badger.Txn) error {
+	return b.updateWithRetry(func(txn *badger.Txn) error {
+		return setPending(txn, records)
+	})
+}
+
+// pendingRecord is a message encoded by pendingRecords, ready to be stored as pending.
+type pendingRecord struct {
+	key, value, index []byte
+	ttl               time.Duration
+}
+
+func (b BadgerDB) pendingRecords(batch []SaveRequest) ([]pendingRecord, error) {
+	records := make([]pendingRecord, 0, len(batch))
+	for _, r := range batch {
+		message := r.Message
+		if !strings.HasPrefix(message.ID(), MsgPrefixFalse) {
+			return nil, errors.New("invalid key, should start with 'false'")
+		}
+
+		// messages published before seqs existed still need a place in the topic.
+		if message.Seq() == 0 {
+			seq, err := b.NextSeq(message.Topic())
+			if err != nil {
+				return nil, err
+			}
+			message.seq = seq
+		}
+
 		message.IncAttempts() // store the messages with attempt 1.
-		var (
-			bytes []byte
-			err   error
-		)
-		if FormatJSON == format {
-			bytes, err = message.Marshall()
-		} else {
-			bytes, err = message.MarshalBinary()
+		bytes, err := encodeRecord(message, r.Format)
+		if err != nil {
+			return nil, err
 		}
 
+		records = append(records, pendingRecord{
+			key:   messageKey(message.Topic(), message.Seq()),
+			value: bytes,
+			index: pendingKey(message.ID()),
+			ttl:   message.TTL(),
+		})
+	}
+
+	return records, nil
+}
+
+func setPending(txn *badger.Txn, records []pendingRecord) error {
+	for _, r := range records {
+		acked, err := isAcked(txn, r.key, r.index)
 		if err != nil {
 			return err
 		}
+		if acked {
+			continue
+		}
 
-		err = txn.Set([]byte(message.ID()), bytes)
-		if err != nil {
+		// badger drops expired entries by itself, the pending index goes with the message.
+		entry := badger.NewEntry(r.key, r.value)
+		index := badger.NewEntry(r.index, r.key)
+		if r.ttl > 0 {
+			entry, index = entry.WithTTL(r.ttl), index.WithTTL(r.ttl)
+		}
+
+		if err = txn.SetEntry(entry); err != nil {
 			return err
 		}
+		if err = txn.SetEntry(index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isAcked tells if the message under key was stored and acked already, it is left with no
+// pending index entry.
+func isAcked(txn *badger.Txn, key, index []byte) (bool, error) {
+	if _, err := txn.Get(key); errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	_, err := txn.Get(index)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return true, nil
+	}
+
+	return false, err
+}
+
+func (b BadgerDB) Ack(message Message) error {
+	return b.DB.Update(func(txn *badger.Txn) error {
+		key, err := keyOf(txn, message)
+		if err != nil {
+			return fmt.Errorf("cannot find message with ID %s: %w", message.ID(), err)
+		}
+
+		return ackKey(txn, key, message)
+	})
+}
+
+// ackKey stores the message under key as acked, out of the pending index.
+func ackKey(txn *badger.Txn, key []byte, message Message) error {
+	if err := txn.Delete(pendingKey(message.ID())); err != nil {
+		return err
+	}
+
+	// the ACK does not carry the TTL, keep the expiry of the stored message.
+	var expiresAt uint64
+	if item, errGet := txn.Get(key); errGet == nil {
+		expiresAt = item.ExpiresAt()
+	}
+
+	message.updateACK()
+	msgBytes, err := encodeRecord(message, FormatJSON)
+	if err != nil {
+		return err
+	}
+
+	entry := badger.NewEntry(key, msgBytes)
+	entry.ExpiresAt = expiresAt
+
+	return txn.SetEntry(entry)
+}
+
+func (b BadgerDB) PendingMessages() ([]Message, error) {
+	var (
+		messages []Message
+		corrupt  []corruptRecord
+	)
+	err := b.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(pendingPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			k := it.Item().Key()
+			key, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			item, err := txn.Get(key)
+			if err != nil {
+				b.logger().Warn("cannot get pending message", "id", string(k[len(prefix):]), "err", err)
+				continue
+			}
+
+			var msg Message
+			if err = item.Value(func(v []byte) error {
+				msg, err = decodeRecord(v)
+				return err
+			}); err != nil {
+				r := newCorruptRecord(item, err)
+				r.index = it.Item().KeyCopy(nil)
+				corrupt = append(corrupt, r)
+				continue
+			}
+
+			msg.IncAttempts()
+			if msg.Attempts() <= maxDeliveryAttempts {
+				messages = append(messages, msg)
+			}
+		}
 
 		return nil
 	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	b.quarantine(corrupt)
+	return messages, nil
 }
 
-func (b BadgerDB) updateMessageACK(message Message) error {
+// Delete removes the message along with its pending index entry.
+func (b BadgerDB) Delete(message Message) error {
 	return b.DB.Update(func(txn *badger.Txn) error {
-		// delete entry with old key.
-		fmt.Println("deleting message")
-		if err := txn.Delete([]byte(message.ID())); err != nil {
-			log.Printf("cannot delete message with ID %s", message.ID())
+		key, err := keyOf(txn, message)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
 		}
-
-		message.updateACK()
-		msgBytes, err := message.Marshall()
 		if err != nil {
 			return err
 		}
 
-		err = txn.Set([]byte(message.ID()), msgBytes)
-		if err != nil {
+		if err = txn.Delete(pendingKey(message.ID())); err != nil {
 			return err
 		}
 
-		return nil
+		return txn.Delete(key)
 	})
 }
 
-func (b BadgerDB) checkNotDeliveredMessages() ([]Message, error) {
-	var messages []Message
+func (b BadgerDB) StoredItems() ([]StoredItem, error) {
+	items := []StoredItem{}
+
 	err := b.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 10
+		it := txn.NewIterator(opts)
 		defer it.Close()
-		prefix := []byte(MsgPrefixFalse)
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+
+		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
-			k := item.Key()
-			err := item.Value(func(v []byte) error {
-				msg, err := DecodeMessage(v)
-				if err != nil {
-					return err
-				}
+			key := string(item.Key())
+			if isInternalKey(key) {
+				continue
+			}
 
-				msg.IncAttempts()
-				if msg.Attempts() <= 3 {
-					messages = append(messages, msg)
+			err := item.Value(func(v []byte) error {
+				// binary records are shown as JSON too.
+				value := string(v)
+				if msg, err := decodeRecord(v); err == nil {
+					if b, err := msg.Marshall(); err == nil {
+						value = string(b)
+					}
 				}
 
+				items = append(items, StoredItem{
+					Key:   key,
+					Value: value,
+				})
 				return nil
 			})
-
 			if err != nil {
-				log.Printf("cannot get message with id %s, %v\n", k, err)
-				continue
+				return err
 			}
 		}
-
 		return nil
 	})
 
@@ -115,5 +398,5 @@ func (b BadgerDB) checkNotDeliveredMessages() ([]Message, error) {
 		return nil, err
 	}
 
-	return messages, nil
+	return items, nil
 }
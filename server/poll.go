@@ -0,0 +1,261 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tomiok/queuety/server/observability"
+)
+
+const (
+	defaultPollMax   = 10
+	maxPollMax       = 1000
+	maxPollWait      = 2 * time.Minute
+	defaultLease     = 30 * time.Second
+	maxLease         = 12 * time.Hour
+	pollRecheckEvery = 250 * time.Millisecond
+)
+
+// lease is a pending message handed to an HTTP consumer, nobody else gets it until the lease
+// expires or the consumer acks it.
+type lease struct {
+	message Message
+	expires time.Time
+}
+
+// leaseTable holds the leases of the HTTP consumers, by lease ID and by message ID.
+type leaseTable struct {
+	mu        sync.Mutex
+	byID      map[string]lease
+	byMessage map[string]string
+}
+
+// expire drops the leases over, the caller holds mu.
+func (l *leaseTable) expire(now time.Time) {
+	for id, ls := range l.byID {
+		if !now.Before(ls.expires) {
+			delete(l.byID, id)
+			delete(l.byMessage, ls.message.ID())
+		}
+	}
+}
+
+// LeasedMessage is a message returned to an HTTP consumer, acked with its LeaseID.
+type LeasedMessage struct {
+	LeaseID string `json:"lease_id"`
+	ID      string `json:"id"`
+	Topic   string `json:"topic"`
+	Seq     uint64 `json:"seq"`
+	// Attempts is how many times the message was leased, this one included.
+	Attempts  int             `json:"attempts"`
+	Published time.Time       `json:"published"`
+	Body      json.RawMessage `json:"body,omitempty"`
+	// BodyString carries the bodies that are not JSON.
+	BodyString string `json:"body_string,omitempty"`
+}
+
+// LeaseMessages leases up to max pending messages of the topic for d, in publish order. A
+// lease counts as a delivery attempt, the messages never acked end up dead lettered.
+func (s *Server) LeaseMessages(topic Topic, max int, d time.Duration) ([]LeasedMessage, error) {
+	messages, err := s.DB.MessagesAfter(topic, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	s.leases.mu.Lock()
+	defer s.leases.mu.Unlock()
+
+	if s.leases.byID == nil {
+		s.leases.byID = make(map[string]lease)
+		s.leases.byMessage = make(map[string]string)
+	}
+	s.leases.expire(now)
+
+	var leased []LeasedMessage
+	for _, m := range messages {
+		if len(leased) == max {
+			break
+		}
+		if !strings.HasPrefix(m.ID(), MsgPrefixFalse) || m.Attempts() >= maxDeliveryAttempts || m.expired(now) {
+			continue
+		}
+		if _, ok := s.leases.byMessage[m.ID()]; ok {
+			continue
+		}
+
+		// saving it again stores one more attempt.
+		if err = s.DB.SaveMessage(m, FormatJSON); err != nil {
+			return leased, err
+		}
+		m.IncAttempts()
+
+		id := uuid.NewString()
+		s.leases.byID[id] = lease{message: m, expires: now.Add(d)}
+		s.leases.byMessage[m.ID()] = id
+
+		s.trace(m, TraceEvent{Stage: TraceDelivered, Attempts: m.Attempts(), Detail: "http lease " + id})
+		s.incSentMessages(topic)
+		observability.MessagesDelivered.WithLabelValues(topic.Name).Inc()
+
+		lm := LeasedMessage{
+			LeaseID: id,
+			ID:      m.ID(),
+			Topic:   topic.Name,
+			Seq:     m.Seq(),
+			// stored once before the first lease.
+			Attempts:  m.Attempts() - 1,
+			Published: time.Unix(m.Timestamp(), 0),
+		}
+		if json.Valid(m.Body()) {
+			lm.Body = m.Body()
+		} else {
+			lm.BodyString = m.BodyString()
+		}
+		leased = append(leased, lm)
+	}
+
+	return leased, nil
+}
+
+// AckLeases acks the messages of the topic leased under the given IDs, returning the IDs
+// not acked because their lease expired or is unknown.
+func (s *Server) AckLeases(topic Topic, ids []string) (acked int, expired []string, err error) {
+	s.leases.mu.Lock()
+	defer s.leases.mu.Unlock()
+
+	s.leases.expire(time.Now())
+
+	for _, id := range ids {
+		ls, ok := s.leases.byID[id]
+		if !ok || ls.message.Topic() != topic {
+			expired = append(expired, id)
+			continue
+		}
+
+		message := ls.message
+		if err = s.DB.Ack(message); err != nil {
+			return acked, expired, err
+		}
+		if errClear := s.DB.ClearDeliveries(message.ID()); errClear != nil {
+			s.logger().Error("cannot clear deliveries", "id", message.ID(), "err", errClear)
+		}
+		delete(s.leases.byID, id)
+		delete(s.leases.byMessage, message.ID())
+
+		observability.MessagesAcked.WithLabelValues(topic.Name).Inc()
+		s.trace(message, TraceEvent{Stage: TraceAcked, Detail: "http lease " + id})
+		s.trace(message, TraceEvent{Stage: TraceCompleted})
+
+		message.updateACK()
+		s.archiver.add(message)
+		acked++
+	}
+
+	return acked, expired, nil
+}
+
+// handlePoll serves GET /topics/{name}/messages: it waits up to ?wait= for pending messages
+// and leases up to ?max= of them for ?lease=, 30 seconds by default.
+func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	max := defaultPollMax
+	if v := q.Get("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid max", http.StatusBadRequest)
+			return
+		}
+		max = min(n, maxPollMax)
+	}
+
+	var wait time.Duration
+	if v := q.Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = min(d, maxPollWait)
+	}
+
+	leaseFor := defaultLease
+	if v := q.Get("lease"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid lease", http.StatusBadRequest)
+			return
+		}
+		leaseFor = min(d, maxLease)
+	}
+
+	topic := NewTopic(r.PathValue("name"))
+	if !s.hasTopic(topic) {
+		http.Error(w, errTopicNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	// the tap wakes the wait on a publish, the recheck catches the message once it is saved.
+	t := s.addTap(topic, 1)
+	defer s.removeTap(topic, t)
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	recheck := time.NewTicker(pollRecheckEvery)
+	defer recheck.Stop()
+
+	for {
+		leased, err := s.LeaseMessages(topic, max, leaseFor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(leased) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"messages": leased})
+			return
+		}
+
+		select {
+		case <-t.messages:
+		case <-recheck.C:
+		case <-timeout.C:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"messages": []LeasedMessage{}})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handlePollAck serves POST /topics/{name}/messages/ack, ?leases= is the comma separated
+// lease IDs returned by handlePoll.
+func (s *Server) handlePollAck(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query().Get("leases")
+	if v == "" {
+		http.Error(w, "missing leases", http.StatusBadRequest)
+		return
+	}
+
+	acked, expired, err := s.AckLeases(NewTopic(r.PathValue("name")), strings.Split(v, ","))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if expired == nil {
+		expired = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"acked": acked, "expired": expired})
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_LeaseMessages(t *testing.T) {
+	topic := NewTopic("orders")
+	srv := Server{DB: NewMemoryStore(0), clients: map[Topic][]Client{topic: {}}, sentMessages: map[Topic]*atomic.Int32{}}
+
+	seq, _ := srv.DB.NextSeq(topic)
+	msg := NewMessageBuilder().WithID("false-1").WithNextID("1").WithTopic(topic).WithSeq(seq).WithBody([]byte(`{"v":1}`)).Build()
+	if err := srv.DB.SaveMessage(msg, FormatJSON); err != nil {
+		t.Fatalf("cannot save %v", err)
+	}
+
+	leased, err := srv.LeaseMessages(topic, 10, time.Minute)
+	if err != nil || len(leased) != 1 || leased[0].ID != "false-1" || string(leased[0].Body) != `{"v":1}` {
+		t.Fatalf("expected false-1 leased, got %v %v", leased, err)
+	}
+	if again, _ := srv.LeaseMessages(topic, 10, time.Minute); len(again) != 0 {
+		t.Fatalf("expected the leased message held back, got %v", again)
+	}
+
+	acked, expired, err := srv.AckLeases(topic, []string{leased[0].LeaseID, "unknown"})
+	if err != nil || acked != 1 || len(expired) != 1 || expired[0] != "unknown" {
+		t.Fatalf("expected 1 acked and the unknown lease reported, got %d %v %v", acked, expired, err)
+	}
+	if pending, _ := srv.DB.PendingMessages(); len(pending) != 0 {
+		t.Fatalf("expected nothing pending after the ack, got %v", pending)
+	}
+}
+
+func Test_PollWaitsForMessages(t *testing.T) {
+	topic := NewTopic("orders")
+	srv := Server{DB: NewMemoryStore(0), clients: map[Topic][]Client{topic: {}}, sentMessages: map[Topic]*atomic.Int32{}}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		// no subscriber, the publish is saved for the pollers.
+		seq, _ := srv.DB.NextSeq(topic)
+		srv.sendMessageSync(NewMessageBuilder().WithID("false-1").WithNextID("1").WithTopic(topic).WithSeq(seq).WithBody([]byte(`"hi"`)).Build(), topic)
+	}()
+
+	r := httptest.NewRequest("GET", "/topics/orders/messages?wait=5s", nil)
+	r.SetPathValue("name", "orders")
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	srv.handlePoll(w, r)
+
+	var body struct {
+		Messages []LeasedMessage `json:"messages"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || len(body.Messages) != 1 {
+		t.Fatalf("expected the published message, got %v %v", body, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected the poll to return on the publish, took %s", elapsed)
+	}
+
+	r = httptest.NewRequest("GET", "/topics/orders/messages?wait=10ms", nil)
+	r.SetPathValue("name", "orders")
+	w = httptest.NewRecorder()
+	srv.handlePoll(w, r)
+	if !strings.Contains(w.Body.String(), `"messages":[]`) {
+		t.Fatalf("expected no messages once leased, got %s", w.Body)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// QoS is the delivery guarantee of a publish, the messages of one topic can mix them.
+type QoS uint8
+
+const (
+	// QoSDefault is QoSAtLeastOnce, or QoSAtMostOnce for a PublishMessage.FireAndForget.
+	QoSDefault QoS = iota
+	// QoSAtMostOnce is FireAndForget: not stored, not confirmed, not redelivered.
+	QoSAtMostOnce
+	// QoSAtLeastOnce stores, confirms and redelivers the message until acked. A publisher
+	// sending it again after a lost confirm stores it twice.
+	QoSAtLeastOnce
+	// QoSEffectivelyOnce is QoSAtLeastOnce with the publishes deduplicated by their id over
+	// the dedup window: a publish sent again is confirmed with the seq of the first one and
+	// neither stored nor delivered twice. The consumers still ack, a redelivery is flagged.
+	QoSEffectivelyOnce
+)
+
+func (q QoS) String() string {
+	switch q {
+	case QoSDefault:
+		return "default"
+	case QoSAtMostOnce:
+		return "at_most_once"
+	case QoSAtLeastOnce:
+		return "at_least_once"
+	case QoSEffectivelyOnce:
+		return "effectively_once"
+	default:
+		return fmt.Sprintf("qos(%d)", uint8(q))
+	}
+}
+
+// dedupPrefix keeps the publishes of QoSEffectivelyOnce under dedup/<topic>/<id>, the value
+// is their seq. The keys expire with the dedup window.
+const dedupPrefix = "dedup/"
+
+// defaultDedupWindow is how long the effectively once publishes are remembered when
+// Config.DedupWindow is 0.
+const defaultDedupWindow = 10 * time.Minute
+
+func dedupKey(topic Topic, id string) []byte {
+	return []byte(dedupPrefix + topic.Name + "/" + id)
+}
+
+// errQoSConflict rejects a fire and forget publish asking for another QoS.
+var errQoSConflict = errors.New("fire and forget with a QoS other than at most once")
+
+// Level is the guarantee of the publish, its QoS or the one FireAndForget stands for.
+func (p PublishMessage) Level() (QoS, error) {
+	if p.FireAndForget {
+		if p.QoS != QoSDefault && p.QoS != QoSAtMostOnce {
+			return 0, errQoSConflict
+		}
+		return QoSAtMostOnce, nil
+	}
+	if p.QoS > QoSEffectivelyOnce {
+		return 0, fmt.Errorf("unknown %s", p.QoS)
+	}
+	if p.QoS == QoSDefault {
+		return QoSAtLeastOnce, nil
+	}
+
+	return p.QoS, nil
+}
+
+// RecordPublish remembers the publish of id on the topic at seq for window, or returns the seq
+// it was first published at and true.
+func (b BadgerDB) RecordPublish(topic Topic, id string, seq uint64, window time.Duration) (uint64, bool, error) {
+	key := dedupKey(topic, id)
+	first := seq
+	duplicate := false
+
+	err := b.updateWithRetry(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == nil {
+			value, errValue := item.ValueCopy(nil)
+			if errValue != nil {
+				return errValue
+			}
+			if len(value) == 8 {
+				first, duplicate = binary.BigEndian.Uint64(value), true
+				return nil
+			}
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		first, duplicate = seq, false
+		value := binary.BigEndian.AppendUint64(nil, seq)
+		return txn.SetEntry(badger.NewEntry(key, value).WithTTL(window))
+	})
+
+	return first, duplicate, err
+}
+
+func (b BadgerDB) ForgetPublish(topic Topic, id string) error {
+	return b.updateWithRetry(func(txn *badger.Txn) error {
+		return txn.Delete(dedupKey(topic, id))
+	})
+}
+
+// dedupEntry is a publish remembered by a MemoryStore.
+type dedupEntry struct {
+	seq     uint64
+	expires time.Time
+}
+
+func (m *MemoryStore) RecordPublish(topic Topic, id string, seq uint64, window time.Duration) (uint64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.dedup == nil {
+		m.dedup = make(map[string]dedupEntry)
+	}
+	key := string(dedupKey(topic, id))
+	if e, ok := m.dedup[key]; ok && now.Before(e.expires) {
+		return e.seq, true, nil
+	}
+
+	// the expired ones go as the map grows, no sweeper needed.
+	if len(m.dedup) >= maxMemoryDedup {
+		for k, e := range m.dedup {
+			if !now.Before(e.expires) {
+				delete(m.dedup, k)
+			}
+		}
+	}
+	m.dedup[key] = dedupEntry{seq: seq, expires: now.Add(window)}
+
+	return seq, false, nil
+}
+
+func (m *MemoryStore) ForgetPublish(topic Topic, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.dedup, string(dedupKey(topic, id)))
+	return nil
+}
+
+// maxMemoryDedup is the size a MemoryStore drops the expired publishes at.
+const maxMemoryDedup = 100_000
+
+// publishedBefore records the publish of msg, or tells it was recorded already within the dedup
+// window, msg then holding the first seq.
+func (s *Server) publishedBefore(msg *Message) (bool, error) {
+	window := s.dedupWindow
+	if window <= 0 {
+		window = defaultDedupWindow
+	}
+
+	seq, duplicate, err := s.DB.RecordPublish(msg.Topic(), msg.ID(), msg.seq, window)
+	if err != nil || !duplicate {
+		return false, err
+	}
+	msg.seq = seq
+
+	return true, nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// quarantinePrefix holds the records that failed to decode, out of the way of the scans.
+const quarantinePrefix = "quarantine/"
+
+// QuarantinedRecord is a record that could not be decoded, kept with what went wrong.
+type QuarantinedRecord struct {
+	Key   string    `json:"key"`
+	Value []byte    `json:"value"`
+	Error string    `json:"error"`
+	At    time.Time `json:"at"`
+}
+
+// corruptRecord is found during a read transaction and quarantined once it is over.
+type corruptRecord struct {
+	key   []byte
+	value []byte
+	err   error
+	// index is the pending index entry pointing at key, if any.
+	index []byte
+}
+
+func newCorruptRecord(item *badger.Item, err error) corruptRecord {
+	value, _ := item.ValueCopy(nil)
+	return corruptRecord{key: item.KeyCopy(nil), value: value, err: err}
+}
+
+// quarantine moves the records under quarantinePrefix so they are reported instead of
+// failing every scan again.
+func (b BadgerDB) quarantine(records []corruptRecord) {
+	if len(records) == 0 {
+		return
+	}
+
+	err := b.DB.Update(func(txn *badger.Txn) error {
+		now := time.Now()
+		for _, r := range records {
+			b.logger().Warn("quarantining record", "key", string(r.key), "err", r.err)
+
+			entry, err := json.Marshal(QuarantinedRecord{Key: string(r.key), Value: r.value, Error: r.err.Error(), At: now})
+			if err != nil {
+				return err
+			}
+
+			if err = txn.Set(append([]byte(quarantinePrefix), r.key...), entry); err != nil {
+				return err
+			}
+			if err = txn.Delete(r.key); err != nil {
+				return err
+			}
+			if r.index != nil {
+				if err = txn.Delete(r.index); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		b.logger().Error("cannot quarantine records", "records", len(records), "err", err)
+	}
+}
+
+// Quarantined returns how many records are quarantined and up to limit of them.
+func (b BadgerDB) Quarantined(limit int) (int, []QuarantinedRecord, error) {
+	var (
+		count   int
+		records = []QuarantinedRecord{}
+	)
+
+	err := b.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(quarantinePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			count++
+			if len(records) >= limit {
+				continue
+			}
+
+			var r QuarantinedRecord
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &r)
+			})
+			if err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return count, records, nil
+}
+
+// Quarantined is always empty, the memory store keeps decoded messages only.
+func (m *MemoryStore) Quarantined(int) (int, []QuarantinedRecord, error) {
+	return 0, []QuarantinedRecord{}, nil
+}
+
+// handleQuarantine lists the quarantined records, ?limit= bounds the list, 100 by default.
+func (s *Server) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	count, records, err := s.DB.Quarantined(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]any{
+		"count":   count,
+		"records": records,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// StoredMessage is a message kept in the store, as GET /topics/{name}/history lists it.
+type StoredMessage struct {
+	ID        string            `json:"id"`
+	Topic     string            `json:"topic"`
+	Seq       uint64            `json:"seq"`
+	Key       string            `json:"key,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Published time.Time         `json:"published"`
+	// Pending is set until the message is acked.
+	Pending  bool            `json:"pending"`
+	Attempts int             `json:"attempts"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	// BodyString carries the bodies that are not JSON.
+	BodyString string `json:"body_string,omitempty"`
+}
+
+func newStoredMessage(m Message) StoredMessage {
+	sm := StoredMessage{
+		ID:        m.ID(),
+		Topic:     m.Topic().Name,
+		Seq:       m.Seq(),
+		Key:       m.Key(),
+		Headers:   m.Headers(),
+		Published: time.Unix(m.Timestamp(), 0).UTC(),
+		Pending:   strings.HasPrefix(m.ID(), MsgPrefixFalse),
+		Attempts:  m.Attempts(),
+	}
+	if json.Valid(m.Body()) {
+		sm.Body = m.Body()
+	} else {
+		sm.BodyString = m.BodyString()
+	}
+
+	return sm
+}
+
+// MessagePage is a page of a history query, Next is the after= of the following page, 0 on
+// the last one.
+type MessagePage struct {
+	Messages []StoredMessage `json:"messages"`
+	Next     uint64          `json:"next,omitempty"`
+}
+
+// QueryMessages returns up to limit of the stored messages of the topic within the range, in
+// publish order, starting past the seq after. The messages removed by the retention or acked
+// and collected are gone.
+func (s *Server) QueryMessages(topic Topic, r ReplayRange, after uint64, limit int) (MessagePage, error) {
+	if !s.hasTopic(topic) {
+		return MessagePage{}, errTopicNotFound
+	}
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+
+	r.FromSeq = max(r.FromSeq, after+1)
+	messages, err := s.ReplayTopic(topic, r)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	page := MessagePage{Messages: []StoredMessage{}}
+	for i, m := range messages {
+		if i == limit {
+			page.Next = messages[i-1].Seq()
+			break
+		}
+		page.Messages = append(page.Messages, newStoredMessage(m))
+	}
+
+	return page, nil
+}
+
+// handleHistory lists the stored messages of the topic published between ?from= and ?to=, see
+// parseReplayRange, ?limit= at a time. ?after= is the Next of the previous page.
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	rr, err := parseReplayRange(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultQueryLimit
+	if v := q.Get("limit"); v != "" {
+		n, errLimit := strconv.Atoi(v)
+		if errLimit != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxQueryLimit)
+	}
+
+	var after uint64
+	if v := q.Get("after"); v != "" {
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+
+	topic := NewTopic(r.PathValue("name"))
+	page, err := s.QueryMessages(topic, rr, after, limit)
+	switch {
+	case errors.Is(err, errTopicNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the history shows the bodies, reading it is audited.
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditHistory, User: user, RemoteAddr: r.RemoteAddr, Topic: topic.Name, Detail: r.URL.RawQuery})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(page); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
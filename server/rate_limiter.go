@@ -2,7 +2,9 @@ package server
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"fmt"
+	"log/slog"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -12,6 +14,8 @@ type RateLimiter struct {
 	limiter *rate.Limiter
 	queue   chan Message
 	quit    chan struct{}
+
+	logger *slog.Logger
 }
 
 func NewRateLimiter(maxPerSecond int, queueSize int) *RateLimiter {
@@ -56,7 +60,7 @@ func (rl *RateLimiter) ProcessQueue(processFunc func(Message)) {
 		select {
 		case message := <-rl.queue:
 			if err := rl.Wait(ctx); err != nil {
-				log.Printf("rate limiter wait failed: %v", err)
+				loggerOr(rl.logger).Warn("rate limiter wait failed", "err", err)
 				continue
 			}
 			processFunc(message)
@@ -65,3 +69,103 @@ func (rl *RateLimiter) ProcessQueue(processFunc func(Message)) {
 		}
 	}
 }
+
+// ByteLimiter throttles outbound traffic by bytes instead of messages, a single huge
+// binary payload costs the same as many small ones.
+type ByteLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewByteLimiter creates a limiter allowing bytesPerSecond with a burst of one second of traffic.
+func NewByteLimiter(bytesPerSecond int) *ByteLimiter {
+	return &ByteLimiter{
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), bytesPerSecond),
+	}
+}
+
+// WaitN blocks until n bytes can be written. Frames bigger than the burst are paid in
+// burst sized chunks, so they are delayed instead of rejected. A nil limiter never blocks.
+func (bl *ByteLimiter) WaitN(ctx context.Context, n int) error {
+	if bl == nil {
+		return nil
+	}
+
+	burst := bl.limiter.Burst()
+	for n > 0 {
+		chunk := min(n, burst)
+		if err := bl.limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+
+	return nil
+}
+
+// DeliveryLimiter paces the messages written to one subscriber, the rest of the topic is not
+// slowed down by it.
+type DeliveryLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewDeliveryLimiter creates a limiter spacing the deliveries evenly at messagesPerSecond.
+func NewDeliveryLimiter(messagesPerSecond int) *DeliveryLimiter {
+	return &DeliveryLimiter{
+		limiter: rate.NewLimiter(rate.Limit(messagesPerSecond), 1),
+	}
+}
+
+// Wait blocks until the next message can be written. A nil limiter never blocks.
+func (dl *DeliveryLimiter) Wait(ctx context.Context) error {
+	if dl == nil {
+		return nil
+	}
+
+	return dl.limiter.Wait(ctx)
+}
+
+// SubscribeOptions is the body of a NEW_SUB message, an empty body subscribes with the
+// server defaults.
+type SubscribeOptions struct {
+	// MaxRate caps the messages per second delivered to the subscriber, 0 leaves it to the
+	// server. A rate above Config.MaxSubscriberMessagesPerSecond gets that one.
+	MaxRate int `json:"max_rate,omitempty"`
+	// BatchSize asks for the deliveries in BATCH frames of up to that many messages, acked
+	// at once with BATCH_ACK. 0 and 1 deliver them one by one, the most is 1000.
+	BatchSize int `json:"batch_size,omitempty"`
+	// NoAck counts every delivery to the subscriber as done once written, it sends no ACK
+	// and a message it misses is not redelivered to it.
+	NoAck bool `json:"no_ack,omitempty"`
+}
+
+func parseSubscribeOptions(body []byte) (SubscribeOptions, error) {
+	var opts SubscribeOptions
+	if len(body) > 0 && string(body) != "null" {
+		if err := json.Unmarshal(body, &opts); err != nil {
+			return SubscribeOptions{}, fmt.Errorf("invalid subscribe options: %w", err)
+		}
+	}
+
+	if opts.MaxRate < 0 {
+		return SubscribeOptions{}, fmt.Errorf("invalid max_rate %d", opts.MaxRate)
+	}
+	if opts.BatchSize < 0 || opts.BatchSize > maxBatchSize {
+		return SubscribeOptions{}, fmt.Errorf("invalid batch_size %d", opts.BatchSize)
+	}
+
+	return opts, nil
+}
+
+// deliveryLimiter is the limiter of a new subscriber, the lowest of the rate it asked for and
+// the server one. Nil when neither is set.
+func (s *Server) deliveryLimiter(opts SubscribeOptions) *DeliveryLimiter {
+	limit := s.subscriberMessagesPerSecond
+	if opts.MaxRate > 0 && (limit <= 0 || opts.MaxRate < limit) {
+		limit = opts.MaxRate
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	return NewDeliveryLimiter(limit)
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// registryPrefix holds the topics and the durable subscribers of each, so both survive a restart.
+const registryPrefix = "registry/"
+
+func registryTopicKey(topic Topic) []byte {
+	return fmt.Appendf(nil, "%stopic/%s", registryPrefix, topic.Name)
+}
+
+func registryOptionsKey(topic Topic) []byte {
+	return fmt.Appendf(nil, "%soptions/%s", registryPrefix, topic.Name)
+}
+
+func registrySubscriberKey(topic Topic, subscriber string) []byte {
+	// the NUL keeps topic names containing "/" apart from subscriber names.
+	return fmt.Appendf(nil, "%ssubscriber/%s\x00%s", registryPrefix, topic.Name, subscriber)
+}
+
+func (b BadgerDB) SaveTopic(topic Topic) error {
+	return b.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(registryTopicKey(topic), nil)
+	})
+}
+
+func (b BadgerDB) SaveSubscriber(topic Topic, subscriber string) error {
+	return b.DB.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(registryTopicKey(topic), nil); err != nil {
+			return err
+		}
+
+		return txn.Set(registrySubscriberKey(topic, subscriber), nil)
+	})
+}
+
+func (b BadgerDB) Topics() (map[Topic][]string, error) {
+	topics := make(map[Topic][]string)
+	err := b.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		topicPrefix := []byte(registryPrefix + "topic/")
+		for it.Seek(topicPrefix); it.ValidForPrefix(topicPrefix); it.Next() {
+			topic := NewTopic(string(it.Item().Key()[len(topicPrefix):]))
+			if _, ok := topics[topic]; !ok {
+				topics[topic] = []string{}
+			}
+		}
+
+		subscriberPrefix := []byte(registryPrefix + "subscriber/")
+		for it.Seek(subscriberPrefix); it.ValidForPrefix(subscriberPrefix); it.Next() {
+			name, subscriber, ok := bytes.Cut(it.Item().Key()[len(subscriberPrefix):], []byte{0})
+			if !ok {
+				b.logger().Warn("invalid subscriber key", "key", string(it.Item().Key()))
+				continue
+			}
+
+			topic := NewTopic(string(name))
+			topics[topic] = append(topics[topic], string(subscriber))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return topics, nil
+}
+
+func (b BadgerDB) SaveTopicOptions(topic Topic, opts TopicOptions) error {
+	v, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+
+	return b.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(registryOptionsKey(topic), v)
+	})
+}
+
+func (b BadgerDB) SavedTopicOptions() (map[Topic]TopicOptions, error) {
+	options := make(map[Topic]TopicOptions)
+	err := b.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(registryPrefix + "options/")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			topic := NewTopic(string(it.Item().Key()[len(prefix):]))
+			err := it.Item().Value(func(v []byte) error {
+				var opts TopicOptions
+				if err := json.Unmarshal(v, &opts); err != nil {
+					b.logger().Warn("invalid topic options", "topic", topic.Name, "err", err)
+					return nil
+				}
+				options[topic] = opts
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return options, nil
+}
+
+// DeleteTopic removes the topic with its messages, durable subscribers and their cursors.
+func (b BadgerDB) DeleteTopic(topic Topic) (PurgeResult, error) {
+	result, err := b.purge(topic, func(Message) bool { return true })
+	if err != nil {
+		return PurgeResult{}, err
+	}
+
+	err = b.DB.Update(func(txn *badger.Txn) error {
+		var keys [][]byte
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+
+		prefix := fmt.Appendf(nil, "%ssubscriber/%s\x00", registryPrefix, topic.Name)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			subscriber := string(it.Item().Key()[len(prefix):])
+			keys = append(keys, it.Item().KeyCopy(nil), cursorKey(topic, subscriber))
+		}
+		it.Close()
+
+		keys = append(keys, registryTopicKey(topic), registryOptionsKey(topic), []byte(sequencePrefix+topic.Name))
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return PurgeResult{}, err
+	}
+
+	return result, nil
+}
+
+func (m *MemoryStore) SaveTopic(topic Topic) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.topics[topic]; !ok {
+		m.topics[topic] = []string{}
+	}
+	return nil
+}
+
+func (m *MemoryStore) SaveSubscriber(topic Topic, subscriber string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !slices.Contains(m.topics[topic], subscriber) {
+		m.topics[topic] = append(m.topics[topic], subscriber)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Topics() (map[Topic][]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	topics := make(map[Topic][]string, len(m.topics))
+	for topic, subscribers := range m.topics {
+		topics[topic] = slices.Clone(subscribers)
+	}
+	return topics, nil
+}
+
+func (m *MemoryStore) SaveTopicOptions(topic Topic, opts TopicOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.topicOptions[topic] = opts
+	return nil
+}
+
+func (m *MemoryStore) SavedTopicOptions() (map[Topic]TopicOptions, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return maps.Clone(m.topicOptions), nil
+}
+
+func (m *MemoryStore) DeleteTopic(topic Topic) (PurgeResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := m.purge(topic, func(Message) bool { return true })
+	delete(m.seqIndex, topic)
+	delete(m.seqs, topic)
+	delete(m.cursors, topic)
+	delete(m.cursorAcks, topic)
+	delete(m.topics, topic)
+	delete(m.topicOptions, topic)
+
+	return result, nil
+}
+
+// loadTopics brings back the topics registered before a restart, publishes to them are
+// stored even while nobody is subscribed.
+func (s *Server) loadTopics() error {
+	topics, err := s.DB.Topics()
+	if err != nil {
+		return err
+	}
+
+	s.clientsMu.Lock()
+	if s.clients == nil {
+		s.clients = make(map[Topic][]Client)
+	}
+	if s.durableTopics == nil {
+		s.durableTopics = make(map[Topic][]string)
+	}
+
+	for topic, subscribers := range topics {
+		if _, ok := s.clients[topic]; !ok {
+			s.clients[topic] = []Client{}
+		}
+		s.durableTopics[topic] = subscribers
+	}
+	s.clientsMu.Unlock()
+
+	return s.loadTopicOptions()
+}
+
+// registerTopic keeps the topic around once its last subscriber leaves.
+func (s *Server) registerTopic(topic Topic) {
+	s.clientsMu.Lock()
+	if s.durableTopics == nil {
+		s.durableTopics = make(map[Topic][]string)
+	}
+	if _, ok := s.durableTopics[topic]; !ok {
+		s.durableTopics[topic] = []string{}
+	}
+	s.clientsMu.Unlock()
+
+	if err := s.DB.SaveTopic(topic); err != nil {
+		s.logger().Error("cannot save topic", "topic", topic.Name, "err", err)
+	}
+}
+
+func (s *Server) registerSubscriber(topic Topic, subscriber string) {
+	s.clientsMu.Lock()
+	if s.durableTopics == nil {
+		s.durableTopics = make(map[Topic][]string)
+	}
+	if !slices.Contains(s.durableTopics[topic], subscriber) {
+		s.durableTopics[topic] = append(s.durableTopics[topic], subscriber)
+	}
+	s.clientsMu.Unlock()
+
+	if err := s.DB.SaveSubscriber(topic, subscriber); err != nil {
+		s.logger().Error("cannot save subscriber", "topic", topic.Name, "subscriber", subscriber, "err", err)
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tomiok/queuety/server/observability"
+)
+
+var errNotSubscribed = errors.New("not subscribed to the topic")
+
+// ReplayRange selects the stored messages of a topic to send again, it is the body of a
+// REPLAY message. Zero values are open ends, seq and time bounds are inclusive and combine.
+type ReplayRange struct {
+	FromSeq uint64    `json:"from_seq,omitempty"`
+	ToSeq   uint64    `json:"to_seq,omitempty"`
+	From    time.Time `json:"from,omitzero"`
+	To      time.Time `json:"to,omitzero"`
+}
+
+// Position is where a replay starts or ends, a seq of the topic or a publish time.
+type Position interface {
+	uint64 | time.Time
+}
+
+// NewReplayRange builds the range from a position up to the optional to position.
+func NewReplayRange[P Position](from P, to ...P) ReplayRange {
+	var r ReplayRange
+	switch v := any(from).(type) {
+	case uint64:
+		r.FromSeq = v
+	case time.Time:
+		r.From = v
+	}
+
+	if len(to) > 0 {
+		switch v := any(to[0]).(type) {
+		case uint64:
+			r.ToSeq = v
+		case time.Time:
+			r.To = v
+		}
+	}
+
+	return r
+}
+
+func (r ReplayRange) contains(message Message) bool {
+	if r.ToSeq > 0 && message.Seq() > r.ToSeq {
+		return false
+	}
+	if !r.From.IsZero() && message.Timestamp() < r.From.Unix() {
+		return false
+	}
+	if !r.To.IsZero() && message.Timestamp() > r.To.Unix() {
+		return false
+	}
+
+	return true
+}
+
+// ReplayTopic returns the messages of the topic still stored within the range, in publish order.
+func (s *Server) ReplayTopic(topic Topic, r ReplayRange) ([]Message, error) {
+	var after uint64
+	if r.FromSeq > 0 {
+		after = r.FromSeq - 1
+	}
+
+	messages, err := s.DB.MessagesAfter(topic, after)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := messages[:0]
+	for _, msg := range messages {
+		if r.contains(msg) {
+			selected = append(selected, msg)
+		}
+	}
+
+	return selected, nil
+}
+
+// replay sends the messages of the range to client, encoded in its format.
+func (s *Server) replay(client Client, messages []Message) (int, error) {
+	for i, msg := range messages {
+		payload, err := encodeMessage(msg, client.Format)
+		if err != nil {
+			return i, err
+		}
+
+		if err = s.deliver(client, msg, payload); err != nil {
+			return i, err
+		}
+	}
+
+	return len(messages), nil
+}
+
+// handleReplay serves a REPLAY message, the messages go to the subscription conn has on the topic.
+func (s *Server) handleReplay(conn net.Conn, format MessageFormat, msg Message) {
+	var r ReplayRange
+	if err := json.Unmarshal(msg.Body(), &r); err != nil {
+		s.sendError(conn, format, ErrCodeMalformedFrame, "invalid replay range: "+err.Error(), msg)
+		return
+	}
+
+	var (
+		client Client
+		found  bool
+	)
+	for _, c := range s.clientsOf(msg.Topic()) {
+		if c.conn == conn {
+			client, found = c, true
+			break
+		}
+	}
+	if !found {
+		s.sendError(conn, format, ErrCodeUnknownTopic, errNotSubscribed.Error(), msg)
+		return
+	}
+
+	messages, err := s.ReplayTopic(msg.Topic(), r)
+	if err != nil {
+		s.sendError(conn, format, ErrCodeInternal, err.Error(), msg)
+		return
+	}
+
+	go func() {
+		if _, err := s.replay(client, messages); err != nil {
+			s.logger().Warn("replay stopped", "topic", msg.Topic().Name, "err", err)
+		}
+	}()
+}
+
+// Republish publishes the stored messages of the topic within the range again as new messages
+// of target, the topic itself when target is empty. They get a new ID and seq, are persisted
+// and reach every subscriber of target, durable ones included, as if a client sent them.
+func (s *Server) Republish(topic Topic, r ReplayRange, target Topic) (int, error) {
+	if target.IsEmpty() {
+		target = topic
+	}
+	if !s.hasTopic(target) {
+		return 0, errTopicNotFound
+	}
+
+	messages, err := s.ReplayTopic(topic, r)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, stored := range messages {
+		id := uuid.NewString()
+		msg := NewMessageBuilder().
+			WithID(MsgPrefixFalse + "-" + id).
+			WithNextID(id).
+			WithType(MessageTypeNew).
+			WithTopic(target).
+			WithBody(stored.Body()).
+			WithTimestamp(time.Now().Unix()).
+			WithTTL(s.topicRetention[target.Name]).
+			Build()
+
+		if msg.seq, err = s.nextSeq(target); err != nil {
+			return i, err
+		}
+		s.trace(msg, TraceEvent{Stage: TraceReceived, Detail: fmt.Sprintf("republished from %s seq %d", topic.Name, stored.Seq())})
+		if err = s.sendNewMessage(msg); err != nil {
+			return i, err
+		}
+		observability.MessagesPublished.WithLabelValues(target.Name).Inc()
+	}
+
+	return len(messages), nil
+}
+
+// parseReplayRange reads from_seq, to_seq, and from, to as RFC 3339 times from the query.
+func parseReplayRange(q url.Values) (ReplayRange, error) {
+	var (
+		rr  ReplayRange
+		err error
+	)
+
+	if v := q.Get("from_seq"); v != "" {
+		if rr.FromSeq, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return rr, errors.New("invalid from_seq")
+		}
+	}
+	if v := q.Get("to_seq"); v != "" {
+		if rr.ToSeq, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return rr, errors.New("invalid to_seq")
+		}
+	}
+	if v := q.Get("from"); v != "" {
+		if rr.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return rr, errors.New("invalid from")
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if rr.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return rr, errors.New("invalid to")
+		}
+	}
+
+	return rr, nil
+}
+
+// handleReplayTopic sends the range to every current subscriber of the topic.
+// The range comes in the query, see parseReplayRange.
+func (s *Server) handleReplayTopic(w http.ResponseWriter, r *http.Request) {
+	rr, err := parseReplayRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	topic := NewTopic(r.PathValue("name"))
+	messages, err := s.ReplayTopic(topic, rr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	clients := s.clientsOf(topic)
+	for _, client := range clients {
+		go func() {
+			if _, err := s.replay(client, messages); err != nil {
+				s.logger().Warn("replay stopped", "topic", topic.Name, "err", err)
+			}
+		}()
+	}
+
+	user := adminUser(r)
+	s.audit(AuditEntry{
+		Action:     AuditReplay,
+		User:       user,
+		RemoteAddr: r.RemoteAddr,
+		Topic:      topic.Name,
+		Detail:     strconv.Itoa(len(messages)) + " messages",
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(map[string]int{"messages": len(messages), "subscribers": len(clients)}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleRepublish publishes the range again as new messages, to ?target= or to the topic
+// itself. The range comes in the query, see parseReplayRange.
+func (s *Server) handleRepublish(w http.ResponseWriter, r *http.Request) {
+	rr, err := parseReplayRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	topic := NewTopic(r.PathValue("name"))
+	target := NewTopic(r.URL.Query().Get("target"))
+	if target.IsEmpty() {
+		target = topic
+	}
+
+	republished, err := s.Republish(topic, rr, target)
+
+	user := adminUser(r)
+	s.audit(AuditEntry{
+		Action:     AuditRepublish,
+		User:       user,
+		RemoteAddr: r.RemoteAddr,
+		Topic:      topic.Name,
+		Detail:     fmt.Sprintf("%d messages to %s", republished, target.Name),
+	})
+
+	switch {
+	case errors.Is(err, errTopicNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errRateLimited):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(map[string]any{"republished": republished, "target": target.Name}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
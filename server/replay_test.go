@@ -0,0 +1,112 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_ReplayTopic(t *testing.T) {
+	srv := Server{DB: NewMemoryStore(0)}
+	topic := NewTopic("orders")
+
+	for i := int64(1); i <= 4; i++ {
+		seq, _ := srv.DB.NextSeq(topic)
+		msg := NewMessageBuilder().
+			WithID("false-" + strconv.FormatInt(i, 10)).
+			WithTopic(topic).
+			WithTimestamp(i * 100).
+			WithSeq(seq).
+			Build()
+		if err := srv.DB.SaveMessage(msg, FormatJSON); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	messages, err := srv.ReplayTopic(topic, NewReplayRange(uint64(2), 3))
+	if err != nil || len(messages) != 2 || messages[0].Seq() != 2 || messages[1].Seq() != 3 {
+		t.Fatalf("expected seqs 2 and 3, got %v %v", messages, err)
+	}
+
+	messages, _ = srv.ReplayTopic(topic, NewReplayRange(time.Unix(300, 0)))
+	if len(messages) != 2 || messages[0].Seq() != 3 {
+		t.Fatalf("expected the messages published from 300, got %v", messages)
+	}
+}
+
+func Test_Republish(t *testing.T) {
+	srv := Server{DB: NewMemoryStore(0), clients: map[Topic][]Client{}}
+	source, target := NewTopic("orders"), NewTopic("orders-fixed")
+	srv.clients[target] = nil
+
+	for i := int64(1); i <= 3; i++ {
+		seq, _ := srv.DB.NextSeq(source)
+		msg := NewMessageBuilder().
+			WithID("false-" + strconv.FormatInt(i, 10)).
+			WithTopic(source).
+			WithBody([]byte(strconv.FormatInt(i, 10))).
+			WithTimestamp(i * 100).
+			WithSeq(seq).
+			Build()
+		if err := srv.DB.SaveMessage(msg, FormatJSON); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	if _, err := srv.Republish(source, ReplayRange{}, NewTopic("missing")); err == nil {
+		t.Fatal("expected an unknown target to fail")
+	}
+
+	n, err := srv.Republish(source, NewReplayRange(uint64(2)), target)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 messages republished, got %d %v", n, err)
+	}
+
+	messages, err := srv.ReplayTopic(target, ReplayRange{})
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("expected the 2 messages in the target, got %v %v", messages, err)
+	}
+	if messages[0].Seq() != 1 || messages[0].BodyString() != "2" || messages[1].BodyString() != "3" {
+		t.Fatalf("expected new seqs with the original bodies, got %v", messages)
+	}
+	if messages[0].ID() == "false-2" {
+		t.Fatal("expected a new ID")
+	}
+}
+
+func Test_QueryMessagesPages(t *testing.T) {
+	topic := NewTopic("payments")
+	srv := Server{DB: NewMemoryStore(0), clients: map[Topic][]Client{topic: nil}}
+
+	for i := int64(1); i <= 5; i++ {
+		seq, _ := srv.DB.NextSeq(topic)
+		msg := NewMessageBuilder().
+			WithID("false-" + strconv.FormatInt(i, 10)).
+			WithTopic(topic).
+			WithBody([]byte(strconv.FormatInt(i, 10))).
+			WithTimestamp(i * 100).
+			WithSeq(seq).
+			Build()
+		if err := srv.DB.SaveMessage(msg, FormatJSON); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	r := NewReplayRange(time.Unix(200, 0), time.Unix(400, 0))
+	page, err := srv.QueryMessages(topic, r, 0, 2)
+	if err != nil || len(page.Messages) != 2 || page.Messages[0].Seq != 2 || page.Next != 3 {
+		t.Fatalf("expected seqs 2 and 3 with more to come, got %+v %v", page, err)
+	}
+	if !page.Messages[0].Pending || string(page.Messages[0].Body) != "2" {
+		t.Fatalf("expected the pending message with its body, got %+v", page.Messages[0])
+	}
+
+	page, err = srv.QueryMessages(topic, r, page.Next, 2)
+	if err != nil || len(page.Messages) != 1 || page.Messages[0].Seq != 4 || page.Next != 0 {
+		t.Fatalf("expected the last page with seq 4, got %+v %v", page, err)
+	}
+
+	if _, err = srv.QueryMessages(NewTopic("missing"), r, 0, 2); err == nil {
+		t.Fatal("expected an unknown topic to fail")
+	}
+}
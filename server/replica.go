@@ -0,0 +1,328 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultReplicaRetry = time.Second
+	replicaDialTimeout  = 5 * time.Second
+)
+
+// ReplicaConfig makes a broker a read-only replica: it subscribes to the topics on the primary
+// and delivers them to its own subscribers, taking the fan out of the popular topics off the
+// primary. The clients of a replica consume and ack, their publishes are refused.
+type ReplicaConfig struct {
+	// Primary is the broker address of the primary, as in primary:9845.
+	Primary string
+	// Protocol is the one of Primary, tcp when empty.
+	Protocol string
+	// User and Password authenticate the replica on the primary, empty for an open one.
+	User     string
+	Password string
+	// Topics are the ones replicated, created on the replica if missing.
+	Topics []string
+	// Name is the durable subscriber of the replica on the primary, the messages sent while it
+	// was away come on reconnection. The host name prefixed with replica- when empty, every
+	// replica needs its own.
+	Name string
+	// RetryInterval is the wait before connecting again to a lost primary, a second when 0.
+	RetryInterval time.Duration
+}
+
+// ReplicaStatus is the answer of GET /replica.
+type ReplicaStatus struct {
+	Primary    string    `json:"primary"`
+	Name       string    `json:"name"`
+	Topics     []string  `json:"topics"`
+	Connected  bool      `json:"connected"`
+	Replicated int64     `json:"replicated"`
+	LastSeen   time.Time `json:"last_seen,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// replica follows the topics of the primary on a broker connection.
+type replica struct {
+	cfg  ReplicaConfig
+	log  *slog.Logger
+	quit chan struct{}
+	done chan struct{}
+
+	mu         sync.Mutex
+	conn       net.Conn
+	started    bool
+	replicated int64
+	lastSeen   time.Time
+	err        error
+}
+
+func newReplica(cfg ReplicaConfig, logger *slog.Logger) (*replica, error) {
+	if cfg.Primary == "" || len(cfg.Topics) == 0 {
+		return nil, errors.New("a replica needs a primary and topics")
+	}
+	if cfg.Protocol == "" {
+		cfg.Protocol = "tcp"
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = defaultReplicaRetry
+	}
+	if cfg.Name == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("cannot name the replica: %w", err)
+		}
+		cfg.Name = "replica-" + host
+	}
+
+	return &replica{cfg: cfg, log: logger, quit: make(chan struct{}), done: make(chan struct{})}, nil
+}
+
+// start follows the primary until stop.
+func (r *replica) start(s *Server) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.started {
+		return
+	}
+	r.started = true
+	go r.run(s)
+}
+
+func (r *replica) stop() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	started := r.started
+	if started {
+		r.started = false
+		close(r.quit)
+		if r.conn != nil {
+			_ = r.conn.Close()
+		}
+	}
+	r.mu.Unlock()
+
+	if started {
+		<-r.done
+	}
+}
+
+func (r *replica) run(s *Server) {
+	defer close(r.done)
+
+	for {
+		err := r.follow(s)
+
+		r.mu.Lock()
+		r.conn, r.err = nil, err
+		r.mu.Unlock()
+
+		select {
+		case <-r.quit:
+			return
+		default:
+		}
+		r.log.Warn("replica lost the primary", "primary", r.cfg.Primary, "err", err)
+
+		select {
+		case <-r.quit:
+			return
+		case <-time.After(r.cfg.RetryInterval):
+		}
+	}
+}
+
+// follow subscribes to the topics on the primary and replicates what it delivers until the
+// connection is lost. A message is acked to the primary once handed to the local subscribers,
+// or stored for them.
+func (r *replica) follow(s *Server) error {
+	conn, err := net.DialTimeout(r.cfg.Protocol, r.cfg.Primary, replicaDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// listed with the connections of the clients, the replicated messages are traced with it.
+	s.clientConn(conn).setClient(ClientInfo{Name: "replica", Labels: map[string]string{"primary": r.cfg.Primary}}, nil)
+	defer s.removeClientConn(conn)
+
+	r.mu.Lock()
+	select {
+	case <-r.quit:
+		r.mu.Unlock()
+		return net.ErrClosed
+	default:
+	}
+	r.conn, r.err = conn, nil
+	r.mu.Unlock()
+
+	if r.cfg.User != "" || r.cfg.Password != "" {
+		if err = r.login(conn); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range r.cfg.Topics {
+		id := uuid.NewString()
+		sub := NewMessageBuilder().
+			WithID(id).
+			WithNextID(id).
+			WithType(MessageTypeNewSubscriber).
+			WithTopic(NewTopic(name)).
+			WithSubscriber(r.cfg.Name).
+			Build()
+		if err = writeReplicaFrame(conn, sub); err != nil {
+			return err
+		}
+	}
+	r.log.Info("replica following the primary", "primary", r.cfg.Primary, "topics", r.cfg.Topics, "name", r.cfg.Name)
+
+	for {
+		msg, errRead := readReplicaFrame(conn, s.frameLimit())
+		if errRead != nil {
+			return errRead
+		}
+
+		switch msg.Type() {
+		case MessageTypeNew:
+			// the primary stores the acked message as it comes back.
+			ack := msg
+			ack.mType, ack.ack = MessageTypeACK, true
+
+			s.replicate(conn, msg)
+			if err = writeReplicaFrame(conn, ack); err != nil {
+				return err
+			}
+
+			r.mu.Lock()
+			r.replicated++
+			r.lastSeen = time.Now()
+			r.mu.Unlock()
+		case MessageTypeError:
+			body, _ := msg.ErrorBody()
+			r.log.Warn("primary rejected the replica", "topic", msg.Topic().Name, "code", body.Code, "description", body.Description)
+		}
+	}
+}
+
+func (r *replica) login(conn net.Conn) error {
+	auth := NewMessageBuilder().
+		WithID(uuid.NewString()).
+		WithType(MessageTypeAuth).
+		WithUser(r.cfg.User).
+		WithPassword(r.cfg.Password).
+		Build()
+	if err := writeReplicaFrame(conn, auth); err != nil {
+		return err
+	}
+
+	answer, err := readReplicaFrame(conn, defaultMaxFrameSize)
+	if err != nil {
+		return err
+	}
+	if answer.Type() != MessageAuthSuccess {
+		return fmt.Errorf("primary refused the replica credentials: %s", answer.Type())
+	}
+
+	return nil
+}
+
+func writeReplicaFrame(conn net.Conn, m Message) error {
+	payload, err := m.Marshall()
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	frame[0] = byte(FormatJSON)
+	binary.LittleEndian.PutUint32(frame[1:], uint32(len(payload)))
+	_, err = conn.Write(append(frame, payload...))
+
+	return err
+}
+
+func readReplicaFrame(conn net.Conn, limit int) (Message, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return Message{}, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[1:])
+	if int(size) > limit {
+		return Message{}, fmt.Errorf("frame of %d bytes over the limit", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return Message{}, err
+	}
+
+	var msg Message
+	if MessageFormat(header[0]) == FormatBinary {
+		err := msg.UnmarshalBinary(payload)
+		return msg, err
+	}
+
+	return DecodeMessage(payload)
+}
+
+// replicate delivers a message of the primary as if it was published here, with the seq the
+// primary gave it. The marks of its delivery to the replica are dropped.
+func (s *Server) replicate(conn net.Conn, msg Message) {
+	cc := s.clientConn(conn)
+	msg.subscriber, msg.attempts, msg.redelivered, msg.ack = "", 0, false, false
+	if !s.hasTopic(msg.Topic()) {
+		s.logger().Warn("replicated message of an unknown topic", "topic", msg.Topic().Name)
+		return
+	}
+
+	s.trace(msg, TraceEvent{Stage: TraceReceived, ConnectionID: cc.id, Detail: "replicated"})
+	s.sendMessageSync(msg, msg.Topic())
+	s.touchTopic(msg.Topic())
+}
+
+func (r *replica) status() ReplicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st := ReplicaStatus{
+		Primary:    r.cfg.Primary,
+		Name:       r.cfg.Name,
+		Topics:     r.cfg.Topics,
+		Connected:  r.conn != nil,
+		Replicated: r.replicated,
+		LastSeen:   r.lastSeen,
+	}
+	if r.err != nil {
+		st.Error = r.err.Error()
+	}
+
+	return st
+}
+
+func (s *Server) handleReplica(w http.ResponseWriter, _ *http.Request) {
+	if s.replica == nil {
+		http.Error(w, "the broker is not a replica", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.replica.status()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
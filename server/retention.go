@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// PurgeResult is what a retention pass removed from a topic.
+type PurgeResult struct {
+	Messages int   `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// topicPurge accumulates the retention passes of a topic, shown in /retention.
+type topicPurge struct {
+	Messages  int64     `json:"messages"`
+	Bytes     int64     `json:"bytes"`
+	LastPurge time.Time `json:"last_purge"`
+}
+
+type retentionReport struct {
+	mu     sync.Mutex
+	topics map[string]*topicPurge
+}
+
+func (r *retentionReport) add(topic string, result PurgeResult, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.topics == nil {
+		r.topics = make(map[string]*topicPurge)
+	}
+
+	p, ok := r.topics[topic]
+	if !ok {
+		p = &topicPurge{}
+		r.topics[topic] = p
+	}
+	p.Messages += int64(result.Messages)
+	p.Bytes += result.Bytes
+	p.LastPurge = at
+}
+
+func (r *retentionReport) snapshot() map[string]topicPurge {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	topics := make(map[string]topicPurge, len(r.topics))
+	for name, p := range r.topics {
+		topics[name] = *p
+	}
+	return topics
+}
+
+// applyRetention purges every topic with a retention policy of the messages published
+// before it, pending or acked.
+func (s *Server) applyRetention(now time.Time) {
+	for name, retention := range s.topicRetention {
+		if retention <= 0 {
+			continue
+		}
+
+		result, err := s.DB.PurgeTopic(NewTopic(name), now.Add(-retention))
+		if err != nil {
+			s.logger().Error("cannot apply retention", "topic", name, "err", err)
+			continue
+		}
+
+		s.retention.add(name, result, now)
+		s.maintenance.purgedMessages.Add(int64(result.Messages))
+		s.maintenance.purgedBytes.Add(result.Bytes)
+	}
+}
+
+// PurgeTopic removes the messages of the topic published before cutoff, the scan stays
+// within the topic prefix.
+func (b BadgerDB) PurgeTopic(topic Topic, cutoff time.Time) (PurgeResult, error) {
+	return b.purge(topic, func(msg Message) bool {
+		return msg.Timestamp() < cutoff.Unix()
+	})
+}
+
+// purge removes the messages of the topic matching purged, with their pending index entry.
+func (b BadgerDB) purge(topic Topic, purged func(Message) bool) (PurgeResult, error) {
+	var (
+		result PurgeResult
+		keys   [][]byte
+	)
+
+	err := b.View(func(txn *badger.Txn) error {
+		prefix := topicPrefix(topic)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if !isMessageKey(prefix, item.Key()) {
+				continue
+			}
+
+			err := item.Value(func(v []byte) error {
+				msg, err := decodeRecord(v)
+				if err != nil || !purged(msg) {
+					return nil
+				}
+
+				keys = append(keys, item.KeyCopy(nil))
+				if strings.HasPrefix(msg.ID(), MsgPrefixFalse) {
+					keys = append(keys, pendingKey(msg.ID()))
+				}
+
+				result.Messages++
+				result.Bytes += item.EstimatedSize()
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return PurgeResult{}, err
+	}
+
+	wb := b.DB.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, key := range keys {
+		if err = wb.Delete(key); err != nil {
+			return PurgeResult{}, err
+		}
+	}
+
+	if err = wb.Flush(); err != nil {
+		return PurgeResult{}, err
+	}
+
+	return result, nil
+}
+
+func (m *MemoryStore) PurgeTopic(topic Topic, cutoff time.Time) (PurgeResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.purge(topic, func(msg Message) bool {
+		return msg.Timestamp() < cutoff.Unix()
+	}), nil
+}
+
+// purge expects the lock held.
+func (m *MemoryStore) purge(topic Topic, purged func(Message) bool) PurgeResult {
+	var result PurgeResult
+	for seq, keys := range m.seqIndex[topic] {
+		var removed bool
+		for _, key := range keys {
+			msg, ok := m.messages[key]
+			if !ok || !purged(msg) {
+				continue
+			}
+
+			delete(m.messages, key)
+			removed = true
+			result.Messages++
+			result.Bytes += int64(len(key) + len(msg.Body()))
+		}
+
+		if removed {
+			delete(m.seqIndex[topic], seq)
+		}
+	}
+
+	return result
+}
+
+// handleRetention reports the retention policies and what each topic had purged so far.
+func (s *Server) handleRetention(w http.ResponseWriter, _ *http.Request) {
+	policies := make(map[string]string, len(s.topicRetention))
+	for name, retention := range s.topicRetention {
+		policies[name] = retention.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]any{
+		"policies": policies,
+		"topics":   s.retention.snapshot(),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleApplyRetention runs a retention pass now instead of waiting for the maintenance job.
+func (s *Server) handleApplyRetention(w http.ResponseWriter, r *http.Request) {
+	s.applyRetention(time.Now())
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditRetention, User: user, RemoteAddr: r.RemoteAddr})
+
+	s.handleRetention(w, r)
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3ObjectStore uploads the objects with the S3 API, signed with AWS Signature V4. It works
+// with AWS S3, MinIO and the GCS XML API with HMAC keys (Region "auto").
+type S3ObjectStore struct {
+	// Endpoint is the base URL of the service, for example http://minio:9000 or
+	// https://storage.googleapis.com. The bucket goes in the path. Empty means AWS S3 in
+	// Region, with the bucket in the host name.
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	AccessKey string
+	SecretKey string
+
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+}
+
+func (s S3ObjectStore) Put(ctx context.Context, key string, r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	u, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentTypeOf(key))
+	s.sign(req, body, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("put %s: %s: %s", key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+func (s S3ObjectStore) objectURL(key string) (*url.URL, error) {
+	if s.Bucket == "" {
+		return nil, fmt.Errorf("missing bucket")
+	}
+
+	if s.Endpoint == "" {
+		return &url.URL{
+			Scheme:  "https",
+			Host:    fmt.Sprintf("%s.s3.%s.amazonaws.com", s.Bucket, s.Region),
+			Path:    "/" + key,
+			RawPath: "/" + s3Escape(key),
+		}, nil
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	path := "/" + s.Bucket + "/" + key
+	u.RawPath = u.Path + "/" + s3Escape(s.Bucket) + "/" + s3Escape(key)
+	u.Path += path
+
+	return u, nil
+}
+
+// sign adds the AWS Signature V4 headers, the payload is hashed rather than left unsigned
+// since some S3 compatible services refuse UNSIGNED-PAYLOAD.
+func (s S3ObjectStore) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	for _, part := range []string{s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// s3Escape encodes everything but the unreserved characters and the slashes, as the
+// canonical URI of Signature V4 expects.
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func contentTypeOf(key string) string {
+	if strings.HasSuffix(key, ".gz") {
+		return "application/gzip"
+	}
+	return "application/octet-stream"
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultSampleSize      = 100
+	defaultSampleBodyBytes = 256
+)
+
+// MessageSample is a message of a topic captured by Config.SampleRates, the answer of
+// GET /topics/{name}/samples.
+type MessageSample struct {
+	ID      string            `json:"id"`
+	Seq     uint64            `json:"seq"`
+	Key     string            `json:"key,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is the start of the body, up to Config.SampleBodyBytes, BodySize its full length.
+	Body      string    `json:"body"`
+	BodySize  int       `json:"body_size"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Published time.Time `json:"published"`
+	Sampled   time.Time `json:"sampled"`
+}
+
+// sampleRing keeps the last samples of a topic, next is where the one coming goes.
+type sampleRing struct {
+	samples []MessageSample
+	next    int
+}
+
+// sampler captures a fraction of the messages of the topics it has a rate for, the oldest
+// sample of a full ring is overwritten.
+type sampler struct {
+	rates     map[string]float64
+	size      int
+	bodyBytes int
+
+	mu    sync.Mutex
+	rings map[string]*sampleRing
+}
+
+func newSampler(rates map[string]float64, size, bodyBytes int) *sampler {
+	if len(rates) == 0 {
+		return nil
+	}
+	if size <= 0 {
+		size = defaultSampleSize
+	}
+	if bodyBytes <= 0 {
+		bodyBytes = defaultSampleBodyBytes
+	}
+
+	return &sampler{rates: rates, size: size, bodyBytes: bodyBytes, rings: make(map[string]*sampleRing)}
+}
+
+// offer captures the message when its topic draws it, a sampler without a rate for the topic
+// costs a map lookup.
+func (s *sampler) offer(message Message) {
+	if s == nil {
+		return
+	}
+
+	rate := s.rates[message.Topic().Name]
+	if rate <= 0 || (rate < 1 && rand.Float64() >= rate) {
+		return
+	}
+
+	body := message.BodyString()
+	if body == "" {
+		body = string(message.Body())
+	}
+	sample := MessageSample{
+		ID:        message.ID(),
+		Seq:       message.Seq(),
+		Key:       message.Key(),
+		Headers:   message.Headers(),
+		BodySize:  len(body),
+		Published: time.Unix(message.Timestamp(), 0).UTC(),
+		Sampled:   time.Now().UTC(),
+	}
+	if len(body) > s.bodyBytes {
+		// cut on a rune boundary, the body stays valid UTF-8 in the JSON answer.
+		cut := s.bodyBytes
+		for cut > 0 && !utf8.RuneStart(body[cut]) {
+			cut--
+		}
+		body, sample.Truncated = body[:cut], true
+	}
+	sample.Body = body
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ring := s.rings[message.Topic().Name]
+	if ring == nil {
+		ring = &sampleRing{samples: make([]MessageSample, 0, s.size)}
+		s.rings[message.Topic().Name] = ring
+	}
+	if len(ring.samples) < s.size {
+		ring.samples = append(ring.samples, sample)
+		return
+	}
+	ring.samples[ring.next] = sample
+	ring.next = (ring.next + 1) % s.size
+}
+
+// forget drops the samples of the message, as once erased.
+func (s *sampler) forget(message Message) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ring := s.rings[message.Topic().Name]
+	if ring == nil {
+		return
+	}
+
+	// the ring is put back in order, the oldest first, without the message.
+	samples := make([]MessageSample, 0, s.size)
+	for _, sample := range slices.Concat(ring.samples[ring.next:], ring.samples[:ring.next]) {
+		if sample.ID != message.ID() && sample.ID != message.NextID() {
+			samples = append(samples, sample)
+		}
+	}
+	ring.samples, ring.next = samples, 0
+}
+
+// samples returns the samples of the topic, oldest first.
+func (s *sampler) samples(topic Topic) []MessageSample {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ring := s.rings[topic.Name]
+	if ring == nil {
+		return nil
+	}
+
+	samples := make([]MessageSample, 0, len(ring.samples))
+	samples = append(samples, ring.samples[ring.next:]...)
+	return append(samples, ring.samples[:ring.next]...)
+}
+
+// Samples returns the messages of the topic captured by Config.SampleRates, oldest first.
+func (s *Server) Samples(topic Topic) []MessageSample {
+	return s.sampler.samples(topic)
+}
+
+func (s *Server) handleSamples(w http.ResponseWriter, r *http.Request) {
+	topic := NewTopic(r.PathValue("name"))
+	if !s.hasTopic(topic) {
+		http.Error(w, errTopicNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	// the samples show the bodies, reading them is audited as a tail is.
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditSamples, User: user, RemoteAddr: r.RemoteAddr, Topic: topic.Name})
+
+	samples := s.Samples(topic)
+	if samples == nil {
+		samples = []MessageSample{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(samples); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+	"github.com/tomiok/queuety/server/observability"
+)
+
+var errScheduleNotFound = errors.New("schedule not found")
+
+// Schedule is a message the broker publishes on its own whenever Cron fires, a heartbeat or
+// a trigger without a cron job next to the broker. Cron is read in UTC, to the minute.
+type Schedule struct {
+	Name  string `json:"name"`
+	Cron  string `json:"cron"`
+	Topic string `json:"topic"`
+	// Body is a text/template of the message body, given the Name, the Topic and the Time
+	// the schedule fires at: {"at":"{{.Time.Format "2006-01-02T15:04:05Z07:00"}}"}.
+	Body string `json:"body"`
+	Key  string `json:"key,omitempty"`
+}
+
+// scheduleData is what the body template of a Schedule is executed with.
+type scheduleData struct {
+	Name  string
+	Topic string
+	Time  time.Time
+}
+
+func (s Schedule) validate() error {
+	if s.Name == "" || strings.ContainsAny(s.Name, "/\x00") {
+		return fmt.Errorf("invalid schedule name %q", s.Name)
+	}
+	if s.Topic == "" {
+		return errors.New("a schedule needs a topic")
+	}
+	if _, err := parseCron(s.Cron); err != nil {
+		return err
+	}
+	if _, err := template.New(s.Name).Parse(s.Body); err != nil {
+		return fmt.Errorf("invalid body template: %w", err)
+	}
+
+	return nil
+}
+
+// render executes the body template for the minute the schedule fires at.
+func (s Schedule) render(at time.Time) ([]byte, error) {
+	tmpl, err := template.New(s.Name).Parse(s.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err = tmpl.Execute(&b, scheduleData{Name: s.Name, Topic: s.Topic, Time: at}); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func registryScheduleKey(name string) []byte {
+	return fmt.Appendf(nil, "%sschedule/%s", registryPrefix, name)
+}
+
+func (b BadgerDB) SaveSchedule(schedule Schedule) error {
+	v, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+
+	return b.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(registryScheduleKey(schedule.Name), v)
+	})
+}
+
+func (b BadgerDB) Schedules() ([]Schedule, error) {
+	var schedules []Schedule
+	err := b.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(registryPrefix + "schedule/")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				var schedule Schedule
+				if err := json.Unmarshal(v, &schedule); err != nil {
+					b.logger().Warn("invalid schedule", "key", string(it.Item().Key()), "err", err)
+					return nil
+				}
+				schedules = append(schedules, schedule)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return schedules, err
+}
+
+func (b BadgerDB) DeleteSchedule(name string) error {
+	return b.DB.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(registryScheduleKey(name)); errors.Is(err, badger.ErrKeyNotFound) {
+			return errScheduleNotFound
+		} else if err != nil {
+			return err
+		}
+
+		return txn.Delete(registryScheduleKey(name))
+	})
+}
+
+func (m *MemoryStore) SaveSchedule(schedule Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.schedules == nil {
+		m.schedules = make(map[string]Schedule)
+	}
+	m.schedules[schedule.Name] = schedule
+	return nil
+}
+
+func (m *MemoryStore) Schedules() ([]Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	schedules := make([]Schedule, 0, len(m.schedules))
+	for _, schedule := range m.schedules {
+		schedules = append(schedules, schedule)
+	}
+	slices.SortFunc(schedules, func(a, b Schedule) int { return strings.Compare(a.Name, b.Name) })
+	return schedules, nil
+}
+
+func (m *MemoryStore) DeleteSchedule(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.schedules[name]; !ok {
+		return errScheduleNotFound
+	}
+	delete(m.schedules, name)
+	return nil
+}
+
+// runSchedules publishes the messages of the schedules firing at every minute, until quit.
+// The minutes the broker was down are not caught up.
+func (s *Server) runSchedules(quit <-chan struct{}) {
+	for {
+		next := time.Now().UTC().Truncate(time.Minute).Add(time.Minute)
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-timer.C:
+			s.fireSchedules(next)
+		case <-quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// fireSchedules publishes the message of every schedule matching the minute at.
+func (s *Server) fireSchedules(at time.Time) {
+	schedules, err := s.DB.Schedules()
+	if err != nil {
+		s.logger().Error("cannot load schedules", "err", err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		spec, err := parseCron(schedule.Cron)
+		if err != nil {
+			s.logger().Warn("invalid schedule", "schedule", schedule.Name, "err", err)
+			continue
+		}
+		if !spec.matches(at) {
+			continue
+		}
+
+		if err = s.publishScheduled(schedule, at); err != nil {
+			s.logger().Warn("cannot publish scheduled message", "schedule", schedule.Name, "topic", schedule.Topic, "err", err)
+		}
+	}
+}
+
+func (s *Server) publishScheduled(schedule Schedule, at time.Time) error {
+	body, err := schedule.render(at)
+	if err != nil {
+		return err
+	}
+
+	topic := NewTopic(schedule.Topic)
+	id := uuid.NewString()
+	msg := NewMessageBuilder().
+		WithID(MsgPrefixFalse + "-" + id).
+		WithNextID(id).
+		WithType(MessageTypeNew).
+		WithTopic(topic).
+		WithBody(body).
+		WithKey(schedule.Key).
+		WithTimestamp(at.Unix()).
+		WithTTL(s.topicRetention[topic.Name]).
+		Build()
+
+	if err = s.checkKey(msg); err != nil {
+		return err
+	}
+	if err = s.checkSchema(&msg); err != nil {
+		return err
+	}
+	if msg.seq, err = s.nextSeq(topic); err != nil {
+		return err
+	}
+	s.trace(msg, TraceEvent{Stage: TraceReceived, Detail: "scheduled by " + schedule.Name})
+	if err = s.sendNewMessage(msg); err != nil {
+		return err
+	}
+
+	s.touchTopic(topic)
+	observability.MessagesPublished.WithLabelValues(topic.Name).Inc()
+	return nil
+}
+
+func (s *Server) handleSchedules(w http.ResponseWriter, _ *http.Request) {
+	schedules, err := s.DB.Schedules()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if schedules == nil {
+		schedules = []Schedule{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(schedules); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleSaveSchedule registers the schedule of the path, replacing the one of the same name.
+func (s *Server) handleSaveSchedule(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var schedule Schedule
+	if err = json.Unmarshal(body, &schedule); err != nil {
+		http.Error(w, "invalid schedule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	schedule.Name = r.PathValue("name")
+	if err = schedule.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = s.DB.SaveSchedule(schedule); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditSchedule, User: user, RemoteAddr: r.RemoteAddr, Topic: schedule.Topic, Detail: schedule.Name + " " + schedule.Cron})
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) handleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	err := s.DB.DeleteSchedule(name)
+	switch {
+	case errors.Is(err, errScheduleNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditSchedule, User: user, RemoteAddr: r.RemoteAddr, Detail: name + " deleted"})
+
+	w.WriteHeader(http.StatusNoContent)
+}
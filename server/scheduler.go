@@ -1,25 +1,38 @@
 package server
 
 import (
-	"log"
+	"context"
+	"time"
 )
 
 func (s *Server) run(query func() ([]Message, error)) {
 	for {
 		select {
 		case <-s.window.C:
+			start := time.Now()
 			messages, err := query()
+			s.telemetry.StoreOp(context.Background(), "pending", start, err)
 			if err != nil {
-				log.Printf("cannot fetch messages %v\n", err)
+				s.logger().Error("cannot fetch messages", "err", err)
 			}
 
 			if len(messages) == 0 {
 				continue
 			}
 
+			now := time.Now()
 			for _, msg := range messages {
-				s.sendNewMessage(msg)
+				if s.ackExtended(msg.ID(), now) {
+					continue
+				}
+				msg.redelivered = true
+				s.trace(msg, TraceEvent{Stage: TraceRedelivered, Attempts: msg.Attempts()})
+				if err = s.sendNewMessage(msg); err != nil {
+					s.logger().Warn("cannot redeliver message", "id", msg.ID(), "err", err)
+				}
 			}
+		case <-s.maintenanceQuit:
+			return
 		}
 	}
 }
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const (
+	// metaPrefix holds the bookkeeping of the store itself.
+	metaPrefix       = "meta/"
+	schemaVersionKey = metaPrefix + "schema_version"
+
+	// currentSchemaVersion is the layout this build reads and writes. Stores written before the
+	// version key existed are version 1, flat false-<uuid> and <nextID> message keys.
+	currentSchemaVersion = 2
+)
+
+var ErrSchemaTooNew = errors.New("store written by a newer queuety, refusing to start")
+
+// migration upgrades the store from version-1 to version.
+type migration struct {
+	version int
+	name    string
+	run     func(b BadgerDB) error
+}
+
+var migrations = []migration{
+	{
+		version: 2,
+		name:    "topic/<name>/<seq> keys",
+		run: func(b BadgerDB) error {
+			moved, err := b.MigrateKeys()
+			if moved > 0 {
+				b.logger().Info("migrated messages to the topic key layout", "messages", moved)
+			}
+			return err
+		},
+	},
+}
+
+// Migrate brings the store to currentSchemaVersion, running every pending migration in
+// order and recording the version after each one, so an interrupted upgrade resumes.
+func (b BadgerDB) Migrate() error {
+	version, err := b.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if version > currentSchemaVersion {
+		return fmt.Errorf("%w: schema version %d, this build knows up to %d", ErrSchemaTooNew, version, currentSchemaVersion)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		b.logger().Info("migrating store", "schema_version", m.version, "migration", m.name)
+		if err = m.run(b); err != nil {
+			return fmt.Errorf("migration to schema version %d: %w", m.version, err)
+		}
+
+		if err = b.setSchemaVersion(m.version); err != nil {
+			return err
+		}
+		version = m.version
+	}
+
+	if version < currentSchemaVersion {
+		return b.setSchemaVersion(currentSchemaVersion)
+	}
+
+	return nil
+}
+
+// schemaVersion reads the version of the store, an empty store is current already.
+func (b BadgerDB) schemaVersion() (int, error) {
+	version := currentSchemaVersion
+	err := b.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(schemaVersionKey))
+		if err == nil {
+			return item.Value(func(v []byte) error {
+				version = int(binary.BigEndian.Uint32(v))
+				return nil
+			})
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		it.Rewind()
+		if it.Valid() {
+			version = 1
+		}
+
+		return nil
+	})
+
+	return version, err
+}
+
+func (b BadgerDB) setSchemaVersion(version int) error {
+	return b.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(schemaVersionKey), binary.BigEndian.AppendUint32(nil, uint32(version)))
+	})
+}
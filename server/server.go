@@ -1,17 +1,22 @@
 package server
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/dgraph-io/badger/v4"
+	"github.com/tomiok/queuety/internal/bufpool"
+	"github.com/tomiok/queuety/server/observability"
+	"github.com/tomiok/queuety/server/telemetry"
 )
 
 type MessageFormat byte
@@ -21,24 +26,144 @@ const (
 	FormatBinary MessageFormat = 0x02
 )
 
+// frameHeaderSize is the format flag plus the length prefix.
+const frameHeaderSize = 5
+
+// defaultMaxFrameSize bounds the payload a client may announce, the length comes from the
+// client and is allocated before anything is read.
+const defaultMaxFrameSize = 16 << 20
+
 type Server struct {
 	protocol string
 	port     string
 
-	clients map[Topic][]Client
-	window  *time.Ticker
+	// clientsMu guards clients and durableTopics, written by the connections and the admin API.
+	clientsMu sync.RWMutex
+	clients   map[Topic][]Client
+	window    *time.Ticker
 
 	User     string
 	Password string
 
-	DB BadgerDB
+	DB Store
+
+	listenerMu sync.Mutex
+	listener   net.Listener
+	// draining is set by Shutdown, Serve closes the connections accepted afterward.
+	draining bool
+	// handlers counts the connections read by Serve, Shutdown waits for them.
+	handlers sync.WaitGroup
 
-	listener net.Listener
+	shutdownTimeout time.Duration
+	telemetryFlush  func(context.Context) error
+
+	startedAt time.Time
 
 	webServer    *http.Server
+	sentMu       sync.Mutex
 	sentMessages map[Topic]*atomic.Int32
 
 	rateLimiter *RateLimiter
+
+	byteLimiter                 *ByteLimiter
+	subscriberBytesPerSecond    int
+	subscriberMessagesPerSecond int
+
+	ackQuorum int
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]*clientConn
+	connIDs atomic.Uint64
+
+	// ipFilter rejects connections from outside the accepted subnets, nil accepts all of them.
+	ipFilter atomic.Pointer[ipFilter]
+
+	archiver *archiver
+	leases   leaseTable
+	sinks    []*sink
+
+	durability      Durability
+	topicDurability map[string]Durability
+	syncer          *batchSyncer
+
+	ackedRetention  time.Duration
+	gcInterval      time.Duration
+	maintenance     maintenance
+	maintenanceQuit chan struct{}
+
+	// durableTopics are the registered topics with their durable subscribers, they outlive
+	// their connections.
+	durableTopics map[Topic][]string
+
+	topicRetention map[string]time.Duration
+	retention      retentionReport
+
+	topicMaxSubscribers map[string]int
+
+	// topicAutoDelete is TopicAutoDelete, autoDelete the AutoDeleteAfter of the topics
+	// created with one and topicActivity their last publish or subscriber.
+	topicAutoDelete map[string]time.Duration
+	autoDelete      sync.Map
+	topicActivity   sync.Map
+
+	snapshotDir string
+
+	writeBehind *writeBehind
+
+	// background is set once startBackground ran, or by Close before it did, a standby never
+	// promoted has no workers to stop.
+	background atomic.Bool
+	closeOnce  sync.Once
+
+	log *slog.Logger
+
+	debugEndpoints    bool
+	prometheusMetrics bool
+
+	telemetry *telemetry.Telemetry
+
+	notifier *notifier
+	watch    eventWatch
+
+	// taps are the live tails of the topics, see handleTail.
+	tapsMu sync.Mutex
+	taps   map[Topic]map[*tap]struct{}
+	// sampler keeps the messages captured by Config.SampleRates, nil without rates.
+	sampler *sampler
+	// indexedHeaders are the headers the stored messages are searchable by.
+	indexedHeaders []string
+
+	checkpointInterval time.Duration
+	maxFrameSize       int
+
+	health              storageHealth
+	healthCheckInterval time.Duration
+
+	// traceRetention is how long the message traces are kept, negative disables them.
+	traceRetention time.Duration
+
+	// dedupWindow is how long the ids of the QoSEffectivelyOnce publishes are remembered.
+	dedupWindow time.Duration
+
+	// mirror is set on a warm standby, see MirrorConfig.
+	mirror *mirror
+	// replica is set on a read-only replica, see ReplicaConfig.
+	replica *replica
+	// oidc verifies the access tokens of Config.OIDC, nil without one.
+	oidc *oidcVerifier
+
+	// transientTopics maps the topics created with TopicTransient to their in-memory seq.
+	transientTopics sync.Map
+	// values are the latest messages by key of the topics created with TopicCompacted.
+	values lastValues
+	// modes maps the topics created with TopicQueue or TopicExclusive to their *topicMode.
+	modes sync.Map
+	// ackDeadlines maps the messages a consumer extended with IN_PROGRESS to their ackDeadline.
+	ackDeadlines sync.Map
+	// schemas maps the topics with a schema to its latest TopicSchema, schemaMu orders the
+	// registrations.
+	schemas  sync.Map
+	schemaMu sync.Mutex
 }
 
 type Config struct {
@@ -49,11 +174,132 @@ type Config struct {
 	Auth         *Auth
 	InMemoryData bool
 
+	// OIDC accepts the access tokens of an issuer in AUTH, along with Auth or instead of it.
+	OIDC *OIDCConfig
+
+	// Store replaces the Badger persistence, BadgerPath and InMemoryData are ignored when set.
+	Store Store
+
 	WebServerPort string
 
 	RateLimitEnabled     bool
 	MaxMessagesPerSecond int
 	RateLimitQueueSize   int
+
+	// bandwidth limits, 0 means unlimited.
+	MaxBytesPerSecond           int
+	MaxSubscriberBytesPerSecond int
+	// MaxSubscriberMessagesPerSecond paces the deliveries to every subscriber, 0 means
+	// unlimited. A subscriber may ask for a lower rate in SubscribeOptions.
+	MaxSubscriberMessagesPerSecond int
+
+	// AckQuorum is how many subscriber ACKs mark a message delivered, 0 means all of them.
+	AckQuorum int
+
+	// Archive uploads acked messages to object storage, nil keeps them only locally.
+	Archive *ArchiveConfig
+
+	// Mirror makes the broker a warm standby of another one until POST /mirror/promote, nil
+	// for a primary.
+	Mirror *MirrorConfig
+	// Replica makes the broker a read-only replica of some topics of another one, nil for a
+	// broker taking publishes.
+	Replica *ReplicaConfig
+	// Sinks copy the published messages of some topics to object storage, see S3ObjectStore.
+	Sinks []SinkConfig
+
+	// SyncWrites makes Badger fsync every write, whatever the durability of the topic.
+	SyncWrites bool
+	// Durability is the default mode of the topics, TopicDurability overrides it per topic name.
+	Durability      Durability
+	TopicDurability map[string]Durability
+	// SyncInterval is the fsync period of DurabilityBatch topics, 100ms by default.
+	SyncInterval time.Duration
+
+	// AckedRetention deletes acked messages published longer ago, 0 keeps them forever.
+	AckedRetention time.Duration
+	// GCInterval is the period of the cleanup job, 10 minutes by default, negative disables it.
+	GCInterval time.Duration
+	// TopicRetention keeps the messages of a topic name for the duration, pending or not. It is
+	// the TTL of the messages without their own, the maintenance job purges the rest.
+	TopicRetention map[string]time.Duration
+	// TopicMaxSubscribers caps the connected subscribers of a topic name, the NEW_SUB over the
+	// cap is rejected with ErrCodeSubscriberLimit. 1 makes the topic exclusive.
+	TopicMaxSubscribers map[string]int
+	// TopicAutoDelete deletes a topic name with its data once it had no subscribers and no
+	// publishes for the duration, see TopicOptions.AutoDeleteAfter.
+	TopicAutoDelete map[string]time.Duration
+
+	// SampleRates captures the fraction in (0, 1] of the messages of a topic name, their headers
+	// and the start of their body, for GET /topics/{name}/samples. SampleSize is how many are kept
+	// per topic, 100 by default, SampleBodyBytes how much of a body, 256 by default.
+	SampleRates     map[string]float64
+	SampleSize      int
+	SampleBodyBytes int
+
+	// IndexedHeaders are the headers, as a correlation id or a tenant, the stored messages are
+	// indexed by for GET /search. Every one costs a write per message carrying it.
+	IndexedHeaders []string
+
+	// SnapshotDir holds the named snapshots, empty disables them.
+	SnapshotDir string
+	// RestoreSnapshot loads the named snapshot from SnapshotDir before the broker starts.
+	RestoreSnapshot string
+
+	// WriteBehind batches the saves of the publish path, nil saves every message on its own.
+	WriteBehind *WriteBehindConfig
+
+	// Logger receives the logs of the broker, slog.Default() when nil. See NewLogger.
+	Logger *slog.Logger
+
+	// PrometheusMetrics serves the collectors of the observability package on /metrics, the
+	// stored messages dump moves to /stored.
+	PrometheusMetrics bool
+
+	// Webhooks are notified of the broker events, see EventType.
+	Webhooks []WebhookConfig
+	// WebhookCheckInterval is how often the dead letters and the disk size are checked for
+	// the webhooks, 30 seconds by default.
+	WebhookCheckInterval time.Duration
+	// DiskThreshold is the store size in bytes firing EventDiskThreshold, 0 disables it.
+	DiskThreshold int64
+
+	// Telemetry records the broker activity as OpenTelemetry metrics, nil records nothing.
+	Telemetry *telemetry.Telemetry
+	// TelemetryFlush is called last by Shutdown, the ForceFlush or Shutdown of the SDK
+	// MeterProvider behind Telemetry so the final measurements are exported.
+	TelemetryFlush func(context.Context) error
+
+	// ShutdownTimeout bounds the Shutdown done by Run, 8 seconds by default.
+	ShutdownTimeout time.Duration
+
+	// CheckpointInterval is how often the counters shown in /stats are saved to the store,
+	// so they survive a restart. 1 minute by default, negative disables the checkpoints.
+	CheckpointInterval time.Duration
+
+	// HealthCheckInterval is how often the store is probed with a canary write for /readyz,
+	// 10 seconds by default, negative disables the periodic probes.
+	HealthCheckInterval time.Duration
+
+	// AllowedCIDRs are the subnets the broker accepts connections from, empty means all of
+	// them. DeniedCIDRs are rejected even when allowed. PUT /ipfilter replaces both at runtime.
+	AllowedCIDRs []string
+	DeniedCIDRs  []string
+
+	// MaxFrameSize is the largest payload accepted from a client, 16 MiB by default. A client
+	// announcing a larger frame is disconnected.
+	MaxFrameSize int
+
+	// TraceRetention is how long the lifecycle of the messages is kept for
+	// GET /messages/{id}/trace, 24 hours by default, negative disables the tracing.
+	TraceRetention time.Duration
+
+	// DedupWindow is how long the broker remembers the ids of the QoSEffectivelyOnce publishes,
+	// 10 minutes by default. A publish sent again after it is stored twice.
+	DedupWindow time.Duration
+
+	// DebugEndpoints serves pprof and expvar under /debug/ on the web server, behind the admin auth.
+	DebugEndpoints bool
 }
 
 type Auth struct {
@@ -64,12 +310,40 @@ type Auth struct {
 type Client struct {
 	conn   net.Conn
 	Format MessageFormat
+
+	// subscriber is the durable subscription name, empty for ephemeral subscribers.
+	subscriber string
+
+	byteLimiter     *ByteLimiter
+	deliveryLimiter *DeliveryLimiter
+
+	// batch gathers the deliveries of a subscriber asking for batches, nil for the others.
+	batch *deliveryBatch
+
+	// noAck is set for a subscriber not sending ACKs, see SubscribeOptions.NoAck.
+	noAck bool
 }
 
 func NewServer(c Config) (*Server, error) {
-	db, err := NewBadger(c.BadgerPath, c.InMemoryData)
-	if err != nil {
-		return nil, err
+	logger := loggerOr(c.Logger)
+
+	store := c.Store
+	switch {
+	case store != nil:
+	case c.InMemoryData:
+		store = NewMemoryStore(0)
+	default:
+		db, err := OpenBadger(c.BadgerPath, c.SyncWrites)
+		if err != nil {
+			return nil, err
+		}
+		store = BadgerDB{DB: db, Logger: logger}
+	}
+
+	if b, ok := store.(BadgerDB); ok {
+		if err := b.Migrate(); err != nil {
+			return nil, err
+		}
 	}
 
 	var (
@@ -93,14 +367,78 @@ func NewServer(c Config) (*Server, error) {
 			queueSize = 1000
 		}
 		rateLimiter = NewRateLimiter(c.MaxMessagesPerSecond, queueSize)
+		rateLimiter.logger = logger
+	}
+
+	var byteLimiter *ByteLimiter
+	if c.MaxBytesPerSecond > 0 {
+		byteLimiter = NewByteLimiter(c.MaxBytesPerSecond)
 	}
 
-	return &Server{
+	gcInterval := c.GCInterval
+	if gcInterval == 0 {
+		gcInterval = defaultGCInterval
+	}
+
+	syncer := newBatchSyncer(store, c.SyncInterval, logger)
+
+	var wb *writeBehind
+	if c.WriteBehind != nil {
+		wb = newWriteBehind(*c.WriteBehind, store, syncer, logger)
+		wb.telemetry = c.Telemetry
+	}
+
+	checkpointInterval := c.CheckpointInterval
+	if checkpointInterval == 0 {
+		checkpointInterval = defaultCheckpointInterval
+	}
+
+	healthCheckInterval := c.HealthCheckInterval
+	if healthCheckInterval == 0 {
+		healthCheckInterval = defaultHealthCheckInterval
+	}
+
+	traceRetention := c.TraceRetention
+	if traceRetention == 0 {
+		traceRetention = defaultTraceRetention
+	}
+
+	dedupWindow := c.DedupWindow
+	if dedupWindow <= 0 {
+		dedupWindow = defaultDedupWindow
+	}
+
+	shutdownTimeout := c.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+
+	var arch *archiver
+	if c.Archive != nil && c.Archive.Store != nil {
+		arch = newArchiver(*c.Archive, store, logger)
+	}
+
+	var filter *ipFilter
+	if len(c.AllowedCIDRs) > 0 || len(c.DeniedCIDRs) > 0 {
+		var err error
+		if filter, err = newIPFilter(IPFilter{Allowed: c.AllowedCIDRs, Denied: c.DeniedCIDRs}); err != nil {
+			return nil, err
+		}
+	}
+
+	var sinks []*sink
+	for _, cfg := range c.Sinks {
+		if cfg.Store != nil {
+			sinks = append(sinks, newSink(cfg, logger))
+		}
+	}
+
+	s := &Server{
 		protocol: c.Protocol,
 		port:     c.Port,
 		clients:  make(map[Topic][]Client),
 		window:   time.NewTicker(time.Second * 3600),
-		DB:       BadgerDB{DB: db},
+		DB:       store,
 		User:     user,
 		Password: pass,
 		webServer: &http.Server{
@@ -108,7 +446,98 @@ func NewServer(c Config) (*Server, error) {
 		},
 		sentMessages: make(map[Topic]*atomic.Int32),
 		rateLimiter:  rateLimiter,
-	}, nil
+
+		byteLimiter:                 byteLimiter,
+		subscriberBytesPerSecond:    c.MaxSubscriberBytesPerSecond,
+		subscriberMessagesPerSecond: c.MaxSubscriberMessagesPerSecond,
+		conns:                       make(map[net.Conn]*clientConn),
+		ackQuorum:                   c.AckQuorum,
+		archiver:                    arch,
+		sinks:                       sinks,
+		durability:                  c.Durability,
+		topicDurability:             c.TopicDurability,
+		syncer:                      syncer,
+		ackedRetention:              c.AckedRetention,
+		gcInterval:                  gcInterval,
+		maintenanceQuit:             make(chan struct{}),
+		durableTopics:               make(map[Topic][]string),
+		topicRetention:              c.TopicRetention,
+		topicMaxSubscribers:         c.TopicMaxSubscribers,
+		topicAutoDelete:             c.TopicAutoDelete,
+		sampler:                     newSampler(c.SampleRates, c.SampleSize, c.SampleBodyBytes),
+		indexedHeaders:              c.IndexedHeaders,
+		snapshotDir:                 c.SnapshotDir,
+		writeBehind:                 wb,
+		log:                         logger,
+		debugEndpoints:              c.DebugEndpoints,
+		prometheusMetrics:           c.PrometheusMetrics,
+		telemetry:                   c.Telemetry,
+		watch:                       eventWatch{diskLimit: c.DiskThreshold},
+		traceRetention:              traceRetention,
+		dedupWindow:                 dedupWindow,
+		checkpointInterval:          checkpointInterval,
+		maxFrameSize:                c.MaxFrameSize,
+		healthCheckInterval:         healthCheckInterval,
+		shutdownTimeout:             shutdownTimeout,
+		telemetryFlush:              c.TelemetryFlush,
+		startedAt:                   time.Now(),
+	}
+
+	s.ipFilter.Store(filter)
+	if c.Mirror != nil {
+		s.mirror = newMirror(*c.Mirror, logger)
+	}
+	if c.OIDC != nil {
+		s.oidc = newOIDCVerifier(*c.OIDC)
+	}
+	if c.Replica != nil {
+		r, err := newReplica(*c.Replica, logger)
+		if err != nil {
+			return nil, err
+		}
+		s.replica = r
+	}
+
+	if wb != nil {
+		wb.trace = s.trace
+		go wb.run()
+	}
+
+	if c.RestoreSnapshot != "" {
+		if err := s.RestoreSnapshot(c.RestoreSnapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.loadTopics(); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadSchemas(); err != nil {
+		return nil, err
+	}
+
+	if err := s.restoreCounters(); err != nil {
+		return nil, err
+	}
+	if s.replica != nil {
+		for _, name := range s.replica.cfg.Topics {
+			s.CreateTopic(name, TopicOptions{})
+		}
+	}
+	s.probeStorage()
+
+	if s.prometheusMetrics {
+		observability.SetLagSource(s.groupLags)
+	}
+
+	if len(c.Webhooks) > 0 {
+		s.notifier = newNotifier(c.Webhooks, c.WebhookCheckInterval, logger)
+		s.notifier.check = s.checkEvents
+		go s.notifier.run()
+	}
+
+	return s, nil
 }
 
 func (s *Server) Start() error {
@@ -117,36 +546,154 @@ func (s *Server) Start() error {
 		return err
 	}
 
-	s.listener = l
-
 	go func() {
 		err = s.StartWebServer()
-		if err != nil {
-			log.Printf("web server failed to start: %v \n", err)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger().Error("web server failed to start", "err", err)
 		}
 	}()
 
-	if s.rateLimiter != nil {
-		go s.processRateLimitQueue()
+	return s.Serve(l)
+}
+
+// Serve accepts the broker connections on l until it is closed, without starting the web
+// server. It returns nil once Close closed the listener.
+func (s *Server) Serve(l net.Listener) error {
+	s.listenerMu.Lock()
+	if s.draining {
+		s.listenerMu.Unlock()
+		return l.Close()
+	}
+	s.listener = l
+	s.listenerMu.Unlock()
+
+	// a standby starts the rest once promoted.
+	if !s.mirror.begin(s) {
+		s.startBackground()
 	}
 
 	for {
 		conn, errAccept := l.Accept()
+		if errors.Is(errAccept, net.ErrClosed) {
+			return nil
+		}
 		if errAccept != nil {
-			log.Printf("cannot accept conn %v \n", errAccept)
+			s.logger().Warn("cannot accept conn", "err", errAccept)
+			continue
+		}
+
+		if s.mirror.isStandby() {
+			s.logger().Debug("connection rejected by the standby", "remote_addr", conn.RemoteAddr().String())
+			_ = conn.Close()
+			continue
+		}
+
+		if !s.permitted(conn.RemoteAddr()) {
+			s.logger().Debug("connection rejected by the ip filter", "remote_addr", conn.RemoteAddr().String())
+			_ = conn.Close()
 			continue
 		}
 
-		go s.handleConnections(conn)
-		go s.run(s.DB.checkNotDeliveredMessages)
+		// register the connection before the first frame.
+		if !s.track(conn) {
+			_ = conn.Close()
+			continue
+		}
+		go func() {
+			defer s.handlers.Done()
+			s.handleConnections(conn)
+		}()
+		go s.run(s.DB.PendingMessages)
 	}
 }
 
-func (s *Server) Close() error {
+// stopBackground stops the workers, the ones of startBackground only when it ran.
+func (s *Server) stopBackground() {
+	s.mirror.end()
+	s.replica.stop()
+
+	started := s.background.Swap(true)
+	if started {
+		if s.rateLimiter != nil {
+			s.rateLimiter.Stop()
+		}
+		s.archiver.stop()
+		for _, k := range s.sinks {
+			k.stop()
+		}
+	}
+	s.writeBehind.stop() // before the syncer, its last batch gets the final fsync.
+	s.syncer.stop()
+	s.notifier.stop()
+	if s.maintenanceQuit != nil {
+		close(s.maintenanceQuit)
+	}
+	if s.checkpointInterval > 0 {
+		s.checkpointCounters()
+	}
+}
+
+// startBackground starts the workers of a serving broker.
+func (s *Server) startBackground() {
+	if !s.background.CompareAndSwap(false, true) {
+		return
+	}
+
 	if s.rateLimiter != nil {
-		s.rateLimiter.Stop()
+		go s.processRateLimitQueue()
+	}
+
+	if s.archiver != nil {
+		s.archiver.start()
+	}
+
+	for _, k := range s.sinks {
+		k.start()
+	}
+
+	if s.syncer != nil {
+		go s.syncer.run()
+	}
+
+	if s.gcInterval > 0 && s.maintenanceQuit != nil {
+		go s.runMaintenance(s.maintenanceQuit)
+	}
+
+	if s.checkpointInterval > 0 && s.maintenanceQuit != nil {
+		go s.runCheckpoints(s.maintenanceQuit)
+	}
+
+	if s.healthCheckInterval > 0 && s.maintenanceQuit != nil {
+		go s.runHealthChecks(s.maintenanceQuit)
+	}
+
+	// the schedules of a replica publish on the primary.
+	if s.maintenanceQuit != nil && s.replica == nil {
+		go s.runSchedules(s.maintenanceQuit)
+	}
+
+	if s.replica != nil {
+		s.replica.start(s)
 	}
-	return s.listener.Close()
+}
+
+// Close stops the workers of the broker and closes its listener, a second call only closes
+// the listener again.
+func (s *Server) Close() error {
+	s.closeOnce.Do(s.stopBackground)
+
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	// Shutdown closed it already.
+	if err := s.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+
+	return nil
 }
 
 type StoredMessages struct {
@@ -159,82 +706,67 @@ type StoredItem struct {
 }
 
 func (s *Server) getStoredMessages() (*StoredMessages, error) {
-	stats := &StoredMessages{
-		Items: []StoredItem{},
-	}
-
-	err := s.DB.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			key := string(item.Key())
-
-			err := item.Value(func(v []byte) error {
-				stats.Items = append(stats.Items, StoredItem{
-					Key:   key,
-					Value: string(v),
-				})
-				return nil
-			})
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-
+	items, err := s.DB.StoredItems()
 	if err != nil {
 		return nil, err
 	}
 
-	return stats, nil
+	return &StoredMessages{Items: items}, nil
 }
 
 func (s *Server) handleConnections(conn net.Conn) {
+	cc := s.clientConn(conn)
+
+	// the header is reused for every frame, payloads come from the buffer pool.
+	var header [frameHeaderSize]byte
 	for {
-		// Read format flag (1 byte)
-		formatBuff := make([]byte, 1)
-		_, err := io.ReadFull(conn, formatBuff)
+		// Read format flag (1 byte) + length (4 bytes)
+		_, err := io.ReadFull(conn, header[:])
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				s.disconnect(conn)
-				break
+			// EOF is the client leaving between two frames, a kicked connection is closed from
+			// our side. Anything else leaves the stream mid frame or the socket dead.
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+				s.logger().Warn("cannot read frame header, disconnecting", "conn_id", cc.id, "err", err)
 			}
-			log.Printf("cannot read format flag %v \n", err)
-			continue
+			s.disconnect(conn)
+			break
 		}
-		format := MessageFormat(formatBuff[0])
-
-		// Read length (4 bytes)
-		lengthBuff := make([]byte, 4)
-		_, err = io.ReadFull(conn, lengthBuff)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				s.disconnect(conn)
-				break
-			}
-			log.Printf("cannot read message length %v \n", err)
-			continue
+		format := MessageFormat(header[0])
+		messageLength := binary.LittleEndian.Uint32(header[1:])
+		if uint64(messageLength) > uint64(s.frameLimit()) {
+			s.logger().Warn("frame too large, disconnecting", "conn_id", cc.id, "client", cc.clientName(), "size", messageLength, "max", s.frameLimit())
+			s.disconnect(conn)
+			break
 		}
-		messageLength := binary.LittleEndian.Uint32(lengthBuff)
 
 		// Read message payload
-		messageBuff := make([]byte, messageLength)
+		messageBuff := bufpool.Get(int(messageLength))
 		_, err = io.ReadFull(conn, messageBuff)
 		if err != nil {
-			log.Printf("cannot read message body %v \n", err)
-			continue
+			// the next bytes are not a frame header, the stream cannot be read any further.
+			bufpool.Put(messageBuff)
+			s.logger().Warn("cannot read message body, disconnecting", "conn_id", cc.id, "err", err)
+			s.disconnect(conn)
+			break
 		}
 
-		// Handle message based on detected format
+		cc.received(frameHeaderSize + len(messageBuff))
+		cc.traceFrame("in", format, messageBuff)
+
+		// Handle message based on detected format, decoding copies everything it keeps.
 		s.handleMessage(conn, messageBuff, format)
+		bufpool.Put(messageBuff)
 	}
 }
 
+func (s *Server) frameLimit() int {
+	if s.maxFrameSize > 0 {
+		return s.maxFrameSize
+	}
+
+	return defaultMaxFrameSize
+}
+
 func (s *Server) handleMessage(conn net.Conn, buff []byte, format MessageFormat) {
 	var msg Message
 	var err error
@@ -243,86 +775,249 @@ func (s *Server) handleMessage(conn net.Conn, buff []byte, format MessageFormat)
 	case FormatJSON:
 		msg, err = DecodeMessage(buff)
 		if err != nil {
-			log.Printf("cannot parse JSON message %v \n", err)
+			s.logger().Warn("cannot parse JSON message", "err", err)
+			s.sendError(conn, format, ErrCodeMalformedFrame, err.Error(), msg)
 			return
 		}
-		fmt.Printf("decoded JSON message %s\n", msg.body)
 
 	case FormatBinary:
 		err = msg.UnmarshalBinary(buff)
 		if err != nil {
-			log.Printf("cannot parse binary message %v \n", err)
+			s.logger().Warn("cannot parse binary message", "err", err)
+			s.sendError(conn, format, ErrCodeMalformedFrame, err.Error(), Message{})
 			return
 		}
 
 	default:
-		log.Printf("unknown message format: %d \n", format)
+		s.logger().Warn("unknown message format", "format", format)
+		s.sendError(conn, format, ErrCodeUnknownFormat, fmt.Sprintf("unknown message format %d", format), msg)
+		return
+	}
+
+	if msg.Type() != MessageTypeAuth && !s.authenticated(conn) {
+		s.sendError(conn, format, ErrCodeAuthRequired, "authenticate before sending "+string(msg.Type()), msg)
+		return
+	}
+
+	if s.replica != nil && (msg.Type() == MessageTypeNew || msg.Type() == MessageTypeNewTopic || msg.Type() == MessageTypeTxn) {
+		s.sendError(conn, format, ErrCodeReadOnly, errReadOnly.Error(), msg)
 		return
 	}
 
 	// same message handling logic for both formats
 	switch msg.Type() {
 	case MessageTypeNewTopic:
-		s.addNewTopic(msg.Topic().Name)
+		opts, errOpts := parseTopicOptions(msg.Body())
+		if errOpts != nil {
+			s.sendError(conn, format, ErrCodeMalformedFrame, errOpts.Error(), msg)
+			return
+		}
+
+		s.CreateTopic(msg.Topic().Name, opts)
+		cc := s.clientConn(conn)
+		s.audit(AuditEntry{Action: AuditTopicCreate, User: cc.identity(), RemoteAddr: cc.remoteAddr, Topic: msg.Topic().Name})
 	case MessageTypeNew:
-		s.sendNewMessage(msg)
+		if err = s.checkKey(msg); err != nil {
+			s.sendError(conn, format, ErrCodeMalformedFrame, err.Error(), msg)
+			return
+		}
+		if err = s.checkSchema(&msg); err != nil {
+			s.sendError(conn, format, ErrCodeSchemaMismatch, err.Error(), msg)
+			return
+		}
+		cc := s.clientConn(conn)
+		msg.stampPublisher(cc.identity(), cc.id)
+		if msg.ttl == 0 {
+			msg.ttl = int64(s.topicRetention[msg.Topic().Name] / time.Second)
+		}
+		// a fire and forget message is never stored, it takes no place in the topic.
+		if !msg.fireAndForget {
+			if msg.seq, err = s.nextSeq(msg.Topic()); err != nil {
+				s.sendError(conn, format, ErrCodeInternal, err.Error(), msg)
+				return
+			}
+		}
+		if s.hasTopic(msg.Topic()) && msg.dedup {
+			// a publish seen already is confirmed again with its first seq, the new one is a gap.
+			duplicate, errDedup := s.publishedBefore(&msg)
+			if errDedup != nil {
+				s.sendError(conn, format, ErrCodeInternal, errDedup.Error(), msg)
+				return
+			}
+			if duplicate {
+				s.logger().Debug("duplicate publish dropped", "id", msg.ID(), "topic", msg.Topic().Name, "seq", msg.Seq())
+				s.confirmPublish(conn, format, msg)
+				return
+			}
+		}
+		s.trace(msg, TraceEvent{Stage: TraceReceived, ConnectionID: cc.id})
+		if err = s.sendNewMessage(msg); err != nil {
+			if msg.dedup {
+				// not taken, the publisher sending it again is not a duplicate.
+				if errForget := s.DB.ForgetPublish(msg.Topic(), msg.ID()); errForget != nil {
+					s.logger().Error("cannot forget publish", "id", msg.ID(), "err", errForget)
+				}
+			}
+			s.sendError(conn, format, errorCode(err), err.Error(), msg)
+			break
+		}
+		cc.publishedTo(msg.Topic())
+		if !msg.fireAndForget {
+			s.confirmPublish(conn, format, msg)
+		}
+		s.touchTopic(msg.Topic())
+		observability.MessagesPublished.WithLabelValues(msg.Topic().Name).Inc()
+		s.telemetry.Published(context.Background(), msg.Topic().Name, len(msg.Body()))
 	case MessageTypeNewSubscriber:
-		s.addNewSubscriber(conn, msg.Topic(), format)
+		subOpts, errOpts := parseSubscribeOptions(msg.Body())
+		if errOpts != nil {
+			s.sendError(conn, format, ErrCodeMalformedFrame, errOpts.Error(), msg)
+			return
+		}
+		if err = s.acceptsSubscriber(msg.Topic()); err != nil {
+			s.sendError(conn, format, errorCode(err), err.Error(), msg)
+			break
+		}
+		switch {
+		case msg.Subscriber() != "" && (s.isTransient(msg.Topic()) || s.modeOf(msg.Topic()) != TopicFanout):
+			// transient, queue and exclusive topics keep no cursor, the named subscriber gets the live flow only.
+			s.logger().Debug("subscriber name ignored", "topic", msg.Topic().Name, "subscriber", msg.Subscriber())
+			s.addNewSubscriber(conn, msg.Topic(), format, subOpts)
+		case msg.Subscriber() != "":
+			s.addDurableSubscriber(conn, msg.Topic(), format, msg.Subscriber(), subOpts)
+		default:
+			s.addNewSubscriber(conn, msg.Topic(), format, subOpts)
+		}
+		s.notifier.notify(Event{
+			Type:         EventSubscriberConnected,
+			Topic:        msg.Topic().Name,
+			Subscriber:   msg.Subscriber(),
+			ConnectionID: s.clientConn(conn).id,
+		})
 	case MessageTypeACK:
-		s.ack(msg)
+		s.ack(conn, msg)
+	case MessageTypeNack:
+		s.nack(conn, msg)
+	case MessageTypeInProgress:
+		s.extendAck(conn, format, msg)
+	case MessageTypeBatchAck:
+		s.ackBatch(conn, format, msg)
+	case MessageTypeTxn:
+		s.commitTxn(conn, format, msg)
+	case MessageTypeReplay:
+		s.handleReplay(conn, format, msg)
+	case MessageTypeMetadata:
+		s.handleMetadata(conn, format, msg)
 	case MessageTypeAuth:
 		s.doLogin(conn, msg)
+	case MessageTypeHello:
+		s.hello(conn, format, msg)
+	default:
+		s.sendError(conn, format, ErrCodeUnknownType, "unknown message type "+string(msg.Type()), msg)
 	}
 }
 
-func (s *Server) sendNewMessage(message Message) {
-	clients := s.clients[message.Topic()]
-	if len(clients) == 0 {
-		log.Printf("topic not found, actual name: %s, values in memory: %v \n", message.Topic().Name, s.clients)
+func (s *Server) sendNewMessage(message Message) error {
+	if !s.hasTopic(message.Topic()) {
+		s.logger().Warn("topic not found", "topic", message.Topic().Name)
+		return errTopicNotFound
+	}
+
+	return s.sendMessageAsync(message, message.Topic())
+}
+
+// hello stores who the client is, there is no reply unless the info is invalid.
+func (s *Server) hello(conn net.Conn, format MessageFormat, message Message) {
+	info, err := parseClientInfo(message.Body())
+	if err != nil {
+		s.sendError(conn, format, ErrCodeMalformedFrame, err.Error(), message)
 		return
 	}
 
-	format := clients[0].Format
-	s.sendMessageAsync(message, format, message.Topic())
+	var features []string
+	if info.Features != nil {
+		features = negotiate(info.Features)
+	}
+
+	cc := s.clientConn(conn)
+	cc.setClient(info, features)
+	s.logger().Info("client identified", "conn_id", cc.id, "remote_addr", cc.remoteAddr, "client", info.Name, "version", info.Version, "labels", info.Labels, "features", features)
+
+	if features != nil {
+		s.helloReply(conn, format, message, features)
+	}
 }
+
 func (s *Server) doLogin(conn net.Conn, message Message) {
 	if !s.needAuth() {
 		message.updateAuthSuccess() // no auth need means successful.
-		b, err := message.Marshall()
-		if err != nil {
-			// just close the connection.
-			_ = conn.Close()
-		}
-		_, _ = conn.Write(b)
+		s.writeAuthResponse(conn, message)
 		return
 	}
 
-	if !s.validateAuth(message) {
+	cc := s.clientConn(conn)
+	user, ok := s.authenticate(message)
+	if !ok {
+		s.audit(AuditEntry{Action: AuditAuthFailure, User: message.User(), RemoteAddr: cc.remoteAddr})
+		s.telemetry.Auth(context.Background(), false)
 		message.updateAuthFailed()
-		b, err := message.Marshall()
-		if err != nil {
-			// just close the connection.
-			_ = conn.Close()
-		}
-		_, _ = conn.Write(b)
+		s.writeAuthResponse(conn, message)
 		return
 	}
 
+	cc.setUser(user)
+	s.audit(AuditEntry{Action: AuditAuthSuccess, User: user, RemoteAddr: cc.remoteAddr})
+	s.telemetry.Auth(context.Background(), true)
 	message.updateAuthSuccess()
+	s.writeAuthResponse(conn, message)
+}
+
+// writeAuthResponse answers an AUTH message with a JSON frame, without echoing the password.
+func (s *Server) writeAuthResponse(conn net.Conn, message Message) {
+	message.password = ""
 	b, err := message.Marshall()
 	if err != nil {
 		// just close the connection.
 		_ = conn.Close()
+		return
 	}
-	_, _ = conn.Write(b)
+
+	if err = s.clientConn(conn).writeFrame(FormatJSON, b); err != nil {
+		_ = conn.Close()
+	}
+}
+
+// authenticated reports whether conn may send anything else than AUTH.
+func (s *Server) authenticated(conn net.Conn) bool {
+	return !s.needAuth() || s.clientConn(conn).identity() != ""
+}
+
+// authenticate returns who sent the AUTH, its user or the user claim of the access token it
+// carries as the password with Config.OIDC.
+func (s *Server) authenticate(msg Message) (string, bool) {
+	if s.oidc != nil && isToken(msg.Password()) {
+		claims, err := s.oidc.verify(msg.Password())
+		if err != nil {
+			s.logger().Info("access token refused", "err", err)
+			return "", false
+		}
+		return claims.Username, true
+	}
+
+	return msg.User(), s.hasPassword() && s.validateAuth(msg)
 }
 
 func (s *Server) validateAuth(msg Message) bool {
 	return s.User == msg.User() && s.Password == msg.Password()
 }
 
-// you need to set up user and password in order to secure the server.
+// you need to set up user and password in order to secure the server, or an OIDC issuer.
 func (s *Server) needAuth() bool {
+	return s.hasPassword() || s.oidc != nil
+}
+
+// hasPassword tells if the broker has the credentials of Config.Auth.
+func (s *Server) hasPassword() bool {
 	if s.User != "" {
 		return true
 	}
@@ -335,47 +1030,233 @@ func (s *Server) needAuth() bool {
 }
 
 func (s *Server) save(message Message, format MessageFormat) {
-	if err := s.DB.saveMessage(message, format); err != nil {
-		log.Printf("cannot save message with id %s, %v\n", message.ID(), err)
+	durability := s.durabilityOf(message.Topic())
+	if durability == DurabilityNone || message.fireAndForget {
+		return
+	}
+	// before the message is stored, an entry without its message is skipped by the searches.
+	s.index(message)
+
+	if s.writeBehind != nil {
+		// sync topics wait for the batch holding the message, the fsync is done by the queue.
+		if err := s.writeBehind.enqueue(message, format, durability, durability == DurabilitySync); err != nil {
+			s.logger().Error("cannot save message", "id", message.ID(), "err", err)
+		}
+		return
 	}
+
+	start := time.Now()
+	defer func() {
+		observability.PersistDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	topic := message.Topic().Name
+	err := s.DB.SaveMessage(message, format)
+	s.telemetry.StoreOp(context.Background(), "save", start, err)
+	if err != nil {
+		observability.PersistErrors.WithLabelValues(topic).Inc()
+		s.logger().Error("cannot save message", "id", message.ID(), "err", err)
+		return
+	}
+
+	switch durability {
+	case DurabilitySync:
+		syncStart := time.Now()
+		err = s.DB.Sync()
+		s.telemetry.StoreOp(context.Background(), "sync", syncStart, err)
+		if err != nil {
+			observability.PersistErrors.WithLabelValues(topic).Inc()
+			s.logger().Error("cannot sync message", "id", message.ID(), "err", err)
+			return
+		}
+	case DurabilityBatch:
+		s.syncer.markDirty()
+	}
+	observability.MessagesPersisted.WithLabelValues(topic).Inc()
+	s.trace(message, TraceEvent{Stage: TracePersisted, Attempts: message.Attempts() + 1})
 }
 
-func (s *Server) addNewSubscriber(conn net.Conn, topic Topic, format MessageFormat) {
-	s.clients[topic] = append(s.clients[topic], Client{
-		conn:   conn,
-		Format: format,
-	})
+// acceptsSubscriber fails with errSubscriberLimit when the topic has TopicMaxSubscribers
+// subscribers connected already.
+func (s *Server) acceptsSubscriber(topic Topic) error {
+	limit, ok := s.topicMaxSubscribers[topic.Name]
+	if !ok || limit <= 0 {
+		return nil
+	}
+
+	if n := len(s.clientsOf(topic)); n >= limit {
+		return fmt.Errorf("%w: %s accepts %d, %d connected", errSubscriberLimit, topic.Name, limit, n)
+	}
+
+	return nil
+}
+
+func (s *Server) addNewSubscriber(conn net.Conn, topic Topic, format MessageFormat, opts SubscribeOptions) {
+	client := s.subscribe(conn, topic, format, "", opts)
+	if s.values.compacted(topic) {
+		go s.sendSnapshot(client, topic)
+	}
+}
+
+// subscribe adds the client to the topic. The connection lists the topic only once the
+// client is in place, so whoever sees it there can publish to it.
+func (s *Server) subscribe(conn net.Conn, topic Topic, format MessageFormat, subscriber string, opts SubscribeOptions) Client {
+	var byteLimiter *ByteLimiter
+	if s.subscriberBytesPerSecond > 0 {
+		byteLimiter = NewByteLimiter(s.subscriberBytesPerSecond)
+	}
+
+	client := Client{
+		conn:            conn,
+		Format:          format,
+		subscriber:      subscriber,
+		byteLimiter:     byteLimiter,
+		deliveryLimiter: s.deliveryLimiter(opts),
+		batch:           newDeliveryBatch(opts.BatchSize),
+		noAck:           opts.NoAck,
+	}
+	s.clientsMu.Lock()
+	s.clients[topic] = append(s.clients[topic], client)
+	s.clientsMu.Unlock()
+	s.clientConn(conn).addTopic(topic)
+	s.touchTopic(topic)
+
+	return client
 }
 
 func (s *Server) addNewTopic(name string) {
-	s.clients[NewTopic(name)] = []Client{}
+	topic := NewTopic(name)
+	s.ensureTopic(topic)
+	s.registerTopic(topic)
+}
+
+// ensureTopic adds the topic without subscribers, false when it exists already.
+func (s *Server) ensureTopic(topic Topic) bool {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if _, ok := s.clients[topic]; ok {
+		return false
+	}
+	if s.clients == nil {
+		s.clients = make(map[Topic][]Client)
+	}
+	s.clients[topic] = []Client{}
+
+	return true
+}
+
+// hasTopic tells if the topic exists.
+func (s *Server) hasTopic(topic Topic) bool {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	_, ok := s.clients[topic]
+	return ok
 }
 
-func (s *Server) ack(message Message) {
-	if err := s.DB.updateMessageACK(message); err != nil {
-		log.Printf("cannot ACK message with id %s, %v", message.ID(), err)
+// topicClients returns a copy of the subscribers of the topic, false when it does not exist.
+func (s *Server) topicClients(topic Topic) ([]Client, bool) {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	clients, ok := s.clients[topic]
+	return slices.Clone(clients), ok
+}
+
+// clientsOf returns a copy of the subscribers of the topic, none when it does not exist.
+func (s *Server) clientsOf(topic Topic) []Client {
+	clients, _ := s.topicClients(topic)
+	return clients
+}
+
+// topicsClients returns a copy of every topic with its subscribers.
+func (s *Server) topicsClients() map[Topic][]Client {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	topics := make(map[Topic][]Client, len(s.clients))
+	for topic, clients := range s.clients {
+		topics[topic] = slices.Clone(clients)
 	}
+
+	return topics
+}
+
+// durableSubscribers returns a copy of the durable subscribers of the topic.
+func (s *Server) durableSubscribers(topic Topic) []string {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	return slices.Clone(s.durableTopics[topic])
 }
 
 func (s *Server) disconnect(conn net.Conn) {
+	var connID uint64
+	if cc, ok := s.lookupClientConn(conn); ok {
+		connID = cc.id
+		// an ephemeral subscriber does not come back for what it did not ack, its records would
+		// keep the messages from being fully acked.
+		for _, id := range cc.takeUnacked() {
+			if err := s.DB.UntrackDelivery(id, recipient("", connID)); err != nil {
+				s.logger().Error("cannot untrack delivery", "id", id, "err", err)
+			}
+		}
+	}
+	s.dropAckExtensions(connID)
+
+	// the clients are taken off under the lock, what follows their removal runs after it.
+	type removal struct {
+		topic  Topic
+		client Client
+		next   *Client
+	}
+	var removed []removal
+
+	s.clientsMu.Lock()
 	for topic, clients := range s.clients {
 		for i, client := range clients {
 			if client.conn == conn {
 				s.clients[topic] = append(clients[:i], clients[i+1:]...)
-				log.Printf("client removed in topic: %s", topic.Name)
+				r := removal{topic: topic, client: client}
+				if i == 0 && len(s.clients[topic]) > 0 && s.modeOf(topic) == TopicExclusive {
+					next := s.clients[topic][0]
+					r.next = &next
+				}
+				removed = append(removed, r)
 				break
 			}
 		}
 
-		if len(s.clients[topic]) == 0 {
+		if _, durable := s.durableTopics[topic]; !durable && len(s.clients[topic]) == 0 {
 			delete(s.clients, topic)
-			log.Printf("%s is empty, deleting", topic.Name)
+			s.transientTopics.Delete(topic)
+			s.modes.Delete(topic)
+			s.logger().Debug("topic is empty, deleting", "topic", topic.Name)
+		}
+	}
+	s.clientsMu.Unlock()
+
+	for _, r := range removed {
+		s.logger().Debug("client removed", "topic", r.topic.Name)
+		if r.client.batch != nil {
+			s.dropBatch(r.client)
+		}
+		if r.next != nil {
+			go s.failover(r.topic, *r.next)
 		}
+		s.notifier.notify(Event{
+			Type:         EventSubscriberDisconnected,
+			Topic:        r.topic.Name,
+			Subscriber:   r.client.subscriber,
+			ConnectionID: connID,
+		})
 	}
 
+	s.removeClientConn(conn)
 	err := conn.Close()
 	if err != nil {
-		log.Printf("cannot close deleted connection %v", err)
+		s.logger().Debug("cannot close deleted connection", "err", err)
 	}
 }
 
@@ -384,76 +1265,239 @@ func saveUnsentMessage(msg Message, format MessageFormat, saveFn func(Message, M
 	saveFn(msg, format)
 }
 
-func (s *Server) sendMessageAsync(message Message, format MessageFormat, topic Topic) {
+func (s *Server) sendMessageAsync(message Message, topic Topic) error {
 	if s.rateLimiter == nil {
-		s.sendMessageSync(message, format, topic)
-		return
+		s.sendMessageSync(message, topic)
+		return nil
 	}
 
 	if s.rateLimiter.Allow() {
-		go s.sendMessageSync(message, format, topic)
+		go s.sendMessageSync(message, topic)
 	} else {
 		if !s.rateLimiter.Queue(message) {
-			log.Printf("rate limit queue full, dropping message for topic %s", topic.Name)
+			s.logger().Warn("rate limit queue full, dropping message", "topic", topic.Name, "id", message.ID())
+			return errRateLimited
 		}
 	}
+
+	return nil
 }
 
-func (s *Server) sendMessageSync(message Message, format MessageFormat, topic Topic) {
-	clients := s.clients[topic]
+func (s *Server) sendMessageSync(message Message, topic Topic) {
+	s.tapMessage(message)
+	s.sampler.offer(message)
+	for _, k := range s.sinks {
+		k.add(message)
+	}
+	s.compact(message)
+
+	clients := routeByKey(message, s.consumerOf(topic, s.clientsOf(topic)))
 	if len(clients) == 0 {
+		// nobody is listening, keep it for the durable subscribers to catch up.
+		s.save(message, FormatJSON)
 		return
 	}
 
-	var payload []byte
-	var err error
+	exclusive := s.modeOf(topic) == TopicExclusive
 
-	if FormatJSON == format {
-		payload, err = message.Marshall()
-	} else {
-		payload, err = message.MarshalBinary()
+	// encode once per format, subscribers on the same topic may speak different ones.
+	payloads := make(map[MessageFormat][]byte, 2)
+	targets := make([]Client, 0, len(clients))
+	for _, client := range clients {
+		if client.noAck && message.redelivered {
+			// got it once, or missed it for good.
+			continue
+		}
+
+		if _, ok := payloads[client.Format]; !ok {
+			payload, err := encodeMessage(message, client.Format)
+			if err != nil {
+				s.logger().Error("cannot marshall message", "id", message.ID(), "err", err)
+				return
+			}
+			payloads[client.Format] = payload
+		}
+		targets = append(targets, client)
 	}
 
-	if err != nil {
-		log.Printf("cannot marshall message: %v\n", err)
-		return
+	// every recipient is tracked before any write, an early ACK from one of them must not
+	// complete the message for the others.
+	for _, client := range targets {
+		s.trackDeliveries(client, []Message{message})
 	}
 
-	for _, client := range clients {
+	for _, client := range targets {
+		payload := payloads[client.Format]
+		if client.batch != nil {
+			// queued in publish order, nothing is written until the batch goes out.
+			s.addToBatch(client, message)
+			continue
+		}
+		if exclusive || (message.Key() != "" && client.subscriber != "") {
+			// written before the next publish, the active consumer and the group member of
+			// the key get them in order.
+			s.sendToClient(client, message, payload)
+			continue
+		}
 		go s.sendToClient(client, message, payload)
 	}
 }
 
+func encodeMessage(message Message, format MessageFormat) ([]byte, error) {
+	if FormatJSON == format {
+		return message.Marshall()
+	}
+
+	return message.MarshalBinary()
+}
+
 func (s *Server) sendToClient(client Client, message Message, payload []byte) {
-	err := binary.Write(client.conn, binary.LittleEndian, client.Format)
-	if err != nil {
-		log.Printf("cannot write format flag: %v\n", err)
+	if client.batch != nil {
+		s.addToBatch(client, message)
 		return
 	}
 
-	length := uint32(len(payload))
-	err = binary.Write(client.conn, binary.LittleEndian, length)
-	if err != nil {
-		log.Printf("cannot write length: %v\n", err)
+	s.afterDelivery(client, message, s.writeDeliveries(client, []Message{message}, payload))
+}
+
+// afterDelivery saves the message once delivered, or counts the failed attempt when err is set.
+func (s *Server) afterDelivery(client Client, message Message, err error) {
+	if client.noAck {
+		// delivered at most once, the subscribers waiting for ACKs have it stored for them.
 		return
 	}
 
-	_, err = client.conn.Write(payload)
 	if err != nil {
-		log.Printf("cannot write payload: %v\n", err)
+		observability.DeliveryFailures.WithLabelValues(message.Topic().Name).Inc()
+		s.telemetry.DeliveryFailed(context.Background(), message.Topic().Name)
+		s.logger().Warn("cannot deliver message", "id", message.ID(), "err", err)
+		s.trace(message, TraceEvent{Stage: TraceDeliveryFailed, Subscriber: client.subscriber, Detail: err.Error()})
 		saveUnsentMessage(message, client.Format, s.save)
+		// the failed attempt is counted by saveUnsentMessage and by the store.
+		if attempts := message.Attempts() + 2; attempts >= maxDeliveryAttempts {
+			s.trace(message, TraceEvent{Stage: TraceDeadLettered, Attempts: attempts})
+		}
 		return
 	}
 
 	if message.attempts <= 1 {
 		s.save(message, client.Format)
 	}
+}
+
+// deliver writes the encoded message to one subscriber, tracking the delivery for its ACK.
+func (s *Server) deliver(client Client, message Message, payload []byte) error {
+	return s.deliverFrame(client, []Message{message}, payload)
+}
+
+// deliverFrame writes one frame carrying the messages, a single one or a BATCH, tracking the
+// delivery of each for its ACK.
+func (s *Server) deliverFrame(client Client, messages []Message, payload []byte) error {
+	s.trackDeliveries(client, messages)
+	return s.writeDeliveries(client, messages, payload)
+}
+
+// writeDeliveries writes one frame carrying the messages already tracked, handing the
+// deliveries back when the frame does not go out.
+func (s *Server) writeDeliveries(client Client, messages []Message, payload []byte) error {
+	if err := s.throttleBytes(client, frameHeaderSize+len(payload)); err != nil {
+		s.untrackDeliveries(client, messages)
+		return fmt.Errorf("bandwidth limiter wait failed: %w", err)
+	}
+	if err := client.deliveryLimiter.Wait(context.Background()); err != nil {
+		s.untrackDeliveries(client, messages)
+		return fmt.Errorf("delivery limiter wait failed: %w", err)
+	}
+
+	cc, ok := s.lookupClientConn(client.conn)
+	if !ok {
+		return ErrConnectionNotFound
+	}
+
+	if err := cc.writeFrame(client.Format, payload); err != nil {
+		s.untrackDeliveries(client, messages)
+		return fmt.Errorf("cannot write frame: %w", err)
+	}
+
+	topic := messages[0].Topic()
+	timeout := s.visibilityOf(topic)
+	size := frameHeaderSize + len(payload)
+	for _, message := range messages {
+		cc.delivered(topic)
+		if s.tracked(client, message) && timeout > 0 {
+			s.hide(message, cc.id, timeout)
+		}
+		s.trace(message, TraceEvent{Stage: TraceDelivered, ConnectionID: cc.id, Subscriber: client.subscriber, Attempts: message.Attempts()})
+		s.incSentMessages(topic)
+		observability.MessagesDelivered.WithLabelValues(topic.Name).Inc()
+		// the bytes of the frame go with its first message.
+		s.telemetry.Delivered(context.Background(), topic.Name, size)
+		size = 0
+	}
+	return nil
+}
+
+// trackDeliveries records the deliveries of the messages to the client before they are
+// written, the ACK may come back before the write returns.
+func (s *Server) trackDeliveries(client Client, messages []Message) {
+	cc, ok := s.lookupClientConn(client.conn)
+	if !ok {
+		return
+	}
+
+	to := recipient(client.subscriber, cc.id)
+	for _, message := range messages {
+		if !s.tracked(client, message) {
+			continue
+		}
+		if err := s.DB.TrackDelivery(message.ID(), to); err != nil {
+			s.logger().Error("cannot track delivery", "id", message.ID(), "err", err)
+		}
+		if client.subscriber == "" {
+			cc.addUnacked(message.ID())
+		}
+	}
+}
+
+// untrackDeliveries forgets the deliveries of the messages the client never got.
+func (s *Server) untrackDeliveries(client Client, messages []Message) {
+	cc, ok := s.lookupClientConn(client.conn)
+	if !ok {
+		// gone, disconnect took the ephemeral deliveries back, the durable ones wait for
+		// their redelivery.
+		return
+	}
+
+	to := recipient(client.subscriber, cc.id)
+	for _, message := range messages {
+		if !s.tracked(client, message) {
+			continue
+		}
+		cc.dropUnacked(message.ID())
+		if err := s.DB.UntrackDelivery(message.ID(), to); err != nil {
+			s.logger().Error("cannot untrack delivery", "id", message.ID(), "err", err)
+		}
+	}
+}
+
+// tracked tells if the delivery waits for its ACK. The transient topics, the fire and forget
+// messages and the subscribers asking for no ACK are done with once written.
+func (s *Server) tracked(client Client, message Message) bool {
+	return !client.noAck && !message.fireAndForget && !s.isTransient(message.Topic())
+}
+
+// throttleBytes waits on the global bandwidth budget first and then on the subscriber one.
+func (s *Server) throttleBytes(client Client, n int) error {
+	ctx := context.Background()
+	if err := s.byteLimiter.WaitN(ctx, n); err != nil {
+		return err
+	}
 
-	s.incSentMessages(message.Topic())
+	return client.byteLimiter.WaitN(ctx, n)
 }
 
 func (s *Server) processRateLimitQueue() {
 	s.rateLimiter.ProcessQueue(func(message Message) {
-		go s.sendMessageSync(message, FormatJSON, message.Topic())
+		go s.sendMessageSync(message, message.Topic())
 	})
 }
@@ -1,16 +1,32 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tomiok/queuety/server/observability"
+	"github.com/tomiok/queuety/server/telemetry"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 )
 
 func Test_ServerStart(t *testing.T) {
@@ -68,7 +84,7 @@ func Test_Server(t *testing.T) {
 	conn, err := net.Dial("tcp", ":60123")
 	topic := NewTopic("test-topic")
 	srv.addNewTopic("test-topic")
-	srv.addNewSubscriber(conn, topic, FormatJSON)
+	srv.addNewSubscriber(conn, topic, FormatJSON, SubscribeOptions{})
 
 	_msg := msg{Value: 1}
 	bMsg, _ := json.Marshal(_msg)
@@ -90,13 +106,13 @@ func Test_Server(t *testing.T) {
 
 	time.Sleep(10 * time.Microsecond)
 	err = db.View(func(txn *badger.Txn) error {
-		item, rerr := txn.Get([]byte("false-" + id))
+		item, rerr := txn.Get(pendingKey("false-" + id))
 		if rerr != nil {
 			return rerr
 		}
 
 		key := string(item.Key())
-		if !strings.HasPrefix(key, "false") {
+		if !strings.HasPrefix(key, pendingPrefix+"false") {
 			return errors.New("invalid key saved")
 		}
 
@@ -110,3 +126,894 @@ func Test_Server(t *testing.T) {
 type msg struct {
 	Value int `json:"value"`
 }
+
+func Test_NewLogger(t *testing.T) {
+	level, err := ParseLogLevel("warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf strings.Builder
+	logger := NewLogger(&buf, level, LogFormatJSON)
+	logger.Info("not logged")
+	logger.Warn("cannot deliver message", "id", "false-1")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("want 1 record, got %q", buf.String())
+	}
+
+	var record map[string]any
+	if err = json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["level"] != "WARN" || record["id"] != "false-1" {
+		t.Fatalf("unexpected record %v", record)
+	}
+
+	if _, err = ParseLogLevel("loud"); err == nil {
+		t.Fatal("want an error for an unknown level")
+	}
+}
+
+func Test_SaveIsInstrumented(t *testing.T) {
+	srv := Server{DB: NewMemoryStore(0), durability: DurabilityAsync}
+	topic := NewTopic("instrumented")
+	before := testutil.ToFloat64(observability.MessagesPersisted.WithLabelValues(topic.Name))
+
+	srv.save(NewMessageBuilder().WithID("false-1").WithNextID("1").WithTopic(topic).Build(), FormatJSON)
+
+	if got := testutil.ToFloat64(observability.MessagesPersisted.WithLabelValues(topic.Name)); got != before+1 {
+		t.Fatalf("expected the persisted counter at %v, got %v", before+1, got)
+	}
+}
+
+func Test_TelemetryCallSites(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	tel, err := telemetry.New(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := NewTopic("orders")
+	srv := Server{DB: NewMemoryStore(0), telemetry: tel, User: "admin", Password: "pass", sentMessages: make(map[Topic]*atomic.Int32)}
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+
+	msg := NewMessageBuilder().WithID("false-1").WithNextID("1").WithTopic(topic).WithBody([]byte(`"hi"`)).Build()
+	srv.save(msg, FormatJSON)
+	srv.clientConn(conn)
+	if err = srv.deliver(Client{conn: conn, Format: FormatJSON}, msg, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	srv.ack(conn, msg)
+	srv.doLogin(conn, NewMessageBuilder().WithUser("admin").WithPassword("wrong").Build())
+
+	var rm metricdata.ResourceMetrics
+	if err = reader.Collect(t.Context(), &rm); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]bool)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			got[m.Name] = true
+		}
+	}
+
+	for _, name := range []string{"queuety.store.duration", "queuety.messages.delivered", "queuety.bytes.sent", "queuety.auth.attempts"} {
+		if !got[name] {
+			t.Errorf("expected %s to be recorded, got %v", name, got)
+		}
+	}
+}
+
+func Test_TailStreamsMessages(t *testing.T) {
+	topic := NewTopic("orders")
+	srv := &Server{DB: NewMemoryStore(0), clients: map[Topic][]Client{topic: {}}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /topics/{name}/tail", srv.handleTail)
+	web := httptest.NewServer(mux)
+	defer web.Close()
+
+	if resp, err := http.Get(web.URL + "/topics/orders/tail?sample=2"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a bad request for sample=2, got %v %v", resp, err)
+	}
+
+	resp, err := http.Get(web.URL + "/topics/orders/tail?duration=2s")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer resp.Body.Close()
+
+	// the headers are flushed once the tap is registered.
+	msg := NewMessageBuilder().WithID("false-abc").WithNextID("abc").WithTopic(topic).WithBody(json.RawMessage(`"hello"`)).Build()
+	srv.sendMessageSync(msg, topic)
+
+	line, err := bufio.NewReader(resp.Body).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tailed, err := DecodeMessage(line)
+	if err != nil || tailed.ID() != msg.ID() || string(tailed.Body()) != `"hello"` {
+		t.Fatalf("expected the published message, got %v %v", tailed, err)
+	}
+	if pending, _ := srv.DB.PendingMessages(); len(pending) != 1 {
+		t.Fatalf("tailing should not take the message from the store, got %v", pending)
+	}
+}
+
+func Test_SamplesKeepTheLastMessages(t *testing.T) {
+	topic := NewTopic("orders")
+	srv := &Server{
+		DB:      NewMemoryStore(0),
+		clients: map[Topic][]Client{topic: {}, NewTopic("payments"): {}},
+		sampler: newSampler(map[string]float64{"orders": 1}, 2, 4),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /topics/{name}/samples", srv.handleSamples)
+	web := httptest.NewServer(mux)
+	defer web.Close()
+
+	for _, body := range []string{`"one"`, `"two"`, `"three"`} {
+		msg := NewMessageBuilder().WithID("false-" + body).WithTopic(topic).WithHeaders(map[string]string{"tenant": "acme"}).WithBody(json.RawMessage(body)).Build()
+		srv.sendMessageSync(msg, topic)
+	}
+	srv.sendMessageSync(NewMessageBuilder().WithID("false-p").WithTopic(NewTopic("payments")).WithBody(json.RawMessage(`1`)).Build(), NewTopic("payments"))
+
+	resp, err := http.Get(web.URL + "/topics/orders/samples")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer resp.Body.Close()
+
+	var samples []MessageSample
+	if err = json.NewDecoder(resp.Body).Decode(&samples); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(samples) != 2 || samples[0].ID != `false-"two"` || samples[1].ID != `false-"three"` {
+		t.Fatalf("expected the last two messages oldest first, got %+v", samples)
+	}
+	if s := samples[1]; s.Body != `"thr` || !s.Truncated || s.BodySize != 7 || s.Headers["tenant"] != "acme" {
+		t.Fatalf("expected the headers and a truncated body, got %+v", s)
+	}
+	if got := srv.Samples(NewTopic("payments")); got != nil {
+		t.Fatalf("a topic without a rate should not be sampled, got %+v", got)
+	}
+}
+
+func Test_ConnectionTraceLogsFrames(t *testing.T) {
+	var logs bytes.Buffer
+	srv := &Server{log: NewLogger(&logs, slog.LevelInfo, LogFormatJSON)}
+
+	server, client := net.Pipe()
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+	cc := srv.clientConn(server)
+
+	msg := NewMessageBuilder().WithID("false-abc").WithType(MessageTypeNew).WithTopic(NewTopic("orders")).WithBody(json.RawMessage(`"secret"`)).Build()
+	payload, _ := msg.Marshall()
+
+	if err := cc.writeFrame(FormatJSON, payload); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("expected nothing logged before tracing is on, got %s", logs.String())
+	}
+
+	if err := srv.TraceConnection(cc.id, false); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := cc.writeFrame(FormatJSON, payload); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	line := logs.String()
+	for _, want := range []string{`"direction":"out"`, `"type":"NEW_MESSAGE"`, `"id":"false-abc"`} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("expected %s in %s", want, line)
+		}
+	}
+	if strings.Contains(line, "secret") {
+		t.Fatalf("the body should not be logged by default, got %s", line)
+	}
+
+	if err := srv.TraceConnection(cc.id+1, false); !errors.Is(err, ErrConnectionNotFound) {
+		t.Fatalf("expected ErrConnectionNotFound, got %v", err)
+	}
+}
+
+func Test_ConcurrentFramesStayWhole(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	cc := newClientConn(1, server)
+
+	// small frames are buffered, the large ones go out with a vectored write.
+	sizes := []int{10, 100 << 10, 300, 64 << 10}
+	var wg sync.WaitGroup
+	for i, size := range sizes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cc.writeFrame(FormatBinary, bytes.Repeat([]byte{byte('a' + i)}, size)); err != nil {
+				t.Errorf("%v", err)
+			}
+		}()
+	}
+
+	for range sizes {
+		var header [frameHeaderSize]byte
+		if _, err := io.ReadFull(client, header[:]); err != nil {
+			t.Fatalf("%v", err)
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(client, payload); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if i := int(payload[0] - 'a'); i < 0 || i >= len(sizes) || len(payload) != sizes[i] || bytes.Count(payload, payload[:1]) != len(payload) {
+			t.Fatalf("interleaved frame of %d bytes", len(payload))
+		}
+	}
+	wg.Wait()
+}
+
+func FuzzHandleMessage(f *testing.F) {
+	for _, seed := range binarySeeds() {
+		f.Add(byte(FormatBinary), seed)
+	}
+	for _, seed := range []string{
+		`{"id":"false-1","next_id":"1","type":"NEW_MESSAGE","topic":{"name":"orders"},"body":{"value":1}}`,
+		`{"id":"1","type":"NEW_TOPIC","topic":{"name":"orders"},"body":{"class":"transient"}}`,
+		`{"id":"1","type":"NEW_SUB","topic":{"name":"orders"},"subscriber":"billing"}`,
+		`{"id":"false-1","type":"ACK","topic":{"name":"orders"},"seq":1}`,
+		`{"id":"1","type":"REPLAY","topic":{"name":"orders"},"body":{"from_seq":1}}`,
+		`{"type":"AUTH","user":"admin","password":"pass"}`,
+		`{"type":"HELLO","body":{"name":"billing","labels":{"env":"prod"}}}`,
+		`{"type":"`,
+	} {
+		f.Add(byte(FormatJSON), []byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, format byte, payload []byte) {
+		topic := NewTopic("orders")
+		srv := &Server{
+			DB:            NewMemoryStore(0),
+			clients:       map[Topic][]Client{topic: {}},
+			sentMessages:  make(map[Topic]*atomic.Int32),
+			durableTopics: make(map[Topic][]string),
+			log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+		}
+
+		conn, peer := net.Pipe()
+		defer conn.Close()
+		go func() { _, _ = io.Copy(io.Discard, peer) }()
+
+		// a malformed frame is answered with an error, it must never take the broker down.
+		srv.handleMessage(conn, payload, MessageFormat(format))
+	})
+}
+
+func Test_OversizedFrameDisconnects(t *testing.T) {
+	srv := &Server{DB: NewMemoryStore(0), clients: map[Topic][]Client{}, maxFrameSize: 64}
+
+	conn, peer := net.Pipe()
+	srv.clientConn(conn)
+	done := make(chan struct{})
+	go func() {
+		srv.handleConnections(conn)
+		close(done)
+	}()
+
+	// a length nobody could have sent, the broker must not allocate it.
+	if _, err := peer.Write([]byte{byte(FormatBinary), 0xff, 0xff, 0xff, 0xff}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the connection dropped")
+	}
+	if _, ok := srv.lookupClientConn(conn); ok {
+		t.Fatal("expected the connection unregistered")
+	}
+}
+
+// resetConn fails every read as a connection reset by the peer does.
+type resetConn struct{ net.Conn }
+
+func (resetConn) Read([]byte) (int, error) { return 0, syscall.ECONNRESET }
+
+func Test_ReadErrorDisconnects(t *testing.T) {
+	srv := &Server{DB: NewMemoryStore(0), clients: map[Topic][]Client{}, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	pipe, _ := net.Pipe()
+	conn := resetConn{pipe}
+	srv.clientConn(conn)
+	done := make(chan struct{})
+	go func() {
+		srv.handleConnections(conn)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the reset connection dropped instead of read again")
+	}
+}
+
+func Test_ShutdownDrainsConnections(t *testing.T) {
+	var flushed atomic.Bool
+	srv, err := NewServer(Config{
+		Protocol:      "tcp",
+		WebServerPort: "localhost:0",
+		InMemoryData:  true,
+		Duration:      time.Hour,
+		TelemetryFlush: func(context.Context) error {
+			flushed.Store(true)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+
+	for deadline := time.Now().Add(time.Second); len(srv.Connections()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
+		t.Fatalf("should shut down cleanly: %v", err)
+	}
+
+	if err = <-served; err != nil {
+		t.Fatalf("Serve should return nil, got %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the connection closed by the broker, got %v", err)
+	}
+	if !flushed.Load() {
+		t.Fatal("expected the telemetry flushed")
+	}
+}
+
+func Test_HelloIdentifiesClient(t *testing.T) {
+	topic := NewTopic("orders")
+	srv := &Server{
+		DB:            NewMemoryStore(0),
+		clients:       map[Topic][]Client{topic: {}},
+		sentMessages:  make(map[Topic]*atomic.Int32),
+		durableTopics: make(map[Topic][]string),
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+
+	srv.handleMessage(conn, []byte(`{"type":"HELLO","body":{"name":"billing","version":"1.4.2","labels":{"env":"prod"}}}`), FormatJSON)
+	for i := range 3 {
+		seq := strconv.Itoa(i)
+		srv.handleMessage(conn, []byte(`{"id":"false-`+seq+`","next_id":"`+seq+`","type":"NEW_MESSAGE","topic":{"Name":"orders"},"body":1}`), FormatJSON)
+	}
+
+	conns := srv.Connections()
+	if len(conns) != 1 || conns[0].Client == nil || conns[0].Client.Name != "billing" || conns[0].Client.Labels["env"] != "prod" {
+		t.Fatalf("expected the connection identified as billing, got %+v", conns)
+	}
+	if conns[0].Published["orders"] != 3 {
+		t.Fatalf("expected 3 messages published to orders, got %v", conns[0].Published)
+	}
+	if publishers := srv.topicPublishers(topic); len(publishers) != 1 || publishers[0].Client != "billing" {
+		t.Fatalf("expected billing among the publishers, got %v", publishers)
+	}
+
+	if _, err := parseClientInfo([]byte(`{"version":"1"}`)); err == nil {
+		t.Fatal("expected a HELLO without name rejected")
+	}
+}
+
+func Test_InfoReportsLimitsAndFeatures(t *testing.T) {
+	s := &Server{
+		User:         "admin",
+		rateLimiter:  NewRateLimiter(50, 10),
+		maxFrameSize: 1024,
+		startedAt:    time.Now().Add(-time.Minute),
+	}
+
+	rec := httptest.NewRecorder()
+	s.WebHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/info", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	var info Info
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if info.Version != Version || info.Uptime < 60 || info.GoVersion == "" {
+		t.Fatalf("unexpected build info %+v", info)
+	}
+	if info.Limits.MaxFrameSize != 1024 || info.Limits.MaxMessagesPerSecond != 50 || info.Limits.RateLimitQueueSize != 10 {
+		t.Fatalf("unexpected limits %+v", info.Limits)
+	}
+	if strings.Join(info.Features, ",") != "auth,http_consume,rate_limit" {
+		t.Fatalf("unexpected features %v", info.Features)
+	}
+}
+
+func Test_ConnectionsAndGroupsAreAdminOnly(t *testing.T) {
+	s := &Server{User: "admin", Password: "secret", DB: NewMemoryStore(0), clients: map[Topic][]Client{}}
+	web := s.WebHandler()
+
+	for _, path := range []string{"/connections", "/groups"} {
+		rec := httptest.NewRecorder()
+		web.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected %s refused without credentials, got %d", path, rec.Code)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.SetBasicAuth("admin", "secret")
+		rec = httptest.NewRecorder()
+		web.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected %s served to the admin, got %d", path, rec.Code)
+		}
+	}
+}
+
+func Test_MaxSubscribersRejectsExtraSubscriber(t *testing.T) {
+	topic := NewTopic("orders")
+	srv := &Server{
+		DB:                  NewMemoryStore(0),
+		clients:             map[Topic][]Client{topic: {}},
+		durableTopics:       make(map[Topic][]string),
+		topicMaxSubscribers: map[string]int{"orders": 1},
+		log:                 slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	first, firstPeer := net.Pipe()
+	defer first.Close()
+	go func() { _, _ = io.Copy(io.Discard, firstPeer) }()
+	srv.handleMessage(first, []byte(`{"id":"1","type":"NEW_SUB","topic":{"Name":"orders"}}`), FormatJSON)
+
+	second, secondPeer := net.Pipe()
+	defer second.Close()
+	go srv.handleMessage(second, []byte(`{"id":"2","type":"NEW_SUB","topic":{"Name":"orders"}}`), FormatJSON)
+
+	var header [5]byte
+	if _, err := io.ReadFull(secondPeer, header[:]); err != nil {
+		t.Fatalf("%v", err)
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(secondPeer, payload); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	m, err := DecodeMessage(payload)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if body, ok := m.ErrorBody(); !ok || body.Code != ErrCodeSubscriberLimit || body.MessageID != "2" {
+		t.Fatalf("expected the second subscriber rejected, got %s", m.Body())
+	}
+	if n := len(srv.clients[topic]); n != 1 {
+		t.Fatalf("expected 1 subscriber, got %d", n)
+	}
+}
+
+func Test_DeleteIdleTopics(t *testing.T) {
+	srv := &Server{
+		DB:            NewMemoryStore(0),
+		clients:       make(map[Topic][]Client),
+		durableTopics: make(map[Topic][]string),
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	srv.CreateTopic("job-1", TopicOptions{AutoDeleteAfter: 60})
+	srv.CreateTopic("job-2", TopicOptions{AutoDeleteAfter: 60})
+	srv.CreateTopic("orders", TopicOptions{})
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+	srv.addNewSubscriber(conn, NewTopic("job-2"), FormatJSON, SubscribeOptions{})
+
+	srv.deleteIdleTopics(time.Now().Add(2 * time.Minute))
+
+	if _, ok := srv.clients[NewTopic("job-1")]; ok {
+		t.Fatal("expected the idle job-1 deleted")
+	}
+	for _, name := range []string{"job-2", "orders"} {
+		if _, ok := srv.clients[NewTopic(name)]; !ok {
+			t.Fatalf("expected %s kept", name)
+		}
+	}
+
+	options, _ := srv.DB.SavedTopicOptions()
+	if _, ok := options[NewTopic("job-1")]; ok || options[NewTopic("job-2")].AutoDeleteAfter != 60 {
+		t.Fatalf("unexpected saved options %v", options)
+	}
+}
+
+func Test_TopicsChangeWhileClientsSubscribe(t *testing.T) {
+	srv := &Server{
+		DB:            NewMemoryStore(0),
+		clients:       make(map[Topic][]Client),
+		durableTopics: make(map[Topic][]string),
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	// run with -race, the admin API changes the topics the connections subscribe to.
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				conn, peer := net.Pipe()
+				go func() { _, _ = io.Copy(io.Discard, peer) }()
+				srv.addNewSubscriber(conn, NewTopic("orders"), FormatJSON, SubscribeOptions{})
+				srv.disconnect(conn)
+			}
+		}()
+	}
+	for range 50 {
+		srv.CreateTopic("orders", TopicOptions{})
+		_, _ = srv.Subscribers(NewTopic("orders"))
+		_, _ = srv.DeleteTopic(NewTopic("orders"))
+	}
+	wg.Wait()
+}
+
+func Test_CompactedTopicKeepsLatestPerKey(t *testing.T) {
+	topic := NewTopic("presence")
+	srv := &Server{
+		DB:            NewMemoryStore(0),
+		clients:       make(map[Topic][]Client),
+		durableTopics: make(map[Topic][]string),
+		sentMessages:  make(map[Topic]*atomic.Int32),
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	srv.CreateTopic(topic.Name, TopicOptions{Class: TopicCompacted})
+
+	if err := srv.checkKey(NewMessageBuilder().WithTopic(topic).Build()); !errors.Is(err, errMissingKey) {
+		t.Fatalf("expected a message without key rejected, got %v", err)
+	}
+
+	for i, kv := range [][2]string{{"ana", `"online"`}, {"bob", `"online"`}, {"ana", `"away"`}, {"bob", `null`}, {"eve", `"online"`}} {
+		seq := uint64(i + 1)
+		msg := NewMessageBuilder().
+			WithID("false-" + strconv.FormatUint(seq, 10)).
+			WithNextID(strconv.FormatUint(seq, 10)).
+			WithTopic(topic).
+			WithSeq(seq).
+			WithKey(kv[0]).
+			WithBody([]byte(kv[1])).
+			Build()
+		srv.sendMessageSync(msg, topic)
+	}
+	srv.compactTopics()
+
+	stored, _ := srv.DB.MessagesAfter(topic, 0)
+	if len(stored) != 2 || stored[0].Key() != "ana" || stored[1].Key() != "eve" {
+		t.Fatalf("expected the latest of ana and eve stored, got %v", stored)
+	}
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	srv.addNewSubscriber(conn, topic, FormatJSON, SubscribeOptions{})
+
+	want := map[string]string{"ana": `"away"`, "eve": `"online"`}
+	for range want {
+		var header [5]byte
+		if _, err := io.ReadFull(peer, header[:]); err != nil {
+			t.Fatalf("%v", err)
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(peer, payload); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		m, err := DecodeMessage(payload)
+		if err != nil || want[m.Key()] != string(m.Body()) {
+			t.Fatalf("unexpected snapshot message %v %v", m, err)
+		}
+		delete(want, m.Key())
+	}
+}
+
+func Test_QueueTopicDeliversToOneSubscriber(t *testing.T) {
+	srv := &Server{
+		DB:            NewMemoryStore(0),
+		clients:       make(map[Topic][]Client),
+		durableTopics: make(map[Topic][]string),
+		sentMessages:  make(map[Topic]*atomic.Int32),
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	jobs, events := NewTopic("jobs"), NewTopic("events")
+	srv.CreateTopic(jobs.Name, TopicOptions{Mode: TopicQueue})
+	srv.CreateTopic(events.Name, TopicOptions{})
+
+	for range 2 {
+		conn, peer := net.Pipe()
+		defer conn.Close()
+		go func() { _, _ = io.Copy(io.Discard, peer) }()
+		srv.addNewSubscriber(conn, jobs, FormatJSON, SubscribeOptions{})
+		srv.addNewSubscriber(conn, events, FormatJSON, SubscribeOptions{})
+	}
+
+	for i := range 4 {
+		id := strconv.Itoa(i)
+		srv.sendMessageSync(NewMessageBuilder().WithID("false-j"+id).WithNextID("j"+id).WithTopic(jobs).WithBody([]byte(`1`)).Build(), jobs)
+		srv.sendMessageSync(NewMessageBuilder().WithID("false-e"+id).WithNextID("e"+id).WithTopic(events).WithBody([]byte(`1`)).Build(), events)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for (srv.sentCount(jobs) < 4 || srv.sentCount(events) < 8) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, d := range srv.subscriberDeliveries(jobs, srv.clients[jobs]) {
+		if d.Delivered != 2 {
+			t.Fatalf("expected the queue split in turns, got %v", srv.subscriberDeliveries(jobs, srv.clients[jobs]))
+		}
+	}
+	if srv.sentCount(events) != 8 {
+		t.Fatalf("expected every event to every subscriber, got %d", srv.sentCount(events))
+	}
+
+	if options, _ := srv.DB.SavedTopicOptions(); options[jobs].Mode != TopicQueue {
+		t.Fatalf("expected the queue mode saved, got %v", options)
+	}
+}
+
+func Test_VisibilityTimeoutHandsOverUnacked(t *testing.T) {
+	srv := &Server{
+		DB:            NewMemoryStore(0),
+		clients:       make(map[Topic][]Client),
+		durableTopics: make(map[Topic][]string),
+		sentMessages:  make(map[Topic]*atomic.Int32),
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	jobs := NewTopic("jobs")
+	srv.CreateTopic(jobs.Name, TopicOptions{Mode: TopicQueue, VisibilityTimeout: 1})
+
+	for range 2 {
+		conn, peer := net.Pipe()
+		defer conn.Close()
+		go func() { _, _ = io.Copy(io.Discard, peer) }()
+		srv.addNewSubscriber(conn, jobs, FormatJSON, SubscribeOptions{})
+	}
+
+	srv.sendMessageSync(NewMessageBuilder().WithID("false-j1").WithNextID("j1").WithTopic(jobs).WithBody([]byte(`1`)).Build(), jobs)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for srv.sentCount(jobs) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, d := range srv.subscriberDeliveries(jobs, srv.clients[jobs]) {
+		if d.Delivered != 1 {
+			t.Fatalf("expected the unacked job handed to the other subscriber, got %v", srv.subscriberDeliveries(jobs, srv.clients[jobs]))
+		}
+	}
+
+	if options, _ := srv.DB.SavedTopicOptions(); options[jobs].VisibilityTimeout != 1 {
+		t.Fatalf("expected the visibility timeout saved, got %v", options)
+	}
+	if _, err := parseTopicOptions([]byte(`{"visibility_timeout":30}`)); err == nil {
+		t.Fatal("expected a visibility timeout on a fanout topic rejected")
+	}
+}
+
+func Test_ExclusiveTopicFailsOver(t *testing.T) {
+	srv := &Server{
+		DB:            NewMemoryStore(0),
+		clients:       make(map[Topic][]Client),
+		durableTopics: make(map[Topic][]string),
+		sentMessages:  make(map[Topic]*atomic.Int32),
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	topic := NewTopic("ledger")
+	srv.CreateTopic(topic.Name, TopicOptions{Mode: TopicExclusive})
+
+	active, activePeer := net.Pipe()
+	spare, sparePeer := net.Pipe()
+	defer spare.Close()
+	go func() { _, _ = io.Copy(io.Discard, activePeer) }()
+	go func() { _, _ = io.Copy(io.Discard, sparePeer) }()
+	srv.addNewSubscriber(active, topic, FormatJSON, SubscribeOptions{})
+	srv.addNewSubscriber(spare, topic, FormatJSON, SubscribeOptions{})
+
+	for i := range 3 {
+		id := strconv.Itoa(i)
+		srv.sendMessageSync(NewMessageBuilder().WithID("false-"+id).WithNextID(id).WithTopic(topic).WithSeq(uint64(i+1)).WithBody([]byte(`1`)).Build(), topic)
+	}
+
+	subs, _ := srv.Subscribers(topic)
+	if !subs.Connected[0].Active || subs.Connected[1].Active {
+		t.Fatalf("expected the first subscriber active, got %v", subs.Connected)
+	}
+	if d := srv.subscriberDeliveries(topic, srv.clients[topic]); d[0].Delivered != 3 || d[1].Delivered != 0 {
+		t.Fatalf("expected everything to the active subscriber, got %v", d)
+	}
+
+	// nothing was acked, the spare gets it all again once it takes over.
+	srv.disconnect(active)
+
+	deadline := time.Now().Add(time.Second)
+	for srv.sentCount(topic) < 6 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if d := srv.subscriberDeliveries(topic, srv.clients[topic]); len(d) != 1 || d[0].Delivered != 3 {
+		t.Fatalf("expected the unacked messages redelivered to the spare, got %v", d)
+	}
+}
+
+func Test_RouteByKeyPicksOneGroupMember(t *testing.T) {
+	var clients []Client
+	for _, name := range []string{"billing", "billing", "", "billing", "audit"} {
+		conn, _ := net.Pipe()
+		defer conn.Close()
+		clients = append(clients, Client{conn: conn, subscriber: name})
+	}
+
+	if routed := routeByKey(NewMessageBuilder().Build(), clients); len(routed) != len(clients) {
+		t.Fatalf("expected a message without key to every subscriber, got %d", len(routed))
+	}
+
+	member := make(map[string]net.Conn)
+	for i := range 20 {
+		key := "customer-" + strconv.Itoa(i%5)
+		routed := routeByKey(NewMessageBuilder().WithKey(key).Build(), clients)
+		if len(routed) != 3 {
+			t.Fatalf("expected one billing member, the audit and the plain subscriber, got %v", routed)
+		}
+
+		for _, c := range routed {
+			if c.subscriber != "billing" {
+				continue
+			}
+			if conn, ok := member[key]; ok && conn != c.conn {
+				t.Fatalf("expected %s always routed to the same member", key)
+			}
+			member[key] = c.conn
+		}
+	}
+}
+
+func Test_DeliveryLimiterTakesLowestRate(t *testing.T) {
+	srv := &Server{subscriberMessagesPerSecond: 100}
+
+	if opts, err := parseSubscribeOptions([]byte(`{"max_rate":10}`)); err != nil || opts.MaxRate != 10 {
+		t.Fatalf("unexpected options %v %v", opts, err)
+	}
+	if _, err := parseSubscribeOptions([]byte(`{"max_rate":-1}`)); err == nil {
+		t.Fatal("expected a negative rate rejected")
+	}
+	if _, err := parseSubscribeOptions([]byte(`{"batch_size":1001}`)); err == nil {
+		t.Fatal("expected a batch above the limit rejected")
+	}
+
+	for requested, want := range map[int]float64{0: 100, 10: 10, 500: 100} {
+		if got := srv.deliveryLimiter(SubscribeOptions{MaxRate: requested}).limiter.Limit(); float64(got) != want {
+			t.Fatalf("asked %d, expected %v, got %v", requested, want, got)
+		}
+	}
+
+	if (&Server{}).deliveryLimiter(SubscribeOptions{}) != nil {
+		t.Fatal("expected no limiter without a rate")
+	}
+}
+
+func Test_ByteLimiterWaits(t *testing.T) {
+	for name, tc := range map[string]struct {
+		limiter         *ByteLimiter
+		writes          []int
+		atLeast, atMost time.Duration
+	}{
+		// 200 bytes past the burst of 1000 cost 200ms, rate.Limiter alone rejects the frame.
+		"frame over the burst": {NewByteLimiter(1000), []int{1200}, 150 * time.Millisecond, time.Second},
+		"nil never blocks":     {nil, []int{1 << 30}, 0, 50 * time.Millisecond},
+		// the burst goes at once, the next 500 bytes take half a second.
+		"rate enforced": {NewByteLimiter(1000), []int{1000, 250, 250}, 400 * time.Millisecond, time.Second},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			start := time.Now()
+			for _, n := range tc.writes {
+				if err := tc.limiter.WaitN(ctx, n); err != nil {
+					t.Fatalf("cannot wait for %d bytes %v", n, err)
+				}
+			}
+			if took := time.Since(start); took < tc.atLeast || took > tc.atMost {
+				t.Fatalf("expected between %s and %s, took %s", tc.atLeast, tc.atMost, took)
+			}
+		})
+	}
+}
+
+func Test_ScheduleFiresOnCron(t *testing.T) {
+	for expr, want := range map[string]bool{
+		"*/15 * * * *":  true,
+		"30 9 * * 1-5":  true,
+		"30 9 * * 0,6":  false,
+		"30 9 15 * 6":   true,
+		"0 * * * *":     false,
+		"@daily":        false,
+		"30 9 * 1-12 *": true,
+	} {
+		spec, err := parseCron(expr)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		// a Monday.
+		if got := spec.matches(time.Date(2025, 9, 15, 9, 30, 0, 0, time.UTC)); got != want {
+			t.Fatalf("%s: expected %v, got %v", expr, want, got)
+		}
+	}
+	for _, expr := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Fatalf("%s: expected an error", expr)
+		}
+	}
+
+	srv := &Server{
+		DB:            NewMemoryStore(0),
+		clients:       make(map[Topic][]Client),
+		durableTopics: make(map[Topic][]string),
+		sentMessages:  make(map[Topic]*atomic.Int32),
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	heartbeats := NewTopic("heartbeats")
+	srv.CreateTopic(heartbeats.Name, TopicOptions{})
+
+	schedule := Schedule{Name: "beat", Cron: "*/5 * * * *", Topic: heartbeats.Name, Body: `{"from":"{{.Name}}","at":{{.Time.Unix}}}`}
+	if err := schedule.validate(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := srv.DB.SaveSchedule(schedule); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	at := time.Date(2025, 9, 15, 9, 30, 0, 0, time.UTC)
+	srv.fireSchedules(at)
+	srv.fireSchedules(at.Add(time.Minute))
+
+	messages, err := srv.DB.MessagesAfter(heartbeats, 0)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(messages) != 1 || string(messages[0].Body()) != `{"from":"beat","at":`+strconv.FormatInt(at.Unix(), 10)+`}` {
+		t.Fatalf("expected one heartbeat at 9:30, got %v", messages)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// defaultShutdownTimeout leaves Run a margin inside the 10 seconds Docker waits after the
+// SIGTERM before killing the container.
+const defaultShutdownTimeout = 8 * time.Second
+
+// Run starts a broker with cfg and serves until ctx is done, then shuts it down within
+// cfg.ShutdownTimeout. It returns the error that stopped the broker before ctx, if any.
+func Run(ctx context.Context, cfg Config) error {
+	s, err := NewServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Start()
+	}()
+
+	select {
+	case err = <-served:
+		// the broker stopped on its own, the store still has to be closed.
+		return errors.Join(err, s.Shutdown(context.Background()))
+	case <-ctx.Done():
+	}
+
+	s.logger().Info("shutting down", "timeout", s.shutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	if err = s.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	return <-served
+}
+
+// Shutdown stops the broker gracefully: the listeners stop accepting, the frames being
+// handled finish and the connections are closed, then the pending writes are flushed, the
+// store is closed and the telemetry flushed. When ctx ends first the remaining connections
+// are cut, the store is closed all the same and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.listenerMu.Lock()
+	s.draining = true
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	s.listenerMu.Unlock()
+
+	var errs []error
+	if s.webServer != nil {
+		if err := s.webServer.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errs = append(errs, err)
+		}
+	}
+
+	// a connection reads its next frame once the current one is handled, closing the read
+	// side ends it there and lets the replies of that frame out.
+	for _, conn := range s.openConns() {
+		if c, ok := conn.(interface{ CloseRead() error }); ok {
+			_ = c.CloseRead()
+		} else {
+			_ = conn.Close()
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.logger().Warn("shutdown timed out, closing the remaining connections")
+		for _, conn := range s.openConns() {
+			_ = conn.Close()
+		}
+		errs = append(errs, ctx.Err())
+	}
+
+	if err := s.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.DB.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if s.telemetryFlush != nil {
+		if err := s.telemetryFlush(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// track registers a connection accepted by Serve, false once Shutdown started. The handler
+// is counted under the listener lock, so Shutdown waits for every connection it let in.
+func (s *Server) track(conn net.Conn) bool {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+
+	if s.draining {
+		return false
+	}
+
+	s.clientConn(conn)
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *Server) openConns() []net.Conn {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
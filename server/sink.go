@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// SinkConfig copies the messages published to some topics into object storage, as gzip
+// compressed JSON lines, for the long term retention and the batch jobs downstream.
+type SinkConfig struct {
+	Store ObjectStore
+	// Topics are the names of the topics copied, empty means all of them.
+	Topics []string
+	// Prefix goes before the keys, <prefix><topic>/<yyyy>/<mm>/<dd>/<unix nano>.jsonl.gz.
+	Prefix string
+	// MaxBytes uploads the batch of a topic once its uncompressed size reaches it, 8 MiB by default.
+	MaxBytes int
+	// FlushInterval uploads the batches that did not reach MaxBytes, 1 minute by default.
+	FlushInterval time.Duration
+}
+
+func (c SinkConfig) wants(topic Topic) bool {
+	return len(c.Topics) == 0 || slices.Contains(c.Topics, topic.Name)
+}
+
+const (
+	defaultSinkMaxBytes      = 8 << 20
+	defaultSinkFlushInterval = time.Minute
+	sinkQueueSize            = 1024
+	// sinkMaxBacklog is how many MaxBytes a topic keeps while its uploads fail, older lines
+	// are dropped past it.
+	sinkMaxBacklog = 4
+)
+
+// sink batches the published messages of its topics, unlike the archiver it keeps no local
+// copy: a batch failing to upload is retried on the next flush.
+type sink struct {
+	cfg SinkConfig
+
+	in   chan Message
+	quit chan struct{}
+	done chan struct{}
+	// started is set by start, or by stop on a sink that never ran.
+	started atomic.Bool
+
+	// failing leaves the retries to the ticker after an upload failed, instead of one per
+	// message added to a full batch.
+	failing bool
+
+	logger *slog.Logger
+}
+
+func newSink(cfg SinkConfig, logger *slog.Logger) *sink {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultSinkMaxBytes
+	}
+
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultSinkFlushInterval
+	}
+
+	return &sink{
+		cfg:  cfg,
+		in:   make(chan Message, sinkQueueSize),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+
+		logger: logger.With("component", "sink"),
+	}
+}
+
+// add queues a published message of the topics of the sink, it blocks the publish path only
+// when the queue is full.
+func (k *sink) add(message Message) {
+	if !k.cfg.wants(message.Topic()) {
+		return
+	}
+
+	select {
+	case k.in <- message:
+	case <-k.quit:
+	}
+}
+
+// start runs the sink once, none after stop.
+func (k *sink) start() {
+	if k.started.CompareAndSwap(false, true) {
+		go k.run()
+	}
+}
+
+func (k *sink) run() {
+	defer close(k.done)
+
+	ticker := time.NewTicker(k.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batches := make(map[Topic]*bytes.Buffer)
+	for {
+		select {
+		case message := <-k.in:
+			batch := k.append(batches, message)
+			if batch.Len() >= k.cfg.MaxBytes && !k.failing {
+				k.flush(batches, message.Topic())
+			}
+
+		case <-ticker.C:
+			for topic := range batches {
+				k.flush(batches, topic)
+			}
+
+		case <-k.quit:
+			k.drain(batches)
+			for topic := range batches {
+				k.flush(batches, topic)
+			}
+			return
+		}
+	}
+}
+
+// drain moves the messages still queued into the batches.
+func (k *sink) drain(batches map[Topic]*bytes.Buffer) {
+	for {
+		select {
+		case message := <-k.in:
+			k.append(batches, message)
+		default:
+			return
+		}
+	}
+}
+
+func (k *sink) append(batches map[Topic]*bytes.Buffer, message Message) *bytes.Buffer {
+	batch := batches[message.Topic()]
+	if batch == nil {
+		batch = new(bytes.Buffer)
+		batches[message.Topic()] = batch
+	}
+
+	line, err := message.Marshall()
+	if err != nil {
+		k.logger.Error("cannot encode message", "id", message.ID(), "err", err)
+		return batch
+	}
+	batch.Write(line)
+	batch.WriteByte('\n')
+
+	return batch
+}
+
+// flush uploads the batch of the topic, on failure the batch stays for the next flush.
+func (k *sink) flush(batches map[Topic]*bytes.Buffer, topic Topic) {
+	batch := batches[topic]
+	if batch == nil || batch.Len() == 0 {
+		delete(batches, topic)
+		return
+	}
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	_, _ = zw.Write(batch.Bytes())
+	if err := zw.Close(); err != nil {
+		k.logger.Error("cannot compress batch", "topic", topic.Name, "err", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%s%s/%s/%d.jsonl.gz", k.cfg.Prefix, topic.Name, now.Format("2006/01/02"), now.UnixNano())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := k.cfg.Store.Put(ctx, key, &body); err != nil {
+		k.logger.Error("cannot upload batch", "topic", topic.Name, "bytes", batch.Len(), "err", err)
+		k.failing = true
+		k.trim(batch, topic)
+		return
+	}
+
+	k.failing = false
+	delete(batches, topic)
+}
+
+// trim drops the oldest lines of a batch grown past the backlog while the store is down.
+func (k *sink) trim(batch *bytes.Buffer, topic Topic) {
+	limit := sinkMaxBacklog * k.cfg.MaxBytes
+	if batch.Len() <= limit {
+		return
+	}
+
+	b := batch.Bytes()
+	cut := len(b) - limit
+	if i := bytes.IndexByte(b[cut:], '\n'); i >= 0 {
+		cut += i + 1
+	}
+	k.logger.Warn("sink backlog full, dropping the oldest messages", "topic", topic.Name, "bytes", cut)
+	batch.Next(cut)
+}
+
+func (k *sink) stop() {
+	if k == nil {
+		return
+	}
+
+	close(k.quit)
+	// a sink never started has nothing to wait for.
+	if !k.started.CompareAndSwap(false, true) {
+		<-k.done
+	}
+}
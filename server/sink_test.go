@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *memoryObjectStore) Put(_ context.Context, key string, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.objects == nil {
+		m.objects = make(map[string][]byte)
+	}
+	m.objects[key] = b
+	return nil
+}
+
+func Test_SinkBatchesSelectedTopics(t *testing.T) {
+	objects := &memoryObjectStore{}
+	k := newSink(SinkConfig{Store: objects, Topics: []string{"orders"}, Prefix: "raw/", MaxBytes: 1, FlushInterval: time.Hour}, slog.Default())
+	k.start()
+
+	for _, topic := range []string{"orders", "payments"} {
+		k.add(NewMessageBuilder().WithID("false-" + topic).WithTopic(NewTopic(topic)).WithBody([]byte(`{"v":1}`)).Build())
+	}
+	k.stop()
+
+	if len(objects.objects) != 1 {
+		t.Fatalf("expected one object for orders, got %v", objects.objects)
+	}
+	for key, b := range objects.objects {
+		if !strings.HasPrefix(key, "raw/orders/") || !strings.HasSuffix(key, ".jsonl.gz") {
+			t.Fatalf("unexpected key %s", key)
+		}
+
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		content, _ := io.ReadAll(zr)
+		if !strings.Contains(string(content), `"id":"false-orders"`) {
+			t.Fatalf("unexpected object content %s", content)
+		}
+	}
+}
+
+func Test_S3ObjectStorePut(t *testing.T) {
+	var (
+		path, auth, hash string
+		body             []byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth, hash = r.URL.EscapedPath(), r.Header.Get("Authorization"), r.Header.Get("X-Amz-Content-Sha256")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	store := S3ObjectStore{Endpoint: srv.URL, Region: "us-east-1", Bucket: "archive", AccessKey: "key", SecretKey: "secret"}
+	if err := store.Put(context.Background(), "orders/a b.jsonl.gz", strings.NewReader("data")); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if path != "/archive/orders/a%20b.jsonl.gz" || string(body) != "data" || hash != sha256Hex([]byte("data")) {
+		t.Fatalf("unexpected request %s %q %s", path, body, hash)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=key/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		t.Fatalf("unexpected authorization %s", auth)
+	}
+}
+
+func Test_SinkStopsWithoutRunning(t *testing.T) {
+	k := newSink(SinkConfig{Store: &memoryObjectStore{}}, slog.Default())
+
+	stopped := make(chan struct{})
+	go func() {
+		k.stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a sink never started to stop")
+	}
+}
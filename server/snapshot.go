@@ -0,0 +1,204 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const snapshotExt = ".snap"
+
+var (
+	ErrSnapshotNotFound  = errors.New("snapshot not found")
+	ErrSnapshotsDisabled = errors.New("snapshots are disabled, set Config.SnapshotDir")
+	errInvalidSnapshot   = errors.New("invalid snapshot name, use letters, digits, '-', '_' and '.'")
+
+	snapshotName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+)
+
+// SnapshotInfo describes a named snapshot stored under Config.SnapshotDir.
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *Server) snapshotPath(name string) (string, error) {
+	if s.snapshotDir == "" {
+		return "", ErrSnapshotsDisabled
+	}
+	if !snapshotName.MatchString(name) {
+		return "", errInvalidSnapshot
+	}
+
+	return filepath.Join(s.snapshotDir, name+snapshotExt), nil
+}
+
+// CreateSnapshot writes a consistent copy of the store (messages, cursors, topics) named name.
+// The file only shows up once complete, an existing snapshot with the same name is replaced.
+func (s *Server) CreateSnapshot(name string) (SnapshotInfo, error) {
+	path, err := s.snapshotPath(name)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	if err = os.MkdirAll(s.snapshotDir, 0o755); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	tmp, err := os.CreateTemp(s.snapshotDir, name+".*.tmp")
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = s.Backup(tmp); err != nil {
+		_ = tmp.Close()
+		return SnapshotInfo{}, err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return SnapshotInfo{}, err
+	}
+	if err = tmp.Close(); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	return snapshotInfo(path)
+}
+
+// Snapshots lists the named snapshots, newest first.
+func (s *Server) Snapshots() ([]SnapshotInfo, error) {
+	if s.snapshotDir == "" {
+		return nil, ErrSnapshotsDisabled
+	}
+
+	entries, err := os.ReadDir(s.snapshotDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []SnapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []SnapshotInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), snapshotExt) {
+			continue
+		}
+
+		info, err := snapshotInfo(filepath.Join(s.snapshotDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, info)
+	}
+
+	slices.SortFunc(snapshots, func(a, b SnapshotInfo) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return snapshots, nil
+}
+
+// RestoreSnapshot loads the named snapshot into the store, meant for a fresh broker.
+func (s *Server) RestoreSnapshot(name string) error {
+	path, err := s.snapshotPath(name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrSnapshotNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return s.Restore(f)
+}
+
+func snapshotInfo(path string) (SnapshotInfo, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	return SnapshotInfo{
+		Name:      strings.TrimSuffix(filepath.Base(path), snapshotExt),
+		Size:      stat.Size(),
+		CreatedAt: stat.ModTime(),
+	}, nil
+}
+
+func snapshotStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSnapshotNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrSnapshotsDisabled):
+		return http.StatusNotImplemented
+	case errors.Is(err, errInvalidSnapshot):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (s *Server) handleSnapshotsList(w http.ResponseWriter, _ *http.Request) {
+	snapshots, err := s.Snapshots()
+	if err != nil {
+		http.Error(w, err.Error(), snapshotStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(snapshots); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) handleSnapshotCreate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditSnapshot, User: user, RemoteAddr: r.RemoteAddr, Detail: name})
+
+	info, err := s.CreateSnapshot(name)
+	if err != nil {
+		http.Error(w, err.Error(), snapshotStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err = json.NewEncoder(w).Encode(info); err != nil {
+		return
+	}
+}
+
+func (s *Server) handleSnapshotRestore(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditRestore, User: user, RemoteAddr: r.RemoteAddr, Detail: name})
+
+	if err := s.RestoreSnapshot(name); err != nil {
+		http.Error(w, err.Error(), snapshotStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -5,33 +5,69 @@ import (
 	"encoding/json"
 	"net"
 	"net/http"
+	"sort"
 	"sync/atomic"
 	"time"
+
+	"github.com/tomiok/queuety/server/observability"
 )
 
 type statistics struct {
-	Connections connections `json:"connections"`
-	Topics      topics      `json:"topics"`
+	Connections connections      `json:"connections"`
+	Topics      topics           `json:"topics"`
+	Maintenance maintenanceStats `json:"maintenance"`
+	Storage     *StorageStats    `json:"storage,omitempty"`
+	// Attempts counts the pending messages of every topic by delivery attempts.
+	Attempts     map[int]int       `json:"attempts"`
+	DeadLettered int               `json:"dead_lettered"`
+	RateLimiter  *rateLimiterStats `json:"rate_limiter,omitempty"`
+}
+
+type rateLimiterStats struct {
+	Queued   int `json:"queued"`
+	Capacity int `json:"capacity"`
 }
 
 type topics map[string]topicDetail
 
 type topicDetail struct {
-	Subscribers  int   `json:"subscribers"`
-	MessagesSent int32 `json:"messages_sent"`
+	Mode               TopicMode `json:"mode"`
+	Subscribers        int       `json:"subscribers"`
+	MessagesSent       int32     `json:"messages_sent"`
+	DurableSubscribers []string  `json:"durable_subscribers,omitempty"`
+	// Lag is the one of the consumer group furthest behind.
+	Lag          uint64        `json:"lag"`
+	Groups       []GroupOffset `json:"groups,omitempty"`
+	Pending      int           `json:"pending"`
+	DeadLettered int           `json:"dead_lettered"`
+	// Deliveries are the messages written to each connected subscriber.
+	Deliveries []subscriberDeliveries `json:"deliveries"`
+	// Publishers are the connected clients that published to the topic.
+	Publishers []topicPublisher `json:"publishers,omitempty"`
+}
+
+type topicPublisher struct {
+	ConnectionID uint64 `json:"connection_id"`
+	Client       string `json:"client,omitempty"`
+	Published    uint64 `json:"published"`
+}
+
+type subscriberDeliveries struct {
+	ConnectionID uint64 `json:"connection_id"`
+	Subscriber   string `json:"subscriber,omitempty"`
+	Client       string `json:"client,omitempty"`
+	Delivered    uint64 `json:"delivered"`
 }
 
 type connections struct {
 	Active         int `json:"active"`
 	TotalConnected int `json:"total_connected"`
+	// Accepted counts every connection since the store was created, across restarts.
+	Accepted uint64 `json:"accepted"`
 }
 
 func (s *Server) StartWebServer() error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /stats", s.handleStats)
-	mux.HandleFunc("GET /metrics", s.handleMetrics)
-
-	s.webServer.Handler = mux
+	s.webServer.Handler = s.WebHandler()
 	if err := s.webServer.ListenAndServe(); err != nil {
 		return err
 	}
@@ -39,15 +75,84 @@ func (s *Server) StartWebServer() error {
 	return nil
 }
 
+// WebHandler serves the stats and admin endpoints, for embedding them in another server.
+func (s *Server) WebHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats", s.handleStats)
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	mux.HandleFunc("GET /info", s.handleInfo)
+	if s.prometheusMetrics {
+		mux.Handle("GET /metrics", observability.Handler())
+		mux.HandleFunc("GET /stored", s.handleMetrics)
+	} else {
+		mux.HandleFunc("GET /metrics", s.handleMetrics)
+	}
+	mux.HandleFunc("GET /connections", s.adminOnly(s.handleConnectionsList))
+	mux.HandleFunc("DELETE /connections/{id}", s.adminOnly(s.handleKickConnection))
+	mux.HandleFunc("PUT /connections/{id}/trace", s.adminOnly(s.handleConnectionTrace))
+	mux.HandleFunc("GET /ipfilter", s.adminOnly(s.handleIPFilter))
+	mux.HandleFunc("PUT /ipfilter", s.adminOnly(s.handleIPFilter))
+	mux.HandleFunc("DELETE /connections/{id}/trace", s.adminOnly(s.handleConnectionTrace))
+	mux.HandleFunc("POST /topics/{name}", s.adminOnly(s.handleCreateTopic))
+	mux.HandleFunc("DELETE /topics/{name}", s.adminOnly(s.handleDeleteTopic))
+	mux.HandleFunc("GET /topics/{name}/subscribers", s.adminOnly(s.handleTopicSubscribers))
+	mux.HandleFunc("DELETE /topics/{name}/subscribers", s.adminOnly(s.handleKickTopic))
+	mux.HandleFunc("GET /topics/{name}/tail", s.adminOnly(s.handleTail))
+	mux.HandleFunc("GET /topics/{name}/samples", s.adminOnly(s.handleSamples))
+	mux.HandleFunc("GET /topics/{name}/history", s.adminOnly(s.handleHistory))
+	mux.HandleFunc("GET /search", s.adminOnly(s.handleSearch))
+	mux.HandleFunc("POST /erase", s.adminOnly(s.handleErase))
+	mux.HandleFunc("GET /topics/{name}/messages", s.adminOnly(s.handlePoll))
+	mux.HandleFunc("POST /topics/{name}/messages/ack", s.adminOnly(s.handlePollAck))
+	mux.HandleFunc("POST /topics/{name}/purge", s.adminOnly(s.handlePurgeTopic))
+	mux.HandleFunc("GET /dlq", s.adminOnly(s.handleDeadLetters))
+	mux.HandleFunc("POST /dlq/requeue", s.adminOnly(s.handleRequeue))
+	mux.HandleFunc("GET /schedules", s.adminOnly(s.handleSchedules))
+	mux.HandleFunc("PUT /schedules/{name}", s.adminOnly(s.handleSaveSchedule))
+	mux.HandleFunc("DELETE /schedules/{name}", s.adminOnly(s.handleDeleteSchedule))
+	mux.HandleFunc("GET /topics/{name}/schemas", s.adminOnly(s.handleSchemas))
+	mux.HandleFunc("POST /topics/{name}/schemas", s.adminOnly(s.handleRegisterSchema))
+	mux.HandleFunc("DELETE /topics/{name}/schemas", s.adminOnly(s.handleDeleteSchemas))
+	mux.HandleFunc("GET /messages/{id}/trace", s.adminOnly(s.handleMessageTrace))
+	mux.HandleFunc("GET /audit", s.adminOnly(s.handleAudit))
+	mux.HandleFunc("GET /backup", s.adminOnly(s.handleBackup))
+	mux.HandleFunc("POST /restore", s.adminOnly(s.handleRestore))
+	mux.HandleFunc("GET /mirror", s.adminOnly(s.handleMirror))
+	mux.HandleFunc("POST /mirror/promote", s.adminOnly(s.handlePromote))
+	mux.HandleFunc("GET /replica", s.adminOnly(s.handleReplica))
+	mux.HandleFunc("POST /topics/{name}/replay", s.adminOnly(s.handleReplayTopic))
+	mux.HandleFunc("POST /topics/{name}/republish", s.adminOnly(s.handleRepublish))
+	mux.HandleFunc("GET /retention", s.adminOnly(s.handleRetention))
+	mux.HandleFunc("POST /retention", s.adminOnly(s.handleApplyRetention))
+	mux.HandleFunc("GET /groups", s.adminOnly(s.handleGroups))
+	mux.HandleFunc("GET /quarantine", s.adminOnly(s.handleQuarantine))
+	mux.HandleFunc("GET /snapshots", s.adminOnly(s.handleSnapshotsList))
+	mux.HandleFunc("PUT /snapshots/{name}", s.adminOnly(s.handleSnapshotCreate))
+	mux.HandleFunc("POST /snapshots/{name}/restore", s.adminOnly(s.handleSnapshotRestore))
+
+	if s.debugEndpoints {
+		s.registerDebugEndpoints(mux)
+	}
+
+	return mux
+}
+
 func (s *Server) handleStats(w http.ResponseWriter, _ *http.Request) {
 	stats := statistics{
-		Connections: connections{},
+		Connections: connections{Accepted: s.connIDs.Load()},
 		Topics:      make(map[string]topicDetail),
+		Maintenance: s.maintenance.stats(),
+	}
+
+	if storage, err := s.storageStats(); err != nil {
+		s.logger().Warn("cannot read storage stats", "err", err)
+	} else {
+		stats.Storage = &storage
 	}
 
 	conns := make(map[net.Conn]bool)
 
-	for topic, clients := range s.clients {
+	for topic, clients := range s.topicsClients() {
 		for _, c := range clients {
 			_, ok := conns[c.conn]
 			if !ok {
@@ -58,22 +163,62 @@ func (s *Server) handleStats(w http.ResponseWriter, _ *http.Request) {
 
 		_, ok := stats.Topics[topic.Name]
 		if !ok {
-			sentMsgs := s.sentMessages[topic]
-
 			stats.Topics[topic.Name] = topicDetail{
-				Subscribers:  len(clients),
-				MessagesSent: sentMsgs.Load(),
+				Mode:               s.modeOf(topic),
+				Subscribers:        len(clients),
+				MessagesSent:       s.sentCount(topic),
+				DurableSubscribers: s.durableSubscribers(topic),
+				Deliveries:         s.subscriberDeliveries(topic, clients),
+				Publishers:         s.topicPublishers(topic),
 			}
 		}
 	}
 
-	if err := json.NewEncoder(w).Encode(&stats); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	pending, err := s.DB.PendingStats()
+	if err != nil {
+		s.logger().Warn("cannot read pending stats", "err", err)
+	}
+
+	stats.Attempts = make(map[int]int)
+	for topic, p := range pending {
+		detail, ok := stats.Topics[topic.Name]
+		if !ok {
+			detail = topicDetail{Mode: s.modeOf(topic), MessagesSent: s.sentCount(topic), DurableSubscribers: s.durableSubscribers(topic)}
+		}
+		detail.Pending = p.Pending
+		detail.DeadLettered = p.DeadLettered
+		stats.Topics[topic.Name] = detail
+
+		stats.DeadLettered += p.DeadLettered
+		for attempts, n := range p.Attempts {
+			stats.Attempts[attempts] += n
+		}
+	}
+
+	offsets, err := s.GroupOffsets()
+	if err != nil {
+		s.logger().Warn("cannot read group offsets", "err", err)
+	}
+
+	for _, o := range offsets {
+		detail, ok := stats.Topics[o.Topic]
+		if !ok {
+			continue
+		}
+		detail.Groups = append(detail.Groups, o)
+		detail.Lag = max(detail.Lag, o.Lag)
+		stats.Topics[o.Topic] = detail
+	}
+
+	if s.rateLimiter != nil {
+		stats.RateLimiter = &rateLimiterStats{Queued: len(s.rateLimiter.queue), Capacity: cap(s.rateLimiter.queue)}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(&stats); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
 
 func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
@@ -92,16 +237,80 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) handleConnectionsList(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(s.Connections()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
 func (s *Server) incSentMessages(topic Topic) {
+	s.sentMu.Lock()
 	val, ok := s.sentMessages[topic]
-	if ok {
-		val.Add(1)
-		return
+	if !ok {
+		val = &atomic.Int32{}
+		s.sentMessages[topic] = val
 	}
+	s.sentMu.Unlock()
+
+	val.Add(1)
+}
+
+// Delivered is how many times the messages of the topic were written to a subscriber, a
+// message sent to two subscribers counts twice.
+func (s *Server) Delivered(topic Topic) int {
+	return int(s.sentCount(topic))
+}
+
+// sentCount is 0 for the topics nothing was sent to yet.
+func (s *Server) sentCount(topic Topic) int32 {
+	s.sentMu.Lock()
+	defer s.sentMu.Unlock()
+
+	if val, ok := s.sentMessages[topic]; ok {
+		return val.Load()
+	}
+
+	return 0
+}
+
+func (s *Server) subscriberDeliveries(topic Topic, clients []Client) []subscriberDeliveries {
+	deliveries := make([]subscriberDeliveries, 0, len(clients))
+	for _, c := range clients {
+		cc, ok := s.lookupClientConn(c.conn)
+		if !ok {
+			continue
+		}
+
+		deliveries = append(deliveries, subscriberDeliveries{
+			ConnectionID: cc.id,
+			Subscriber:   c.subscriber,
+			Client:       cc.clientName(),
+			Delivered:    cc.deliveriesOf(topic),
+		})
+	}
+
+	return deliveries
+}
+
+// topicPublishers lists the connections that published to the topic, busiest first.
+func (s *Server) topicPublishers(topic Topic) []topicPublisher {
+	s.connsMu.Lock()
+	var publishers []topicPublisher
+	for _, cc := range s.conns {
+		if n := cc.publishedOf(topic); n > 0 {
+			publishers = append(publishers, topicPublisher{ConnectionID: cc.id, Client: cc.clientName(), Published: n})
+		}
+	}
+	s.connsMu.Unlock()
+
+	sort.Slice(publishers, func(i, j int) bool {
+		return publishers[i].Published > publishers[j].Published
+	})
 
-	var newVal = &atomic.Int32{}
-	newVal.Add(1)
-	s.sentMessages[topic] = newVal
+	return publishers
 }
 
 func (s *Server) ShutdownWebServer() error {
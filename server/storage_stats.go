@@ -0,0 +1,179 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// StorageStats describe what the store holds, for capacity planning.
+type StorageStats struct {
+	// LSMBytes and VLogBytes are the Badger sizes on disk, 0 for stores without them.
+	LSMBytes  int64 `json:"lsm_bytes"`
+	VLogBytes int64 `json:"vlog_bytes"`
+	// Keys counts the keys by prefix, e.g. "topic/", "pending/", "cursor/".
+	Keys    map[string]int `json:"keys"`
+	Pending int            `json:"pending_messages"`
+	Acked   int            `json:"acked_messages"`
+	LastGC  time.Time      `json:"last_gc,omitzero"`
+}
+
+// keyGroup is the prefix a key is counted under, up to the first "/".
+func keyGroup(key string) string {
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		return key[:i+1]
+	}
+
+	return "other"
+}
+
+func (b BadgerDB) StorageStats() (StorageStats, error) {
+	stats := StorageStats{Keys: make(map[string]int)}
+	stats.LSMBytes, stats.VLogBytes = b.DB.Size()
+
+	err := b.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			stats.Keys[keyGroup(string(it.Item().Key()))]++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return StorageStats{}, err
+	}
+
+	// every message lives under topic/, the unacked ones also have a pending/ entry.
+	stats.Pending = stats.Keys[pendingPrefix]
+	stats.Acked = max(stats.Keys[messagePrefix]-stats.Pending, 0)
+
+	return stats, nil
+}
+
+func (m *MemoryStore) StorageStats() (StorageStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := StorageStats{Keys: map[string]int{
+		"messages":   len(m.messages),
+		"sequences":  len(m.seqs),
+		"cursors":    len(m.cursors),
+		"deliveries": len(m.deliveries),
+		"topics":     len(m.topics),
+		"audit":      len(m.audit),
+	}}
+
+	for key, msg := range m.messages {
+		if strings.HasPrefix(key, MsgPrefixFalse) && !msg.ACK() {
+			stats.Pending++
+			continue
+		}
+		stats.Acked++
+	}
+
+	return stats, nil
+}
+
+// storageStats adds the last GC run of the maintenance job to the store figures.
+func (s *Server) storageStats() (StorageStats, error) {
+	stats, err := s.DB.StorageStats()
+	if err != nil {
+		return StorageStats{}, err
+	}
+
+	if ts := s.maintenance.lastRun.Load(); ts > 0 {
+		stats.LastGC = time.Unix(0, ts)
+	}
+
+	return stats, nil
+}
+
+// maxDeliveryAttempts is how many times a message is delivered before the scheduler gives
+// up on it. The pending messages past it are the dead letters, kept until acked or purged.
+const maxDeliveryAttempts = 3
+
+// PendingStats describe the unacked messages of a topic.
+type PendingStats struct {
+	Pending int `json:"pending"`
+	// DeadLettered are the pending messages out of delivery attempts.
+	DeadLettered int `json:"dead_lettered"`
+	// Attempts counts the pending messages by delivery attempts.
+	Attempts map[int]int `json:"attempts"`
+}
+
+func (p *PendingStats) add(message Message) {
+	if p.Attempts == nil {
+		p.Attempts = make(map[int]int)
+	}
+
+	p.Pending++
+	p.Attempts[message.Attempts()]++
+	if message.Attempts() >= maxDeliveryAttempts {
+		p.DeadLettered++
+	}
+}
+
+func (b BadgerDB) PendingStats() (map[Topic]PendingStats, error) {
+	stats := make(map[Topic]PendingStats)
+	err := b.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(pendingPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			item, err := txn.Get(key)
+			if err != nil {
+				continue
+			}
+
+			var msg Message
+			if err = item.Value(func(v []byte) error {
+				msg, err = decodeRecord(v)
+				return err
+			}); err != nil {
+				// left to PendingMessages to quarantine.
+				continue
+			}
+
+			p := stats[msg.Topic()]
+			p.add(msg)
+			stats[msg.Topic()] = p
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (m *MemoryStore) PendingStats() (map[Topic]PendingStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	stats := make(map[Topic]PendingStats)
+	for key, msg := range m.messages {
+		if !strings.HasPrefix(key, MsgPrefixFalse) || msg.ACK() || msg.expired(now) {
+			continue
+		}
+
+		p := stats[msg.Topic()]
+		p.add(msg)
+		stats[msg.Topic()] = p
+	}
+
+	return stats, nil
+}
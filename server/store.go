@@ -0,0 +1,129 @@
+package server
+
+import (
+	"io"
+	"time"
+)
+
+// Store is the persistence used by the broker. BadgerDB is the default implementation,
+// Config.Store plugs a different backend.
+type Store interface {
+	// SaveMessage stores a message not yet delivered, its ID starts with MsgPrefixFalse.
+	SaveMessage(message Message, format MessageFormat) error
+	// SaveBatch stores several messages at once, a message already acked is not stored again.
+	SaveBatch(batch []SaveRequest) error
+	// Ack moves a delivered message out of the pending ones.
+	Ack(message Message) error
+	// CommitTxn acks the messages and stores the batch in a single transaction, nothing is
+	// done and errTxnConflict is returned when one of the messages was acked already.
+	CommitTxn(acks []Message, batch []SaveRequest) error
+	// RecordPublish remembers the id published on the topic at seq for window, a publish of
+	// an id remembered already returns the seq of the first one and true.
+	RecordPublish(topic Topic, id string, seq uint64, window time.Duration) (uint64, bool, error)
+	// ForgetPublish drops the id recorded by RecordPublish, for a publish rejected after it.
+	ForgetPublish(topic Topic, id string) error
+	// PendingMessages returns the messages that should be delivered again.
+	PendingMessages() ([]Message, error)
+	// Delete removes the stored message, pending or acked.
+	Delete(message Message) error
+	// StoredItems dumps the stored messages for the metrics endpoint.
+	StoredItems() ([]StoredItem, error)
+
+	// NextSeq returns the next position of the topic, starting at 1.
+	NextSeq(topic Topic) (uint64, error)
+	// LatestSeq returns the last position handed out, without taking a new one.
+	LatestSeq(topic Topic) (uint64, error)
+	// MessagesAfter returns the stored messages of the topic after seq, in order.
+	MessagesAfter(topic Topic, seq uint64) ([]Message, error)
+	// IndexAttributes records the message under each header value of attrs, for as long as the
+	// message lives.
+	IndexAttributes(message Message, attrs map[string]string) error
+	// DropAttributes removes the entries of the message recorded by IndexAttributes.
+	DropAttributes(message Message, attrs map[string]string) error
+	// SearchAttribute returns up to limit stored messages of any topic indexed with the header
+	// value, 0 for all of them.
+	SearchAttribute(name, value string, limit int) ([]Message, error)
+	LoadCursor(topic Topic, subscriber string) (uint64, error)
+	// AdvanceCursor records a seq acked by a durable subscriber, its cursor moves forward across
+	// the acked prefix only.
+	AdvanceCursor(topic Topic, subscriber string, seq uint64) error
+
+	SaveTopic(topic Topic) error
+	// SaveSubscriber registers a durable subscriber of the topic, and the topic itself.
+	SaveSubscriber(topic Topic, subscriber string) error
+	// Topics returns the registered topics with the names of their durable subscribers.
+	Topics() (map[Topic][]string, error)
+	// SaveTopicOptions keeps the options of a registered topic across restarts.
+	SaveTopicOptions(topic Topic, opts TopicOptions) error
+	// SavedTopicOptions returns the options saved by SaveTopicOptions.
+	SavedTopicOptions() (map[Topic]TopicOptions, error)
+	// DeleteTopic removes the topic with its messages, durable subscribers and cursors.
+	DeleteTopic(topic Topic) (PurgeResult, error)
+
+	// SaveSchedule registers a recurring publication, replacing the one of the same name.
+	SaveSchedule(schedule Schedule) error
+	// Schedules returns the registered schedules, sorted by name.
+	Schedules() ([]Schedule, error)
+	// DeleteSchedule removes the schedule, errScheduleNotFound when there is none of that name.
+	DeleteSchedule(name string) error
+	// SaveSchema stores a new version of the schema of a topic.
+	SaveSchema(schema TopicSchema) error
+	// Schemas returns every version of every topic schema, sorted by topic and version.
+	Schemas() ([]TopicSchema, error)
+	// DeleteSchemas removes the versions of the schema of the topic, errSchemaNotFound when
+	// it has none.
+	DeleteSchemas(topic string) error
+
+	// TrackDelivery records the message handed to the recipient, a durable subscriber name or
+	// a connection, see recipient.
+	TrackDelivery(messageID, recipient string) error
+	UntrackDelivery(messageID, recipient string) error
+	// AckDelivery marks one recipient delivery as acked, returning the acked and total deliveries.
+	// A recipient without a record gets errDeliveryNotTracked.
+	AckDelivery(messageID, recipient string) (acked, total int, err error)
+	ClearDeliveries(messageID string) error
+
+	AppendAudit(entry AuditEntry) error
+	// AuditEntries returns up to limit entries, newest first, optionally filtered by action.
+	AuditEntries(limit int, action string) ([]AuditEntry, error)
+
+	// Probe writes to the store and reads it back, reporting whether it is usable.
+	Probe() error
+
+	// SaveCounters checkpoints the running totals of the broker, LoadCounters reads them back.
+	SaveCounters(counters Counters) error
+	LoadCounters() (Counters, error)
+
+	// AppendTrace records a step in the life of a message, dropped after ttl.
+	AppendTrace(messageID string, event TraceEvent, ttl time.Duration) error
+	// Trace returns the recorded steps of the message, oldest first.
+	Trace(messageID string) ([]TraceEvent, error)
+
+	// DeleteAckedBefore removes the acked messages published before cutoff, returning how many.
+	DeleteAckedBefore(cutoff time.Time) (int, error)
+	// PurgeTopic removes the messages of the topic published before cutoff, pending or acked.
+	PurgeTopic(topic Topic, cutoff time.Time) (PurgeResult, error)
+	// CollectGarbage reclaims the space of deleted records, returning the bytes freed.
+	CollectGarbage() (int64, error)
+
+	// Quarantined returns how many records failed to decode and up to limit of them.
+	Quarantined(limit int) (int, []QuarantinedRecord, error)
+
+	// StorageStats returns the sizes and key counts of the store.
+	StorageStats() (StorageStats, error)
+	// PendingStats returns the unacked messages of every topic by delivery attempts.
+	PendingStats() (map[Topic]PendingStats, error)
+
+	// Backup writes a full snapshot of the store, Restore loads one back.
+	Backup(w io.Writer) error
+	// BackupSince writes what changed since the version, returning the one to ask for next. A
+	// store without versions writes all of it, returning 0.
+	BackupSince(w io.Writer, since uint64) (uint64, error)
+	Restore(r io.Reader) error
+
+	// Sync flushes the written data to disk.
+	Sync() error
+	Close() error
+}
+
+var _ Store = BadgerDB{}
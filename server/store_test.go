@@ -0,0 +1,1019 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+func Test_StoreContract(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	stores := map[string]Store{
+		"badger": BadgerDB{DB: db},
+		"memory": NewMemoryStore(0),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testStoreContract(t, store)
+		})
+	}
+}
+
+func testStoreContract(t *testing.T, store Store) {
+	t.Helper()
+
+	topic := NewTopic("orders")
+	seq, err := store.NextSeq(topic)
+	if err != nil || seq != 1 {
+		t.Fatalf("expected first seq 1, got %d %v", seq, err)
+	}
+
+	msg := NewMessageBuilder().
+		WithID("false-1").
+		WithNextID("1").
+		WithType(MessageTypeNew).
+		WithTopic(topic).
+		WithBody([]byte(`{"value":1}`)).
+		WithSeq(seq).
+		Build()
+
+	if err = store.SaveMessage(msg, FormatJSON); err != nil {
+		t.Fatalf("cannot save %v", err)
+	}
+
+	pending, err := store.PendingMessages()
+	if err != nil || len(pending) != 1 || pending[0].ID() != msg.ID() {
+		t.Fatalf("expected the saved message pending, got %v %v", pending, err)
+	}
+
+	if stats, errStats := store.StorageStats(); errStats != nil || stats.Pending != 1 || stats.Acked != 0 {
+		t.Fatalf("expected one pending message in the stats, got %+v %v", stats, errStats)
+	}
+
+	after, err := store.MessagesAfter(topic, 0)
+	if err != nil || len(after) != 1 || after[0].Seq() != seq {
+		t.Fatalf("expected the saved message after 0, got %v %v", after, err)
+	}
+
+	if err = store.Ack(msg); err != nil {
+		t.Fatalf("cannot ack %v", err)
+	}
+
+	pending, err = store.PendingMessages()
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("expected nothing pending after ack, got %v %v", pending, err)
+	}
+
+	// a save landing after the ACK, from a write-behind batch or a second subscriber.
+	if err = store.SaveBatch([]SaveRequest{{Message: msg, Format: FormatJSON}}); err != nil {
+		t.Fatalf("cannot save %v", err)
+	}
+	if pending, _ = store.PendingMessages(); len(pending) != 0 {
+		t.Fatalf("expected an acked message to stay acked, got %v", pending)
+	}
+
+	if deleted, errDelete := store.DeleteAckedBefore(time.Now().Add(time.Hour)); errDelete != nil || deleted != 1 {
+		t.Fatalf("expected the acked message deleted, got %d %v", deleted, errDelete)
+	}
+
+	if err = store.AdvanceCursor(topic, "billing", 5); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = store.AdvanceCursor(topic, "billing", 3); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if cursor, _ := store.LoadCursor(topic, "billing"); cursor != 5 {
+		t.Fatalf("expected the cursor to stay at 5, got %d", cursor)
+	}
+
+	// an ACK coming before the one of an older message leaves the cursor before the older one.
+	payments := NewTopic("payments")
+	var paid []Message
+	for _, id := range []string{"1", "2"} {
+		pseq, _ := store.NextSeq(payments)
+		paid = append(paid, NewMessageBuilder().WithID("false-p"+id).WithNextID("p"+id).WithTopic(payments).WithSeq(pseq).Build())
+		_ = store.SaveMessage(paid[len(paid)-1], FormatJSON)
+	}
+	_ = store.AdvanceCursor(payments, "billing", 2)
+	if cursor, _ := store.LoadCursor(payments, "billing"); cursor != 0 {
+		t.Fatalf("expected the cursor held by the unacked seq 1, got %d", cursor)
+	}
+	_ = store.AdvanceCursor(payments, "billing", 1)
+	if cursor, _ := store.LoadCursor(payments, "billing"); cursor != 2 {
+		t.Fatalf("expected the cursor past both acks, got %d", cursor)
+	}
+	for _, m := range paid {
+		_ = store.Ack(m)
+	}
+
+	_ = store.TrackDelivery("m", "conn/1")
+	_ = store.TrackDelivery("m", "sub/billing")
+	if acked, total, _ := store.AckDelivery("m", "conn/1"); acked != 1 || total != 2 {
+		t.Fatalf("expected 1 of 2 acked, got %d of %d", acked, total)
+	}
+	if _, _, err = store.AckDelivery("m", "conn/2"); !errors.Is(err, errDeliveryNotTracked) {
+		t.Fatalf("expected the ACK of an untracked delivery rejected, got %v", err)
+	}
+	if acked, total, _ := store.AckDelivery("m", "sub/billing"); acked != 2 || total != 2 {
+		t.Fatalf("expected 2 of 2 acked, got %d of %d", acked, total)
+	}
+
+	// a transaction acks its input and stores its output at once, or does nothing.
+	seq, _ = store.NextSeq(topic)
+	input := NewMessageBuilder().WithID("false-2").WithNextID("2").WithType(MessageTypeNew).WithTopic(topic).WithBody([]byte(`{"value":2}`)).WithSeq(seq).Build()
+	if err = store.SaveMessage(input, FormatJSON); err != nil {
+		t.Fatalf("cannot save %v", err)
+	}
+
+	invoices := NewTopic("invoices")
+	output := func(id string) SaveRequest {
+		seq, _ := store.NextSeq(invoices)
+		m := NewMessageBuilder().WithID("false-" + id).WithNextID(id).WithType(MessageTypeNew).WithTopic(invoices).WithBody([]byte(`{"order":2}`)).WithSeq(seq).Build()
+		return SaveRequest{Message: m, Format: FormatJSON}
+	}
+	if err = store.CommitTxn([]Message{input}, []SaveRequest{output("3")}); err != nil {
+		t.Fatalf("cannot commit %v", err)
+	}
+	if err = store.CommitTxn([]Message{input}, []SaveRequest{output("4")}); !errors.Is(err, errTxnConflict) {
+		t.Fatalf("expected a conflict committing an acked input again, got %v", err)
+	}
+	if pending, _ = store.PendingMessages(); len(pending) != 1 || pending[0].ID() != "false-3" {
+		t.Fatalf("expected only the output of the first commit pending, got %v", pending)
+	}
+
+	if seq, duplicate, errDedup := store.RecordPublish(invoices, "false-5", 5, time.Minute); errDedup != nil || duplicate || seq != 5 {
+		t.Fatalf("expected a first publish recorded, got %d %v %v", seq, duplicate, errDedup)
+	}
+	if seq, duplicate, errDedup := store.RecordPublish(invoices, "false-5", 6, time.Minute); errDedup != nil || !duplicate || seq != 5 {
+		t.Fatalf("expected the publish seen at seq 5, got %d %v %v", seq, duplicate, errDedup)
+	}
+	if _, duplicate, _ := store.RecordPublish(topic, "false-5", 7, time.Minute); duplicate {
+		t.Fatal("expected the id of another topic to be a new publish")
+	}
+	_ = store.ForgetPublish(invoices, "false-5")
+	if _, duplicate, _ := store.RecordPublish(invoices, "false-5", 8, time.Minute); duplicate {
+		t.Fatal("expected a forgotten publish to be a new one")
+	}
+}
+
+func Test_BackupRestore(t *testing.T) {
+	fresh := map[string]func() Store{
+		"badger": func() Store {
+			db, err := NewBadger("", true)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			return BadgerDB{DB: db}
+		},
+		"memory": func() Store { return NewMemoryStore(0) },
+	}
+
+	for name, newStore := range fresh {
+		t.Run(name, func(t *testing.T) {
+			source := newStore()
+			msg := NewMessageBuilder().WithID("false-1").WithNextID("1").WithTopic(NewTopic("orders")).Build()
+			_ = source.SaveMessage(msg, FormatJSON)
+			// the seqs before 3 of invoices hold no message, nothing keeps the cursor back.
+			_ = source.AdvanceCursor(NewTopic("invoices"), "billing", 3)
+
+			var buf bytes.Buffer
+			if err := source.Backup(&buf); err != nil {
+				t.Fatalf("cannot backup %v", err)
+			}
+
+			target := newStore()
+			if err := target.Restore(&buf); err != nil {
+				t.Fatalf("cannot restore %v", err)
+			}
+
+			pending, _ := target.PendingMessages()
+			if len(pending) != 1 || pending[0].ID() != msg.ID() {
+				t.Fatalf("expected the pending message restored, got %v", pending)
+			}
+
+			if cursor, _ := target.LoadCursor(NewTopic("invoices"), "billing"); cursor != 3 {
+				t.Fatalf("expected the cursor restored, got %d", cursor)
+			}
+		})
+	}
+}
+
+func Test_MigrateKeys(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	store := BadgerDB{DB: db}
+
+	topic := NewTopic("orders")
+	legacy := map[string]Message{
+		"false-1": NewMessageBuilder().WithID("false-1").WithNextID("1").WithTopic(topic).WithTimestamp(1).Build(),
+		"2":       NewMessageBuilder().WithID("2").WithNextID("2").WithTopic(topic).WithTimestamp(2).WithAck(true).Build(),
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		for key, msg := range legacy {
+			b, _ := msg.Marshall()
+			if err := txn.Set([]byte(key), b); err != nil {
+				return err
+			}
+		}
+		return txn.Set([]byte(legacySeqIndexPrefix+"orders/1"), []byte("false-1"))
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if moved, errMigrate := store.MigrateKeys(); errMigrate != nil || moved != 2 {
+		t.Fatalf("expected 2 messages moved, got %d %v", moved, errMigrate)
+	}
+	if moved, _ := store.MigrateKeys(); moved != 0 {
+		t.Fatalf("expected a second run to move nothing, got %d", moved)
+	}
+
+	after, err := store.MessagesAfter(topic, 0)
+	if err != nil || len(after) != 2 || after[0].ID() != "false-1" || after[1].Seq() != 2 {
+		t.Fatalf("expected both messages in publish order, got %v %v", after, err)
+	}
+
+	pending, err := store.PendingMessages()
+	if err != nil || len(pending) != 1 || pending[0].ID() != "false-1" {
+		t.Fatalf("expected the unacked message pending, got %v %v", pending, err)
+	}
+
+	items, _ := store.StoredItems()
+	for _, item := range items {
+		if !strings.HasPrefix(item.Key, messagePrefix) {
+			t.Fatalf("unexpected key left behind %s", item.Key)
+		}
+	}
+}
+
+func Test_MigrateLegacyRecords(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	store := BadgerDB{DB: db}
+
+	// as the old queuety/server wrote them, Body was a []byte.
+	legacy := map[string]string{
+		"false-a1": `{"ID":"false-a1","NextID":"a1","Type":"NEW_MESSAGE","User":"","Password":"","Topic":{"Name":"orders"},"Body":"eyJuIjoxfQ==","BodyString":"{\"n\":1}","Timestamp":10,"ACK":false,"Attempts":1}`,
+		"b2":       `{"ID":"b2","NextID":"b2","Type":"NEW_MESSAGE","User":"","Password":"","Topic":{"Name":"orders"},"Body":"eyJuIjoyfQ==","BodyString":"{\"n\":2}","Timestamp":20,"ACK":true,"Attempts":0}`,
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		for key, v := range legacy {
+			if err := txn.Set([]byte(key), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err = store.Migrate(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	pending, err := store.PendingMessages()
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("expected the undelivered message pending, got %v %v", pending, err)
+	}
+	// fetching the pending messages counts the coming attempt.
+	if m := pending[0]; m.ID() != "false-a1" || m.NextID() != "a1" || m.BodyString() != `{"n":1}` || m.Attempts() != 2 || m.Seq() != 1 {
+		t.Fatalf("unexpected migrated message %+v", m)
+	}
+
+	after, err := store.MessagesAfter(NewTopic("orders"), 0)
+	if err != nil || len(after) != 2 || string(after[1].Body()) != `{"n":2}` || !after[1].ACK() {
+		t.Fatalf("expected both messages in the topic, got %v %v", after, err)
+	}
+}
+
+func Test_TopicsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{Protocol: "tcp", Port: ":0", WebServerPort: ":1", BadgerPath: dir}
+
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	srv.addNewTopic("orders")
+	srv.registerSubscriber(NewTopic("orders"), "billing")
+	srv.CreateTopic("job", TopicOptions{AutoDeleteAfter: 30})
+	if err = srv.DB.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	srv, err = NewServer(cfg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer srv.DB.Close()
+
+	if _, ok := srv.clients[NewTopic("orders")]; !ok {
+		t.Fatal("expected the topic reloaded")
+	}
+	if subscribers := srv.durableTopics[NewTopic("orders")]; len(subscribers) != 1 || subscribers[0] != "billing" {
+		t.Fatalf("expected the durable subscriber reloaded, got %v", subscribers)
+	}
+	if d := srv.autoDeleteOf(NewTopic("job")); d != 30*time.Second {
+		t.Fatalf("expected the auto delete period reloaded, got %s", d)
+	}
+	if err = srv.sendNewMessage(NewMessageBuilder().WithTopic(NewTopic("orders")).Build()); err != nil {
+		t.Fatalf("expected publishes to a reloaded topic accepted, got %v", err)
+	}
+}
+
+func Test_BadgerTTL(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	store := BadgerDB{DB: db}
+
+	topic := NewTopic("orders")
+	msg := NewMessageBuilder().
+		WithID("false-1").
+		WithNextID("1").
+		WithTopic(topic).
+		WithSeq(1).
+		WithTTL(time.Hour).
+		Build()
+	if err = store.SaveMessage(msg, FormatJSON); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ack := NewMessageBuilder().WithID("false-1").WithNextID("1").WithTopic(topic).WithSeq(1).Build()
+	if err = store.Ack(ack); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	err = db.View(func(txn *badger.Txn) error {
+		item, errGet := txn.Get(messageKey(topic, 1))
+		if errGet != nil {
+			return errGet
+		}
+		if item.ExpiresAt() == 0 {
+			t.Fatal("expected the acked message to keep its expiry")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func Test_PurgeTopic(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for name, store := range map[string]Store{"badger": BadgerDB{DB: db}, "memory": NewMemoryStore(0)} {
+		t.Run(name, func(t *testing.T) {
+			orders, other := NewTopic("orders"), NewTopic("orders/eu")
+			for i, topic := range []Topic{orders, orders, other} {
+				msg := NewMessageBuilder().
+					WithID(fmt.Sprintf("false-%d", i)).
+					WithNextID(strconv.Itoa(i)).
+					WithTopic(topic).
+					WithTimestamp(int64(100 * (i + 1))).
+					WithSeq(uint64(i + 1)).
+					Build()
+				if err := store.SaveMessage(msg, FormatJSON); err != nil {
+					t.Fatalf("%v", err)
+				}
+			}
+
+			result, err := store.PurgeTopic(orders, time.Unix(150, 0))
+			if err != nil || result.Messages != 1 || result.Bytes == 0 {
+				t.Fatalf("expected one message purged, got %+v %v", result, err)
+			}
+
+			if left, _ := store.MessagesAfter(orders, 0); len(left) != 1 || left[0].Seq() != 2 {
+				t.Fatalf("expected the newer message kept, got %v", left)
+			}
+			if left, _ := store.MessagesAfter(other, 0); len(left) != 1 {
+				t.Fatalf("expected the other topic untouched, got %v", left)
+			}
+			if pending, _ := store.PendingMessages(); len(pending) != 2 {
+				t.Fatalf("expected the purged message gone from pending, got %v", pending)
+			}
+		})
+	}
+}
+
+func Test_SnapshotIntoFreshBroker(t *testing.T) {
+	cfg := Config{Protocol: "tcp", Port: ":0", WebServerPort: ":1", InMemoryData: true, SnapshotDir: t.TempDir()}
+
+	source, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	source.addNewTopic("orders")
+	msg := NewMessageBuilder().WithID("false-1").WithNextID("1").WithTopic(NewTopic("orders")).WithSeq(1).Build()
+	if err = source.DB.SaveMessage(msg, FormatJSON); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if _, err = source.CreateSnapshot("drill"); err != nil {
+		t.Fatalf("cannot snapshot %v", err)
+	}
+	if _, err = source.CreateSnapshot("../escape"); err == nil {
+		t.Fatal("expected an invalid name rejected")
+	}
+
+	cfg.RestoreSnapshot = "drill"
+	target, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("cannot restore %v", err)
+	}
+
+	if _, ok := target.clients[NewTopic("orders")]; !ok {
+		t.Fatal("expected the topic restored")
+	}
+	if pending, _ := target.DB.PendingMessages(); len(pending) != 1 {
+		t.Fatalf("expected the message restored, got %v", pending)
+	}
+	if snapshots, _ := target.Snapshots(); len(snapshots) != 1 || snapshots[0].Name != "drill" {
+		t.Fatalf("expected the snapshot listed, got %v", snapshots)
+	}
+}
+
+func Test_StandbyMirrorsPrimary(t *testing.T) {
+	badgerStore := func() Store {
+		db, err := NewBadger("", true)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return BadgerDB{DB: db}
+	}
+	cfg := Config{Protocol: "tcp", Port: ":0", WebServerPort: ":1", Store: badgerStore()}
+
+	primary, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	primary.addNewTopic("orders")
+	first := NewMessageBuilder().WithID("false-1").WithNextID("1").WithTopic(NewTopic("orders")).WithSeq(1).Build()
+	second := NewMessageBuilder().WithID("false-2").WithNextID("2").WithTopic(NewTopic("orders")).WithSeq(2).Build()
+	_ = primary.DB.SaveBatch([]SaveRequest{{Message: first, Format: FormatJSON}, {Message: second, Format: FormatJSON}})
+
+	web := httptest.NewServer(http.HandlerFunc(primary.handleBackup))
+	defer web.Close()
+
+	cfg.Store, cfg.Mirror = badgerStore(), &MirrorConfig{Primary: web.URL}
+	standby, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err = standby.mirror.pull(standby); err != nil {
+		t.Fatalf("cannot pull %v", err)
+	}
+	if pending, _ := standby.DB.PendingMessages(); len(pending) != 2 {
+		t.Fatalf("expected both messages mirrored, got %v", pending)
+	}
+
+	// an incremental pull carries the deletes, the acked message is not redelivered after a promotion.
+	version := standby.MirrorStatus().Version
+	_ = primary.DB.Ack(first)
+	if err = standby.mirror.pull(standby); err != nil {
+		t.Fatalf("cannot pull %v", err)
+	}
+	if pending, _ := standby.DB.PendingMessages(); len(pending) != 1 || pending[0].ID() != second.ID() {
+		t.Fatalf("expected the ack mirrored, got %v", pending)
+	}
+	if st := standby.MirrorStatus(); !st.Standby || st.Version <= version {
+		t.Fatalf("expected the version to move on, got %+v after %d", st, version)
+	}
+
+	if err = standby.Promote(); err != nil {
+		t.Fatalf("cannot promote %v", err)
+	}
+	if _, ok := standby.clients[NewTopic("orders")]; !ok || standby.mirror.isStandby() {
+		t.Fatal("expected the promoted broker to serve the mirrored topics")
+	}
+	if err = standby.Promote(); !errors.Is(err, errNotStandby) {
+		t.Fatalf("expected a second promotion rejected, got %v", err)
+	}
+}
+
+func Test_StandbyShutsDownWithoutPromotion(t *testing.T) {
+	primary := httptest.NewServer(http.NotFoundHandler())
+	defer primary.Close()
+
+	standby, err := NewServer(Config{
+		Protocol:      "tcp",
+		Port:          ":0",
+		WebServerPort: ":1",
+		InMemoryData:  true,
+		Mirror:        &MirrorConfig{Primary: primary.URL, Interval: time.Hour},
+		Archive:       &ArchiveConfig{Store: DirObjectStore{Root: t.TempDir()}},
+		Sinks:         []SinkConfig{{Store: DirObjectStore{Root: t.TempDir()}}},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- standby.Serve(l) }()
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		stopped <- standby.Shutdown(ctx)
+	}()
+
+	select {
+	case err = <-stopped:
+		if err != nil {
+			t.Fatalf("cannot shut down %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a standby never promoted to shut down")
+	}
+	<-served
+
+	// closed again, nothing is stopped twice.
+	if err = standby.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func Test_GroupOffsets(t *testing.T) {
+	srv := Server{DB: NewMemoryStore(0)}
+	topic := NewTopic("orders")
+	srv.registerSubscriber(topic, "billing")
+
+	for range 5 {
+		_, _ = srv.DB.NextSeq(topic)
+	}
+	_ = srv.DB.AdvanceCursor(topic, "billing", 2)
+
+	offsets, err := srv.GroupOffsets()
+	if err != nil || len(offsets) != 1 {
+		t.Fatalf("expected one group, got %v %v", offsets, err)
+	}
+	if o := offsets[0]; o.Group != "billing" || o.Committed != 2 || o.Latest != 5 || o.Lag != 3 {
+		t.Fatalf("unexpected offset %+v", o)
+	}
+}
+
+func Test_RedeliveryDecodesEveryFormat(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	store := BadgerDB{DB: db}
+
+	topic := NewTopic("orders")
+	for i, format := range []MessageFormat{FormatJSON, FormatBinary} {
+		msg := NewMessageBuilder().
+			WithID(fmt.Sprintf("false-%d", i)).
+			WithNextID(strconv.Itoa(i)).
+			WithTopic(topic).
+			WithBody([]byte(`{"value":1}`)).
+			WithSeq(uint64(i + 1)).
+			Build()
+		if err = store.SaveMessage(msg, format); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// a record of an older version, bare JSON without the format flag.
+	legacy := NewMessageBuilder().WithID("false-2").WithNextID("2").WithTopic(topic).WithSeq(3).Build()
+	raw, _ := legacy.Marshall()
+	err = db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(messageKey(topic, 3), raw); err != nil {
+			return err
+		}
+		return txn.Set(pendingKey("false-2"), messageKey(topic, 3))
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	pending, err := store.PendingMessages()
+	if err != nil || len(pending) != 3 {
+		t.Fatalf("expected JSON, binary and legacy records pending, got %v %v", pending, err)
+	}
+	for _, msg := range pending {
+		if msg.Topic() != topic {
+			t.Fatalf("record decoded wrong %s", msg.String())
+		}
+	}
+
+	if after, _ := store.MessagesAfter(topic, 0); len(after) != 3 || string(after[1].Body()) != `{"value":1}` {
+		t.Fatalf("expected the binary record replayed, got %v", after)
+	}
+}
+
+func Test_QuarantineCorruptRecords(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	store := BadgerDB{DB: db}
+
+	topic := NewTopic("orders")
+	err = db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(messageKey(topic, 1), []byte{byte(FormatBinary), 0xff}); err != nil {
+			return err
+		}
+		return txn.Set(pendingKey("false-1"), messageKey(topic, 1))
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if pending, errPending := store.PendingMessages(); errPending != nil || len(pending) != 0 {
+		t.Fatalf("expected the corrupt record skipped, got %v %v", pending, errPending)
+	}
+
+	count, records, err := store.Quarantined(10)
+	if err != nil || count != 1 || records[0].Key != string(messageKey(topic, 1)) || records[0].Error == "" {
+		t.Fatalf("expected the record quarantined, got %d %v %v", count, records, err)
+	}
+	if keyExists(t, db, string(pendingKey("false-1"))) {
+		t.Fatal("expected the pending index entry removed")
+	}
+}
+
+func Test_TransientTopicSkipsStore(t *testing.T) {
+	srv, err := NewServer(Config{Protocol: "tcp", Port: ":0", WebServerPort: ":1", InMemoryData: true})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	opts, err := parseTopicOptions([]byte(`{"class":"transient"}`))
+	if err != nil || opts.Class != TopicTransient {
+		t.Fatalf("expected the transient class, got %v %v", opts, err)
+	}
+	if opts, err = parseTopicOptions([]byte(`{"class":"ephemeral"}`)); err != nil || opts.Class != TopicTransient {
+		t.Fatalf("expected ephemeral read as transient, got %v %v", opts, err)
+	}
+	if _, err = parseTopicOptions([]byte(`{"class":"forever"}`)); err == nil {
+		t.Fatal("expected an unknown class rejected")
+	}
+
+	topic := NewTopic("telemetry")
+	srv.addTransientTopic(topic.Name)
+
+	seq, _ := srv.nextSeq(topic)
+	msg := NewMessageBuilder().WithID("false-1").WithNextID("1").WithTopic(topic).WithSeq(seq).Build()
+	if err = srv.sendNewMessage(msg); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if pending, _ := srv.DB.PendingMessages(); len(pending) != 0 {
+		t.Fatalf("expected nothing stored for a transient topic, got %v", pending)
+	}
+	if latest, _ := srv.DB.LatestSeq(topic); latest != 0 {
+		t.Fatalf("expected the seq kept out of the store, got %d", latest)
+	}
+	if topics, _ := srv.DB.Topics(); len(topics) != 0 {
+		t.Fatalf("expected the topic not registered, got %v", topics)
+	}
+
+	// a named subscriber keeps no cursor, the topic goes away with it.
+	conn, peer := net.Pipe()
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+	srv.handleMessage(conn, []byte(`{"id":"1","type":"NEW_SUB","topic":{"name":"telemetry"},"subscriber":"billing"}`), FormatJSON)
+	if topics, _ := srv.DB.Topics(); len(topics) != 0 {
+		t.Fatalf("expected the subscriber not registered, got %v", topics)
+	}
+
+	srv.disconnect(conn)
+	if _, ok := srv.clients[topic]; ok || srv.isTransient(topic) {
+		t.Fatal("expected the topic gone with its last subscriber")
+	}
+}
+
+func Test_SchemaMigrations(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	store := BadgerDB{DB: db}
+
+	// a store of version 1, with no version key and flat message keys.
+	legacy := NewMessageBuilder().WithID("false-1").WithNextID("1").WithTopic(NewTopic("orders")).Build()
+	raw, _ := legacy.Marshall()
+	if err = db.Update(func(txn *badger.Txn) error { return txn.Set([]byte("false-1"), raw) }); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err = store.Migrate(); err != nil {
+		t.Fatalf("cannot migrate %v", err)
+	}
+	if version, _ := store.schemaVersion(); version != currentSchemaVersion {
+		t.Fatalf("expected version %d, got %d", currentSchemaVersion, version)
+	}
+	if after, _ := store.MessagesAfter(NewTopic("orders"), 0); len(after) != 1 {
+		t.Fatalf("expected the legacy message migrated, got %v", after)
+	}
+
+	if err = store.setSchemaVersion(currentSchemaVersion + 1); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = store.Migrate(); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected a newer schema refused, got %v", err)
+	}
+}
+
+func Test_PendingStats(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for name, store := range map[string]Store{"badger": BadgerDB{DB: db}, "memory": NewMemoryStore(0)} {
+		t.Run(name, func(t *testing.T) {
+			topic := NewTopic("stats")
+			for i, attempts := range []int{0, 0, maxDeliveryAttempts - 1} {
+				id := strconv.Itoa(i)
+				msg := NewMessageBuilder().WithID("false-" + id).WithNextID(id).WithTopic(topic).WithAttempts(attempts).Build()
+				if err := store.SaveMessage(msg, FormatJSON); err != nil {
+					t.Fatalf("cannot save %v", err)
+				}
+			}
+
+			stats, err := store.PendingStats()
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			p := stats[topic]
+			if p.Pending != 3 || p.DeadLettered != 1 || p.Attempts[1] != 2 || p.Attempts[maxDeliveryAttempts] != 1 {
+				t.Fatalf("unexpected pending stats %+v", p)
+			}
+		})
+	}
+}
+
+func Test_DeleteTopic(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for name, store := range map[string]Store{"badger": BadgerDB{DB: db}, "memory": NewMemoryStore(0)} {
+		t.Run(name, func(t *testing.T) {
+			topic, other := NewTopic("gone"), NewTopic("gone/kept")
+			for i, tp := range []Topic{topic, topic, other} {
+				id := strconv.Itoa(i)
+				seq, _ := store.NextSeq(tp)
+				msg := NewMessageBuilder().WithID("false-" + id).WithNextID(id).WithTopic(tp).WithSeq(seq).Build()
+				if err := store.SaveMessage(msg, FormatJSON); err != nil {
+					t.Fatalf("cannot save %v", err)
+				}
+			}
+			_ = store.SaveSubscriber(topic, "billing")
+			_ = store.AdvanceCursor(topic, "billing", 2)
+			_ = store.SaveSubscriber(other, "billing")
+
+			result, err := store.DeleteTopic(topic)
+			if err != nil || result.Messages != 2 {
+				t.Fatalf("expected 2 messages deleted, got %+v %v", result, err)
+			}
+
+			topics, _ := store.Topics()
+			if _, ok := topics[topic]; ok {
+				t.Fatalf("expected the topic unregistered, got %v", topics)
+			}
+			if _, ok := topics[other]; !ok {
+				t.Fatalf("expected %s to stay registered", other.Name)
+			}
+			if cursor, _ := store.LoadCursor(topic, "billing"); cursor != 0 {
+				t.Fatalf("expected the cursor deleted, got %d", cursor)
+			}
+			if pending, _ := store.PendingMessages(); len(pending) != 1 || pending[0].Topic() != other {
+				t.Fatalf("expected only the message of %s pending, got %v", other.Name, pending)
+			}
+		})
+	}
+}
+
+func Test_SearchIndexedHeaders(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for name, store := range map[string]Store{"badger": BadgerDB{DB: db}, "memory": NewMemoryStore(0)} {
+		t.Run(name, func(t *testing.T) {
+			srv := &Server{DB: store, indexedHeaders: []string{"tenant"}}
+			for i, tp := range []Topic{NewTopic("orders"), NewTopic("payments"), NewTopic("orders")} {
+				id := strconv.Itoa(i)
+				tenant := "acme/eu"
+				if i == 2 {
+					tenant = "acme"
+				}
+				seq, _ := store.NextSeq(tp)
+				msg := NewMessageBuilder().WithID("false-" + id).WithNextID(id).WithTopic(tp).WithSeq(seq).WithHeaders(map[string]string{"tenant": tenant}).Build()
+				srv.save(msg, FormatJSON)
+				srv.save(msg, FormatJSON)
+			}
+
+			found, err := srv.SearchMessages("tenant", "acme/eu", 0)
+			if err != nil || len(found) != 2 || found[0].Topic != "orders" || found[1].Topic != "payments" {
+				t.Fatalf("expected the messages of acme/eu on both topics once, got %+v %v", found, err)
+			}
+
+			if err = store.Delete(NewMessageBuilder().WithID("false-0").WithTopic(NewTopic("orders")).WithSeq(1).Build()); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if found, _ = srv.SearchMessages("tenant", "acme/eu", 0); len(found) != 1 || found[0].ID != "false-1" {
+				t.Fatalf("expected the deleted message skipped, got %+v", found)
+			}
+			if _, err = srv.SearchMessages("user", "ana", 0); err == nil {
+				t.Fatal("expected a header not indexed to be refused")
+			}
+		})
+	}
+}
+
+func Test_EraseMessages(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for name, store := range map[string]Store{"badger": BadgerDB{DB: db}, "memory": NewMemoryStore(0)} {
+		t.Run(name, func(t *testing.T) {
+			orders, payments := NewTopic("orders"), NewTopic("payments")
+			srv := &Server{DB: store, clients: map[Topic][]Client{orders: nil, payments: nil}, indexedHeaders: []string{"customer"}}
+			saved := make([]Message, 4)
+			for i, tp := range []Topic{orders, orders, payments, payments} {
+				id := strconv.Itoa(i)
+				seq, _ := store.NextSeq(tp)
+				saved[i] = NewMessageBuilder().WithID("false-" + id).WithNextID(id).WithTopic(tp).WithSeq(seq).
+					WithKey("k" + id).WithHeaders(map[string]string{"customer": []string{"ana", "bob"}[i%2]}).Build()
+				srv.save(saved[i], FormatJSON)
+			}
+			if err := store.Ack(saved[2]); err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			if _, err := srv.Erase(Erasure{Topic: "orders"}); err == nil {
+				t.Fatal("expected an erasure without criteria refused")
+			}
+
+			// ana published 0 and 2, the acked one included.
+			erased, err := srv.Erase(Erasure{Header: "customer", Value: "ana"})
+			if err != nil || len(erased) != 2 {
+				t.Fatalf("expected the 2 messages of ana erased, got %v %v", erased, err)
+			}
+			if found, _ := store.SearchAttribute("customer", "ana", 0); len(found) != 0 {
+				t.Fatalf("expected nothing left indexed for ana, got %v", found)
+			}
+
+			if erased, err = srv.Erase(Erasure{Topic: "payments", Key: "k3"}); err != nil || len(erased) != 1 || erased[0] != "false-3" {
+				t.Fatalf("expected the message of k3 erased, got %v %v", erased, err)
+			}
+			if erased, err = srv.Erase(Erasure{IDs: []string{"1"}, Key: "other"}); err != nil || len(erased) != 0 {
+				t.Fatalf("expected every criterion to be matched, got %v %v", erased, err)
+			}
+
+			left, _ := store.MessagesAfter(orders, 0)
+			if others, _ := store.MessagesAfter(payments, 0); len(left) != 1 || left[0].ID() != "false-1" || len(others) != 0 {
+				t.Fatalf("expected only the message of bob on orders left, got %v %v", left, others)
+			}
+		})
+	}
+}
+
+func Test_CountersSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{Protocol: "tcp", Port: ":0", WebServerPort: ":1", BadgerPath: dir}
+
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	first, _ := net.Pipe()
+	srv.clientConn(first)
+	srv.incSentMessages(NewTopic("orders"))
+	srv.incSentMessages(NewTopic("orders"))
+	srv.maintenance.purgedMessages.Add(5)
+	srv.checkpointCounters()
+	if err = srv.DB.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	srv, err = NewServer(cfg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer srv.DB.Close()
+
+	if sent := srv.sentCount(NewTopic("orders")); sent != 2 {
+		t.Fatalf("expected 2 sent after the restart, got %d", sent)
+	}
+	if purged := srv.maintenance.stats().PurgedMessages; purged != 5 {
+		t.Fatalf("expected 5 purged after the restart, got %d", purged)
+	}
+
+	// connection IDs keep counting, old deliveries are never mistaken for new ones.
+	second, _ := net.Pipe()
+	if id := srv.clientConn(second).id; id != 2 {
+		t.Fatalf("expected connection ID 2 after the restart, got %d", id)
+	}
+}
+
+func Test_ReadinessFollowsStorageProbe(t *testing.T) {
+	db, err := NewBadger("", true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	srv := &Server{DB: BadgerDB{DB: db}}
+
+	rec := httptest.NewRecorder()
+	srv.handleReady(rec, nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected unready before the first probe, got %d", rec.Code)
+	}
+
+	srv.probeStorage()
+	rec = httptest.NewRecorder()
+	srv.handleReady(rec, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected ready, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	_ = db.Close()
+	srv.probeStorage()
+	rec = httptest.NewRecorder()
+	srv.handleReady(rec, nil)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "error") {
+		t.Fatalf("expected unready once the store is closed, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func Test_TopicSchemaVersions(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{Protocol: "tcp", Port: ":0", WebServerPort: ":1", BadgerPath: dir}
+
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	v1 := TopicSchema{Fields: []SchemaField{{Name: "order_id", Type: "string", Required: true}}}
+	if _, err = srv.RegisterSchema("orders", v1); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// a backward compatible version cannot require what the messages of v1 may not have.
+	breaking := TopicSchema{Fields: append(v1.Fields, SchemaField{Name: "total", Type: "number", Required: true})}
+	if _, err = srv.RegisterSchema("orders", breaking); !errors.Is(err, errSchemaIncompatible) {
+		t.Fatalf("expected the new required field rejected, got %v", err)
+	}
+	v2, err := srv.RegisterSchema("orders", TopicSchema{Fields: append(v1.Fields, SchemaField{Name: "total", Type: "number"})})
+	if err != nil || v2.Version != 2 || v2.Compatibility != SchemaBackward {
+		t.Fatalf("unexpected version %+v %v", v2, err)
+	}
+	if err = srv.DB.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	srv, err = NewServer(cfg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer srv.DB.Close()
+
+	msg := NewMessageBuilder().WithTopic(NewTopic("orders")).WithBody([]byte(`{"order_id":"A-1","total":19.9}`)).Build()
+	if err = srv.checkSchema(&msg); err != nil || msg.Headers()[SchemaVersionHeader] != "2" {
+		t.Fatalf("expected the message stamped with version 2, got %v %v", msg.Headers(), err)
+	}
+	for _, body := range []string{`{"total":1}`, `{"order_id":1}`, `{"order_id":"A-1","total":"1"}`, `"A-1"`} {
+		msg = NewMessageBuilder().WithTopic(NewTopic("orders")).WithBody([]byte(body)).Build()
+		if err = srv.checkSchema(&msg); !errors.Is(err, errSchemaMismatch) {
+			t.Fatalf("expected %s rejected, got %v", body, err)
+		}
+	}
+}
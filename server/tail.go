@@ -0,0 +1,147 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultTailDuration = time.Minute
+	maxTailDuration     = 10 * time.Minute
+	// tailBufferSize is how many messages a slow tail may lag behind before dropping them.
+	tailBufferSize = 256
+)
+
+// tap receives a copy of the messages flowing through a topic, it never slows the
+// delivery down: a full buffer drops the message for the tap only.
+type tap struct {
+	messages chan Message
+	sample   float64
+}
+
+func (t *tap) offer(message Message) {
+	if t.sample < 1 && rand.Float64() >= t.sample {
+		return
+	}
+
+	select {
+	case t.messages <- message:
+	default:
+	}
+}
+
+func (s *Server) addTap(topic Topic, sample float64) *tap {
+	t := &tap{messages: make(chan Message, tailBufferSize), sample: sample}
+
+	s.tapsMu.Lock()
+	defer s.tapsMu.Unlock()
+
+	if s.taps == nil {
+		s.taps = make(map[Topic]map[*tap]struct{})
+	}
+	if s.taps[topic] == nil {
+		s.taps[topic] = make(map[*tap]struct{})
+	}
+	s.taps[topic][t] = struct{}{}
+
+	return t
+}
+
+func (s *Server) removeTap(topic Topic, t *tap) {
+	s.tapsMu.Lock()
+	defer s.tapsMu.Unlock()
+
+	delete(s.taps[topic], t)
+	if len(s.taps[topic]) == 0 {
+		delete(s.taps, topic)
+	}
+}
+
+// Tap copies the messages published to the topic into the returned channel until stop is
+// called. The messages a slow reader lets pile up past the buffer are dropped for it.
+func (s *Server) Tap(topic Topic) (messages <-chan Message, stop func()) {
+	t := s.addTap(topic, 1)
+	return t.messages, func() { s.removeTap(topic, t) }
+}
+
+// tapMessage copies the message to the tails of its topic.
+func (s *Server) tapMessage(message Message) {
+	s.tapsMu.Lock()
+	defer s.tapsMu.Unlock()
+
+	for t := range s.taps[message.Topic()] {
+		t.offer(message)
+	}
+}
+
+// handleTail streams the messages of the topic as JSON lines until the client leaves or the
+// duration runs out. sample is the fraction of the messages sent, 1 by default.
+func (s *Server) handleTail(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	sample := 1.0
+	if v := q.Get("sample"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n <= 0 || n > 1 {
+			http.Error(w, "invalid sample, expected a fraction in (0, 1]", http.StatusBadRequest)
+			return
+		}
+		sample = n
+	}
+
+	duration := defaultTailDuration
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		duration = min(d, maxTailDuration)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	topic := NewTopic(r.PathValue("name"))
+	if !s.hasTopic(topic) {
+		http.Error(w, errTopicNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditTail, User: user, RemoteAddr: r.RemoteAddr, Topic: topic.Name, Detail: duration.String()})
+
+	t := s.addTap(topic, sample)
+	defer s.removeTap(topic, t)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	timeout := time.NewTimer(duration)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case message := <-t.messages:
+			b, err := message.Marshall()
+			if err != nil {
+				s.logger().Warn("cannot marshall tailed message", "id", message.ID(), "err", err)
+				continue
+			}
+			if _, err = w.Write(append(b, '\n')); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-timeout.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Package telemetry records the broker activity as OpenTelemetry metrics. A nil *Telemetry
+// records nothing, so call sites need no checks.
+package telemetry
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const scope = "github.com/tomiok/queuety/server"
+
+// Telemetry holds the instruments of the broker.
+type Telemetry struct {
+	published     metric.Int64Counter
+	delivered     metric.Int64Counter
+	failures      metric.Int64Counter
+	bytesIn       metric.Int64Counter
+	bytesOut      metric.Int64Counter
+	storeDuration metric.Float64Histogram
+	authAttempts  metric.Int64Counter
+}
+
+// New creates the instruments on the meter of provider.
+func New(provider metric.MeterProvider) (*Telemetry, error) {
+	meter := provider.Meter(scope)
+
+	var (
+		t   Telemetry
+		err error
+	)
+
+	if t.published, err = meter.Int64Counter("queuety.messages.published",
+		metric.WithDescription("Messages accepted from publishers.")); err != nil {
+		return nil, err
+	}
+	if t.delivered, err = meter.Int64Counter("queuety.messages.delivered",
+		metric.WithDescription("Messages written to a subscriber.")); err != nil {
+		return nil, err
+	}
+	if t.failures, err = meter.Int64Counter("queuety.deliveries.failed",
+		metric.WithDescription("Deliveries that failed and were left for redelivery.")); err != nil {
+		return nil, err
+	}
+	if t.bytesIn, err = meter.Int64Counter("queuety.bytes.received", metric.WithUnit("By"),
+		metric.WithDescription("Message bodies received from publishers.")); err != nil {
+		return nil, err
+	}
+	if t.bytesOut, err = meter.Int64Counter("queuety.bytes.sent", metric.WithUnit("By"),
+		metric.WithDescription("Frames written to subscribers.")); err != nil {
+		return nil, err
+	}
+	if t.storeDuration, err = meter.Float64Histogram("queuety.store.duration", metric.WithUnit("s"),
+		metric.WithDescription("Duration of the store operations.")); err != nil {
+		return nil, err
+	}
+	if t.authAttempts, err = meter.Int64Counter("queuety.auth.attempts",
+		metric.WithDescription("Logins, by result.")); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func topicAttr(topic string) metric.MeasurementOption {
+	return metric.WithAttributes(attribute.String("topic", topic))
+}
+
+// Published records a message accepted on topic with a body of size bytes.
+func (t *Telemetry) Published(ctx context.Context, topic string, size int) {
+	if t == nil {
+		return
+	}
+
+	t.published.Add(ctx, 1, topicAttr(topic))
+	t.bytesIn.Add(ctx, int64(size), topicAttr(topic))
+}
+
+// Delivered records a frame of size bytes written to a subscriber of topic.
+func (t *Telemetry) Delivered(ctx context.Context, topic string, size int) {
+	if t == nil {
+		return
+	}
+
+	t.delivered.Add(ctx, 1, topicAttr(topic))
+	t.bytesOut.Add(ctx, int64(size), topicAttr(topic))
+}
+
+func (t *Telemetry) DeliveryFailed(ctx context.Context, topic string) {
+	if t == nil {
+		return
+	}
+
+	t.failures.Add(ctx, 1, topicAttr(topic))
+}
+
+// StoreOp records how long the store operation op took since start, and whether it failed.
+func (t *Telemetry) StoreOp(ctx context.Context, op string, start time.Time, err error) {
+	if t == nil {
+		return
+	}
+
+	t.storeDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+		attribute.String("op", op),
+		attribute.Bool("error", err != nil),
+	))
+}
+
+func (t *Telemetry) Auth(ctx context.Context, success bool) {
+	if t == nil {
+		return
+	}
+
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	t.authAttempts.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+}
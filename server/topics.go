@@ -0,0 +1,219 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// SubscriberInfo is a connected subscriber of a topic.
+type SubscriberInfo struct {
+	ConnectionID uint64 `json:"connection_id"`
+	RemoteAddr   string `json:"remote_addr"`
+	Format       string `json:"format"`
+	// Subscriber is the durable name, empty for ephemeral subscribers.
+	Subscriber string `json:"subscriber,omitempty"`
+	// Active is the subscriber of an exclusive topic getting the messages, the others stand by.
+	Active bool `json:"active,omitempty"`
+}
+
+// TopicSubscribers lists who is connected to a topic and the durable subscribers it keeps.
+type TopicSubscribers struct {
+	Topic     string           `json:"topic"`
+	Connected []SubscriberInfo `json:"connected"`
+	Durable   []string         `json:"durable"`
+	// MaxSubscribers is the TopicMaxSubscribers of the topic, 0 when unlimited.
+	MaxSubscribers int `json:"max_subscribers,omitempty"`
+}
+
+// CreateTopic creates the topic, the same as a NEW_TOPIC frame with opts as its body.
+func (s *Server) CreateTopic(name string, opts TopicOptions) {
+	exists := s.hasTopic(NewTopic(name))
+
+	// an existing topic keeps its mode.
+	if !exists {
+		s.setMode(NewTopic(name), opts)
+	}
+
+	switch opts.Class {
+	case TopicTransient:
+		s.addTransientTopic(name)
+	case TopicCompacted:
+		s.addCompactedTopic(name)
+		s.setTopicOptions(NewTopic(name), opts)
+	default:
+		s.addNewTopic(name)
+		s.setTopicOptions(NewTopic(name), opts)
+	}
+
+	if !exists {
+		s.notifier.notify(Event{Type: EventTopicCreated, Topic: name})
+	}
+}
+
+// TopicExists tells if the topic is there, created by a client, the admin API or a restart.
+func (s *Server) TopicExists(topic Topic) bool {
+	return s.hasTopic(topic)
+}
+
+// DeleteTopic removes the topic and everything stored about it. Its subscribers stop
+// receiving it, their connections stay open for the other topics.
+func (s *Server) DeleteTopic(topic Topic) (PurgeResult, error) {
+	s.clientsMu.Lock()
+	if _, ok := s.clients[topic]; !ok {
+		s.clientsMu.Unlock()
+		return PurgeResult{}, errTopicNotFound
+	}
+	delete(s.clients, topic)
+	delete(s.durableTopics, topic)
+	s.clientsMu.Unlock()
+
+	s.transientTopics.Delete(topic)
+	s.autoDelete.Delete(topic)
+	s.topicActivity.Delete(topic)
+	s.values.drop(topic)
+	s.modes.Delete(topic)
+	s.notifier.notify(Event{Type: EventTopicDeleted, Topic: topic.Name})
+
+	return s.DB.DeleteTopic(topic)
+}
+
+// Subscribers returns the connected and durable subscribers of the topic.
+func (s *Server) Subscribers(topic Topic) (TopicSubscribers, error) {
+	clients, ok := s.topicClients(topic)
+	if !ok {
+		return TopicSubscribers{}, errTopicNotFound
+	}
+
+	subs := TopicSubscribers{
+		Topic:          topic.Name,
+		Connected:      make([]SubscriberInfo, 0, len(clients)),
+		Durable:        s.durableSubscribers(topic),
+		MaxSubscribers: s.topicMaxSubscribers[topic.Name],
+	}
+	if subs.Durable == nil {
+		subs.Durable = []string{}
+	}
+
+	exclusive := s.modeOf(topic) == TopicExclusive
+	for i, c := range clients {
+		cc, ok := s.lookupClientConn(c.conn)
+		if !ok {
+			continue
+		}
+
+		subs.Connected = append(subs.Connected, SubscriberInfo{
+			ConnectionID: cc.id,
+			RemoteAddr:   cc.remoteAddr,
+			Format:       formatName(c.Format),
+			Subscriber:   c.subscriber,
+			Active:       exclusive && i == 0,
+		})
+	}
+
+	return subs, nil
+}
+
+func formatName(format MessageFormat) string {
+	if format == FormatBinary {
+		return "binary"
+	}
+
+	return "json"
+}
+
+// handleCreateTopic takes an optional TopicOptions body, the topic is durable by default.
+func (s *Server) handleCreateTopic(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := parseTopicOptions(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := r.PathValue("name")
+	s.CreateTopic(name, opts)
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditTopicCreate, User: user, RemoteAddr: r.RemoteAddr, Topic: name, Detail: string(opts.Class)})
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) handleDeleteTopic(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	result, err := s.DeleteTopic(NewTopic(name))
+	if err != nil {
+		if errors.Is(err, errTopicNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditTopicDelete, User: user, RemoteAddr: r.RemoteAddr, Topic: name})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(result); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) handleTopicSubscribers(w http.ResponseWriter, r *http.Request) {
+	subs, err := s.Subscribers(NewTopic(r.PathValue("name")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(subs); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// handlePurgeTopic removes the messages of the topic, ?before= (RFC 3339) keeps the newer ones.
+func (s *Server) handlePurgeTopic(w http.ResponseWriter, r *http.Request) {
+	cutoff := time.Now()
+	if v := r.URL.Query().Get("before"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+		cutoff = t
+	}
+
+	name := r.PathValue("name")
+	topic := NewTopic(name)
+	if !s.hasTopic(topic) {
+		http.Error(w, errTopicNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	result, err := s.DB.PurgeTopic(topic, cutoff)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditTopicPurge, User: user, RemoteAddr: r.RemoteAddr, Topic: name, Detail: cutoff.Format(time.RFC3339)})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(result); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,446 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// SchemaVersionHeader is the header the broker stamps on the messages of a topic with a schema,
+// the version they were checked against.
+const SchemaVersionHeader = "queuety-schema-version"
+
+var (
+	errSchemaNotFound     = errors.New("topic has no schema")
+	errSchemaMismatch     = errors.New("message does not match the topic schema")
+	errSchemaIncompatible = errors.New("schema is not compatible with the latest version")
+)
+
+// SchemaCompatibility is what a new version of a topic schema must keep from the latest one.
+type SchemaCompatibility string
+
+const (
+	// SchemaBackward lets the consumers of the new version read the messages of the latest one:
+	// no new required field, no type change. It is the default.
+	SchemaBackward SchemaCompatibility = "backward"
+	// SchemaForward lets the consumers of the latest version read the messages of the new one:
+	// no required field dropped or made optional, no type change.
+	SchemaForward SchemaCompatibility = "forward"
+	// SchemaFull is both SchemaBackward and SchemaForward.
+	SchemaFull SchemaCompatibility = "full"
+	// SchemaNone accepts any new version.
+	SchemaNone SchemaCompatibility = "none"
+)
+
+// SchemaField is a top level field of the JSON object body, Type one of string, number,
+// integer, boolean, object, array or any.
+type SchemaField struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// TopicSchema is a version of the schema of a topic. Once a topic has one the broker rejects
+// the publishes whose body does not match the latest version, fields it does not list are let
+// through.
+type TopicSchema struct {
+	Topic         string              `json:"topic"`
+	Version       int                 `json:"version"`
+	Compatibility SchemaCompatibility `json:"compatibility"`
+	Fields        []SchemaField       `json:"fields"`
+	CreatedAt     time.Time           `json:"created_at"`
+}
+
+func (t TopicSchema) validate() error {
+	switch t.Compatibility {
+	case SchemaBackward, SchemaForward, SchemaFull, SchemaNone:
+	default:
+		return fmt.Errorf("invalid compatibility %q", t.Compatibility)
+	}
+
+	seen := make(map[string]struct{}, len(t.Fields))
+	for _, f := range t.Fields {
+		if f.Name == "" {
+			return errors.New("a schema field needs a name")
+		}
+		if _, ok := seen[f.Name]; ok {
+			return fmt.Errorf("duplicated field %q", f.Name)
+		}
+		seen[f.Name] = struct{}{}
+
+		switch f.Type {
+		case "string", "number", "integer", "boolean", "object", "array", "any":
+		default:
+			return fmt.Errorf("field %q: invalid type %q", f.Name, f.Type)
+		}
+	}
+
+	return nil
+}
+
+func (t TopicSchema) field(name string) (SchemaField, bool) {
+	for _, f := range t.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+
+	return SchemaField{}, false
+}
+
+// compatible lists why next breaks the compatibility of t, nothing when it keeps it.
+func (t TopicSchema) compatible(next TopicSchema) []string {
+	var problems []string
+	backward := next.Compatibility == SchemaBackward || next.Compatibility == SchemaFull
+	forward := next.Compatibility == SchemaForward || next.Compatibility == SchemaFull
+
+	for _, f := range next.Fields {
+		prev, ok := t.field(f.Name)
+		if ok && prev.Type != f.Type {
+			problems = append(problems, fmt.Sprintf("field %q changes type from %s to %s", f.Name, prev.Type, f.Type))
+			continue
+		}
+		if backward && f.Required && (!ok || !prev.Required) {
+			problems = append(problems, fmt.Sprintf("field %q is required, the messages of version %d may not have it", f.Name, t.Version))
+		}
+	}
+	if forward {
+		for _, prev := range t.Fields {
+			if f, ok := next.field(prev.Name); prev.Required && (!ok || !f.Required) {
+				problems = append(problems, fmt.Sprintf("field %q is required by version %d", prev.Name, t.Version))
+			}
+		}
+	}
+
+	return problems
+}
+
+// check tells if the body matches the schema: a JSON object with the required fields, the
+// fields it lists of their type. A null is as good as a missing field.
+func (t TopicSchema) check(body []byte) error {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil || object == nil {
+		return fmt.Errorf("%w: version %d expects a JSON object", errSchemaMismatch, t.Version)
+	}
+
+	for _, f := range t.Fields {
+		v, ok := object[f.Name]
+		if !ok || string(v) == "null" {
+			if f.Required {
+				return fmt.Errorf("%w: version %d requires %q", errSchemaMismatch, t.Version, f.Name)
+			}
+			continue
+		}
+		if !jsonTypeIs(v, f.Type) {
+			return fmt.Errorf("%w: version %d expects %q to be %s", errSchemaMismatch, t.Version, f.Name, f.Type)
+		}
+	}
+
+	return nil
+}
+
+func jsonTypeIs(v json.RawMessage, typ string) bool {
+	switch typ {
+	case "any":
+		return true
+	case "string":
+		return v[0] == '"'
+	case "boolean":
+		return string(v) == "true" || string(v) == "false"
+	case "object":
+		return v[0] == '{'
+	case "array":
+		return v[0] == '['
+	case "number":
+		_, err := strconv.ParseFloat(string(v), 64)
+		return err == nil
+	case "integer":
+		_, err := strconv.ParseInt(string(v), 10, 64)
+		return err == nil
+	}
+
+	return false
+}
+
+func registrySchemaPrefix(topic string) []byte {
+	return fmt.Appendf(nil, "%sschemas/%s\x00", registryPrefix, topic)
+}
+
+func registrySchemaKey(topic string, version int) []byte {
+	return binary.BigEndian.AppendUint32(registrySchemaPrefix(topic), uint32(version))
+}
+
+func (b BadgerDB) SaveSchema(schema TopicSchema) error {
+	v, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+
+	return b.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(registrySchemaKey(schema.Topic, schema.Version), v)
+	})
+}
+
+func (b BadgerDB) Schemas() ([]TopicSchema, error) {
+	var schemas []TopicSchema
+	err := b.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(registryPrefix + "schemas/")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				var schema TopicSchema
+				if err := json.Unmarshal(v, &schema); err != nil {
+					b.logger().Warn("invalid topic schema", "key", string(it.Item().Key()), "err", err)
+					return nil
+				}
+				schemas = append(schemas, schema)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return schemas, err
+}
+
+func (b BadgerDB) DeleteSchemas(topic string) error {
+	return b.DB.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+
+		var keys [][]byte
+		prefix := registrySchemaPrefix(topic)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+
+		if len(keys) == 0 {
+			return errSchemaNotFound
+		}
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (m *MemoryStore) SaveSchema(schema TopicSchema) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.schemas == nil {
+		m.schemas = make(map[string][]TopicSchema)
+	}
+	m.schemas[schema.Topic] = append(m.schemas[schema.Topic], schema)
+	return nil
+}
+
+func (m *MemoryStore) Schemas() ([]TopicSchema, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var schemas []TopicSchema
+	for _, versions := range m.schemas {
+		schemas = append(schemas, versions...)
+	}
+	slices.SortFunc(schemas, func(a, b TopicSchema) int {
+		if c := strings.Compare(a.Topic, b.Topic); c != 0 {
+			return c
+		}
+		return a.Version - b.Version
+	})
+	return schemas, nil
+}
+
+func (m *MemoryStore) DeleteSchemas(topic string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.schemas[topic]; !ok {
+		return errSchemaNotFound
+	}
+	delete(m.schemas, topic)
+	return nil
+}
+
+// loadSchemas keeps the latest schema of every topic for the publishes.
+func (s *Server) loadSchemas() error {
+	schemas, err := s.DB.Schemas()
+	if err != nil {
+		return err
+	}
+
+	// sorted by topic and version, the latest one is stored last.
+	for _, schema := range schemas {
+		s.schemas.Store(schema.Topic, schema)
+	}
+
+	return nil
+}
+
+func (s *Server) latestSchema(topic string) (TopicSchema, bool) {
+	v, ok := s.schemas.Load(topic)
+	if !ok {
+		return TopicSchema{}, false
+	}
+
+	return v.(TopicSchema), true
+}
+
+// checkSchema rejects a publish whose body does not match the schema of its topic, the one
+// it matches gets the version in SchemaVersionHeader.
+func (s *Server) checkSchema(message *Message) error {
+	schema, ok := s.latestSchema(message.Topic().Name)
+	if !ok {
+		return nil
+	}
+
+	if err := schema.check(message.Body()); err != nil {
+		return err
+	}
+
+	headers := make(map[string]string, len(message.headers)+1)
+	for k, v := range message.headers {
+		headers[k] = v
+	}
+	headers[SchemaVersionHeader] = strconv.Itoa(schema.Version)
+	message.headers = headers
+	return nil
+}
+
+// RegisterSchema adds the next version of the schema of the topic, errSchemaIncompatible when
+// it breaks the compatibility asked for. Without one it keeps the compatibility of the latest
+// version, SchemaBackward for the first.
+func (s *Server) RegisterSchema(topic string, schema TopicSchema) (TopicSchema, error) {
+	s.schemaMu.Lock()
+	defer s.schemaMu.Unlock()
+
+	latest, exists := s.latestSchema(topic)
+	if schema.Compatibility == "" {
+		schema.Compatibility = SchemaBackward
+		if exists {
+			schema.Compatibility = latest.Compatibility
+		}
+	}
+	schema.Topic = topic
+	schema.Version = latest.Version + 1
+	schema.CreatedAt = time.Now().UTC()
+	if err := schema.validate(); err != nil {
+		return TopicSchema{}, err
+	}
+
+	if exists {
+		if problems := latest.compatible(schema); len(problems) > 0 {
+			return TopicSchema{}, fmt.Errorf("%w, %s: %s", errSchemaIncompatible, schema.Compatibility, strings.Join(problems, ", "))
+		}
+	}
+
+	if err := s.DB.SaveSchema(schema); err != nil {
+		return TopicSchema{}, err
+	}
+	s.schemas.Store(topic, schema)
+
+	return schema, nil
+}
+
+func (s *Server) handleSchemas(w http.ResponseWriter, r *http.Request) {
+	schemas, err := s.DB.Schemas()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := r.PathValue("name")
+	versions := []TopicSchema{}
+	for _, schema := range schemas {
+		if schema.Topic == name {
+			versions = append(versions, schema)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(versions); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleRegisterSchema adds a version to the schema of the topic of the path, 409 when it is
+// not compatible with the latest one.
+func (s *Server) handleRegisterSchema(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var schema TopicSchema
+	if err = json.Unmarshal(body, &schema); err != nil {
+		http.Error(w, "invalid schema: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	schema, err = s.RegisterSchema(r.PathValue("name"), schema)
+	switch {
+	case errors.Is(err, errSchemaIncompatible):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditSchema, User: user, RemoteAddr: r.RemoteAddr, Topic: schema.Topic, Detail: "version " + strconv.Itoa(schema.Version)})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(schema)
+}
+
+// handleDeleteSchemas removes every version of the schema of the topic, its publishes are
+// not checked anymore.
+func (s *Server) handleDeleteSchemas(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	s.schemaMu.Lock()
+	err := s.DB.DeleteSchemas(name)
+	if err == nil {
+		s.schemas.Delete(name)
+	}
+	s.schemaMu.Unlock()
+
+	switch {
+	case errors.Is(err, errSchemaNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := adminUser(r)
+	s.audit(AuditEntry{Action: AuditSchema, User: user, RemoteAddr: r.RemoteAddr, Topic: name, Detail: "deleted"})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// tracePrefix keeps the lifecycle of the messages under trace/<id>/<time>.
+const tracePrefix = "trace/"
+
+// defaultTraceRetention is how long the traces are kept when Config.TraceRetention is 0.
+const defaultTraceRetention = 24 * time.Hour
+
+// TraceStage is a step in the life of a message.
+type TraceStage string
+
+const (
+	TraceReceived       TraceStage = "received"
+	TracePersisted      TraceStage = "persisted"
+	TraceDelivered      TraceStage = "delivered"
+	TraceDeliveryFailed TraceStage = "delivery_failed"
+	// TraceAcked is an ACK of one subscriber, TraceCompleted is recorded once enough of them acked.
+	TraceAcked        TraceStage = "acked"
+	TraceCompleted    TraceStage = "completed"
+	TraceNacked       TraceStage = "nacked"
+	TraceRedelivered  TraceStage = "redelivered"
+	TraceDeadLettered TraceStage = "dead_lettered"
+)
+
+type TraceEvent struct {
+	Time         time.Time  `json:"time"`
+	Stage        TraceStage `json:"stage"`
+	ConnectionID uint64     `json:"connection_id,omitempty"`
+	Subscriber   string     `json:"subscriber,omitempty"`
+	Attempts     int        `json:"attempts,omitempty"`
+	Detail       string     `json:"detail,omitempty"`
+}
+
+var traceSeq atomic.Uint64
+
+func traceKey(messageID string) string {
+	return tracePrefix + messageID + "/"
+}
+
+// AppendTrace stores the event under a key ordered by time, it expires after ttl.
+func (b BadgerDB) AppendTrace(messageID string, event TraceEvent, ttl time.Duration) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s%020d-%06d", traceKey(messageID), event.Time.UnixNano(), traceSeq.Add(1)%1_000_000)
+	return b.DB.Update(func(txn *badger.Txn) error {
+		entry := badger.NewEntry([]byte(key), value)
+		if ttl > 0 {
+			entry = entry.WithTTL(ttl)
+		}
+		return txn.SetEntry(entry)
+	})
+}
+
+// Trace returns the recorded events of the message, oldest first.
+func (b BadgerDB) Trace(messageID string) ([]TraceEvent, error) {
+	events := []TraceEvent{}
+	err := b.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(traceKey(messageID))
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var event TraceEvent
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &event)
+			})
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// maxMemoryTraces bounds how many messages a MemoryStore keeps the trace of, the ttl is not
+// honored there.
+const maxMemoryTraces = 10_000
+
+func (m *MemoryStore) AppendTrace(messageID string, event TraceEvent, _ time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.traces == nil {
+		m.traces = make(map[string][]TraceEvent)
+	}
+
+	if _, ok := m.traces[messageID]; !ok {
+		m.traceOrder = append(m.traceOrder, messageID)
+		if len(m.traceOrder) > maxMemoryTraces {
+			delete(m.traces, m.traceOrder[0])
+			m.traceOrder = m.traceOrder[1:]
+		}
+	}
+	m.traces[messageID] = append(m.traces[messageID], event)
+
+	return nil
+}
+
+func (m *MemoryStore) Trace(messageID string) ([]TraceEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]TraceEvent{}, m.traces[messageID]...), nil
+}
+
+// trace records a step of the message, transient topics are not traced since they never
+// touch the store.
+func (s *Server) trace(message Message, event TraceEvent) {
+	if s.traceRetention < 0 || s.isTransient(message.Topic()) {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if err := s.DB.AppendTrace(message.ID(), event, s.traceRetention); err != nil {
+		s.logger().Warn("cannot write trace", "id", message.ID(), "stage", event.Stage, "err", err)
+	}
+}
+
+// MessageTrace returns the lifecycle of the message. The ID may be given with or without
+// the MsgPrefixFalse prefix the publishers add.
+func (s *Server) MessageTrace(id string) ([]TraceEvent, error) {
+	events, err := s.DB.Trace(id)
+	if err != nil || len(events) > 0 || strings.HasPrefix(id, MsgPrefixFalse+"-") {
+		return events, err
+	}
+
+	return s.DB.Trace(MsgPrefixFalse + "-" + id)
+}
+
+func (s *Server) handleMessageTrace(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	events, err := s.MessageTrace(id)
+	if err != nil {
+		http.Error(w, "cannot read trace", http.StatusInternalServerError)
+		return
+	}
+	if len(events) == 0 {
+		http.Error(w, "no trace for message "+id, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(map[string]any{"id": id, "events": events}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
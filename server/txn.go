@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+	"github.com/tomiok/queuety/server/observability"
+)
+
+// maxTxnMessages bounds the acks and the publishes of a transaction together.
+const maxTxnMessages = 1000
+
+var errTxnConflict = errors.New("message acked already")
+
+// Transaction is the body of TXN: the deliveries a consumer processed, echoed as ACK does,
+// and the messages it publishes out of them. The broker acks and stores them all or none, a
+// consumer going down before the commit gets the deliveries again and nothing of it went out.
+type Transaction struct {
+	Acks    []json.RawMessage `json:"acks"`
+	Publish []PublishMessage  `json:"publish"`
+}
+
+// EncodeTransaction builds the body of TXN.
+func EncodeTransaction(acks []Message, publish []PublishMessage) ([]byte, error) {
+	raw := make([]json.RawMessage, len(acks))
+	for i, m := range acks {
+		b, err := m.Marshall()
+		if err != nil {
+			return nil, err
+		}
+		raw[i] = b
+	}
+
+	return json.Marshal(Transaction{Acks: raw, Publish: publish})
+}
+
+func parseTransaction(body []byte) ([]Message, []PublishMessage, error) {
+	var txn Transaction
+	if err := json.Unmarshal(body, &txn); err != nil {
+		return nil, nil, fmt.Errorf("invalid transaction: %w", err)
+	}
+	if len(txn.Acks)+len(txn.Publish) == 0 {
+		return nil, nil, errors.New("empty transaction")
+	}
+	if len(txn.Acks)+len(txn.Publish) > maxTxnMessages {
+		return nil, nil, fmt.Errorf("transaction over %d messages", maxTxnMessages)
+	}
+
+	acks := make([]Message, len(txn.Acks))
+	for i, b := range txn.Acks {
+		if err := acks[i].Unmarshal(b); err != nil {
+			return nil, nil, fmt.Errorf("invalid transaction ack %d: %w", i, err)
+		}
+	}
+
+	return acks, txn.Publish, nil
+}
+
+func (b BadgerDB) CommitTxn(acks []Message, batch []SaveRequest) error {
+	records, err := b.pendingRecords(batch)
+	if err != nil {
+		return err
+	}
+
+	return b.updateWithRetry(func(txn *badger.Txn) error {
+		for _, message := range acks {
+			key, err := txnAckKey(txn, message)
+			if err != nil {
+				return err
+			}
+			if err = ackKey(txn, key, message); err != nil {
+				return err
+			}
+		}
+
+		return setPending(txn, records)
+	})
+}
+
+// txnAckKey resolves where a message acked by a transaction goes. A message stored without
+// its pending entry was acked already, one not stored yet is stored acked, for its save to
+// leave it alone.
+func txnAckKey(txn *badger.Txn, message Message) ([]byte, error) {
+	item, err := txn.Get(pendingKey(message.ID()))
+	if err == nil {
+		return item.ValueCopy(nil)
+	}
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, err
+	}
+	if message.Seq() == 0 {
+		return nil, fmt.Errorf("cannot find message with ID %s: %w", message.ID(), err)
+	}
+
+	key := messageKey(message.Topic(), message.Seq())
+	if _, err = txn.Get(key); err == nil {
+		return nil, fmt.Errorf("%w: %s", errTxnConflict, message.ID())
+	} else if !errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (m *MemoryStore) CommitTxn(acks []Message, batch []SaveRequest) error {
+	for _, r := range batch {
+		if !strings.HasPrefix(r.Message.ID(), MsgPrefixFalse) {
+			return errors.New("invalid key, should start with 'false'")
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, message := range acks {
+		if stored, ok := m.messages[message.NextID()]; ok && stored.ACK() {
+			return fmt.Errorf("%w: %s", errTxnConflict, message.ID())
+		}
+	}
+
+	for _, message := range acks {
+		m.ack(message)
+	}
+	for _, r := range batch {
+		m.save(r.Message)
+	}
+
+	return nil
+}
+
+// commitTxn runs the TXN of a consumer: every publish is checked as a NEW_MESSAGE is, then
+// the deliveries are acked and the publishes stored at once. The publishes are delivered
+// once committed, PUBLISHED with the id of the TXN tells the consumer it went through.
+func (s *Server) commitTxn(conn net.Conn, format MessageFormat, message Message) {
+	acks, publish, err := parseTransaction(message.Body())
+	if err != nil {
+		s.sendError(conn, format, ErrCodeMalformedFrame, err.Error(), message)
+		return
+	}
+
+	cc := s.clientConn(conn)
+	for _, m := range acks {
+		if err = s.txnTopic(m.Topic()); err != nil {
+			s.sendError(conn, format, errorCode(err), err.Error(), message)
+			return
+		}
+	}
+
+	outputs := make([]Message, len(publish))
+	for i, p := range publish {
+		if err = s.txnTopic(p.Topic); err != nil {
+			s.sendError(conn, format, errorCode(err), err.Error(), message)
+			return
+		}
+
+		id := uuid.NewString()
+		out := NewMessageBuilder().
+			WithID(MsgPrefixFalse + "-" + id).
+			WithNextID(id).
+			WithType(MessageTypeNew).
+			WithTopic(p.Topic).
+			WithBody(p.Body).
+			WithKey(p.Key).
+			WithHeaders(p.Headers).
+			WithTTL(p.TTL).
+			Build()
+		if out.ttl == 0 {
+			out.ttl = int64(s.topicRetention[p.Topic.Name] / time.Second)
+		}
+		if err = s.checkKey(out); err != nil {
+			s.sendError(conn, format, ErrCodeMalformedFrame, err.Error(), message)
+			return
+		}
+		if err = s.checkSchema(&out); err != nil {
+			s.sendError(conn, format, ErrCodeSchemaMismatch, err.Error(), message)
+			return
+		}
+		out.stampPublisher(cc.identity(), cc.id)
+		outputs[i] = out
+	}
+
+	// the seqs come before the commit, a rejected transaction leaves a gap in the topics.
+	batch := make([]SaveRequest, len(outputs))
+	for i := range outputs {
+		if outputs[i].seq, err = s.nextSeq(outputs[i].Topic()); err != nil {
+			s.sendError(conn, format, ErrCodeInternal, err.Error(), message)
+			return
+		}
+		batch[i] = SaveRequest{Message: outputs[i], Format: FormatJSON}
+	}
+
+	type tally struct{ acked, total int }
+	tallies := make([]tally, len(acks))
+	var complete []Message
+	for i, m := range acks {
+		acked, total, errAck := s.DB.AckDelivery(m.ID(), recipient(s.durableSubscriber(conn, m.Topic()), cc.id))
+		if errors.Is(errAck, errDeliveryNotTracked) {
+			// not one of its deliveries, or acked and done with already, nothing is committed
+			// on an ACK that does not count.
+			s.untrackTxn(cc, acks[:i])
+			s.sendError(conn, format, ErrCodeTxnConflict, fmt.Sprintf("%v: %s", errAck, m.ID()), message)
+			return
+		}
+		if errAck != nil {
+			s.untrackTxn(cc, acks[:i])
+			s.sendError(conn, format, ErrCodeInternal, errAck.Error(), message)
+			return
+		}
+		tallies[i] = tally{acked, total}
+		if s.modeOf(m.Topic()) != TopicFanout || s.fullyAcked(acked, total) {
+			complete = append(complete, m)
+		}
+	}
+
+	start := time.Now()
+	err = s.DB.CommitTxn(complete, batch)
+	s.telemetry.StoreOp(context.Background(), "commit", start, err)
+	if err != nil {
+		// back to unacked, the deliveries are redelivered as if the TXN never came.
+		s.untrackTxn(cc, acks)
+		code := ErrCodeInternal
+		if errors.Is(err, errTxnConflict) {
+			code = ErrCodeTxnConflict
+		}
+		s.logger().Warn("transaction rejected", "id", message.ID(), "err", err)
+		s.sendError(conn, format, code, err.Error(), message)
+		return
+	}
+
+	for i, m := range acks {
+		cc.dropUnacked(m.ID())
+		observability.MessagesAcked.WithLabelValues(m.Topic().Name).Inc()
+		subscriber := s.durableSubscriber(conn, m.Topic())
+		s.trace(m, TraceEvent{Stage: TraceAcked, ConnectionID: cc.id, Subscriber: subscriber, Detail: "transaction " + message.ID()})
+		if subscriber != "" && m.Seq() > 0 {
+			if err = s.DB.AdvanceCursor(m.Topic(), subscriber, m.Seq()); err != nil {
+				s.logger().Error("cannot advance cursor", "subscriber", subscriber, "err", err)
+			}
+		}
+		if s.modeOf(m.Topic()) != TopicFanout || s.fullyAcked(tallies[i].acked, tallies[i].total) {
+			s.completed(m, tallies[i].acked, tallies[i].total)
+		}
+	}
+
+	for _, out := range outputs {
+		s.trace(out, TraceEvent{Stage: TraceReceived, ConnectionID: cc.id, Detail: "transaction " + message.ID()})
+		// stored already, the delivery saving it again leaves it as it is.
+		s.sendMessageSync(out, out.Topic())
+		cc.publishedTo(out.Topic())
+		s.touchTopic(out.Topic())
+		observability.MessagesPublished.WithLabelValues(out.Topic().Name).Inc()
+		s.telemetry.Published(context.Background(), out.Topic().Name, len(out.Body()))
+	}
+
+	s.writePublished(cc, format, message)
+}
+
+// txnTopic tells if a transaction can ack or publish on the topic, a transient one keeps
+// nothing to commit.
+func (s *Server) txnTopic(topic Topic) error {
+	if !s.hasTopic(topic) {
+		return fmt.Errorf("%w: %s", errTopicNotFound, topic.Name)
+	}
+	if s.isTransient(topic) {
+		return fmt.Errorf("transient topic %s in a transaction", topic.Name)
+	}
+
+	return nil
+}
+
+// untrackTxn hands the deliveries of a rejected transaction back to their unacked state.
+func (s *Server) untrackTxn(cc *clientConn, acks []Message) {
+	for _, m := range acks {
+		to := recipient(s.durableSubscriber(cc.Conn, m.Topic()), cc.id)
+		if err := s.DB.UntrackDelivery(m.ID(), to); err != nil {
+			s.logger().Error("cannot untrack delivery", "id", m.ID(), "err", err)
+		}
+		if err := s.DB.TrackDelivery(m.ID(), to); err != nil {
+			s.logger().Error("cannot track delivery", "id", m.ID(), "err", err)
+		}
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -19,6 +23,30 @@ const (
 	MessageTypeAuth          MType = "AUTH"
 	MessageAuthSuccess       MType = "AUTH_SUCCESS"
 	MessageAuthFailed        MType = "AUTH_FAILED"
+	MessageTypeError         MType = "ERROR"
+	MessageTypeReplay        MType = "REPLAY"
+	// MessageTypeHello identifies the client after the connection, its body is a ClientInfo.
+	MessageTypeHello MType = "HELLO"
+	// MessageTypePublished confirms a NEW_MESSAGE to a client that negotiated
+	// FeaturePublishConfirms, with the id and the seq the broker stores it with.
+	MessageTypePublished MType = "PUBLISHED"
+	// MessageTypeNack hands a delivery back to the broker, echoing it as ACK does, for it
+	// to be delivered again. Clients send it once they negotiated FeatureNack.
+	MessageTypeNack MType = "NACK"
+	// MessageTypeInProgress extends the ack deadline of a delivery still being processed, its
+	// body is an AckExtension. Clients send it once they negotiated FeatureAckExtension.
+	MessageTypeInProgress MType = "IN_PROGRESS"
+	// MessageTypeBatch carries the deliveries of a subscriber asking for batches, its body is
+	// the JSON array of the messages.
+	MessageTypeBatch MType = "BATCH"
+	// MessageTypeBatchAck acks every message of a BATCH, echoing its body.
+	MessageTypeBatchAck MType = "BATCH_ACK"
+	// MessageTypeTxn acks deliveries and publishes messages at once, its body is a
+	// Transaction. The broker answers PUBLISHED with its id once committed.
+	MessageTypeTxn MType = "TXN"
+	// MessageTypeMetadata asks for the TopicMetadata of its topic, the broker answers with one
+	// echoing its id. Clients send it once they negotiated FeatureMetadata.
+	MessageTypeMetadata MType = "METADATA"
 
 	MsgPrefixFalse = "false"
 )
@@ -38,6 +66,22 @@ func (t Topic) IsEmpty() bool {
 type PublishMessage struct {
 	Topic Topic           `json:"topic"`
 	Body  json.RawMessage `json:"body"`
+	// TTL expires the message once it is over, 0 falls back to the retention of the topic.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Key identifies what the message is about, a compacted topic keeps the latest per key and
+	// the consumer groups deliver a key to one member, in order.
+	Key string `json:"key,omitempty"`
+	// Headers travel with the message up to the consumers, the broker does not read them.
+	Headers map[string]string `json:"headers,omitempty"`
+	// FireAndForget skips the store, the confirm and the ACK, the message goes to the subscribers
+	// connected at most once. For the metrics and the like, losing a few is cheaper than a write.
+	FireAndForget bool `json:"fire_and_forget,omitempty"`
+	// QoS picks the guarantee of the publish, at least once by default. QoSAtMostOnce is
+	// FireAndForget, QoSEffectivelyOnce drops the publishes the broker has seen the id of.
+	QoS QoS `json:"qos,omitempty"`
+	// ID is the id of the message, a random one when empty. A QoSEffectivelyOnce publish is
+	// deduplicated by it, an id of the application, as the row of an outbox, survives restarts.
+	ID string `json:"id,omitempty"`
 }
 
 type Message struct {
@@ -52,20 +96,61 @@ type Message struct {
 	timestamp  int64
 	ack        bool
 	attempts   int
+
+	// connID is the broker connection the message was published from, stamped by the server.
+	connID uint64
+
+	// seq is the position of the message in its topic, assigned by the server.
+	seq uint64
+
+	// subscriber is the durable subscription name sent with NEW_SUB.
+	subscriber string
+
+	// ttl is how long the message is kept in seconds, 0 keeps it until acked and cleaned up.
+	ttl int64
+
+	// key is set by the publisher, see TopicCompacted.
+	key string
+
+	// headers are set by the publisher and delivered as they are.
+	headers map[string]string
+
+	// redelivered is set by the broker on a message it delivers again, once unacked, nacked
+	// or hidden past its visibility timeout.
+	redelivered bool
+
+	// fireAndForget is set by the publisher of a message neither stored nor confirmed nor
+	// tracked, delivered at most once to the subscribers connected.
+	fireAndForget bool
+
+	// dedup is set by the publisher of a QoSEffectivelyOnce message, the broker drops it when
+	// it has seen its id on the topic within the dedup window.
+	dedup bool
 }
 
 type messageJSON struct {
-	ID         string          `json:"id"`
-	NextID     string          `json:"next_id"`
-	Type       MType           `json:"type"`
-	User       string          `json:"user"`
-	Password   string          `json:"password"`
-	Topic      Topic           `json:"topic"`
-	Body       json.RawMessage `json:"body"`
-	BodyString string          `json:"body_string"`
-	Timestamp  int64           `json:"timestamp"`
-	ACK        bool            `json:"ack"`
-	Attempts   int             `json:"attempts"`
+	ID         string            `json:"id"`
+	NextID     string            `json:"next_id"`
+	Type       MType             `json:"type"`
+	User       string            `json:"user"`
+	Password   string            `json:"password"`
+	Topic      Topic             `json:"topic"`
+	Body       json.RawMessage   `json:"body"`
+	BodyString string            `json:"body_string"`
+	Timestamp  int64             `json:"timestamp"`
+	ACK        bool              `json:"ack"`
+	Attempts   int               `json:"attempts"`
+	ConnID     uint64            `json:"conn_id,omitempty"`
+	Seq        uint64            `json:"seq,omitempty"`
+	Subscriber string            `json:"subscriber,omitempty"`
+	TTL        int64             `json:"ttl,omitempty"`
+	Key        string            `json:"key,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	// Redelivered is omitted from the first delivery, the frames of older brokers have none.
+	Redelivered bool `json:"redelivered,omitempty"`
+	// FireAndForget is omitted from the messages the broker stores, the default.
+	FireAndForget bool `json:"fire_and_forget,omitempty"`
+	Dedup         bool `json:"dedup,omitempty"`
 }
 
 func (m *Message) ID() string {
@@ -112,15 +197,69 @@ func (m *Message) Attempts() int {
 	return m.attempts
 }
 
+func (m *Message) ConnID() uint64 {
+	return m.connID
+}
+
+func (m *Message) Seq() uint64 {
+	return m.seq
+}
+
+func (m *Message) Subscriber() string {
+	return m.subscriber
+}
+
+func (m *Message) TTL() time.Duration {
+	return time.Duration(m.ttl) * time.Second
+}
+
+func (m *Message) Key() string {
+	return m.key
+}
+
+// Headers returns the headers of the message, they must not be modified.
+func (m *Message) Headers() map[string]string {
+	return m.headers
+}
+
+// Redelivered tells if the broker delivered the message before, Attempts counts how often.
+func (m *Message) Redelivered() bool {
+	return m.redelivered
+}
+
+// FireAndForget tells if the message skips the store, the confirm and the ACK, see
+// PublishMessage.FireAndForget.
+func (m *Message) FireAndForget() bool {
+	return m.fireAndForget
+}
+
+// expired tells if the TTL of the message, counted from its timestamp, is over at now.
+func (m *Message) expired(now time.Time) bool {
+	return m.ttl > 0 && now.Unix() >= m.timestamp+m.ttl
+}
+
 func (m *Message) IncAttempts() {
 	m.attempts++
 }
 
+// deliverable tells if the stored message waits for an ACK with attempts left.
+func (m *Message) deliverable() bool {
+	return strings.HasPrefix(m.id, MsgPrefixFalse) && m.attempts < maxDeliveryAttempts
+}
+
 func (m *Message) updateACK() {
 	m.id = m.nextID
 	m.ack = true
 }
 
+// stampPublisher replaces the client supplied identity with the one the broker knows about,
+// the password never travels further than the broker.
+func (m *Message) stampPublisher(user string, connID uint64) {
+	m.user = user
+	m.password = ""
+	m.connID = connID
+}
+
 func (m *Message) updateAuthSuccess() {
 	m.mType = MessageAuthSuccess
 }
@@ -130,9 +269,16 @@ func (m *Message) updateAuthFailed() {
 }
 
 func NewMessage(pubMsg PublishMessage) Message {
+	level, _ := pubMsg.Level()
+
 	return NewMessageBuilder().
 		WithTopic(pubMsg.Topic).
 		WithBody(pubMsg.Body).
+		WithTTL(pubMsg.TTL).
+		WithKey(pubMsg.Key).
+		WithHeaders(pubMsg.Headers).
+		WithFireAndForget(level == QoSAtMostOnce).
+		WithDedup(level == QoSEffectivelyOnce).
 		Build()
 }
 
@@ -164,6 +310,16 @@ func (m *Message) Marshall() ([]byte, error) {
 		Timestamp:  m.timestamp,
 		ACK:        m.ack,
 		Attempts:   m.attempts,
+		ConnID:     m.connID,
+		Seq:        m.seq,
+		Subscriber: m.subscriber,
+		TTL:        m.ttl,
+		Key:        m.key,
+		Headers:    m.headers,
+
+		Redelivered:   m.redelivered,
+		FireAndForget: m.fireAndForget,
+		Dedup:         m.dedup,
 	}
 
 	return json.Marshal(mJSON)
@@ -186,6 +342,15 @@ func (m *Message) Unmarshal(data []byte) error {
 	m.timestamp = mJSON.Timestamp
 	m.ack = mJSON.ACK
 	m.attempts = mJSON.Attempts
+	m.connID = mJSON.ConnID
+	m.seq = mJSON.Seq
+	m.subscriber = mJSON.Subscriber
+	m.ttl = mJSON.TTL
+	m.key = mJSON.Key
+	m.headers = mJSON.Headers
+	m.redelivered = mJSON.Redelivered
+	m.fireAndForget = mJSON.FireAndForget
+	m.dedup = mJSON.Dedup
 	return nil
 }
 
@@ -195,7 +360,7 @@ func DecodeMessage(b []byte) (Message, error) {
 	if err := json.NewDecoder(r).Decode(&mJSON); err != nil {
 		return Message{}, err
 	}
-	
+
 	return Message{
 		id:         mJSON.ID,
 		nextID:     mJSON.NextID,
@@ -208,6 +373,16 @@ func DecodeMessage(b []byte) (Message, error) {
 		timestamp:  mJSON.Timestamp,
 		ack:        mJSON.ACK,
 		attempts:   mJSON.Attempts,
+		connID:     mJSON.ConnID,
+		seq:        mJSON.Seq,
+		subscriber: mJSON.Subscriber,
+		ttl:        mJSON.TTL,
+		key:        mJSON.Key,
+		headers:    mJSON.Headers,
+
+		redelivered:   mJSON.Redelivered,
+		fireAndForget: mJSON.FireAndForget,
+		dedup:         mJSON.Dedup,
 	}, nil
 }
 
@@ -266,211 +441,350 @@ func (mb *MessageBuilder) WithTimestamp(ts int64) *MessageBuilder {
 	return mb
 }
 
-func (mb *MessageBuilder) Build() Message {
-	return mb.msg
+func (mb *MessageBuilder) WithSeq(seq uint64) *MessageBuilder {
+	mb.msg.seq = seq
+	return mb
 }
 
-// MarshalBinary serializes Message to binary format
-func (m *Message) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
-
-	// Write ID length + ID
-	idBytes := []byte(m.id)
-	if err := binary.Write(buf, binary.LittleEndian, uint16(len(idBytes))); err != nil {
-		return nil, err
-	}
+func (mb *MessageBuilder) WithSubscriber(subscriber string) *MessageBuilder {
+	mb.msg.subscriber = subscriber
+	return mb
+}
 
-	buf.Write(idBytes)
+func (mb *MessageBuilder) WithKey(key string) *MessageBuilder {
+	mb.msg.key = key
+	return mb
+}
 
-	// Write NextID length + NextID
-	nextIDBytes := []byte(m.nextID)
-	if err := binary.Write(buf, binary.LittleEndian, uint16(len(nextIDBytes))); err != nil {
-		return nil, err
-	}
+func (mb *MessageBuilder) WithHeaders(headers map[string]string) *MessageBuilder {
+	mb.msg.headers = headers
+	return mb
+}
 
-	buf.Write(nextIDBytes)
+func (mb *MessageBuilder) WithRedelivered(redelivered bool) *MessageBuilder {
+	mb.msg.redelivered = redelivered
+	return mb
+}
 
-	// Write Type length + Type
-	typeBytes := []byte(m.mType)
-	if err := binary.Write(buf, binary.LittleEndian, uint16(len(typeBytes))); err != nil {
-		return nil, err
-	}
+func (mb *MessageBuilder) WithFireAndForget(fireAndForget bool) *MessageBuilder {
+	mb.msg.fireAndForget = fireAndForget
+	return mb
+}
 
-	buf.Write(typeBytes)
+func (mb *MessageBuilder) WithDedup(dedup bool) *MessageBuilder {
+	mb.msg.dedup = dedup
+	return mb
+}
 
-	// Write User length + User
-	userBytes := []byte(m.user)
-	if err := binary.Write(buf, binary.LittleEndian, uint16(len(userBytes))); err != nil {
-		return nil, err
-	}
+// WithTTL keeps the message stored for ttl at most, rounded down to seconds.
+func (mb *MessageBuilder) WithTTL(ttl time.Duration) *MessageBuilder {
+	mb.msg.ttl = int64(ttl / time.Second)
+	return mb
+}
 
-	buf.Write(userBytes)
+func (mb *MessageBuilder) Build() Message {
+	return mb.msg
+}
 
-	// Write Password length + Password
-	passwordBytes := []byte(m.password)
-	if err := binary.Write(buf, binary.LittleEndian, uint16(len(passwordBytes))); err != nil {
-		return nil, err
-	}
+// errFieldTooLong is returned when a string does not fit its binary length prefix.
+var errFieldTooLong = errors.New("field too long for binary encoding")
 
-	buf.Write(passwordBytes)
+// the bits of the flags byte closing the trailer.
+const (
+	flagRedelivered   = 1
+	flagFireAndForget = 2
+	flagDedup         = 4
+)
 
-	// Write Topic name length + Topic name
-	topicBytes := []byte(m.topic.Name)
-	if err := binary.Write(buf, binary.LittleEndian, uint16(len(topicBytes))); err != nil {
-		return nil, err
+func (m *Message) flags() byte {
+	var flags byte
+	if m.redelivered {
+		flags |= flagRedelivered
+	}
+	if m.fireAndForget {
+		flags |= flagFireAndForget
 	}
+	if m.dedup {
+		flags |= flagDedup
+	}
+
+	return flags
+}
 
-	buf.Write(topicBytes)
+// MarshalBinary serializes Message to binary format
+func (m *Message) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(make([]byte, 0, m.binarySize()))
+}
 
-	// Write Body length + Body
-	bodyBytes := []byte(m.body)
-	if err := binary.Write(buf, binary.LittleEndian, uint32(len(bodyBytes))); err != nil {
-		return nil, err
+// AppendBinary appends the binary encoding of the Message to b, so callers can reuse their buffers.
+// Fields are length prefixed (uint16 for short strings, uint32 for the body) and little endian.
+// BodyString is only written when it differs from Body, an empty one is rebuilt from Body on decode.
+func (m *Message) AppendBinary(b []byte) ([]byte, error) {
+	for _, field := range [...]string{m.id, m.nextID, string(m.mType), m.user, m.password, m.topic.Name} {
+		if len(field) > math.MaxUint16 {
+			return nil, errFieldTooLong
+		}
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(field)))
+		b = append(b, field...)
 	}
 
-	buf.Write(bodyBytes)
+	bodyString := m.bodyString
+	if bodyString == string(m.body) {
+		bodyString = ""
+	}
 
-	// Write BodyString length + BodyString
-	bodyStringBytes := []byte(m.bodyString)
-	if err := binary.Write(buf, binary.LittleEndian, uint32(len(bodyStringBytes))); err != nil {
-		return nil, err
+	if uint64(len(m.body)) > math.MaxUint32 || uint64(len(bodyString)) > math.MaxUint32 {
+		return nil, errFieldTooLong
 	}
 
-	buf.Write(bodyStringBytes)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(m.body)))
+	b = append(b, m.body...)
 
-	// Write Timestamp (8 bytes)
-	if err := binary.Write(buf, binary.LittleEndian, m.timestamp); err != nil {
-		return nil, err
-	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(bodyString)))
+	b = append(b, bodyString...)
 
-	// Write ACK (1 byte)
-	ackByte := byte(0)
+	// Timestamp (8 bytes), ACK (1 byte), Attempts (4 bytes)
+	b = binary.LittleEndian.AppendUint64(b, uint64(m.timestamp))
 	if m.ack {
-		ackByte = 1
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
 	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(int32(m.attempts)))
 
-	if err := binary.Write(buf, binary.LittleEndian, ackByte); err != nil {
-		return nil, err
+	// optional trailer fields, older encoders simply stop before them.
+	if len(m.subscriber) > math.MaxUint16 || len(m.key) > math.MaxUint16 {
+		return nil, errFieldTooLong
+	}
+	b = binary.LittleEndian.AppendUint64(b, m.connID)
+	b = binary.LittleEndian.AppendUint64(b, m.seq)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.subscriber)))
+	b = append(b, m.subscriber...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(m.ttl))
+	flags := m.flags()
+	// the key, the headers and the flags are written only when set, the frames without them
+	// stay as they were. Each needs the fields before it, even empty ones.
+	if m.key != "" || len(m.headers) > 0 || flags != 0 {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(m.key)))
+		b = append(b, m.key...)
+	}
+	if len(m.headers) > 0 || flags != 0 {
+		var err error
+		if b, err = m.appendHeaders(b); err != nil {
+			return nil, err
+		}
+	}
+	if flags != 0 {
+		b = append(b, flags)
 	}
 
-	// Write Attempts (4 bytes)
-	if err := binary.Write(buf, binary.LittleEndian, int32(m.attempts)); err != nil {
-		return nil, err
+	return b, nil
+}
+
+// binarySize is the exact length of the binary encoding, used to size the buffer once.
+func (m *Message) binarySize() int {
+	size := 6*2 + len(m.id) + len(m.nextID) + len(m.mType) + len(m.user) + len(m.password) + len(m.topic.Name)
+	size += 4 + len(m.body) + 4
+	if m.bodyString != string(m.body) {
+		size += len(m.bodyString)
+	}
+
+	size += 8 + 1 + 4 + 8 + 8 + 2 + len(m.subscriber) + 8
+	flags := m.flags()
+	if m.key != "" || len(m.headers) > 0 || flags != 0 {
+		size += 2 + len(m.key)
+	}
+	if len(m.headers) > 0 || flags != 0 {
+		size += 2
+		for name, value := range m.headers {
+			size += 2 + len(name) + 2 + len(value)
+		}
+	}
+	if flags != 0 {
+		size++
 	}
 
-	return buf.Bytes(), nil
+	return size
 }
 
-// UnmarshalBinary deserializes binary data into Message
+// UnmarshalBinary deserializes binary data into Message. Every value is copied out of data,
+// so the caller is free to reuse it afterwards.
 func (m *Message) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewReader(data)
+	r := binaryReader{data: data}
 
-	// Read ID
-	var idLen uint16
-	if err := binary.Read(buf, binary.LittleEndian, &idLen); err != nil {
-		return err
+	m.id = r.string16()
+	m.nextID = r.string16()
+	m.mType = MType(r.string16())
+	m.user = r.string16()
+	m.password = r.string16()
+	m.topic = Topic{Name: r.string16()}
+
+	body := r.bytes32()
+	m.body = nil
+	if body != nil {
+		m.body = append(json.RawMessage(make([]byte, 0, len(body))), body...)
 	}
-	idBytes := make([]byte, idLen)
-	if _, err := io.ReadFull(buf, idBytes); err != nil {
-		return err
+
+	m.bodyString = string(r.bytes32())
+	m.timestamp = int64(r.uint64())
+	m.ack = r.byte() == 1
+	m.attempts = int(int32(r.uint32()))
+
+	if r.err != nil {
+		return r.err
 	}
-	m.id = string(idBytes)
 
-	// Read NextID
-	var nextIDLen uint16
-	if err := binary.Read(buf, binary.LittleEndian, &nextIDLen); err != nil {
-		return err
+	m.connID, m.seq, m.subscriber, m.ttl, m.key, m.headers = 0, 0, "", 0, "", nil
+	m.redelivered, m.fireAndForget, m.dedup = false, false, false
+	if r.remaining() > 0 {
+		m.connID = r.uint64()
 	}
-	nextIDBytes := make([]byte, nextIDLen)
-	if _, err := io.ReadFull(buf, nextIDBytes); err != nil {
-		return err
+	if r.remaining() > 0 {
+		m.seq = r.uint64()
 	}
-	m.nextID = string(nextIDBytes)
-
-	// Read Format
-	var typeLen uint16
-	if err := binary.Read(buf, binary.LittleEndian, &typeLen); err != nil {
-		return err
+	if r.remaining() > 0 {
+		m.subscriber = r.string16()
 	}
-	typeBytes := make([]byte, typeLen)
-	if _, err := io.ReadFull(buf, typeBytes); err != nil {
-		return err
+	if r.remaining() > 0 {
+		m.ttl = int64(r.uint64())
+	}
+	if r.remaining() > 0 {
+		m.key = r.string16()
+	}
+	if r.remaining() > 0 {
+		m.headers = r.headers()
+	}
+	if r.remaining() > 0 {
+		flags := r.byte()
+		m.redelivered, m.fireAndForget = flags&flagRedelivered != 0, flags&flagFireAndForget != 0
+		m.dedup = flags&flagDedup != 0
 	}
-	m.mType = MType(typeBytes)
 
-	// Read User
-	var userLen uint16
-	if err := binary.Read(buf, binary.LittleEndian, &userLen); err != nil {
-		return err
+	if r.err != nil {
+		return r.err
 	}
-	userBytes := make([]byte, userLen)
-	if _, err := io.ReadFull(buf, userBytes); err != nil {
-		return err
+
+	if m.bodyString == "" {
+		m.bodyString = string(m.body)
 	}
-	m.user = string(userBytes)
 
-	// Read Password
-	var passwordLen uint16
-	if err := binary.Read(buf, binary.LittleEndian, &passwordLen); err != nil {
-		return err
+	return nil
+}
+
+// appendHeaders writes the count of the headers and then every name and value, sorted by
+// name so a message always gives the same bytes.
+func (m *Message) appendHeaders(b []byte) ([]byte, error) {
+	if len(m.headers) > math.MaxUint16 {
+		return nil, errFieldTooLong
 	}
-	passwordBytes := make([]byte, passwordLen)
-	if _, err := io.ReadFull(buf, passwordBytes); err != nil {
-		return err
+
+	names := make([]string, 0, len(m.headers))
+	for name, value := range m.headers {
+		if len(name) > math.MaxUint16 || len(value) > math.MaxUint16 {
+			return nil, errFieldTooLong
+		}
+		names = append(names, name)
 	}
-	m.password = string(passwordBytes)
+	slices.Sort(names)
 
-	// Read Topic
-	var topicLen uint16
-	if err := binary.Read(buf, binary.LittleEndian, &topicLen); err != nil {
-		return err
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(names)))
+	for _, name := range names {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(name)))
+		b = append(b, name...)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(m.headers[name])))
+		b = append(b, m.headers[name]...)
 	}
-	topicBytes := make([]byte, topicLen)
-	if _, err := io.ReadFull(buf, topicBytes); err != nil {
-		return err
+
+	return b, nil
+}
+
+// binaryReader walks an encoded message without intermediate copies. The first short read
+// sets err and every following call returns zero values.
+type binaryReader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func (r *binaryReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
 	}
-	m.topic = Topic{Name: string(topicBytes)}
 
-	// Read Body
-	var bodyLen uint32
-	if err := binary.Read(buf, binary.LittleEndian, &bodyLen); err != nil {
-		return err
+	if n < 0 || len(r.data)-r.off < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
 	}
-	bodyBytes := make([]byte, bodyLen)
-	if _, err := io.ReadFull(buf, bodyBytes); err != nil {
-		return err
+
+	b := r.data[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *binaryReader) remaining() int {
+	return len(r.data) - r.off
+}
+
+func (r *binaryReader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
 	}
-	m.body = json.RawMessage(bodyBytes)
+	return b[0]
+}
 
-	// Read BodyString
-	var bodyStringLen uint32
-	if err := binary.Read(buf, binary.LittleEndian, &bodyStringLen); err != nil {
-		return err
+func (r *binaryReader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
 	}
-	bodyStringBytes := make([]byte, bodyStringLen)
-	if _, err := io.ReadFull(buf, bodyStringBytes); err != nil {
-		return err
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (r *binaryReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
 	}
-	m.bodyString = string(bodyStringBytes)
+	return binary.LittleEndian.Uint32(b)
+}
 
-	// Read Timestamp
-	if err := binary.Read(buf, binary.LittleEndian, &m.timestamp); err != nil {
-		return err
+func (r *binaryReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (r *binaryReader) string16() string {
+	return string(r.next(int(r.uint16())))
+}
+
+func (r *binaryReader) bytes32() []byte {
+	n := r.uint32()
+	if uint64(n) > uint64(len(r.data)) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
 	}
+	return r.next(int(n))
+}
 
-	// Read ACK
-	var ackByte byte
-	if err := binary.Read(buf, binary.LittleEndian, &ackByte); err != nil {
-		return err
+// headers reads what appendHeaders wrote, nil when there is none.
+func (r *binaryReader) headers() map[string]string {
+	n := int(r.uint16())
+	if n == 0 || r.err != nil {
+		return nil
 	}
-	m.ack = ackByte == 1
 
-	// Read Attempts
-	var attempts int32
-	if err := binary.Read(buf, binary.LittleEndian, &attempts); err != nil {
-		return err
+	headers := make(map[string]string, min(n, r.remaining()/4))
+	for range n {
+		name := r.string16()
+		headers[name] = r.string16()
+		if r.err != nil {
+			return nil
+		}
 	}
-	m.attempts = int(attempts)
 
-	return nil
+	return headers
 }
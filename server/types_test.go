@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_MessageBinaryRoundTrip(t *testing.T) {
+	original := NewMessageBuilder().
+		WithID("false-1").
+		WithNextID("1").
+		WithType(MessageTypeNew).
+		WithTopic(NewTopic("orders")).
+		WithBody([]byte(`{"value":1}`)).
+		WithAttempts(2).
+		WithAck(true).
+		WithTTL(time.Minute).
+		WithKey("customer-42").
+		WithHeaders(map[string]string{"trace-id": "4bf92f35", "source": "billing"}).
+		WithRedelivered(true).
+		WithFireAndForget(true).
+		WithDedup(true).
+		Build()
+	original.stampPublisher("admin", 7)
+
+	b, err := original.MarshalBinary()
+	if err != nil {
+		t.Fatalf("cannot marshal %v", err)
+	}
+
+	if len(b) != original.binarySize() {
+		t.Fatalf("expected %d bytes, got %d", original.binarySize(), len(b))
+	}
+
+	var decoded Message
+	if err = decoded.UnmarshalBinary(b); err != nil {
+		t.Fatalf("cannot unmarshal %v", err)
+	}
+
+	if decoded.ID() != original.ID() || decoded.Topic() != original.Topic() || decoded.Type() != original.Type() {
+		t.Fatalf("header mismatch, got %s", decoded.String())
+	}
+
+	if !bytes.Equal(decoded.Body(), original.Body()) || decoded.BodyString() != original.BodyString() {
+		t.Fatalf("body mismatch, got %s / %s", decoded.Body(), decoded.BodyString())
+	}
+
+	if decoded.Attempts() != 2 || !decoded.ACK() || decoded.Timestamp() != original.Timestamp() || decoded.ConnID() != 7 || decoded.TTL() != time.Minute || decoded.Key() != "customer-42" {
+		t.Fatalf("trailer mismatch, got %s", decoded.String())
+	}
+
+	if !reflect.DeepEqual(decoded.Headers(), original.Headers()) || !decoded.Redelivered() || !decoded.FireAndForget() || !decoded.dedup {
+		t.Fatalf("headers mismatch, got %v redelivered %v", decoded.Headers(), decoded.Redelivered())
+	}
+
+	// the flags byte closes the trailer, cutting into the headers before it.
+	if err = decoded.UnmarshalBinary(b[:len(b)-2]); err == nil {
+		t.Fatal("expected an error on a truncated message")
+	}
+}
+
+// binarySeeds are valid encodings the fuzzers start from, see also testdata/fuzz.
+func binarySeeds() [][]byte {
+	messages := []Message{
+		NewMessageBuilder().WithID("false-1").WithNextID("1").WithType(MessageTypeNew).WithTopic(NewTopic("orders")).WithBody([]byte(`{"value":1}`)).Build(),
+		NewMessageBuilder().WithID("1").WithType(MessageTypeNewSubscriber).WithTopic(NewTopic("orders")).WithSubscriber("billing").Build(),
+		NewMessageBuilder().WithType(MessageTypeAuth).WithUser("admin").WithPassword("secret").Build(),
+		{},
+	}
+
+	seeds := make([][]byte, 0, len(messages))
+	for _, m := range messages {
+		b, _ := m.MarshalBinary()
+		seeds = append(seeds, b)
+	}
+
+	return seeds
+}
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	for _, seed := range binarySeeds() {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg Message
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return
+		}
+
+		// whatever decodes must survive a round trip unchanged.
+		b, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("cannot marshal a decoded message %v", err)
+		}
+
+		var again Message
+		if err = again.UnmarshalBinary(b); err != nil {
+			t.Fatalf("cannot decode a re-encoded message %v", err)
+		}
+		if !reflect.DeepEqual(again, msg) {
+			t.Fatalf("round trip changed the message\n%#v\n%#v", msg, again)
+		}
+	})
+}
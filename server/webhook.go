@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebhookRetries       = 3
+	defaultWebhookTimeout       = 5 * time.Second
+	defaultWebhookCheckInterval = 30 * time.Second
+	webhookQueueSize            = 1024
+	webhookBackoff              = 200 * time.Millisecond
+)
+
+// EventType is what happened in the broker, as sent to the webhooks.
+type EventType string
+
+const (
+	EventTopicCreated           EventType = "topic.created"
+	EventTopicDeleted           EventType = "topic.deleted"
+	EventSubscriberConnected    EventType = "subscriber.connected"
+	EventSubscriberDisconnected EventType = "subscriber.disconnected"
+	// EventDeadLettered is fired when the dead letters of a topic grow, Count is how many
+	// are there now.
+	EventDeadLettered EventType = "message.dead_lettered"
+	// EventDiskThreshold is fired when the store grows past Config.DiskThreshold, once until
+	// it goes back under it.
+	EventDiskThreshold EventType = "disk.threshold_exceeded"
+)
+
+// Event is the JSON body posted to the webhooks.
+type Event struct {
+	Type         EventType `json:"type"`
+	Time         time.Time `json:"time"`
+	Topic        string    `json:"topic,omitempty"`
+	Subscriber   string    `json:"subscriber,omitempty"`
+	ConnectionID uint64    `json:"connection_id,omitempty"`
+	Count        int       `json:"count,omitempty"`
+	Bytes        int64     `json:"bytes,omitempty"`
+}
+
+// WebhookConfig is an endpoint notified of the broker events.
+type WebhookConfig struct {
+	URL string
+	// Secret signs the body, the X-Queuety-Signature header is sha256=<hex HMAC-SHA256>.
+	Secret string
+	// Events narrows the notified events, empty means all of them.
+	Events []EventType
+	// MaxRetries is how many times a failed post is retried, 3 by default, negative disables retries.
+	MaxRetries int
+	// Timeout bounds every post, 5 seconds by default.
+	Timeout time.Duration
+}
+
+func (w WebhookConfig) wants(event EventType) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, event)
+}
+
+// notifier posts the events to the webhooks from a single goroutine, in order. It also polls
+// the conditions that have no call site of their own, the dead letters and the disk size.
+type notifier struct {
+	hooks    []WebhookConfig
+	client   *http.Client
+	events   chan Event
+	interval time.Duration
+	check    func()
+	logger   *slog.Logger
+
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newNotifier(hooks []WebhookConfig, interval time.Duration, logger *slog.Logger) *notifier {
+	if interval <= 0 {
+		interval = defaultWebhookCheckInterval
+	}
+
+	return &notifier{
+		hooks:    hooks,
+		client:   &http.Client{},
+		events:   make(chan Event, webhookQueueSize),
+		interval: interval,
+		logger:   logger,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// notify queues the event, it is dropped when the queue is full rather than blocking the broker.
+func (n *notifier) notify(event Event) {
+	if n == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	select {
+	case n.events <- event:
+	default:
+		n.logger.Warn("webhook queue full, dropping event", "event", event.Type)
+	}
+}
+
+func (n *notifier) run() {
+	defer close(n.done)
+
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-n.events:
+			n.send(event)
+		case <-ticker.C:
+			if n.check != nil {
+				n.check()
+			}
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+func (n *notifier) send(event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		n.logger.Error("cannot marshall event", "event", event.Type, "err", err)
+		return
+	}
+
+	for _, hook := range n.hooks {
+		if !hook.wants(event.Type) {
+			continue
+		}
+
+		if err = n.post(hook, event.Type, body); err != nil {
+			n.logger.Warn("cannot notify webhook", "url", hook.URL, "event", event.Type, "err", err)
+		}
+	}
+}
+
+// post retries with an exponential backoff, giving up early when the broker stops.
+func (n *notifier) post(hook WebhookConfig, event EventType, body []byte) error {
+	retries := hook.MaxRetries
+	if retries == 0 {
+		retries = defaultWebhookRetries
+	}
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	var err error
+	for attempt := 0; attempt <= max(retries, 0); attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(webhookBackoff << (attempt - 1)):
+			case <-n.quit:
+				return err
+			}
+		}
+
+		if err = n.postOnce(hook, event, body, timeout); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (n *notifier) postOnce(hook WebhookConfig, event EventType, body []byte, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Queuety-Event", string(event))
+	if hook.Secret != "" {
+		req.Header.Set("X-Queuety-Signature", "sha256="+sign(hook.Secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+
+	return nil
+}
+
+// sign is the hex HMAC-SHA256 of body, receivers compare it with hmac.Equal.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *notifier) stop() {
+	if n == nil {
+		return
+	}
+
+	n.stopOnce.Do(func() {
+		close(n.quit)
+		<-n.done
+	})
+}
+
+// eventWatch remembers what the polled events reported last, so they fire on a change only.
+type eventWatch struct {
+	deadLetters map[Topic]int
+	overDisk    bool
+	diskLimit   int64
+}
+
+// checkEvents fires the dead letter and disk events, called from the notifier goroutine.
+func (s *Server) checkEvents() {
+	w := &s.watch
+
+	pending, err := s.DB.PendingStats()
+	if err != nil {
+		s.logger().Warn("cannot read pending stats", "err", err)
+		return
+	}
+
+	if w.deadLetters == nil {
+		w.deadLetters = make(map[Topic]int)
+	}
+	for topic, p := range pending {
+		if p.DeadLettered > w.deadLetters[topic] {
+			s.notifier.notify(Event{Type: EventDeadLettered, Topic: topic.Name, Count: p.DeadLettered})
+		}
+		w.deadLetters[topic] = p.DeadLettered
+	}
+	for topic := range w.deadLetters {
+		if _, ok := pending[topic]; !ok {
+			delete(w.deadLetters, topic)
+		}
+	}
+
+	if w.diskLimit <= 0 {
+		return
+	}
+
+	stats, err := s.DB.StorageStats()
+	if err != nil {
+		s.logger().Warn("cannot read storage stats", "err", err)
+		return
+	}
+
+	size := stats.LSMBytes + stats.VLogBytes
+	over := size > w.diskLimit
+	if over && !w.overDisk {
+		s.notifier.notify(Event{Type: EventDiskThreshold, Bytes: size})
+	}
+	w.overDisk = over
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_WebhookRetriesAndSigns(t *testing.T) {
+	var calls atomic.Int32
+	received := make(chan Event, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		signature := strings.TrimPrefix(r.Header.Get("X-Queuety-Signature"), "sha256=")
+		if !hmac.Equal([]byte(signature), []byte(sign("s3cret", body))) {
+			t.Errorf("invalid signature %q", signature)
+		}
+
+		var event Event
+		_ = json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer hook.Close()
+
+	n := newNotifier([]WebhookConfig{{URL: hook.URL, Secret: "s3cret"}}, time.Hour, slog.Default())
+	go n.run()
+	defer n.stop()
+
+	topic := NewTopic("orders")
+	srv := Server{DB: NewMemoryStore(0), notifier: n}
+	n.check = srv.checkEvents
+
+	msg := NewMessageBuilder().WithID("false-1").WithNextID("1").WithTopic(topic).WithAttempts(maxDeliveryAttempts).Build()
+	if err := srv.DB.SaveMessage(msg, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	srv.checkEvents()
+
+	select {
+	case event := <-received:
+		if event.Type != EventDeadLettered || event.Topic != topic.Name || event.Count != 1 {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+
+	if calls.Load() != 2 {
+		t.Fatalf("expected the failed post retried once, got %d calls", calls.Load())
+	}
+
+	// the same dead letters are not reported twice.
+	srv.checkEvents()
+	select {
+	case event := <-received:
+		t.Fatalf("unexpected event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/tomiok/queuety/server/observability"
+	"github.com/tomiok/queuety/server/telemetry"
+)
+
+const (
+	defaultWriteBehindBatch    = 128
+	defaultWriteBehindInterval = 5 * time.Millisecond
+)
+
+var errWriteBehindStopped = errors.New("write-behind queue stopped")
+
+// WriteBehindConfig batches the saves of the publish path into one transaction every
+// BatchSize messages or FlushInterval, whatever comes first.
+type WriteBehindConfig struct {
+	// BatchSize is 128 by default.
+	BatchSize int
+	// FlushInterval is 5ms by default.
+	FlushInterval time.Duration
+	// QueueSize bounds the saves waiting for a flush, publishers block once it is full.
+	// It is 8 batches by default.
+	QueueSize int
+}
+
+// SaveRequest is one message of a batched save.
+type SaveRequest struct {
+	Message Message
+	Format  MessageFormat
+}
+
+type writeRequest struct {
+	SaveRequest
+	durability Durability
+	// done is closed with the result of the flush, nil for fire and forget saves.
+	done chan error
+}
+
+// writeBehind is the queue between the publish path and the store.
+type writeBehind struct {
+	store    Store
+	syncer   *batchSyncer
+	size     int
+	interval time.Duration
+	requests chan writeRequest
+	quit     chan struct{}
+	stopped  chan struct{}
+	logger   *slog.Logger
+
+	telemetry *telemetry.Telemetry
+	// trace records the persisted messages, nil records nothing.
+	trace func(Message, TraceEvent)
+}
+
+func newWriteBehind(cfg WriteBehindConfig, store Store, syncer *batchSyncer, logger *slog.Logger) *writeBehind {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultWriteBehindBatch
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultWriteBehindInterval
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 8 * cfg.BatchSize
+	}
+
+	return &writeBehind{
+		store:    store,
+		syncer:   syncer,
+		size:     cfg.BatchSize,
+		interval: cfg.FlushInterval,
+		requests: make(chan writeRequest, cfg.QueueSize),
+		quit:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		logger:   logger,
+	}
+}
+
+// enqueue hands the message to the queue. With wait it returns once the batch holding the
+// message is committed, and fsynced for DurabilitySync.
+func (w *writeBehind) enqueue(message Message, format MessageFormat, durability Durability, wait bool) error {
+	req := writeRequest{SaveRequest: SaveRequest{Message: message, Format: format}, durability: durability}
+	if wait {
+		req.done = make(chan error, 1)
+	}
+
+	select {
+	case <-w.quit:
+		return errWriteBehindStopped
+	default:
+	}
+
+	select {
+	case w.requests <- req:
+	case <-w.quit:
+		return errWriteBehindStopped
+	}
+
+	if !wait {
+		return nil
+	}
+
+	return <-req.done
+}
+
+func (w *writeBehind) run() {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	batch := make([]writeRequest, 0, w.size)
+	for {
+		select {
+		case req := <-w.requests:
+			batch = append(batch, req)
+			if len(batch) >= w.size {
+				batch = w.flush(batch)
+			}
+		case <-ticker.C:
+			batch = w.flush(batch)
+		case <-w.quit:
+			// everything enqueued before the stop still gets written.
+			for {
+				select {
+				case req := <-w.requests:
+					batch = append(batch, req)
+				default:
+					w.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush commits the batch in one transaction and returns it emptied for reuse.
+func (w *writeBehind) flush(batch []writeRequest) []writeRequest {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	saves := make([]SaveRequest, len(batch))
+	var needSync, needBatchSync bool
+	for i, req := range batch {
+		saves[i] = req.SaveRequest
+		needSync = needSync || req.durability == DurabilitySync
+		needBatchSync = needBatchSync || req.durability == DurabilityBatch
+	}
+
+	start := time.Now()
+	err := w.store.SaveBatch(saves)
+	if err != nil {
+		w.logger.Error("cannot save batch", "messages", len(batch), "err", err)
+	}
+
+	if err == nil && needSync {
+		err = w.store.Sync()
+	}
+	if err == nil && needBatchSync {
+		w.syncer.markDirty()
+	}
+	observability.PersistDuration.Observe(time.Since(start).Seconds())
+	w.telemetry.StoreOp(context.Background(), "save_batch", start, err)
+
+	for _, req := range batch {
+		if err != nil {
+			observability.PersistErrors.WithLabelValues(req.Message.Topic().Name).Inc()
+		} else {
+			observability.MessagesPersisted.WithLabelValues(req.Message.Topic().Name).Inc()
+			if w.trace != nil {
+				w.trace(req.Message, TraceEvent{Stage: TracePersisted, Attempts: req.Message.Attempts() + 1})
+			}
+		}
+
+		if req.done != nil {
+			req.done <- err
+		}
+	}
+
+	return batch[:0]
+}
+
+func (w *writeBehind) stop() {
+	if w == nil {
+		return
+	}
+
+	close(w.quit)
+	<-w.stopped
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"log/slog"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_WriteBehindBatches(t *testing.T) {
+	store := NewMemoryStore(0)
+	wb := newWriteBehind(WriteBehindConfig{BatchSize: 2, FlushInterval: time.Hour}, store, nil, slog.Default())
+	go wb.run()
+
+	newMsg := func(i int) Message {
+		return NewMessageBuilder().
+			WithID("false-" + strconv.Itoa(i)).
+			WithNextID(strconv.Itoa(i)).
+			WithTopic(NewTopic("orders")).
+			WithSeq(uint64(i)).
+			Build()
+	}
+
+	if err := wb.enqueue(newMsg(1), FormatJSON, DurabilityAsync, false); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// the second message fills the batch, waiting returns once both are stored.
+	if err := wb.enqueue(newMsg(2), FormatJSON, DurabilitySync, true); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if pending, _ := store.PendingMessages(); len(pending) != 2 {
+		t.Fatalf("expected the batch stored, got %v", pending)
+	}
+
+	if err := wb.enqueue(newMsg(3), FormatJSON, DurabilityAsync, false); err != nil {
+		t.Fatalf("%v", err)
+	}
+	wb.stop()
+	if pending, _ := store.PendingMessages(); len(pending) != 3 {
+		t.Fatalf("expected the queue drained on stop, got %v", pending)
+	}
+
+	if err := wb.enqueue(newMsg(4), FormatJSON, DurabilityAsync, false); err == nil {
+		t.Fatal("expected saves refused once stopped")
+	}
+}